@@ -1,77 +1,372 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/yebrai/go-chat/internal/auth"
 	"github.com/yebrai/go-chat/internal/cache"
 	"github.com/yebrai/go-chat/internal/handlers"
+	"github.com/yebrai/go-chat/internal/logging"
+	"github.com/yebrai/go-chat/internal/tracing"
 	"github.com/yebrai/go-chat/internal/websocket"
 )
 
+// defaultRoomID is the room the web client joins by default. It is created at startup.
+const defaultRoomID = "general"
+
+// defaultServiceName names this service in trace spans unless OTEL_SERVICE_NAME says otherwise.
+const defaultServiceName = "go-chat"
+
+// defaultShutdownTimeout is how long a graceful shutdown may take unless SHUTDOWN_TIMEOUT says otherwise.
+const defaultShutdownTimeout = 15 * time.Second
+
+// defaultAdminAddr is where the admin endpoints are served unless ADMIN_ADDR says otherwise:
+// on the loopback interface only, out of reach of the clients of the public port.
+const defaultAdminAddr = "localhost:9090"
+
+// fatal logs msg as an error with args and exits with status 1, without running deferred calls.
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// rateLimitsFromEnv returns the rate limits set by the environment variable name, as accepted
+// by websocket.ParseRateLimits, or defaults if it is unset. It exits if they are invalid.
+func rateLimitsFromEnv(logger *slog.Logger, name string, defaults websocket.RateLimits) websocket.RateLimits {
+	limits := defaults
+	if raw := os.Getenv(name); raw != "" {
+		var err error
+		limits, err = websocket.ParseRateLimits(raw)
+		if err != nil {
+			fatal(logger, "Invalid "+name+". Expected limits like '10/10s,20/10s'.", "value", raw, "error", err)
+		}
+	}
+	logger.Info("Configured "+name, "value", limits.String())
+	return limits
+}
+
 func main() {
+	// --- Logging Setup ---
+	// Retrieve the minimum log level, e.g. "debug", "info" (default), "warn" or "error". It can be
+	// changed at runtime through /debug/loglevel.
+	logLevel := new(slog.LevelVar)
+	if raw := os.Getenv("LOG_LEVEL"); raw != "" {
+		level, err := logging.ParseLevel(raw)
+		if err != nil {
+			fatal(slog.Default(), "Invalid LOG_LEVEL", "value", raw, "error", err)
+		}
+		logLevel.Set(level)
+	}
+	// Retrieve whether message content may be logged. It is redacted by default, since it
+	// belongs to the users; enable it only to debug with consent.
+	logContent := false
+	if raw := os.Getenv("LOG_MESSAGE_CONTENT"); raw != "" {
+		var err error
+		logContent, err = strconv.ParseBool(raw)
+		if err != nil {
+			fatal(slog.Default(), "Invalid LOG_MESSAGE_CONTENT", "value", raw, "error", err)
+		}
+	}
+	// Retrieve the log format: "text" (default) or "json", for log collectors.
+	baseLogger, err := logging.New(os.Stderr, logging.Options{Format: os.Getenv("LOG_FORMAT"), Level: logLevel, LogContent: logContent})
+	if err != nil {
+		fatal(slog.Default(), "Invalid LOG_FORMAT", "error", err)
+	}
+	// Everything else logs through it too, including the standard log package.
+	slog.SetDefault(baseLogger)
+	logger := baseLogger.With("component", "main")
+
 	// Application starting point.
-	log.Println("MAIN: Starting Simple Go Chat Application...")
+	logger.Info("Starting Simple Go Chat Application")
 
 	// --- Configuration Setup ---
+	// Retrieve the store backend from environment variable or use default.
+	// "redis" (default) is required to run several instances; "memory" runs standalone without Redis.
+	storeBackend := os.Getenv("STORE_BACKEND")
+	if storeBackend == "" {
+		storeBackend = "redis"
+		logger.Info("STORE_BACKEND not set in environment, using default", "value", storeBackend)
+	} else {
+		logger.Info("Using STORE_BACKEND from environment", "value", storeBackend)
+	}
+
 	// Retrieve Redis URL from environment variable or use default.
 	redisURL := os.Getenv("REDIS_URL")
 	if redisURL == "" {
 		redisURL = "redis://localhost:6379/0" // Default Redis connection URL.
-		log.Printf("MAIN_CONFIG: REDIS_URL not set in environment, using default: %s", redisURL)
+		logger.Info("REDIS_URL not set in environment, using default", "value", redisURL)
 	} else {
-		log.Printf("MAIN_CONFIG: Using REDIS_URL from environment: %s", redisURL)
+		logger.Info("Using REDIS_URL from environment", "value", redisURL)
 	}
 
 	// Retrieve Port from environment variable or use default.
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080" // Default HTTP port.
-		log.Printf("MAIN_CONFIG: PORT not set in environment, using default: %s", port)
+		logger.Info("PORT not set in environment, using default", "value", port)
 	} else {
-		log.Printf("MAIN_CONFIG: Using PORT from environment: %s", port)
+		logger.Info("Using PORT from environment", "value", port)
+	}
+
+	// Retrieve the address of the admin listener, which serves the unauthenticated operational
+	// endpoints (/metrics, /debug/loglevel) apart from the public port. Expose it to the monitoring network only.
+	adminAddr := os.Getenv("ADMIN_ADDR")
+	if adminAddr == "" {
+		adminAddr = defaultAdminAddr
+		logger.Info("ADMIN_ADDR not set in environment, using default", "value", adminAddr)
+	} else {
+		logger.Info("Using ADMIN_ADDR from environment", "value", adminAddr)
+	}
+
+	// Retrieve the session token signing secret from environment variable.
+	// Every instance behind the same load balancer must use the same secret.
+	authSecret := []byte(os.Getenv("AUTH_SECRET"))
+	if len(authSecret) == 0 {
+		authSecret = make([]byte, 32)
+		if _, err := rand.Read(authSecret); err != nil {
+			fatal(logger, "Generating random AUTH_SECRET failed", "error", err)
+		}
+		logger.Warn("AUTH_SECRET not set in environment, using a random secret. Sessions will not survive a restart or be valid on other instances.")
+	} else {
+		logger.Info("Using AUTH_SECRET from environment")
+	}
+
+	// Retrieve whether rooms must be created (POST /api/rooms) before they can be joined.
+	// By default, joining a room that does not exist yet creates it.
+	requireRoomCreation := false
+	if raw := os.Getenv("REQUIRE_ROOM_CREATION"); raw != "" {
+		var err error
+		requireRoomCreation, err = strconv.ParseBool(raw)
+		if err != nil {
+			fatal(logger, "Invalid REQUIRE_ROOM_CREATION", "value", raw, "error", err)
+		}
+	}
+	logger.Info("Configured REQUIRE_ROOM_CREATION", "value", requireRoomCreation)
+
+	// Retrieve how long authors may edit or delete their messages after sending them,
+	// e.g. "15m". A negative value removes the limit.
+	messageEditWindow := websocket.DefaultMessageEditWindow
+	if raw := os.Getenv("MESSAGE_EDIT_WINDOW"); raw != "" {
+		var err error
+		messageEditWindow, err = time.ParseDuration(raw)
+		if err != nil || messageEditWindow == 0 {
+			fatal(logger, "Invalid MESSAGE_EDIT_WINDOW. Expected a non-zero duration like '15m'.", "value", raw)
+		}
+	}
+	logger.Info("Configured MESSAGE_EDIT_WINDOW", "value", messageEditWindow.String())
+
+	// Retrieve whether rooms are told when their users read them (read_receipt messages).
+	// Unread counts are kept either way.
+	readReceipts := false
+	if raw := os.Getenv("READ_RECEIPTS"); raw != "" {
+		var err error
+		readReceipts, err = strconv.ParseBool(raw)
+		if err != nil {
+			fatal(logger, "Invalid READ_RECEIPTS", "value", raw, "error", err)
+		}
+	}
+	logger.Info("Configured READ_RECEIPTS", "value", readReceipts)
+
+	// Retrieve how long users must be idle before they are shown as away, e.g. "10m".
+	// A negative value disables automatic away.
+	awayAfter := websocket.DefaultAwayAfter
+	if raw := os.Getenv("AWAY_AFTER"); raw != "" {
+		var err error
+		awayAfter, err = time.ParseDuration(raw)
+		if err != nil || awayAfter == 0 {
+			fatal(logger, "Invalid AWAY_AFTER. Expected a non-zero duration like '10m'.", "value", raw)
+		}
+	}
+	logger.Info("Configured AWAY_AFTER", "value", awayAfter.String())
+
+	// Retrieve the rate limits on text and direct messages, typing notifications and room stats
+	// requests, each as "<per connection>,<per user>", e.g. "10/10s,20/10s". Either limit may be
+	// "off". Per-user limits hold across every instance sharing the store.
+	textRateLimits := rateLimitsFromEnv(logger, "RATE_LIMIT_TEXT", websocket.DefaultTextRateLimits)
+	typingRateLimits := rateLimitsFromEnv(logger, "RATE_LIMIT_TYPING", websocket.DefaultTypingRateLimits)
+	statsRateLimits := rateLimitsFromEnv(logger, "RATE_LIMIT_STATS", websocket.DefaultStatsRateLimits)
+
+	// Retrieve what happens to messages for clients that cannot keep up with them, by class of
+	// message, e.g. "ephemeral=drop_oldest,reply=drop_newest". Classes left out keep their default.
+	slowConsumerPolicies := websocket.DefaultSlowConsumerPolicies
+	if raw := os.Getenv("SLOW_CONSUMER_POLICY"); raw != "" {
+		var err error
+		slowConsumerPolicies, err = websocket.ParseSlowConsumerPolicies(raw)
+		if err != nil {
+			fatal(logger, "Invalid SLOW_CONSUMER_POLICY. Expected policies like 'ephemeral=drop_oldest'.", "value", raw, "error", err)
+		}
+	}
+	logger.Info("Configured SLOW_CONSUMER_POLICY", "value", slowConsumerPolicies.String())
+
+	// Retrieve how many workers store room and direct messages off the Hub's event loop, and how
+	// long their store calls may take for each message, e.g. "5s".
+	roomWorkers := websocket.DefaultRoomWorkers
+	if raw := os.Getenv("ROOM_WORKERS"); raw != "" {
+		var err error
+		roomWorkers, err = strconv.Atoi(raw)
+		if err != nil || roomWorkers <= 0 {
+			fatal(logger, "Invalid ROOM_WORKERS. Expected a positive integer.", "value", raw)
+		}
+	}
+	logger.Info("Configured ROOM_WORKERS", "value", roomWorkers)
+	storeTimeout := websocket.DefaultStoreTimeout
+	if raw := os.Getenv("STORE_TIMEOUT"); raw != "" {
+		var err error
+		storeTimeout, err = time.ParseDuration(raw)
+		if err != nil || storeTimeout <= 0 {
+			fatal(logger, "Invalid STORE_TIMEOUT. Expected a positive duration like '5s'.", "value", raw)
+		}
+	}
+	logger.Info("Configured STORE_TIMEOUT", "value", storeTimeout.String())
+
+	// Retrieve how long a graceful shutdown may take on SIGINT or SIGTERM, e.g. "15s", before the
+	// process exits regardless. Orchestrators usually kill the process 30 seconds after SIGTERM.
+	shutdownTimeout := defaultShutdownTimeout
+	if raw := os.Getenv("SHUTDOWN_TIMEOUT"); raw != "" {
+		var err error
+		shutdownTimeout, err = time.ParseDuration(raw)
+		if err != nil || shutdownTimeout <= 0 {
+			fatal(logger, "Invalid SHUTDOWN_TIMEOUT. Expected a positive duration like '15s'.", "value", raw)
+		}
+	}
+	logger.Info("Configured SHUTDOWN_TIMEOUT", "value", shutdownTimeout.String())
+
+	// Retrieve where trace spans are exported: "otlp" (to the collector set by the standard
+	// OTEL_EXPORTER_OTLP_ENDPOINT variable), "stdout", or "none" (default).
+	traceExporter := os.Getenv("OTEL_TRACES_EXPORTER")
+	if traceExporter == "" {
+		traceExporter = tracing.ExporterNone
+	}
+	logger.Info("Configured OTEL_TRACES_EXPORTER", "value", traceExporter)
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = defaultServiceName
 	}
 
 	// --- Dependency Initialization ---
-	// Initialize Redis Client. This is a critical dependency.
-	redisClient, err := cache.NewRedisClient(redisURL)
+	// Initialize tracing first, so that every span is exported, including the store's.
+	exporter, err := tracing.NewExporter(context.Background(), traceExporter)
 	if err != nil {
-		log.Fatalf("MAIN_FATAL: Failed to initialize Redis client at %s: %v", redisURL, err)
+		fatal(logger, "Invalid OTEL_TRACES_EXPORTER", "value", traceExporter, "error", err)
+	}
+	tracerProvider := tracing.Init(exporter, serviceName)
+
+	// Initialize the store. This is a critical dependency.
+	var store cache.Store
+	switch storeBackend {
+	case "redis":
+		redisClient, err := cache.NewRedisClient(redisURL, baseLogger)
+		if err != nil {
+			fatal(logger, "Failed to initialize Redis client", "url", redisURL, "error", err)
+		}
+		store = redisClient
+		logger.Info("Redis client initialized")
+	case "memory":
+		store = cache.NewMemoryStore()
+		logger.Info("In-memory store initialized. State is not shared with other instances and is lost on restart.")
+	default:
+		fatal(logger, "Unknown STORE_BACKEND. Expected 'redis' or 'memory'.", "value", storeBackend)
 	}
-	// Ensure Redis client is closed gracefully on application shutdown.
+	// Ensure the store is closed gracefully on application shutdown.
 	defer func() {
-		log.Println("MAIN: Closing Redis client connection...")
-		if err := redisClient.Close(); err != nil {
-			log.Printf("MAIN_ERROR: Closing Redis client: %v", err)
+		logger.Info("Closing store")
+		if err := store.Close(); err != nil {
+			logger.Error("Closing store failed", "error", err)
 		}
-		log.Println("MAIN: Redis client connection closed.")
+		logger.Info("Store closed")
 	}()
-	log.Println("MAIN: Redis client initialized successfully.")
 
-	// Initialize WebSocket Hub. The Hub requires the Redis client.
-	hub := websocket.NewHub(redisClient)
+	// Initialize WebSocket Hub. The Hub requires the store.
+	hub := websocket.NewHub(store, websocket.HubOptions{RequireRegisteredRooms: requireRoomCreation, MessageEditWindow: messageEditWindow, ReadReceipts: readReceipts, AwayAfter: awayAfter,
+		TextRateLimits: textRateLimits, TypingRateLimits: typingRateLimits, StatsRateLimits: statsRateLimits,
+		SlowConsumerPolicies: slowConsumerPolicies, RoomWorkers: roomWorkers, StoreTimeout: storeTimeout, Logger: baseLogger})
 	// Start the Hub's main processing loop as a separate goroutine.
 	// This allows the Hub to handle events concurrently with the HTTP server.
 	go hub.Run()
-	log.Println("MAIN: WebSocket Hub initialized and running in a separate goroutine.")
+	logger.Info("WebSocket Hub initialized and running")
+
+	// Make sure the default room exists, so it can be joined even when rooms must be created first.
+	if _, err := hub.CreateRoom(context.Background(), defaultRoomID, "", websocket.RoomSettings{}); err != nil && !errors.Is(err, websocket.ErrRoomExists) {
+		fatal(logger, "Creating default room failed", "room_id", defaultRoomID, "error", err)
+	}
+
+	// Initialize the session token manager used to authenticate WebSocket upgrades.
+	tokenManager, err := auth.NewTokenManager(authSecret, auth.DefaultTokenTTL)
+	if err != nil {
+		fatal(logger, "Failed to initialize token manager", "error", err)
+	}
 
-	// Initialize HTTP Handlers. The ChatHandler requires the Hub and Redis client.
-	chatHandler := handlers.NewChatHandler(hub, redisClient)
-	log.Println("MAIN: Chat HTTP handler initialized.")
+	// Initialize HTTP Handlers. The ChatHandler requires the Hub, the store and the token manager.
+	chatHandler := handlers.NewChatHandler(hub, store, tokenManager, baseLogger)
+	logger.Info("Chat HTTP handler initialized")
 
 	// --- HTTP Router Setup ---
 	// Create a new ServeMux for routing HTTP requests.
 	mux := http.NewServeMux()
 
-	// Register the WebSocket connection handler.
+	// Register the login endpoint that issues session tokens.
+	mux.HandleFunc("/api/login", chatHandler.LoginHTTP)
+	logger.Info("Route registered", "pattern", "/api/login")
+
+	// Register the WebSocket connection handler. Upgrades require a session token.
 	mux.HandleFunc("/ws", chatHandler.ServeWs)
-	log.Printf("MAIN_ROUTES: WebSocket endpoint registered at /ws")
+	logger.Info("Route registered", "pattern", "/ws")
+
+	// Register an optional HTTP endpoint for fetching room statistics. It is kept out of /api/rooms/,
+	// where "stats" would be taken for the ID of a room.
+	mux.HandleFunc("GET /api/stats/rooms", chatHandler.GetRoomStatsHTTP)
+	logger.Info("Route registered", "pattern", "GET /api/stats/rooms")
+
+	// Register the room registry endpoints. All require a session token.
+	mux.HandleFunc("GET /api/rooms", chatHandler.ListRoomsHTTP)
+	mux.HandleFunc("POST /api/rooms", chatHandler.CreateRoomHTTP)
+	mux.HandleFunc("GET /api/rooms/{id}", chatHandler.GetRoomHTTP)
+	mux.HandleFunc("PATCH /api/rooms/{id}", chatHandler.UpdateRoomHTTP)
+	mux.HandleFunc("POST /api/rooms/{id}/archive", chatHandler.ArchiveRoomHTTP)
+	logger.Info("Routes registered", "patterns", "/api/rooms, /api/rooms/{id}")
 
-	// Register an optional HTTP endpoint for fetching room statistics.
-	mux.HandleFunc("/api/rooms/stats", chatHandler.GetRoomStatsHTTP)
-	log.Printf("MAIN_ROUTES: Room stats API endpoint registered at /api/rooms/stats")
+	// Register the room membership endpoints. All require a session token; changes are reserved
+	// to the room's moderators.
+	mux.HandleFunc("GET /api/rooms/{id}/members", chatHandler.ListRoomMembersHTTP)
+	mux.HandleFunc("POST /api/rooms/{id}/members", chatHandler.InviteToRoomHTTP)
+	mux.HandleFunc("DELETE /api/rooms/{id}/members/{username}", chatHandler.KickFromRoomHTTP)
+	mux.HandleFunc("POST /api/rooms/{id}/bans", chatHandler.BanFromRoomHTTP)
+	mux.HandleFunc("DELETE /api/rooms/{id}/bans/{username}", chatHandler.UnbanFromRoomHTTP)
+	logger.Info("Routes registered", "patterns", "/api/rooms/{id}/members, /api/rooms/{id}/bans")
+	mux.HandleFunc("GET /api/rooms/{id}/pins", chatHandler.ListPinnedMessagesHTTP)
+	logger.Info("Route registered", "pattern", "GET /api/rooms/{id}/pins")
+
+	// Register the paginated message history endpoint. Requires a session token.
+	mux.HandleFunc("GET /api/rooms/{id}/messages", chatHandler.GetRoomMessagesHTTP)
+	logger.Info("Route registered", "pattern", "GET /api/rooms/{id}/messages")
+	mux.HandleFunc("GET /api/rooms/{id}/messages/{messageID}/edits", chatHandler.GetMessageEditsHTTP)
+	logger.Info("Route registered", "pattern", "GET /api/rooms/{id}/messages/{messageID}/edits")
+	mux.HandleFunc("GET /api/rooms/{id}/messages/{messageID}/replies", chatHandler.GetThreadRepliesHTTP)
+	logger.Info("Route registered", "pattern", "GET /api/rooms/{id}/messages/{messageID}/replies")
+
+	// Register the direct message conversation endpoints. Both require a session token.
+	mux.HandleFunc("GET /api/conversations", chatHandler.GetConversationsHTTP)
+	logger.Info("Route registered", "pattern", "GET /api/conversations")
+	mux.HandleFunc("GET /api/conversations/{peer}/messages", chatHandler.GetConversationMessagesHTTP)
+	logger.Info("Route registered", "pattern", "GET /api/conversations/{peer}/messages")
+
+	// Register the unread counts endpoint. Requires a session token.
+	mux.HandleFunc("GET /api/users/me/unread", chatHandler.GetUnreadCountsHTTP)
+	logger.Info("Route registered", "pattern", "GET /api/users/me/unread")
+	mux.HandleFunc("GET /api/users/{username}/presence", chatHandler.GetUserPresenceHTTP)
+	logger.Info("Route registered", "pattern", "GET /api/users/{username}/presence")
 
 	// Setup static file serving for the frontend assets.
 	// Files are served from the "./chat-app/web" directory.
@@ -79,11 +374,25 @@ func main() {
 	// Requests to "/style.css" will serve "./chat-app/web/style.css".
 	staticFileServer := http.FileServer(http.Dir("./web"))
 	mux.Handle("/", staticFileServer)
-	log.Printf("MAIN_ROUTES: Static files served from directory ./chat-app/web at root path /")
+	logger.Info("Static files served from directory ./chat-app/web at root path /")
+
+	// --- Admin Router Setup ---
+	// The admin endpoints are unauthenticated, so they get their own listener, on ADMIN_ADDR,
+	// rather than routes on the public port.
+	adminMux := http.NewServeMux()
+
+	// Register the Prometheus metrics endpoint, unauthenticated like scrape targets usually are.
+	adminMux.Handle("GET /metrics", promhttp.Handler())
+	logger.Info("Admin route registered", "pattern", "GET /metrics")
+
+	// Register the log level endpoint: GET reports the current level, PUT {"level": "debug"}
+	// changes it.
+	adminMux.Handle("/debug/loglevel", logging.LevelHandler(logLevel, logger))
+	logger.Info("Admin route registered", "pattern", "/debug/loglevel")
 
 	// --- HTTP Server Start ---
 	serverAddr := ":" + port
-	log.Printf("MAIN: HTTP server starting on http://localhost%s ...", serverAddr)
+	logger.Info("HTTP server starting", "addr", "http://localhost"+serverAddr)
 
 	// Configure the HTTP server.
 	httpServer := &http.Server{
@@ -95,12 +404,56 @@ func main() {
 		IdleTimeout:  120 * time.Second, // Max time for an idle connection.
 	}
 
-	// Start the HTTP server and log any fatal errors.
-	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("MAIN_FATAL: Could not start HTTP server on %s: %v\n", serverAddr, err)
+	logger.Info("Admin server starting", "addr", adminAddr)
+	adminServer := &http.Server{
+		Addr:         adminAddr,
+		Handler:      adminMux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
+
+	// Start the HTTP and admin servers in the background, and wait for either to fail or for a
+	// shutdown signal.
+	serverErrors := make(chan error, 2)
+	go func() {
+		serverErrors <- fmt.Errorf("HTTP server on %s: %w", serverAddr, httpServer.ListenAndServe())
+	}()
+	go func() {
+		serverErrors <- fmt.Errorf("admin server on %s: %w", adminAddr, adminServer.ListenAndServe())
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErrors:
+		fatal(logger, "Could not start HTTP server", "error", err)
+	case sig := <-signals:
+		logger.Info("Shutting down gracefully", "signal", sig.String(), "timeout", shutdownTimeout.String())
 	}
+	signal.Stop(signals) // A second signal kills the process right away.
 
-	// This log message will typically not be reached if ListenAndServe runs indefinitely,
-	// unless the server is gracefully shut down (which is not explicitly handled here but http.ErrServerClosed checks for it).
-	log.Println("MAIN: Server stopped gracefully.")
+	// --- Graceful Shutdown ---
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// Stop accepting connections, WebSocket upgrades included, and wait for in-flight HTTP requests.
+	// Upgraded connections are not tracked by the HTTP server; the Hub closes them.
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logger.Error("Shutting down HTTP server failed", "error", err)
+	}
+	// Tell every WebSocket client to reconnect, close their connections once that notice and the
+	// close frame are written, and remove this instance's users from the store's presence sets.
+	if err := hub.Shutdown(ctx); err != nil {
+		logger.Error("Shutting down WebSocket Hub failed", "error", err)
+	}
+	// Flush the trace spans still buffered.
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			logger.Error("Flushing trace spans failed", "error", err)
+		}
+	}
+	// Stop the admin server last, so that metrics can be scraped while the rest shuts down.
+	if err := adminServer.Shutdown(ctx); err != nil {
+		logger.Error("Shutting down admin server failed", "error", err)
+	}
+	logger.Info("Server stopped gracefully")
 }
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// DefaultTokenTTL is how long an issued session token stays valid.
+	DefaultTokenTTL = 24 * time.Hour
+
+	// tokenIssuer is stamped into, and required on, every token issued by this service.
+	tokenIssuer = "go-chat"
+
+	// minSecretLength is the minimum HMAC secret length accepted, in bytes.
+	minSecretLength = 32
+)
+
+// ErrInvalidToken is returned by Verify for any token that is malformed, expired,
+// signed with a different key or otherwise not acceptable.
+var ErrInvalidToken = errors.New("invalid or expired session token")
+
+// Claims are the verified contents of a session token.
+type Claims struct {
+	Username  string    // The authenticated username (the JWT subject).
+	SessionID string    // Unique ID of the login session (the JWT ID). Shared by all connections opened with the token.
+	ExpiresAt time.Time // When the token stops being valid.
+}
+
+// TokenManager issues and verifies HMAC-SHA256 signed JWT session tokens.
+// All instances serving the same users must share the same secret.
+type TokenManager struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewTokenManager creates a TokenManager that signs tokens with secret.
+// If ttl is <= 0, DefaultTokenTTL is used.
+func NewTokenManager(secret []byte, ttl time.Duration) (*TokenManager, error) {
+	if len(secret) < minSecretLength {
+		return nil, fmt.Errorf("auth secret must be at least %d bytes, got %d", minSecretLength, len(secret))
+	}
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+	return &TokenManager{secret: secret, ttl: ttl}, nil
+}
+
+// Issue creates a signed session token for username, starting a new login session.
+// It returns the token and its claims, including the new session's ID.
+func (tm *TokenManager) Issue(username string) (string, *Claims, error) {
+	if username == "" {
+		return "", nil, fmt.Errorf("username cannot be empty")
+	}
+	sessionID, err := newSessionID()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate session ID for '%s': %w", username, err)
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(tm.ttl)
+
+	claims := jwt.RegisteredClaims{
+		ID:        sessionID,
+		Issuer:    tokenIssuer,
+		Subject:   username,
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(tm.secret)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to sign session token for '%s': %w", username, err)
+	}
+	return signed, &Claims{Username: username, SessionID: sessionID, ExpiresAt: expiresAt}, nil
+}
+
+// Verify checks a token's signature, algorithm, issuer and validity window,
+// and returns its claims. Any failure is reported as ErrInvalidToken.
+func (tm *TokenManager) Verify(tokenString string) (*Claims, error) {
+	if tokenString == "" {
+		return nil, ErrInvalidToken
+	}
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(*jwt.Token) (interface{}, error) {
+		return tm.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), // Reject "none" and algorithm-confusion attacks.
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" || claims.ID == "" {
+		return nil, fmt.Errorf("%w: missing subject or session ID", ErrInvalidToken)
+	}
+	return &Claims{Username: claims.Subject, SessionID: claims.ID, ExpiresAt: claims.ExpiresAt.Time}, nil
+}
+
+// newSessionID returns a random, URL-safe session identifier.
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
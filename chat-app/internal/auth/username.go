@@ -0,0 +1,12 @@
+package auth
+
+import "regexp"
+
+// usernamePattern restricts usernames to a safe, display-friendly character set.
+// Usernames are embedded in store keys, so they must never contain ':'.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// ValidUsername reports whether username is acceptable: 1-32 letters, digits, '.', '_' or '-'.
+func ValidUsername(username string) bool {
+	return usernamePattern.MatchString(username)
+}
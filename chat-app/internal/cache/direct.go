@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// directMessageSeqPrefix is the Redis key for the message ID sequence of a direct conversation.
+	// Format: dm:<userA>:<userB>:seq, with the two usernames in lexical order.
+	directMessageSeqPrefix = "dm:%s:seq"
+
+	// directMessageLogPrefix is the Redis key for the durable log of a direct conversation:
+	// a sorted set of message JSON strings scored by message ID, like a room's log.
+	// Format: dm:<userA>:<userB>:log, with the two usernames in lexical order.
+	directMessageLogPrefix = "dm:%s:log"
+
+	// userConversationsPrefix is the Redis key for the sorted set of a user's direct conversation
+	// peers, scored by the time of the last message exchanged (Unix milliseconds).
+	// Format: user:<username>:conversations
+	userConversationsPrefix = "user:%s:conversations"
+)
+
+// Conversation summarizes one of a user's direct message conversations.
+type Conversation struct {
+	Peer          string    // The other participant.
+	LastMessageAt time.Time // When the last message in the conversation was sent.
+}
+
+// conversationKey identifies the conversation between two users. It is the same
+// whichever user is given first. Usernames cannot contain ':', so keys never collide.
+func conversationKey(userA, userB string) string {
+	if userA > userB {
+		userA, userB = userB, userA
+	}
+	return userA + ":" + userB
+}
+
+// --- Direct Message Operations ---
+
+// NextDirectMessageID reserves and returns the next message ID of the conversation between two users.
+func (rc *RedisClient) NextDirectMessageID(ctx context.Context, userA string, userB string) (int64, error) {
+	ctx = withRedisMethod(ctx, "NextDirectMessageID")
+	if userA == "" || userB == "" {
+		return 0, fmt.Errorf("usernames cannot be empty")
+	}
+	seqKey := fmt.Sprintf(directMessageSeqPrefix, conversationKey(userA, userB))
+	id, err := rc.client.Incr(ctx, seqKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to reserve direct message ID between '%s' and '%s': %w", userA, userB, err)
+	}
+	return id, nil
+}
+
+// AppendDirectMessage stores a message (as a JSON string) in the log of the conversation between
+// two users under its ID. If maxMessages is greater than 0, the oldest entries beyond it are dropped.
+func (rc *RedisClient) AppendDirectMessage(ctx context.Context, userA string, userB string, id int64, messageJSON string, maxMessages int) error {
+	ctx = withRedisMethod(ctx, "AppendDirectMessage")
+	if userA == "" || userB == "" {
+		return fmt.Errorf("usernames cannot be empty")
+	}
+	if id <= 0 {
+		return fmt.Errorf("message ID must be positive, got %d", id)
+	}
+	if messageJSON == "" {
+		return fmt.Errorf("messageJSON cannot be empty")
+	}
+	logKey := fmt.Sprintf(directMessageLogPrefix, conversationKey(userA, userB))
+	if err := rc.appendToLog(ctx, logKey, id, messageJSON, maxMessages); err != nil {
+		return fmt.Errorf("failed to append direct message %d between '%s' and '%s': %w", id, userA, userB, err)
+	}
+	return nil
+}
+
+// GetDirectMessagesBefore returns up to limit messages of the conversation between two users whose
+// ID is lower than beforeID, newest first. A beforeID <= 0 starts from the newest message.
+// If limit is invalid (<=0), it defaults to 10.
+func (rc *RedisClient) GetDirectMessagesBefore(ctx context.Context, userA string, userB string, beforeID int64, limit int) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetDirectMessagesBefore")
+	if userA == "" || userB == "" {
+		return nil, fmt.Errorf("usernames cannot be empty")
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+	logKey := fmt.Sprintf(directMessageLogPrefix, conversationKey(userA, userB))
+	messages, err := rc.readLogBefore(ctx, logKey, beforeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read direct messages between '%s' and '%s' before %d: %w", userA, userB, beforeID, err)
+	}
+	return messages, nil
+}
+
+// RecordConversation moves the conversation between two users to the top of both users'
+// conversation lists, with at as the time of its last message.
+func (rc *RedisClient) RecordConversation(ctx context.Context, userA string, userB string, at time.Time) error {
+	ctx = withRedisMethod(ctx, "RecordConversation")
+	if userA == "" || userB == "" {
+		return fmt.Errorf("usernames cannot be empty")
+	}
+	score := float64(at.UnixMilli())
+	pipe := rc.client.TxPipeline()
+	pipe.ZAdd(ctx, fmt.Sprintf(userConversationsPrefix, userA), &redis.Z{Score: score, Member: userB})
+	pipe.ZAdd(ctx, fmt.Sprintf(userConversationsPrefix, userB), &redis.Z{Score: score, Member: userA})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record conversation between '%s' and '%s': %w", userA, userB, err)
+	}
+	return nil
+}
+
+// GetConversations returns up to limit of a user's direct conversations, most recently active first.
+// If limit is invalid (<=0), it defaults to 50.
+func (rc *RedisClient) GetConversations(ctx context.Context, username string, limit int) ([]Conversation, error) {
+	ctx = withRedisMethod(ctx, "GetConversations")
+	if username == "" {
+		return nil, fmt.Errorf("username cannot be empty")
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+	key := fmt.Sprintf(userConversationsPrefix, username)
+	entries, err := rc.client.ZRevRangeWithScores(ctx, key, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get conversations of user '%s' from Redis: %w", username, err)
+	}
+	conversations := make([]Conversation, 0, len(entries))
+	for _, entry := range entries {
+		peer, ok := entry.Member.(string)
+		if !ok {
+			continue
+		}
+		conversations = append(conversations, Conversation{Peer: peer, LastMessageAt: time.UnixMilli(int64(entry.Score)).UTC()})
+	}
+	return conversations, nil
+}
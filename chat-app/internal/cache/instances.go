@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// instanceHeartbeatsKey is the Redis key for the sorted set of live instances, scored by the
+	// Unix time, in milliseconds, of their last heartbeat.
+	instanceHeartbeatsKey = "instances:heartbeats"
+
+	// instanceUsersPrefix is the Redis key for the hash counting, per user, the connections an
+	// instance added to the global set of active users.
+	// Format: instance:<instanceID>:users
+	instanceUsersPrefix = "instance:%s:users"
+
+	// instanceRoomUsersPrefix is the Redis key for the hash counting, per room and user, the
+	// connections an instance added to the room's active user set. Fields are "<roomID> <username>";
+	// neither room IDs nor usernames can contain spaces.
+	// Format: instance:<instanceID>:room_users
+	instanceRoomUsersPrefix = "instance:%s:room_users"
+)
+
+// ReapedInstance describes what removing the connections of a dead instance changed.
+type ReapedInstance struct {
+	OfflineUsers []string            // Users that were left without connections on any instance.
+	LeftRooms    map[string][]string // Room ID -> users that were left without connections in that room.
+}
+
+// instanceRoomUserField returns the field counting a user's connections to a room in
+// an instance's instanceRoomUsersPrefix hash.
+func instanceRoomUserField(roomID string, username string) string {
+	return roomID + " " + username
+}
+
+// --- Instance Operations ---
+
+// Heartbeat records that instanceID is alive at time at. It returns false if the instance had
+// no heartbeat recorded: it is starting, or it was presumed dead and reaped.
+func (rc *RedisClient) Heartbeat(ctx context.Context, instanceID string, at time.Time) (bool, error) {
+	ctx = withRedisMethod(ctx, "Heartbeat")
+	if instanceID == "" {
+		return false, fmt.Errorf("instanceID cannot be empty")
+	}
+	added, err := rc.client.ZAdd(ctx, instanceHeartbeatsKey, &redis.Z{Score: float64(at.UnixMilli()), Member: instanceID}).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to record heartbeat of instance '%s': %w", instanceID, err)
+	}
+	return added == 0, nil
+}
+
+// GetStaleInstances returns the IDs of the instances whose last heartbeat is older than before.
+func (rc *RedisClient) GetStaleInstances(ctx context.Context, before time.Time) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetStaleInstances")
+	instances, err := rc.client.ZRangeByScore(ctx, instanceHeartbeatsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(before.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instances without a heartbeat since %s: %w", before.Format(time.RFC3339), err)
+	}
+	return instances, nil
+}
+
+// reapInstanceScript removes a dead instance (ARGV[1]) from the heartbeats set (KEYS[1]) unless it
+// heartbeat at or after ARGV[2] (milliseconds), then takes each connection it counted in its users
+// hash (KEYS[2]) off the global connection counts and set (KEYS[3] and KEYS[4]), and each one it
+// counted in its room users hash (KEYS[5]) off the room's counts and set (formats ARGV[3] and
+// ARGV[4]), and deletes both hashes. Running it once per instance makes concurrent reapers safe.
+// Returns the users left offline and the "<roomID> <username>" pairs of the users left out of a
+// room, or nil if the instance was not reaped.
+var reapInstanceScript = redis.NewScript(`
+local beat = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not beat or tonumber(beat) >= tonumber(ARGV[2]) then
+	return nil
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+
+local offline = {}
+local users = redis.call('HGETALL', KEYS[2])
+for i = 1, #users, 2 do
+	if redis.call('HINCRBY', KEYS[3], users[i], -tonumber(users[i + 1])) <= 0 then
+		redis.call('HDEL', KEYS[3], users[i])
+		if redis.call('SREM', KEYS[4], users[i]) == 1 then
+			table.insert(offline, users[i])
+		end
+	end
+end
+
+local left = {}
+local roomUsers = redis.call('HGETALL', KEYS[5])
+for i = 1, #roomUsers, 2 do
+	local sep = string.find(roomUsers[i], ' ', 1, true)
+	local roomID, username = string.sub(roomUsers[i], 1, sep - 1), string.sub(roomUsers[i], sep + 1)
+	local connectionsKey = string.format(ARGV[3], roomID)
+	if redis.call('HINCRBY', connectionsKey, username, -tonumber(roomUsers[i + 1])) <= 0 then
+		redis.call('HDEL', connectionsKey, username)
+		if redis.call('SREM', string.format(ARGV[4], roomID), username) == 1 then
+			table.insert(left, roomUsers[i])
+		end
+	end
+end
+
+redis.call('DEL', KEYS[2], KEYS[5])
+return {offline, left}
+`)
+
+// ReapInstance removes every connection recorded by instanceID from the global and per-room
+// active user sets and counts, provided its last heartbeat is older than before. Connections the
+// same users have through other instances are unaffected. Returns nil if the instance is not
+// stale (any more), including when another instance reaped it first.
+func (rc *RedisClient) ReapInstance(ctx context.Context, instanceID string, before time.Time) (*ReapedInstance, error) {
+	ctx = withRedisMethod(ctx, "ReapInstance")
+	if instanceID == "" {
+		return nil, fmt.Errorf("instanceID cannot be empty")
+	}
+	keys := []string{
+		instanceHeartbeatsKey,
+		fmt.Sprintf(instanceUsersPrefix, instanceID),
+		globalUserConnectionsKey,
+		globalUsersSetKey,
+		fmt.Sprintf(instanceRoomUsersPrefix, instanceID),
+	}
+	result, err := reapInstanceScript.Run(ctx, rc.client, keys, instanceID, before.UnixMilli(), roomUserConnectionsPrefix, roomUsersPrefix).Slice()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reap instance '%s': %w", instanceID, err)
+	}
+
+	reaped := &ReapedInstance{LeftRooms: make(map[string][]string)}
+	offline, _ := result[0].([]interface{})
+	for _, username := range offline {
+		reaped.OfflineUsers = append(reaped.OfflineUsers, fmt.Sprint(username))
+	}
+	left, _ := result[1].([]interface{})
+	for _, field := range left {
+		roomID, username, _ := strings.Cut(fmt.Sprint(field), " ")
+		reaped.LeftRooms[roomID] = append(reaped.LeftRooms[roomID], username)
+	}
+	return reaped, nil
+}
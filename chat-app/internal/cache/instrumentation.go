@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yebrai/go-chat/internal/metrics"
+	"github.com/yebrai/go-chat/internal/tracing"
+)
+
+// redisMethodKey is the context key under which RedisClient's methods name themselves for
+// instrumentationHook.
+type redisMethodKey struct{}
+
+// withRedisMethod returns a context under which Redis calls are labelled as made by the
+// RedisClient method named method. Every exported RedisClient method starts with it.
+func withRedisMethod(ctx context.Context, method string) context.Context {
+	return context.WithValue(ctx, redisMethodKey{}, method)
+}
+
+// redisCallKey is the context key under which instrumentationHook keeps the call being timed.
+type redisCallKey struct{}
+
+// redisCall is a Redis command or pipeline being timed and traced by instrumentationHook.
+type redisCall struct {
+	method string     // The RedisClient method that issued it.
+	start  time.Time  // When it was issued.
+	span   trace.Span // The span covering it.
+}
+
+// instrumentationHook is a go-redis hook that records the latency and errors of every Redis
+// command and pipeline in metrics.RedisCallDuration and metrics.RedisCallErrors, and traces it
+// as a span named "redis.<method>", after the RedisClient method that issued it, as named by
+// withRedisMethod, or "other" for calls made outside of one, such as the Pub/Sub subscription's.
+// The span is a child of whatever span the context the method was given carries. Failed calls are also logged, at
+// debug level since the callers log the errors they get back.
+type instrumentationHook struct {
+	log *slog.Logger
+}
+
+func (instrumentationHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return startRedisCall(ctx, cmd.Name()), nil
+}
+
+func (hook instrumentationHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	hook.observeRedisCall(ctx, cmd.Err())
+	return nil
+}
+
+func (instrumentationHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return startRedisCall(ctx, "pipeline"), nil
+}
+
+func (hook instrumentationHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if redisCallFailed(cmd.Err()) {
+			err = cmd.Err()
+			break
+		}
+	}
+	hook.observeRedisCall(ctx, err)
+	return nil
+}
+
+// startRedisCall starts timing and tracing a call of Redis command operation (or "pipeline"),
+// and returns a context that carries it.
+func startRedisCall(ctx context.Context, operation string) context.Context {
+	method, ok := ctx.Value(redisMethodKey{}).(string)
+	if !ok {
+		method = "other"
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "redis."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "redis"), attribute.String("db.operation", operation)))
+	return context.WithValue(ctx, redisCallKey{}, &redisCall{method: method, start: time.Now(), span: span})
+}
+
+// observeRedisCall records the call carried by ctx, which returned err, and ends its span.
+func (hook instrumentationHook) observeRedisCall(ctx context.Context, err error) {
+	call, ok := ctx.Value(redisCallKey{}).(*redisCall)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(call.start)
+	metrics.RedisCallDuration.WithLabelValues(call.method).Observe(elapsed.Seconds())
+	if redisCallFailed(err) {
+		metrics.RedisCallErrors.WithLabelValues(call.method).Inc()
+		hook.log.Debug("Redis call failed", "method", call.method, "duration", elapsed, "error", err)
+		call.span.RecordError(err)
+		call.span.SetStatus(codes.Error, err.Error())
+	}
+	call.span.End()
+}
+
+// redisCallFailed reports whether err is an actual failure. Missing keys (redis.Nil) are not,
+// nor is the NOSCRIPT error on which redis.Script.Run loads its script with EVAL.
+func redisCallFailed(err error) bool {
+	return err != nil && !errors.Is(err, redis.Nil) && !strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
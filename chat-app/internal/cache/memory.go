@@ -0,0 +1,1740 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-process implementation of Store with the same semantics as
+// RedisClient: the same key layout, list trimming, TTLs and Pub/Sub fan-out.
+// It lets the Hub run without Redis (a single instance, or several Hubs sharing one
+// MemoryStore in the same process) and makes the Hub testable in isolation.
+// Expired keys are removed lazily, when they are next accessed.
+type MemoryStore struct {
+	mu       sync.Mutex
+	lists    map[string][]string            // Redis lists, head at index 0.
+	sets     map[string]map[string]struct{} // Redis sets.
+	hashes   map[string]map[string]int64    // Redis hashes of integer fields.
+	records  map[string]map[string]string   // Redis hashes of string fields.
+	counters map[string]int64               // Redis integer strings.
+	values   map[string]string              // Redis plain strings.
+	logs     map[string][]logEntry          // Redis sorted sets used as message logs, ascending by ID.
+	zsets    map[string]map[string]float64  // Other Redis sorted sets: member -> score.
+	expiry   map[string]time.Time           // Per-key expiry deadlines, like Redis EXPIRE.
+	subs     map[*memoryEventSubscription]struct{}
+	now      func() time.Time // Clock, replaceable so TTL behaviour can be exercised deterministically.
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		lists:    make(map[string][]string),
+		sets:     make(map[string]map[string]struct{}),
+		hashes:   make(map[string]map[string]int64),
+		records:  make(map[string]map[string]string),
+		counters: make(map[string]int64),
+		values:   make(map[string]string),
+		logs:     make(map[string][]logEntry),
+		zsets:    make(map[string]map[string]float64),
+		expiry:   make(map[string]time.Time),
+		subs:     make(map[*memoryEventSubscription]struct{}),
+		now:      time.Now,
+	}
+}
+
+// SetClock replaces the clock used for TTL bookkeeping. It is intended for tests.
+func (ms *MemoryStore) SetClock(now func() time.Time) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.now = now
+}
+
+// expireIfDue deletes key if its TTL has elapsed. The caller must hold ms.mu.
+func (ms *MemoryStore) expireIfDue(key string) {
+	deadline, ok := ms.expiry[key]
+	if !ok || ms.now().Before(deadline) {
+		return
+	}
+	ms.deleteKey(key)
+}
+
+// deleteKey removes key and its TTL, whatever its type. The caller must hold ms.mu.
+func (ms *MemoryStore) deleteKey(key string) {
+	delete(ms.lists, key)
+	delete(ms.sets, key)
+	delete(ms.hashes, key)
+	delete(ms.records, key)
+	delete(ms.counters, key)
+	delete(ms.values, key)
+	delete(ms.logs, key)
+	delete(ms.zsets, key)
+	delete(ms.expiry, key)
+}
+
+// setTTL mirrors Redis EXPIRE, which is a no-op on keys that do not exist. The caller must hold ms.mu.
+func (ms *MemoryStore) setTTL(key string, ttl time.Duration) {
+	_, isList := ms.lists[key]
+	_, isSet := ms.sets[key]
+	_, isHash := ms.hashes[key]
+	_, isRecord := ms.records[key]
+	_, isCounter := ms.counters[key]
+	_, isValue := ms.values[key]
+	_, isLog := ms.logs[key]
+	_, isZSet := ms.zsets[key]
+	if isList || isSet || isHash || isRecord || isCounter || isValue || isLog || isZSet {
+		ms.expiry[key] = ms.now().Add(ttl)
+	}
+}
+
+// --- Message Operations ---
+
+// AddRecentMessage adds a message to the head of a room's recent message list,
+// trims the list to maxMessages and refreshes its TTL, like RedisClient.AddRecentMessage.
+func (ms *MemoryStore) AddRecentMessage(ctx context.Context, roomID string, messageJSON string, maxMessages int, messageTTL time.Duration) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	if messageJSON == "" {
+		return fmt.Errorf("messageJSON cannot be empty")
+	}
+	listKey := fmt.Sprintf(roomMessagesPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(listKey)
+
+	list := append([]string{messageJSON}, ms.lists[listKey]...)
+	if maxMessages > 0 && len(list) > maxMessages {
+		list = list[:maxMessages]
+	}
+	ms.lists[listKey] = list
+
+	if messageTTL <= 0 {
+		messageTTL = defaultRecentMessagesListTTL
+	}
+	ms.setTTL(listKey, messageTTL)
+	return nil
+}
+
+// GetRecentMessages returns up to count recent messages for a room, newest first.
+// If count is invalid (<=0), it defaults to 10.
+func (ms *MemoryStore) GetRecentMessages(ctx context.Context, roomID string, count int) ([]string, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	if count <= 0 {
+		count = 10
+	}
+	listKey := fmt.Sprintf(roomMessagesPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(listKey)
+
+	list := ms.lists[listKey]
+	if count > len(list) {
+		count = len(list)
+	}
+	messages := make([]string, count)
+	copy(messages, list[:count])
+	return messages, nil
+}
+
+// --- Message Log Operations ---
+
+// logEntry is one message in a room's log, the in-memory counterpart of a sorted set member.
+type logEntry struct {
+	id          int64
+	messageJSON string
+}
+
+// NextMessageID reserves and returns the next message ID of a room, like RedisClient.NextMessageID.
+func (ms *MemoryStore) NextMessageID(ctx context.Context, roomID string) (int64, error) {
+	if roomID == "" {
+		return 0, fmt.Errorf("roomID cannot be empty")
+	}
+	seqKey := fmt.Sprintf(roomMessageSeqPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.counters[seqKey]++
+	return ms.counters[seqKey], nil
+}
+
+// AppendToMessageLog stores a message in a room's log under its ID, replacing any entry with
+// the same ID, and drops the oldest entries beyond maxMessages (if > 0).
+func (ms *MemoryStore) AppendToMessageLog(ctx context.Context, roomID string, id int64, messageJSON string, maxMessages int) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	if id <= 0 {
+		return fmt.Errorf("message ID must be positive, got %d", id)
+	}
+	if messageJSON == "" {
+		return fmt.Errorf("messageJSON cannot be empty")
+	}
+	logKey := fmt.Sprintf(roomMessageLogPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.appendToLog(logKey, id, messageJSON, maxMessages)
+	return nil
+}
+
+// GetMessagesBefore returns up to limit messages from a room's log whose ID is lower than
+// beforeID (or from the newest message if beforeID <= 0), newest first.
+// If limit is invalid (<=0), it defaults to 10.
+func (ms *MemoryStore) GetMessagesBefore(ctx context.Context, roomID string, beforeID int64, limit int) ([]string, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+	logKey := fmt.Sprintf(roomMessageLogPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.readLogBefore(logKey, beforeID, limit), nil
+}
+
+// appendToLog stores a message in the log at logKey under its ID, replacing any entry with the
+// same ID, and drops the oldest entries beyond maxMessages (if > 0). The caller must hold ms.mu.
+func (ms *MemoryStore) appendToLog(logKey string, id int64, messageJSON string, maxMessages int) {
+	entries := ms.logs[logKey]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].id >= id })
+	if i < len(entries) && entries[i].id == id {
+		entries[i].messageJSON = messageJSON
+	} else {
+		entries = append(entries, logEntry{})
+		copy(entries[i+1:], entries[i:])
+		entries[i] = logEntry{id: id, messageJSON: messageJSON}
+	}
+	if maxMessages > 0 && len(entries) > maxMessages {
+		entries = append([]logEntry(nil), entries[len(entries)-maxMessages:]...)
+	}
+	ms.logs[logKey] = entries
+}
+
+// readLogBefore returns up to limit messages of the log at logKey with an ID lower than beforeID
+// (or from the newest if beforeID <= 0), newest first. The caller must hold ms.mu.
+func (ms *MemoryStore) readLogBefore(logKey string, beforeID int64, limit int) []string {
+	entries := ms.logs[logKey]
+	end := len(entries)
+	if beforeID > 0 {
+		end = sort.Search(len(entries), func(i int) bool { return entries[i].id >= beforeID })
+	}
+	messages := make([]string, 0, limit)
+	for i := end - 1; i >= 0 && len(messages) < limit; i-- {
+		messages = append(messages, entries[i].messageJSON)
+	}
+	return messages
+}
+
+// GetMessagesAfter returns up to limit messages from a room's log whose ID is greater than
+// afterID, oldest first. If limit is invalid (<=0), it defaults to 10.
+func (ms *MemoryStore) GetMessagesAfter(ctx context.Context, roomID string, afterID int64, limit int) ([]string, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+	logKey := fmt.Sprintf(roomMessageLogPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entries := ms.logs[logKey]
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].id > afterID })
+	messages := make([]string, 0, limit)
+	for i := start; i < len(entries) && len(messages) < limit; i++ {
+		messages = append(messages, entries[i].messageJSON)
+	}
+	return messages, nil
+}
+
+// GetMessage returns the message stored under id in a room's log, or "" if there is none.
+func (ms *MemoryStore) GetMessage(ctx context.Context, roomID string, id int64) (string, error) {
+	if roomID == "" {
+		return "", fmt.Errorf("roomID cannot be empty")
+	}
+	logKey := fmt.Sprintf(roomMessageLogPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entries := ms.logs[logKey]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].id >= id })
+	if i == len(entries) || entries[i].id != id {
+		return "", nil
+	}
+	return entries[i].messageJSON, nil
+}
+
+// GetLatestMessageIDs returns the ID most recently reserved in each of the given rooms, like
+// RedisClient.GetLatestMessageIDs.
+func (ms *MemoryStore) GetLatestMessageIDs(ctx context.Context, roomIDs []string) (map[string]int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	latest := make(map[string]int64, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if id, ok := ms.counters[fmt.Sprintf(roomMessageSeqPrefix, roomID)]; ok {
+			latest[roomID] = id
+		}
+	}
+	return latest, nil
+}
+
+// ReplaceMessage overwrites the message stored under id in a room's log, and its copy in the
+// room's recent messages list if it is still there, provided it is still oldJSON, like
+// RedisClient.ReplaceMessage.
+func (ms *MemoryStore) ReplaceMessage(ctx context.Context, roomID string, id int64, oldJSON string, messageJSON string) (bool, error) {
+	if roomID == "" {
+		return false, fmt.Errorf("roomID cannot be empty")
+	}
+	if messageJSON == "" {
+		return false, fmt.Errorf("messageJSON cannot be empty")
+	}
+	logKey := fmt.Sprintf(roomMessageLogPrefix, roomID)
+	listKey := fmt.Sprintf(roomMessagesPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	entries := ms.logs[logKey]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].id >= id })
+	if i == len(entries) || entries[i].id != id || entries[i].messageJSON != oldJSON {
+		return false, nil
+	}
+	entries[i].messageJSON = messageJSON
+
+	ms.expireIfDue(listKey)
+	for j, message := range ms.lists[listKey] {
+		if message == oldJSON {
+			ms.lists[listKey][j] = messageJSON
+			break
+		}
+	}
+	return true, nil
+}
+
+// AddMessageEdit appends an earlier version of a message to its edit history, keeping only the
+// newest maxEdits versions if maxEdits > 0, like RedisClient.AddMessageEdit.
+func (ms *MemoryStore) AddMessageEdit(ctx context.Context, roomID string, id int64, versionJSON string, maxEdits int) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	if versionJSON == "" {
+		return fmt.Errorf("versionJSON cannot be empty")
+	}
+	editsKey := fmt.Sprintf(messageEditsPrefix, roomID, id)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	versions := append(ms.lists[editsKey], versionJSON)
+	if maxEdits > 0 && len(versions) > maxEdits {
+		versions = append([]string(nil), versions[len(versions)-maxEdits:]...)
+	}
+	ms.lists[editsKey] = versions
+	return nil
+}
+
+// GetMessageEdits returns the earlier versions of a message, oldest first.
+func (ms *MemoryStore) GetMessageEdits(ctx context.Context, roomID string, id int64) ([]string, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return append([]string{}, ms.lists[fmt.Sprintf(messageEditsPrefix, roomID, id)]...), nil
+}
+
+// DeleteMessageEdits drops the edit history of a message.
+func (ms *MemoryStore) DeleteMessageEdits(ctx context.Context, roomID string, id int64) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.deleteKey(fmt.Sprintf(messageEditsPrefix, roomID, id))
+	return nil
+}
+
+// RecordClientMessageID records that the message a user sent with clientMsgID is stored as id,
+// unless it was already recorded, like RedisClient.RecordClientMessageID.
+func (ms *MemoryStore) RecordClientMessageID(ctx context.Context, username string, clientMsgID string, id int64, ttl time.Duration) (int64, bool, error) {
+	if username == "" || clientMsgID == "" {
+		return 0, false, fmt.Errorf("username and clientMsgID cannot be empty")
+	}
+	if ttl <= 0 {
+		return 0, false, fmt.Errorf("ttl must be positive")
+	}
+	key := fmt.Sprintf(clientMessageIDPrefix, username, clientMsgID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(key)
+	if existing, ok := ms.counters[key]; ok {
+		return existing, false, nil
+	}
+	ms.counters[key] = id
+	ms.setTTL(key, ttl)
+	return id, true, nil
+}
+
+// ForgetClientMessageID removes the record of a user's clientMsgID.
+func (ms *MemoryStore) ForgetClientMessageID(ctx context.Context, username string, clientMsgID string) error {
+	if username == "" || clientMsgID == "" {
+		return fmt.Errorf("username and clientMsgID cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.deleteKey(fmt.Sprintf(clientMessageIDPrefix, username, clientMsgID))
+	return nil
+}
+
+// --- Direct Message Operations ---
+
+// NextDirectMessageID reserves and returns the next message ID of the conversation between two users.
+func (ms *MemoryStore) NextDirectMessageID(ctx context.Context, userA string, userB string) (int64, error) {
+	if userA == "" || userB == "" {
+		return 0, fmt.Errorf("usernames cannot be empty")
+	}
+	seqKey := fmt.Sprintf(directMessageSeqPrefix, conversationKey(userA, userB))
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.counters[seqKey]++
+	return ms.counters[seqKey], nil
+}
+
+// AppendDirectMessage stores a message in the log of the conversation between two users.
+func (ms *MemoryStore) AppendDirectMessage(ctx context.Context, userA string, userB string, id int64, messageJSON string, maxMessages int) error {
+	if userA == "" || userB == "" {
+		return fmt.Errorf("usernames cannot be empty")
+	}
+	if id <= 0 {
+		return fmt.Errorf("message ID must be positive, got %d", id)
+	}
+	if messageJSON == "" {
+		return fmt.Errorf("messageJSON cannot be empty")
+	}
+	logKey := fmt.Sprintf(directMessageLogPrefix, conversationKey(userA, userB))
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.appendToLog(logKey, id, messageJSON, maxMessages)
+	return nil
+}
+
+// GetDirectMessagesBefore returns up to limit messages of the conversation between two users
+// whose ID is lower than beforeID (or from the newest if beforeID <= 0), newest first.
+func (ms *MemoryStore) GetDirectMessagesBefore(ctx context.Context, userA string, userB string, beforeID int64, limit int) ([]string, error) {
+	if userA == "" || userB == "" {
+		return nil, fmt.Errorf("usernames cannot be empty")
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+	logKey := fmt.Sprintf(directMessageLogPrefix, conversationKey(userA, userB))
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.readLogBefore(logKey, beforeID, limit), nil
+}
+
+// RecordConversation moves the conversation between two users to the top of both users' conversation lists.
+func (ms *MemoryStore) RecordConversation(ctx context.Context, userA string, userB string, at time.Time) error {
+	if userA == "" || userB == "" {
+		return fmt.Errorf("usernames cannot be empty")
+	}
+	score := float64(at.UnixMilli())
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.zadd(fmt.Sprintf(userConversationsPrefix, userA), userB, score)
+	ms.zadd(fmt.Sprintf(userConversationsPrefix, userB), userA, score)
+	return nil
+}
+
+// GetConversations returns up to limit of a user's direct conversations, most recently active first.
+// If limit is invalid (<=0), it defaults to 50.
+func (ms *MemoryStore) GetConversations(ctx context.Context, username string, limit int) ([]Conversation, error) {
+	if username == "" {
+		return nil, fmt.Errorf("username cannot be empty")
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+	key := fmt.Sprintf(userConversationsPrefix, username)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(key)
+	conversations := make([]Conversation, 0, len(ms.zsets[key]))
+	for peer, score := range ms.zsets[key] {
+		conversations = append(conversations, Conversation{Peer: peer, LastMessageAt: time.UnixMilli(int64(score)).UTC()})
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		if !conversations[i].LastMessageAt.Equal(conversations[j].LastMessageAt) {
+			return conversations[i].LastMessageAt.After(conversations[j].LastMessageAt)
+		}
+		return conversations[i].Peer > conversations[j].Peer // Redis orders equal scores by member, reversed.
+	})
+	if len(conversations) > limit {
+		conversations = conversations[:limit]
+	}
+	return conversations, nil
+}
+
+// zadd sets member's score in the sorted set at key, creating the set if needed. The caller must hold ms.mu.
+func (ms *MemoryStore) zadd(key, member string, score float64) {
+	ms.expireIfDue(key)
+	if _, ok := ms.zsets[key]; !ok {
+		ms.zsets[key] = make(map[string]float64)
+	}
+	ms.zsets[key][member] = score
+}
+
+// --- Room Registry Operations ---
+
+// CreateRoom registers a room unless it is already registered, like RedisClient.CreateRoom.
+func (ms *MemoryStore) CreateRoom(ctx context.Context, room Room) (bool, error) {
+	if room.ID == "" {
+		return false, fmt.Errorf("roomID cannot be empty")
+	}
+	roomJSON, err := json.Marshal(room)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal room '%s': %w", room.ID, err)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, exists := ms.records[roomRegistryKey][room.ID]; exists {
+		return false, nil
+	}
+	if _, ok := ms.records[roomRegistryKey]; !ok {
+		ms.records[roomRegistryKey] = make(map[string]string)
+	}
+	ms.records[roomRegistryKey][room.ID] = string(roomJSON)
+	return true, nil
+}
+
+// GetRoom returns the registry record of a room, or nil if the room is not registered.
+func (ms *MemoryStore) GetRoom(ctx context.Context, roomID string) (*Room, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	ms.mu.Lock()
+	roomJSON, exists := ms.records[roomRegistryKey][roomID]
+	ms.mu.Unlock()
+	if !exists {
+		return nil, nil
+	}
+	return decodeRoom(roomID, roomJSON)
+}
+
+// ListRooms returns every registered room, oldest first.
+func (ms *MemoryStore) ListRooms(ctx context.Context) ([]Room, error) {
+	ms.mu.Lock()
+	entries := make(map[string]string, len(ms.records[roomRegistryKey]))
+	for roomID, roomJSON := range ms.records[roomRegistryKey] {
+		entries[roomID] = roomJSON
+	}
+	ms.mu.Unlock()
+	return decodeRooms(entries)
+}
+
+// UpdateRoom replaces the registry record of an already registered room, like RedisClient.UpdateRoom.
+func (ms *MemoryStore) UpdateRoom(ctx context.Context, room Room) (bool, error) {
+	if room.ID == "" {
+		return false, fmt.Errorf("roomID cannot be empty")
+	}
+	roomJSON, err := json.Marshal(room)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal room '%s': %w", room.ID, err)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, exists := ms.records[roomRegistryKey][room.ID]; !exists {
+		return false, nil
+	}
+	ms.records[roomRegistryKey][room.ID] = string(roomJSON)
+	return true, nil
+}
+
+// --- Room Membership Operations ---
+
+// AddRoomMember makes username a member of a room.
+func (ms *MemoryStore) AddRoomMember(ctx context.Context, roomID string, username string) error {
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.addToSet(fmt.Sprintf(roomMembersPrefix, roomID), username)
+	ms.addToSet(fmt.Sprintf(userRoomsPrefix, username), roomID)
+	return nil
+}
+
+// RemoveRoomMember removes username from a room's members, if present, and clears their role.
+func (ms *MemoryStore) RemoveRoomMember(ctx context.Context, roomID string, username string) error {
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.removeFromSet(fmt.Sprintf(roomMembersPrefix, roomID), username)
+	ms.removeFromSet(fmt.Sprintf(userRoomsPrefix, username), roomID)
+	ms.removeRecord(fmt.Sprintf(roomRolesPrefix, roomID), username)
+	return nil
+}
+
+// BanFromRoom removes username from a room's members, clears their role and bans them from the room.
+func (ms *MemoryStore) BanFromRoom(ctx context.Context, roomID string, username string) error {
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.removeFromSet(fmt.Sprintf(roomMembersPrefix, roomID), username)
+	ms.removeFromSet(fmt.Sprintf(userRoomsPrefix, username), roomID)
+	ms.removeRecord(fmt.Sprintf(roomRolesPrefix, roomID), username)
+	ms.addToSet(fmt.Sprintf(roomBansPrefix, roomID), username)
+	return nil
+}
+
+// UnbanFromRoom lifts a user's ban from a room, if any. It does not restore their membership.
+func (ms *MemoryStore) UnbanFromRoom(ctx context.Context, roomID string, username string) error {
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.removeFromSet(fmt.Sprintf(roomBansPrefix, roomID), username)
+	return nil
+}
+
+// GetRoomAccess reports whether username is a member of a room and whether they are banned from it.
+func (ms *MemoryStore) GetRoomAccess(ctx context.Context, roomID string, username string) (member bool, banned bool, err error) {
+	if roomID == "" || username == "" {
+		return false, false, fmt.Errorf("roomID and username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, member = ms.sets[fmt.Sprintf(roomMembersPrefix, roomID)][username]
+	_, banned = ms.sets[fmt.Sprintf(roomBansPrefix, roomID)][username]
+	return member, banned, nil
+}
+
+// GetRoomsAccess returns the registry record of each of the given rooms and whether username is
+// a member of it and banned from it.
+func (ms *MemoryStore) GetRoomsAccess(ctx context.Context, roomIDs []string, username string) (map[string]RoomAccess, error) {
+	if username == "" {
+		return nil, fmt.Errorf("username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	access := make(map[string]RoomAccess, len(roomIDs))
+	for _, roomID := range roomIDs {
+		var entry RoomAccess
+		_, entry.Member = ms.sets[fmt.Sprintf(roomMembersPrefix, roomID)][username]
+		_, entry.Banned = ms.sets[fmt.Sprintf(roomBansPrefix, roomID)][username]
+		if roomJSON, exists := ms.records[roomRegistryKey][roomID]; exists {
+			room, err := decodeRoom(roomID, roomJSON)
+			if err != nil {
+				return nil, err
+			}
+			entry.Room = room
+		}
+		access[roomID] = entry
+	}
+	return access, nil
+}
+
+// GetRoomMembers returns the members of a room.
+func (ms *MemoryStore) GetRoomMembers(ctx context.Context, roomID string) ([]string, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.members(fmt.Sprintf(roomMembersPrefix, roomID)), nil
+}
+
+// GetRoomBans returns the users banned from a room.
+func (ms *MemoryStore) GetRoomBans(ctx context.Context, roomID string) ([]string, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.members(fmt.Sprintf(roomBansPrefix, roomID)), nil
+}
+
+// GetUserRooms returns the IDs of the rooms username is a member of.
+func (ms *MemoryStore) GetUserRooms(ctx context.Context, username string) ([]string, error) {
+	if username == "" {
+		return nil, fmt.Errorf("username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.members(fmt.Sprintf(userRoomsPrefix, username)), nil
+}
+
+// --- Room Moderation Operations ---
+
+// SetRoomRole gives username a role in a room. RoomRoleMember (or "") clears any role they hold.
+func (ms *MemoryStore) SetRoomRole(ctx context.Context, roomID string, username string, role string) error {
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	rolesKey := fmt.Sprintf(roomRolesPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if role == "" || role == RoomRoleMember {
+		ms.removeRecord(rolesKey, username)
+		return nil
+	}
+	if _, ok := ms.records[rolesKey]; !ok {
+		ms.records[rolesKey] = make(map[string]string)
+	}
+	ms.records[rolesKey][username] = role
+	return nil
+}
+
+// GetRoomRole returns username's role in a room, or "" if they hold none.
+func (ms *MemoryStore) GetRoomRole(ctx context.Context, roomID string, username string) (string, error) {
+	if roomID == "" || username == "" {
+		return "", fmt.Errorf("roomID and username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.records[fmt.Sprintf(roomRolesPrefix, roomID)][username], nil
+}
+
+// GetRoomRoles maps each user holding a role in a room to that role.
+func (ms *MemoryStore) GetRoomRoles(ctx context.Context, roomID string) (map[string]string, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	roles := make(map[string]string, len(ms.records[fmt.Sprintf(roomRolesPrefix, roomID)]))
+	for username, role := range ms.records[fmt.Sprintf(roomRolesPrefix, roomID)] {
+		roles[username] = role
+	}
+	return roles, nil
+}
+
+// MuteInRoom mutes username in a room until the given time, replacing any earlier mute.
+func (ms *MemoryStore) MuteInRoom(ctx context.Context, roomID string, username string, until time.Time) error {
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	mutesKey := fmt.Sprintf(roomMutesPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.hashes[mutesKey]; !ok {
+		ms.hashes[mutesKey] = make(map[string]int64)
+	}
+	ms.hashes[mutesKey][username] = until.UnixMilli()
+	return nil
+}
+
+// UnmuteInRoom lifts username's mute in a room, if any.
+func (ms *MemoryStore) UnmuteInRoom(ctx context.Context, roomID string, username string) error {
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	mutesKey := fmt.Sprintf(roomMutesPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.hashes[mutesKey], username)
+	if len(ms.hashes[mutesKey]) == 0 {
+		ms.deleteKey(mutesKey)
+	}
+	return nil
+}
+
+// GetMutedUntil returns when username's mute in a room ends, or the zero time if they are not
+// muted (or their mute has already ended).
+func (ms *MemoryStore) GetMutedUntil(ctx context.Context, roomID string, username string) (time.Time, error) {
+	if roomID == "" || username == "" {
+		return time.Time{}, fmt.Errorf("roomID and username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	untilMillis, muted := ms.hashes[fmt.Sprintf(roomMutesPrefix, roomID)][username]
+	if !muted {
+		return time.Time{}, nil
+	}
+	return mutedUntil(untilMillis, ms.now()), nil
+}
+
+// PinMessage pins message id of a room, recording when. It returns false if it was already pinned.
+func (ms *MemoryStore) PinMessage(ctx context.Context, roomID string, id int64, at time.Time) (bool, error) {
+	if roomID == "" {
+		return false, fmt.Errorf("roomID cannot be empty")
+	}
+	pinsKey := fmt.Sprintf(roomPinsPrefix, roomID)
+	member := strconv.FormatInt(id, 10)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(pinsKey)
+	if _, pinned := ms.zsets[pinsKey][member]; pinned {
+		return false, nil
+	}
+	ms.zadd(pinsKey, member, float64(at.UnixMilli()))
+	return true, nil
+}
+
+// UnpinMessage unpins message id of a room. It returns false if it was not pinned.
+func (ms *MemoryStore) UnpinMessage(ctx context.Context, roomID string, id int64) (bool, error) {
+	if roomID == "" {
+		return false, fmt.Errorf("roomID cannot be empty")
+	}
+	pinsKey := fmt.Sprintf(roomPinsPrefix, roomID)
+	member := strconv.FormatInt(id, 10)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(pinsKey)
+	if _, pinned := ms.zsets[pinsKey][member]; !pinned {
+		return false, nil
+	}
+	delete(ms.zsets[pinsKey], member)
+	if len(ms.zsets[pinsKey]) == 0 {
+		ms.deleteKey(pinsKey)
+	}
+	return true, nil
+}
+
+// GetPinnedMessageIDs returns the IDs of a room's pinned messages, in the order they were pinned.
+func (ms *MemoryStore) GetPinnedMessageIDs(ctx context.Context, roomID string) ([]int64, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	pinsKey := fmt.Sprintf(roomPinsPrefix, roomID)
+
+	ms.mu.Lock()
+	ms.expireIfDue(pinsKey)
+	pins := ms.zsets[pinsKey]
+	members := make([]string, 0, len(pins))
+	for member := range pins {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { // Ascending by score, then member, like ZRANGE.
+		if pins[members[i]] != pins[members[j]] {
+			return pins[members[i]] < pins[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	ms.mu.Unlock()
+	return parseMessageIDs(roomID, members)
+}
+
+// --- Reaction Operations ---
+
+// AddReaction records username's reaction with emoji to message id of a room, like
+// RedisClient.AddReaction.
+func (ms *MemoryStore) AddReaction(ctx context.Context, roomID string, id int64, emoji string, username string, maxEmojis int) (bool, int64, error) {
+	if roomID == "" || emoji == "" || username == "" {
+		return false, 0, fmt.Errorf("roomID, emoji and username cannot be empty")
+	}
+	countsKey := fmt.Sprintf(messageReactionsPrefix, roomID, id)
+	reactorsKey := fmt.Sprintf(messageReactorsPrefix, roomID, id, emoji)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(countsKey)
+	ms.expireIfDue(reactorsKey)
+	counts := ms.hashes[countsKey]
+	if _, reacted := ms.sets[reactorsKey][username]; reacted {
+		return false, counts[emoji], nil
+	}
+	if _, known := counts[emoji]; !known && maxEmojis > 0 && len(counts) >= maxEmojis {
+		return false, 0, nil
+	}
+	if counts == nil {
+		counts = make(map[string]int64)
+		ms.hashes[countsKey] = counts
+	}
+	ms.addToSet(reactorsKey, username)
+	counts[emoji]++
+	return true, counts[emoji], nil
+}
+
+// RemoveReaction withdraws username's reaction with emoji to message id of a room, like
+// RedisClient.RemoveReaction.
+func (ms *MemoryStore) RemoveReaction(ctx context.Context, roomID string, id int64, emoji string, username string) (bool, int64, error) {
+	if roomID == "" || emoji == "" || username == "" {
+		return false, 0, fmt.Errorf("roomID, emoji and username cannot be empty")
+	}
+	countsKey := fmt.Sprintf(messageReactionsPrefix, roomID, id)
+	reactorsKey := fmt.Sprintf(messageReactorsPrefix, roomID, id, emoji)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(countsKey)
+	ms.expireIfDue(reactorsKey)
+	counts := ms.hashes[countsKey]
+	if _, reacted := ms.sets[reactorsKey][username]; !reacted {
+		return false, counts[emoji], nil
+	}
+	ms.removeFromSet(reactorsKey, username)
+	counts[emoji]--
+	count := counts[emoji]
+	if count <= 0 {
+		delete(counts, emoji)
+		count = 0
+	}
+	if len(counts) == 0 {
+		ms.deleteKey(countsKey)
+	}
+	return true, count, nil
+}
+
+// GetReactions returns the reaction counts of the given messages of a room, leaving out
+// messages without reactions.
+func (ms *MemoryStore) GetReactions(ctx context.Context, roomID string, ids []int64) (map[int64]map[string]int64, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	reactions := make(map[int64]map[string]int64)
+	for _, id := range ids {
+		countsKey := fmt.Sprintf(messageReactionsPrefix, roomID, id)
+		ms.expireIfDue(countsKey)
+		if len(ms.hashes[countsKey]) == 0 {
+			continue
+		}
+		counts := make(map[string]int64, len(ms.hashes[countsKey]))
+		for emoji, count := range ms.hashes[countsKey] {
+			counts[emoji] = count
+		}
+		reactions[id] = counts
+	}
+	return reactions, nil
+}
+
+// DeleteReactions drops every reaction to message id of a room.
+func (ms *MemoryStore) DeleteReactions(ctx context.Context, roomID string, id int64) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	countsKey := fmt.Sprintf(messageReactionsPrefix, roomID, id)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for emoji := range ms.hashes[countsKey] {
+		ms.deleteKey(fmt.Sprintf(messageReactorsPrefix, roomID, id, emoji))
+	}
+	ms.deleteKey(countsKey)
+	return nil
+}
+
+// --- Thread Operations ---
+
+// AddThreadReply indexes message replyID of a room as a reply in the thread of message parentID,
+// like RedisClient.AddThreadReply.
+func (ms *MemoryStore) AddThreadReply(ctx context.Context, roomID string, parentID int64, replyID int64) (int64, error) {
+	if roomID == "" {
+		return 0, fmt.Errorf("roomID cannot be empty")
+	}
+	threadKey := fmt.Sprintf(threadRepliesPrefix, roomID, parentID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.zadd(threadKey, strconv.FormatInt(replyID, 10), float64(replyID))
+	return int64(len(ms.zsets[threadKey])), nil
+}
+
+// GetThreadRepliesBefore returns up to limit replies of the thread of message parentID with an
+// ID lower than beforeID (or from the newest reply if beforeID <= 0), newest first, skipping
+// replies trimmed from the room's log. If limit is invalid (<=0), it defaults to 10.
+func (ms *MemoryStore) GetThreadRepliesBefore(ctx context.Context, roomID string, parentID int64, beforeID int64, limit int) ([]string, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+	threadKey := fmt.Sprintf(threadRepliesPrefix, roomID, parentID)
+	logKey := fmt.Sprintf(roomMessageLogPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(threadKey)
+	ids := make([]int64, 0, len(ms.zsets[threadKey]))
+	for _, score := range ms.zsets[threadKey] {
+		if id := int64(score); beforeID <= 0 || id < beforeID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	entries := ms.logs[logKey]
+	replies := make([]string, 0, len(ids))
+	for _, id := range ids {
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].id >= id })
+		if i < len(entries) && entries[i].id == id {
+			replies = append(replies, entries[i].messageJSON)
+		}
+	}
+	return replies, nil
+}
+
+// FollowThread adds username to the followers of the thread of message parentID.
+func (ms *MemoryStore) FollowThread(ctx context.Context, roomID string, parentID int64, username string) error {
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	followersKey := fmt.Sprintf(threadFollowersPrefix, roomID, parentID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(followersKey)
+	ms.addToSet(followersKey, username)
+	return nil
+}
+
+// UnfollowThread removes username from the followers of the thread of message parentID.
+func (ms *MemoryStore) UnfollowThread(ctx context.Context, roomID string, parentID int64, username string) error {
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	followersKey := fmt.Sprintf(threadFollowersPrefix, roomID, parentID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(followersKey)
+	ms.removeFromSet(followersKey, username)
+	return nil
+}
+
+// GetThreadFollowers returns the users following the thread of message parentID.
+func (ms *MemoryStore) GetThreadFollowers(ctx context.Context, roomID string, parentID int64) ([]string, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	followersKey := fmt.Sprintf(threadFollowersPrefix, roomID, parentID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(followersKey)
+	return ms.members(followersKey), nil
+}
+
+// --- Read Marker Operations ---
+
+// MarkRead moves username's read marker in a room forward to id, like RedisClient.MarkRead.
+func (ms *MemoryStore) MarkRead(ctx context.Context, username string, roomID string, id int64) (bool, error) {
+	if username == "" || roomID == "" {
+		return false, fmt.Errorf("username and roomID cannot be empty")
+	}
+	markersKey := fmt.Sprintf(userReadMarkersPrefix, username)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	markers, ok := ms.hashes[markersKey]
+	if !ok {
+		markers = make(map[string]int64)
+		ms.hashes[markersKey] = markers
+	}
+	if current, ok := markers[roomID]; ok && current >= id {
+		return false, nil
+	}
+	markers[roomID] = id
+	return true, nil
+}
+
+// GetReadMarkers returns username's read markers by room ID.
+func (ms *MemoryStore) GetReadMarkers(ctx context.Context, username string) (map[string]int64, error) {
+	if username == "" {
+		return nil, fmt.Errorf("username cannot be empty")
+	}
+	markersKey := fmt.Sprintf(userReadMarkersPrefix, username)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	markers := make(map[string]int64, len(ms.hashes[markersKey]))
+	for roomID, id := range ms.hashes[markersKey] {
+		markers[roomID] = id
+	}
+	return markers, nil
+}
+
+// AddToTimeline indexes message id of a room in the room's timeline and trims the timeline to
+// its newest maxMessages IDs, like RedisClient.AddToTimeline.
+func (ms *MemoryStore) AddToTimeline(ctx context.Context, roomID string, id int64, maxMessages int) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	timelineKey := fmt.Sprintf(roomTimelinePrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.zadd(timelineKey, strconv.FormatInt(id, 10), float64(id))
+	if timeline := ms.zsets[timelineKey]; maxMessages > 0 && len(timeline) > maxMessages {
+		ids := make([]float64, 0, len(timeline))
+		for _, score := range timeline {
+			ids = append(ids, score)
+		}
+		sort.Float64s(ids)
+		for _, score := range ids[:len(ids)-maxMessages] {
+			delete(timeline, strconv.FormatInt(int64(score), 10))
+		}
+	}
+	return nil
+}
+
+// RemoveFromTimeline drops message id of a room from the room's timeline.
+func (ms *MemoryStore) RemoveFromTimeline(ctx context.Context, roomID string, id int64) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	timelineKey := fmt.Sprintf(roomTimelinePrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.zsets[timelineKey], strconv.FormatInt(id, 10))
+	if len(ms.zsets[timelineKey]) == 0 {
+		ms.deleteKey(timelineKey)
+	}
+	return nil
+}
+
+// CountTimelineAfter counts, for each room ID in afterIDs, the messages of the room's timeline
+// with an ID greater than the one given.
+func (ms *MemoryStore) CountTimelineAfter(ctx context.Context, afterIDs map[string]int64) (map[string]int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	counts := make(map[string]int64, len(afterIDs))
+	for roomID, afterID := range afterIDs {
+		counts[roomID] = 0
+		for _, score := range ms.zsets[fmt.Sprintf(roomTimelinePrefix, roomID)] {
+			if int64(score) > afterID {
+				counts[roomID]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// removeRecord mirrors HDEL on a hash of string fields, including Redis deleting the hash once
+// its last field is removed. The caller must hold ms.mu.
+func (ms *MemoryStore) removeRecord(key, field string) {
+	record, ok := ms.records[key]
+	if !ok {
+		return
+	}
+	delete(record, field)
+	if len(record) == 0 {
+		ms.deleteKey(key)
+	}
+}
+
+// --- User Presence Operations ---
+
+// SetUserStatus records the status username chose and their custom status text.
+func (ms *MemoryStore) SetUserStatus(ctx context.Context, username string, status string, text string) error {
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	record := ms.presenceRecord(username)
+	record["status"] = status
+	record["text"] = text
+	return nil
+}
+
+// SetUserIdle records whether username is away for being idle.
+func (ms *MemoryStore) SetUserIdle(ctx context.Context, username string, idle bool) error {
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	flag := "0"
+	if idle {
+		flag = "1"
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.presenceRecord(username)["idle"] = flag
+	return nil
+}
+
+// TouchUserLastSeen moves username's last-seen time forward to at, like RedisClient.TouchUserLastSeen.
+func (ms *MemoryStore) TouchUserLastSeen(ctx context.Context, username string, at time.Time) error {
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	record := ms.presenceRecord(username)
+	if current, err := strconv.ParseInt(record["last_seen"], 10, 64); err == nil && current >= at.UnixMilli() {
+		return nil
+	}
+	record["last_seen"] = strconv.FormatInt(at.UnixMilli(), 10)
+	return nil
+}
+
+// GetUserPresences returns the presence of each of the given users, by username.
+func (ms *MemoryStore) GetUserPresences(ctx context.Context, usernames []string) (map[string]*UserPresence, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	presences := make(map[string]*UserPresence, len(usernames))
+	for _, username := range usernames {
+		presence, err := parseUserPresence(ms.records[fmt.Sprintf(userPresencePrefix, username)])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse presence of user '%s': %w", username, err)
+		}
+		_, presence.Connected = ms.sets[globalUsersSetKey][username]
+		presences[username] = presence
+	}
+	return presences, nil
+}
+
+// presenceRecord returns username's presence record, creating it if needed. The caller must hold ms.mu.
+func (ms *MemoryStore) presenceRecord(username string) map[string]string {
+	key := fmt.Sprintf(userPresencePrefix, username)
+	record, ok := ms.records[key]
+	if !ok {
+		record = make(map[string]string)
+		ms.records[key] = record
+	}
+	return record
+}
+
+// --- User Operations ---
+
+// AddActiveUserToRoom records one more connection of username in a room, adds the user to the
+// room's active user set and refreshes the room keys' TTL. Returns the user's connection count in the room.
+func (ms *MemoryStore) AddActiveUserToRoom(ctx context.Context, instanceID string, roomID string, username string, userTTL time.Duration) (int64, error) {
+	if roomID == "" || username == "" {
+		return 0, fmt.Errorf("roomID and username cannot be empty")
+	}
+	if userTTL <= 0 {
+		userTTL = defaultRoomUserSetTTL
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.countInstanceConnection(fmt.Sprintf(instanceRoomUsersPrefix, instanceID), instanceRoomUserField(roomID, username), 1)
+	return ms.addUserConnection(fmt.Sprintf(roomUserConnectionsPrefix, roomID), fmt.Sprintf(roomUsersPrefix, roomID), username, userTTL), nil
+}
+
+// RemoveActiveUserFromRoom records that one connection of username left a room, removing the user
+// from the room's active user set once none remain. Returns the user's remaining connection count.
+func (ms *MemoryStore) RemoveActiveUserFromRoom(ctx context.Context, instanceID string, roomID string, username string) (int64, error) {
+	if roomID == "" || username == "" {
+		return 0, fmt.Errorf("roomID and username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.countInstanceConnection(fmt.Sprintf(instanceRoomUsersPrefix, instanceID), instanceRoomUserField(roomID, username), -1)
+	return ms.removeUserConnection(fmt.Sprintf(roomUserConnectionsPrefix, roomID), fmt.Sprintf(roomUsersPrefix, roomID), username), nil
+}
+
+// GetActiveUsersInRoom returns all usernames in a room's active user set.
+func (ms *MemoryStore) GetActiveUsersInRoom(ctx context.Context, roomID string) ([]string, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	setKey := fmt.Sprintf(roomUsersPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(setKey)
+	return ms.members(setKey), nil
+}
+
+// AddUserToGlobalSet records one more connection of username and adds the user to the global
+// set of active users. The set has no TTL. Returns the user's total connection count.
+func (ms *MemoryStore) AddUserToGlobalSet(ctx context.Context, instanceID string, username string) (int64, error) {
+	if username == "" {
+		return 0, fmt.Errorf("username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.countInstanceConnection(fmt.Sprintf(instanceUsersPrefix, instanceID), username, 1)
+	return ms.addUserConnection(globalUserConnectionsKey, globalUsersSetKey, username, 0), nil
+}
+
+// RemoveUserFromGlobalSet records that one connection of username closed, removing the user from
+// the global set once none remain. Returns the user's remaining connection count.
+func (ms *MemoryStore) RemoveUserFromGlobalSet(ctx context.Context, instanceID string, username string) (int64, error) {
+	if username == "" {
+		return 0, fmt.Errorf("username cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.countInstanceConnection(fmt.Sprintf(instanceUsersPrefix, instanceID), username, -1)
+	return ms.removeUserConnection(globalUserConnectionsKey, globalUsersSetKey, username), nil
+}
+
+// GetGlobalActiveUserCount returns the number of users in the global active set.
+func (ms *MemoryStore) GetGlobalActiveUserCount(ctx context.Context) (int64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return int64(len(ms.sets[globalUsersSetKey])), nil
+}
+
+// addToSet mirrors SADD. The caller must hold ms.mu.
+func (ms *MemoryStore) addToSet(key, member string) {
+	set, ok := ms.sets[key]
+	if !ok {
+		set = make(map[string]struct{})
+		ms.sets[key] = set
+	}
+	set[member] = struct{}{}
+}
+
+// removeFromSet mirrors SREM, including Redis deleting a set (and its TTL) once it is empty.
+// The caller must hold ms.mu.
+func (ms *MemoryStore) removeFromSet(key, member string) {
+	set, ok := ms.sets[key]
+	if !ok {
+		return
+	}
+	delete(set, member)
+	if len(set) == 0 {
+		ms.deleteKey(key)
+	}
+}
+
+// addUserConnection mirrors RedisClient's addUserConnectionScript: it increments username's count
+// in hashKey, adds username to setKey and, if ttl > 0, applies ttl to both keys. The caller must hold ms.mu.
+func (ms *MemoryStore) addUserConnection(hashKey, setKey, username string, ttl time.Duration) int64 {
+	ms.expireIfDue(hashKey)
+	ms.expireIfDue(setKey)
+
+	counts, ok := ms.hashes[hashKey]
+	if !ok {
+		counts = make(map[string]int64)
+		ms.hashes[hashKey] = counts
+	}
+	counts[username]++
+	ms.addToSet(setKey, username)
+	if ttl > 0 {
+		ms.setTTL(hashKey, ttl)
+		ms.setTTL(setKey, ttl)
+	}
+	return counts[username]
+}
+
+// removeUserConnection mirrors RedisClient's removeUserConnectionScript: it decrements username's
+// count in hashKey and removes username from setKey once the count reaches zero. The caller must hold ms.mu.
+func (ms *MemoryStore) removeUserConnection(hashKey, setKey, username string) int64 {
+	ms.expireIfDue(hashKey)
+	ms.expireIfDue(setKey)
+
+	counts, ok := ms.hashes[hashKey]
+	if !ok {
+		counts = make(map[string]int64)
+		ms.hashes[hashKey] = counts
+	}
+	counts[username]--
+	remaining := counts[username]
+	if remaining <= 0 {
+		delete(counts, username)
+		ms.removeFromSet(setKey, username)
+		remaining = 0
+	}
+	if len(counts) == 0 {
+		ms.deleteKey(hashKey) // Redis deletes a hash once its last field is removed.
+	}
+	return remaining
+}
+
+// countInstanceConnection adds delta to an instance's count of connections in field of the
+// instance hash at key, dropping the field once it reaches zero. The caller must hold ms.mu.
+func (ms *MemoryStore) countInstanceConnection(key, field string, delta int64) {
+	counts, ok := ms.hashes[key]
+	if !ok {
+		counts = make(map[string]int64)
+		ms.hashes[key] = counts
+	}
+	counts[field] += delta
+	if counts[field] <= 0 {
+		delete(counts, field)
+	}
+	if len(counts) == 0 {
+		ms.deleteKey(key)
+	}
+}
+
+// members mirrors SMEMBERS. The caller must hold ms.mu.
+func (ms *MemoryStore) members(key string) []string {
+	set := ms.sets[key]
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	return members
+}
+
+// --- Instance Operations ---
+
+// Heartbeat records that instanceID is alive at time at. Returns false if it had no heartbeat recorded.
+func (ms *MemoryStore) Heartbeat(ctx context.Context, instanceID string, at time.Time) (bool, error) {
+	if instanceID == "" {
+		return false, fmt.Errorf("instanceID cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, known := ms.zsets[instanceHeartbeatsKey][instanceID]
+	ms.zadd(instanceHeartbeatsKey, instanceID, float64(at.UnixMilli()))
+	return known, nil
+}
+
+// GetStaleInstances returns the IDs of the instances whose last heartbeat is older than before.
+func (ms *MemoryStore) GetStaleInstances(ctx context.Context, before time.Time) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var instances []string
+	for instanceID, beat := range ms.zsets[instanceHeartbeatsKey] {
+		if beat < float64(before.UnixMilli()) {
+			instances = append(instances, instanceID)
+		}
+	}
+	return instances, nil
+}
+
+// ReapInstance removes every connection recorded by instanceID, like RedisClient.ReapInstance.
+func (ms *MemoryStore) ReapInstance(ctx context.Context, instanceID string, before time.Time) (*ReapedInstance, error) {
+	if instanceID == "" {
+		return nil, fmt.Errorf("instanceID cannot be empty")
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	beat, ok := ms.zsets[instanceHeartbeatsKey][instanceID]
+	if !ok || beat >= float64(before.UnixMilli()) {
+		return nil, nil
+	}
+	delete(ms.zsets[instanceHeartbeatsKey], instanceID)
+
+	reaped := &ReapedInstance{LeftRooms: make(map[string][]string)}
+	usersKey := fmt.Sprintf(instanceUsersPrefix, instanceID)
+	for username, count := range ms.hashes[usersKey] {
+		_, present := ms.sets[globalUsersSetKey][username]
+		for ; count > 0; count-- {
+			if ms.removeUserConnection(globalUserConnectionsKey, globalUsersSetKey, username) == 0 {
+				if present {
+					reaped.OfflineUsers = append(reaped.OfflineUsers, username)
+				}
+				break
+			}
+		}
+	}
+	roomUsersKey := fmt.Sprintf(instanceRoomUsersPrefix, instanceID)
+	for field, count := range ms.hashes[roomUsersKey] {
+		roomID, username, _ := strings.Cut(field, " ")
+		setKey := fmt.Sprintf(roomUsersPrefix, roomID)
+		ms.expireIfDue(setKey)
+		_, present := ms.sets[setKey][username]
+		for ; count > 0; count-- {
+			if ms.removeUserConnection(fmt.Sprintf(roomUserConnectionsPrefix, roomID), setKey, username) == 0 {
+				if present {
+					reaped.LeftRooms[roomID] = append(reaped.LeftRooms[roomID], username)
+				}
+				break
+			}
+		}
+	}
+	ms.deleteKey(usersKey)
+	ms.deleteKey(roomUsersKey)
+	return reaped, nil
+}
+
+// --- Rate Limit Operations ---
+
+// TakeTokens takes one token from each of the given buckets, as of now, if they all have one,
+// like RedisClient.TakeTokens.
+func (ms *MemoryStore) TakeTokens(ctx context.Context, buckets []TokenBucket, now time.Time) (time.Duration, error) {
+	for _, bucket := range buckets {
+		if err := bucket.validate(); err != nil {
+			return 0, err
+		}
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	tokens := make([]float64, len(buckets))
+	var wait int64
+	for i, bucket := range buckets {
+		key := fmt.Sprintf(rateLimitBucketPrefix, bucket.Key)
+		ms.expireIfDue(key)
+		tokens[i] = float64(bucket.Capacity)
+		if state, ok := ms.records[key]; ok {
+			left, _ := strconv.ParseFloat(state["tokens"], 64)
+			at, _ := strconv.ParseInt(state["at"], 10, 64)
+			tokens[i] = bucket.refill(left, at, now.UnixMilli())
+		}
+		if tokens[i] < 1 {
+			wait = max(wait, bucket.wait(tokens[i]))
+		}
+	}
+	if wait > 0 {
+		return time.Duration(wait) * time.Millisecond, nil
+	}
+	for i, bucket := range buckets {
+		key := fmt.Sprintf(rateLimitBucketPrefix, bucket.Key)
+		ms.records[key] = map[string]string{
+			"tokens": strconv.FormatFloat(tokens[i]-1, 'f', -1, 64),
+			"at":     strconv.FormatInt(now.UnixMilli(), 10),
+		}
+		ms.setTTL(key, bucket.untilFull(tokens[i]-1))
+	}
+	return 0, nil
+}
+
+// --- Session Operations ---
+
+// ClaimUsername reserves username for sessionID for the given TTL, or refreshes the TTL if the
+// same session already holds it. Returns false if a different session holds the username.
+func (ms *MemoryStore) ClaimUsername(ctx context.Context, username string, sessionID string, ttl time.Duration) (bool, error) {
+	if username == "" || sessionID == "" {
+		return false, fmt.Errorf("username and sessionID cannot be empty")
+	}
+	if ttl <= 0 {
+		return false, fmt.Errorf("ttl must be positive")
+	}
+	key := fmt.Sprintf(usernameClaimPrefix, username)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(key)
+	if owner, ok := ms.values[key]; ok && owner != sessionID {
+		return false, nil
+	}
+	ms.values[key] = sessionID
+	ms.setTTL(key, ttl)
+	return true, nil
+}
+
+// ReleaseUsername frees username if it is still held by sessionID.
+func (ms *MemoryStore) ReleaseUsername(ctx context.Context, username string, sessionID string) error {
+	if username == "" || sessionID == "" {
+		return fmt.Errorf("username and sessionID cannot be empty")
+	}
+	key := fmt.Sprintf(usernameClaimPrefix, username)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(key)
+	if ms.values[key] == sessionID {
+		ms.deleteKey(key)
+	}
+	return nil
+}
+
+// --- Counter Operations ---
+
+// IncrementMessageCounter increments the total message count for a room and returns the new count.
+func (ms *MemoryStore) IncrementMessageCounter(ctx context.Context, roomID string) (int64, error) {
+	if roomID == "" {
+		return 0, fmt.Errorf("roomID cannot be empty")
+	}
+	counterKey := fmt.Sprintf(roomMessageCountPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(counterKey)
+	ms.counters[counterKey]++
+	return ms.counters[counterKey], nil
+}
+
+// GetRoomMessageCount returns the total message count for a room, or 0 if none was recorded.
+func (ms *MemoryStore) GetRoomMessageCount(ctx context.Context, roomID string) (int64, error) {
+	if roomID == "" {
+		return 0, fmt.Errorf("roomID cannot be empty")
+	}
+	counterKey := fmt.Sprintf(roomMessageCountPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(counterKey)
+	return ms.counters[counterKey], nil
+}
+
+// --- Stats Operation ---
+
+// GetRoomStats returns the active user count and total message count for a room.
+func (ms *MemoryStore) GetRoomStats(ctx context.Context, roomID string) (map[string]int64, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	userSetKey := fmt.Sprintf(roomUsersPrefix, roomID)
+	counterKey := fmt.Sprintf(roomMessageCountPrefix, roomID)
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.expireIfDue(userSetKey)
+	ms.expireIfDue(counterKey)
+
+	return map[string]int64{
+		"active_users":  int64(len(ms.sets[userSetKey])),
+		"message_count": ms.counters[counterKey],
+	}, nil
+}
+
+// --- Pub/Sub Operations ---
+
+// memoryEventSubscription is an in-process equivalent of a Redis Pub/Sub subscription.
+type memoryEventSubscription struct {
+	store  *MemoryStore
+	rooms  map[string]struct{} // Rooms this subscription receives events for. Guarded by store.mu.
+	users  map[string]struct{} // Users this subscription receives events for. Guarded by store.mu.
+	events chan Event
+	closed bool // Guarded by store.mu.
+}
+
+// PublishRoomEvent delivers a payload to every subscription subscribed to the room.
+// Like Redis Pub/Sub, delivery is fire-and-forget: slow subscribers lose events rather than block publishers.
+func (ms *MemoryStore) PublishRoomEvent(ctx context.Context, roomID string, payload string) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	ms.publish(Event{RoomID: roomID, Payload: payload})
+	return nil
+}
+
+// PublishGlobalEvent delivers a payload to every subscription.
+func (ms *MemoryStore) PublishGlobalEvent(ctx context.Context, payload string) error {
+	ms.publish(Event{Payload: payload})
+	return nil
+}
+
+// PublishUserEvent delivers a payload to every subscription subscribed to the user.
+func (ms *MemoryStore) PublishUserEvent(ctx context.Context, username string, payload string) error {
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	ms.publish(Event{Username: username, Payload: payload})
+	return nil
+}
+
+// publish fans an event out to all matching subscriptions.
+func (ms *MemoryStore) publish(event Event) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for sub := range ms.subs {
+		if event.RoomID != "" {
+			if _, ok := sub.rooms[event.RoomID]; !ok {
+				continue
+			}
+		}
+		if event.Username != "" {
+			if _, ok := sub.users[event.Username]; !ok {
+				continue
+			}
+		}
+		select {
+		case sub.events <- event:
+		default: // Subscriber is not keeping up; drop the event as Redis would.
+		}
+	}
+}
+
+// SubscribeEvents opens a new subscription that receives global events.
+func (ms *MemoryStore) SubscribeEvents(ctx context.Context) (EventSubscription, error) {
+	sub := &memoryEventSubscription{
+		store:  ms,
+		rooms:  make(map[string]struct{}),
+		users:  make(map[string]struct{}),
+		events: make(chan Event, 256),
+	}
+	ms.mu.Lock()
+	ms.subs[sub] = struct{}{}
+	ms.mu.Unlock()
+	return sub, nil
+}
+
+// Events returns the channel on which received events are delivered.
+func (s *memoryEventSubscription) Events() <-chan Event {
+	return s.events
+}
+
+// SubscribeRoom starts delivering the room's events to this subscription.
+func (s *memoryEventSubscription) SubscribeRoom(ctx context.Context, roomID string) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.rooms[roomID] = struct{}{}
+	return nil
+}
+
+// UnsubscribeRoom stops delivering the room's events to this subscription.
+func (s *memoryEventSubscription) UnsubscribeRoom(ctx context.Context, roomID string) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	delete(s.rooms, roomID)
+	return nil
+}
+
+// SubscribeUser starts delivering the user's events to this subscription.
+func (s *memoryEventSubscription) SubscribeUser(ctx context.Context, username string) error {
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	s.users[username] = struct{}{}
+	return nil
+}
+
+// UnsubscribeUser stops delivering the user's events to this subscription.
+func (s *memoryEventSubscription) UnsubscribeUser(ctx context.Context, username string) error {
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	delete(s.users, username)
+	return nil
+}
+
+// Close terminates the subscription and closes its Events channel.
+func (s *memoryEventSubscription) Close() error {
+	s.store.mu.Lock()
+	defer s.store.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		delete(s.store.subs, s)
+		close(s.events)
+	}
+	return nil
+}
+
+// Close closes every open subscription. The stored data is left intact.
+func (ms *MemoryStore) Close() error {
+	ms.mu.Lock()
+	subs := make([]*memoryEventSubscription, 0, len(ms.subs))
+	for sub := range ms.subs {
+		subs = append(subs, sub)
+	}
+	ms.mu.Unlock()
+
+	for _, sub := range subs {
+		_ = sub.Close()
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// roomMessageSeqPrefix is the Redis key for a room's message ID sequence.
+	// Each message posted to the room takes the next value as its ID.
+	// Format: room:<roomID>:seq
+	roomMessageSeqPrefix = "room:%s:seq"
+
+	// roomMessageLogPrefix is the Redis key for a room's durable message log: a sorted set of
+	// message JSON strings scored by message ID. Unlike the recent messages list it has no TTL.
+	// Format: room:<roomID>:log
+	roomMessageLogPrefix = "room:%s:log"
+
+	// clientMessageIDPrefix is the Redis key recording which message ID a client-supplied
+	// message ID was stored under, so that a retried message is not stored twice.
+	// Format: user:<username>:client_msg:<clientMsgID>
+	clientMessageIDPrefix = "user:%s:client_msg:%s"
+
+	// messageEditsPrefix is the Redis key for the edit history of a room's message: a list of the
+	// message's earlier versions as JSON, oldest first. Like the log, it has no TTL.
+	// Format: room:<roomID>:edits:<messageID>
+	messageEditsPrefix = "room:%s:edits:%d"
+)
+
+// --- Message Log Operations ---
+
+// NextMessageID reserves and returns the next message ID of a room using INCR.
+// IDs start at 1 and only ever increase, so they are stable cursors into the room's log.
+func (rc *RedisClient) NextMessageID(ctx context.Context, roomID string) (int64, error) {
+	ctx = withRedisMethod(ctx, "NextMessageID")
+	if roomID == "" {
+		return 0, fmt.Errorf("roomID cannot be empty")
+	}
+	seqKey := fmt.Sprintf(roomMessageSeqPrefix, roomID)
+	id, err := rc.client.Incr(ctx, seqKey).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to reserve message ID in room '%s': %w", roomID, err)
+	}
+	return id, nil
+}
+
+// AppendToMessageLog stores a message (as a JSON string) in a room's log under its ID, replacing
+// any message already stored under it. If maxMessages is greater than 0, the oldest entries beyond that many are dropped.
+func (rc *RedisClient) AppendToMessageLog(ctx context.Context, roomID string, id int64, messageJSON string, maxMessages int) error {
+	ctx = withRedisMethod(ctx, "AppendToMessageLog")
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	if id <= 0 {
+		return fmt.Errorf("message ID must be positive, got %d", id)
+	}
+	if messageJSON == "" {
+		return fmt.Errorf("messageJSON cannot be empty")
+	}
+	logKey := fmt.Sprintf(roomMessageLogPrefix, roomID)
+	if err := rc.appendToLog(ctx, logKey, id, messageJSON, maxMessages); err != nil {
+		return fmt.Errorf("failed to append message %d to log of room '%s': %w", id, roomID, err)
+	}
+	return nil
+}
+
+// GetMessagesBefore returns up to limit messages from a room's log whose ID is lower than
+// beforeID, newest first. A beforeID <= 0 starts from the newest message in the log.
+// If limit is invalid (<=0), it defaults to 10.
+func (rc *RedisClient) GetMessagesBefore(ctx context.Context, roomID string, beforeID int64, limit int) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetMessagesBefore")
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+	logKey := fmt.Sprintf(roomMessageLogPrefix, roomID)
+	messages, err := rc.readLogBefore(ctx, logKey, beforeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message log of room '%s' before %d: %w", roomID, beforeID, err)
+	}
+	return messages, nil
+}
+
+// GetMessagesAfter returns up to limit messages from a room's log whose ID is greater than
+// afterID, oldest first. If limit is invalid (<=0), it defaults to 10.
+func (rc *RedisClient) GetMessagesAfter(ctx context.Context, roomID string, afterID int64, limit int) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetMessagesAfter")
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+	logKey := fmt.Sprintf(roomMessageLogPrefix, roomID)
+
+	messages, err := rc.client.ZRangeByScore(ctx, logKey, &redis.ZRangeBy{
+		Min:   "(" + strconv.FormatInt(afterID, 10), // Exclusive bound.
+		Max:   "+inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message log of room '%s' after %d: %w", roomID, afterID, err)
+	}
+	return messages, nil
+}
+
+// GetMessage returns the message stored under id in a room's log, or "" if there is none
+// (it was never stored, or has been trimmed from the log).
+func (rc *RedisClient) GetMessage(ctx context.Context, roomID string, id int64) (string, error) {
+	ctx = withRedisMethod(ctx, "GetMessage")
+	if roomID == "" {
+		return "", fmt.Errorf("roomID cannot be empty")
+	}
+	logKey := fmt.Sprintf(roomMessageLogPrefix, roomID)
+	score := strconv.FormatInt(id, 10)
+	messages, err := rc.client.ZRangeByScore(ctx, logKey, &redis.ZRangeBy{Min: score, Max: score}).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to read message %d of room '%s': %w", id, roomID, err)
+	}
+	if len(messages) == 0 {
+		return "", nil
+	}
+	return messages[0], nil
+}
+
+// GetLatestMessageIDs returns the ID most recently reserved by NextMessageID in each of the
+// given rooms, fetched in one pipeline. Rooms without messages are left out of the result.
+func (rc *RedisClient) GetLatestMessageIDs(ctx context.Context, roomIDs []string) (map[string]int64, error) {
+	ctx = withRedisMethod(ctx, "GetLatestMessageIDs")
+	latest := make(map[string]int64, len(roomIDs))
+	if len(roomIDs) == 0 {
+		return latest, nil
+	}
+	pipe := rc.client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(roomIDs))
+	for i, roomID := range roomIDs {
+		cmds[i] = pipe.Get(ctx, fmt.Sprintf(roomMessageSeqPrefix, roomID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get latest message IDs of %d room(s): %w", len(roomIDs), err)
+	}
+	for i, cmd := range cmds {
+		id, err := cmd.Int64()
+		if err == redis.Nil {
+			continue // No message was ever posted to this room.
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse latest message ID of room '%s': %w", roomIDs[i], err)
+		}
+		latest[roomIDs[i]] = id
+	}
+	return latest, nil
+}
+
+// replaceMessageScript replaces the message scored ARGV[1] in the log at KEYS[1] with ARGV[2],
+// provided it is still ARGV[3], and, if the same message is in the recent messages list at
+// KEYS[2], replaces it there too. Returns 1 if the message was replaced, or 0 if it is not in
+// the log or has changed.
+var replaceMessageScript = redis.NewScript(`
+local old = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[1])
+if #old == 0 or old[1] ~= ARGV[3] then
+	return 0
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[1], ARGV[1], ARGV[1])
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+local recent = redis.call('LRANGE', KEYS[2], 0, -1)
+for i, message in ipairs(recent) do
+	if message == old[1] then
+		redis.call('LSET', KEYS[2], i - 1, ARGV[2])
+		break
+	end
+end
+return 1
+`)
+
+// ReplaceMessage overwrites the message stored under id in a room's log, and its copy in the
+// room's recent messages list if it is still there, with messageJSON. It is used to rewrite
+// messages in place, e.g. to leave a tombstone for a deleted message. The message is only
+// replaced if it is still oldJSON, so that concurrent rewrites cannot undo each other; it
+// returns false, changing nothing, if the message is not in the log or has changed.
+func (rc *RedisClient) ReplaceMessage(ctx context.Context, roomID string, id int64, oldJSON string, messageJSON string) (bool, error) {
+	ctx = withRedisMethod(ctx, "ReplaceMessage")
+	if roomID == "" {
+		return false, fmt.Errorf("roomID cannot be empty")
+	}
+	if messageJSON == "" {
+		return false, fmt.Errorf("messageJSON cannot be empty")
+	}
+	keys := []string{fmt.Sprintf(roomMessageLogPrefix, roomID), fmt.Sprintf(roomMessagesPrefix, roomID)}
+	replaced, err := replaceMessageScript.Run(ctx, rc.client, keys, id, messageJSON, oldJSON).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to replace message %d of room '%s': %w", id, roomID, err)
+	}
+	return replaced == 1, nil
+}
+
+// AddMessageEdit appends an earlier version of a message (as a JSON string) to its edit history,
+// keeping only the newest maxEdits versions if maxEdits > 0.
+func (rc *RedisClient) AddMessageEdit(ctx context.Context, roomID string, id int64, versionJSON string, maxEdits int) error {
+	ctx = withRedisMethod(ctx, "AddMessageEdit")
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	if versionJSON == "" {
+		return fmt.Errorf("versionJSON cannot be empty")
+	}
+	editsKey := fmt.Sprintf(messageEditsPrefix, roomID, id)
+	pipe := rc.client.TxPipeline()
+	pipe.RPush(ctx, editsKey, versionJSON)
+	if maxEdits > 0 {
+		pipe.LTrim(ctx, editsKey, int64(-maxEdits), -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record edit of message %d of room '%s': %w", id, roomID, err)
+	}
+	return nil
+}
+
+// GetMessageEdits returns the earlier versions of a message, oldest first.
+func (rc *RedisClient) GetMessageEdits(ctx context.Context, roomID string, id int64) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetMessageEdits")
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	versions, err := rc.client.LRange(ctx, fmt.Sprintf(messageEditsPrefix, roomID, id), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get edits of message %d of room '%s': %w", id, roomID, err)
+	}
+	return versions, nil
+}
+
+// DeleteMessageEdits drops the edit history of a message, e.g. once the message is deleted.
+func (rc *RedisClient) DeleteMessageEdits(ctx context.Context, roomID string, id int64) error {
+	ctx = withRedisMethod(ctx, "DeleteMessageEdits")
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	if err := rc.client.Del(ctx, fmt.Sprintf(messageEditsPrefix, roomID, id)).Err(); err != nil {
+		return fmt.Errorf("failed to delete edits of message %d of room '%s': %w", id, roomID, err)
+	}
+	return nil
+}
+
+// appendToLog adds a message to the sorted set at logKey, scored by its ID, replacing any entry
+// with the same ID, and trims the set to its newest maxMessages entries (if > 0). It is shared by
+// room and direct message logs.
+func (rc *RedisClient) appendToLog(ctx context.Context, logKey string, id int64, messageJSON string, maxMessages int) error {
+	pipe := rc.client.TxPipeline()
+	score := strconv.FormatInt(id, 10)
+	pipe.ZRemRangeByScore(ctx, logKey, score, score) // Members are whole messages, so ZADD alone would keep both.
+	pipe.ZAdd(ctx, logKey, &redis.Z{Score: float64(id), Member: messageJSON})
+	if maxMessages > 0 {
+		// Ranks are ascending by ID: drop everything below the newest maxMessages entries.
+		pipe.ZRemRangeByRank(ctx, logKey, 0, int64(-maxMessages-1))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// readLogBefore returns up to limit messages of the log at logKey with an ID lower than
+// beforeID (or from the newest if beforeID <= 0), newest first.
+func (rc *RedisClient) readLogBefore(ctx context.Context, logKey string, beforeID int64, limit int) ([]string, error) {
+	max := "+inf"
+	if beforeID > 0 {
+		max = "(" + strconv.FormatInt(beforeID, 10) // Exclusive bound.
+	}
+	return rc.client.ZRevRangeByScore(ctx, logKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   max,
+		Count: int64(limit),
+	}).Result()
+}
+
+// recordClientMessageIDScript sets KEYS[1] to the message ID in ARGV[1] with a TTL of ARGV[2]
+// milliseconds, unless it is already set. Returns {1, ARGV[1]} if it was set, or {0, <existing ID>}.
+var recordClientMessageIDScript = redis.NewScript(`
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return {1, tonumber(ARGV[1])}
+end
+return {0, tonumber(redis.call('GET', KEYS[1]))}
+`)
+
+// RecordClientMessageID records that the message a user sent with clientMsgID is stored as id.
+// If the user already sent a message with the same clientMsgID within ttl, nothing is recorded
+// and the ID of that earlier message is returned with recorded set to false.
+func (rc *RedisClient) RecordClientMessageID(ctx context.Context, username string, clientMsgID string, id int64, ttl time.Duration) (int64, bool, error) {
+	ctx = withRedisMethod(ctx, "RecordClientMessageID")
+	if username == "" || clientMsgID == "" {
+		return 0, false, fmt.Errorf("username and clientMsgID cannot be empty")
+	}
+	if ttl <= 0 {
+		return 0, false, fmt.Errorf("ttl must be positive")
+	}
+	key := fmt.Sprintf(clientMessageIDPrefix, username, clientMsgID)
+	result, err := recordClientMessageIDScript.Run(ctx, rc.client, []string{key}, id, ttl.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to record client message ID '%s' of user '%s': %w", clientMsgID, username, err)
+	}
+	if len(result) != 2 {
+		return 0, false, fmt.Errorf("unexpected reply recording client message ID '%s' of user '%s': %v", clientMsgID, username, result)
+	}
+	return result[1], result[0] == 1, nil
+}
+
+// ForgetClientMessageID removes the record of a user's clientMsgID, so that a message which
+// could not be stored after all can be retried under the same ID.
+func (rc *RedisClient) ForgetClientMessageID(ctx context.Context, username string, clientMsgID string) error {
+	ctx = withRedisMethod(ctx, "ForgetClientMessageID")
+	if username == "" || clientMsgID == "" {
+		return fmt.Errorf("username and clientMsgID cannot be empty")
+	}
+	key := fmt.Sprintf(clientMessageIDPrefix, username, clientMsgID)
+	if err := rc.client.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("failed to forget client message ID '%s' of user '%s': %w", clientMsgID, username, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// userPresencePrefix is the Redis key for a user's presence record: a hash with the status they
+// chose ("status"), their custom status text ("text"), whether they are away for being idle
+// ("idle", "1" or "0") and the Unix time, in milliseconds, at which they were last seen active
+// ("last_seen"). Like read markers, it has no TTL, so last-seen times survive restarts.
+// Format: user:<username>:presence
+const userPresencePrefix = "user:%s:presence"
+
+// Presence statuses.
+const (
+	// PresenceOnline users are connected and active. It is also the status users choose to be
+	// shown as online whenever they are connected and not idle.
+	PresenceOnline = "online"
+	// PresenceAway users are connected but chose to be shown away, or have been idle for a while.
+	PresenceAway = "away"
+	// PresenceDoNotDisturb users are connected but do not want to be interrupted.
+	PresenceDoNotDisturb = "dnd"
+	// PresenceOffline users have no open connection.
+	PresenceOffline = "offline"
+)
+
+// UserPresence is what the store knows about a user's presence.
+type UserPresence struct {
+	Status     string    // The status the user chose: PresenceOnline (the default), PresenceAway or PresenceDoNotDisturb.
+	StatusText string    // The user's custom status text. Empty if none.
+	Idle       bool      // Whether the user has been idle on all their connections for a while.
+	LastSeen   time.Time // When the user was last seen active. Zero if never.
+	Connected  bool      // Whether the user has an open connection on any instance.
+}
+
+// --- User Presence Operations ---
+
+// SetUserStatus records the status username chose and their custom status text.
+func (rc *RedisClient) SetUserStatus(ctx context.Context, username string, status string, text string) error {
+	ctx = withRedisMethod(ctx, "SetUserStatus")
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	err := rc.client.HSet(ctx, fmt.Sprintf(userPresencePrefix, username), "status", status, "text", text).Err()
+	if err != nil {
+		return fmt.Errorf("failed to set status of user '%s': %w", username, err)
+	}
+	return nil
+}
+
+// SetUserIdle records whether username is away for being idle.
+func (rc *RedisClient) SetUserIdle(ctx context.Context, username string, idle bool) error {
+	ctx = withRedisMethod(ctx, "SetUserIdle")
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	flag := "0"
+	if idle {
+		flag = "1"
+	}
+	if err := rc.client.HSet(ctx, fmt.Sprintf(userPresencePrefix, username), "idle", flag).Err(); err != nil {
+		return fmt.Errorf("failed to set idle flag of user '%s': %w", username, err)
+	}
+	return nil
+}
+
+// touchLastSeenScript sets field "last_seen" of the hash at KEYS[1] to ARGV[1] unless it already
+// holds a later time, so that instances reporting activity late cannot move it backwards.
+var touchLastSeenScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'last_seen')
+if current and tonumber(current) >= tonumber(ARGV[1]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'last_seen', ARGV[1])
+return 1
+`)
+
+// TouchUserLastSeen moves username's last-seen time forward to at. Earlier times are ignored.
+func (rc *RedisClient) TouchUserLastSeen(ctx context.Context, username string, at time.Time) error {
+	ctx = withRedisMethod(ctx, "TouchUserLastSeen")
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	key := fmt.Sprintf(userPresencePrefix, username)
+	if err := touchLastSeenScript.Run(ctx, rc.client, []string{key}, at.UnixMilli()).Err(); err != nil {
+		return fmt.Errorf("failed to update last-seen time of user '%s': %w", username, err)
+	}
+	return nil
+}
+
+// GetUserPresences returns the presence of each of the given users, by username, reading all of
+// them in one round trip. Users the store knows nothing about are offline, and online once connected.
+func (rc *RedisClient) GetUserPresences(ctx context.Context, usernames []string) (map[string]*UserPresence, error) {
+	ctx = withRedisMethod(ctx, "GetUserPresences")
+	records := make([]*redis.StringStringMapCmd, len(usernames))
+	connected := make([]*redis.BoolCmd, len(usernames))
+	pipe := rc.client.Pipeline()
+	for i, username := range usernames {
+		records[i] = pipe.HGetAll(ctx, fmt.Sprintf(userPresencePrefix, username))
+		connected[i] = pipe.SIsMember(ctx, globalUsersSetKey, username)
+	}
+	if len(usernames) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to get presence of %d user(s): %w", len(usernames), err)
+		}
+	}
+
+	presences := make(map[string]*UserPresence, len(usernames))
+	for i, username := range usernames {
+		presence, err := parseUserPresence(records[i].Val())
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse presence of user '%s': %w", username, err)
+		}
+		presence.Connected = connected[i].Val()
+		presences[username] = presence
+	}
+	return presences, nil
+}
+
+// parseUserPresence decodes the fields of a presence record.
+func parseUserPresence(fields map[string]string) (*UserPresence, error) {
+	presence := &UserPresence{Status: fields["status"], StatusText: fields["text"], Idle: fields["idle"] == "1"}
+	if presence.Status == "" {
+		presence.Status = PresenceOnline
+	}
+	if raw, ok := fields["last_seen"]; ok {
+		millis, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		presence.LastSeen = time.UnixMilli(millis).UTC()
+	}
+	return presence, nil
+}
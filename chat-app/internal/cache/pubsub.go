@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Event is a single payload received from a Pub/Sub channel.
+// RoomID is set for room-scoped events, Username for user-scoped events, and neither for global events.
+type Event struct {
+	RoomID   string // The room the event was published to, or "".
+	Username string // The user the event was published to, or "".
+	Payload  string // The raw payload, typically a JSON-encoded envelope.
+}
+
+// redisEventSubscription is a live Redis Pub/Sub subscription used by a Hub to receive
+// events published by other server instances. It is always subscribed to the
+// global events channel; room and user channels are added and removed on demand.
+type redisEventSubscription struct {
+	pubsub *redis.PubSub
+	events chan Event
+}
+
+// --- Pub/Sub Operations ---
+
+// PublishRoomEvent publishes a payload on a room's events channel.
+// Every instance subscribed to the room receives it, including the publisher itself.
+func (rc *RedisClient) PublishRoomEvent(ctx context.Context, roomID string, payload string) error {
+	ctx = withRedisMethod(ctx, "PublishRoomEvent")
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	channel := fmt.Sprintf(roomEventsChannelPrefix, roomID)
+	if err := rc.client.Publish(ctx, channel, payload).Err(); err != nil {
+		return fmt.Errorf("failed to publish event to room '%s' channel in Redis: %w", roomID, err)
+	}
+	return nil
+}
+
+// PublishGlobalEvent publishes a payload on the global events channel.
+func (rc *RedisClient) PublishGlobalEvent(ctx context.Context, payload string) error {
+	ctx = withRedisMethod(ctx, "PublishGlobalEvent")
+	if err := rc.client.Publish(ctx, globalEventsChannel, payload).Err(); err != nil {
+		return fmt.Errorf("failed to publish global event in Redis: %w", err)
+	}
+	return nil
+}
+
+// PublishUserEvent publishes a payload on a user's events channel, reaching every instance
+// where that user has a connection.
+func (rc *RedisClient) PublishUserEvent(ctx context.Context, username string, payload string) error {
+	ctx = withRedisMethod(ctx, "PublishUserEvent")
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	channel := fmt.Sprintf(userEventsChannelPrefix, username)
+	if err := rc.client.Publish(ctx, channel, payload).Err(); err != nil {
+		return fmt.Errorf("failed to publish event to user '%s' channel in Redis: %w", username, err)
+	}
+	return nil
+}
+
+// SubscribeEvents opens a new Pub/Sub subscription subscribed to the global events channel.
+// Received events are delivered on the subscription's Events channel until Close is called.
+func (rc *RedisClient) SubscribeEvents(ctx context.Context) (EventSubscription, error) {
+	ctx = withRedisMethod(ctx, "SubscribeEvents")
+	pubsub := rc.client.Subscribe(ctx, globalEventsChannel)
+	// Wait for the subscription confirmation so that errors surface here rather than later.
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to global events channel in Redis: %w", err)
+	}
+
+	sub := &redisEventSubscription{
+		pubsub: pubsub,
+		events: make(chan Event, 256),
+	}
+	go sub.forward()
+	return sub, nil
+}
+
+// forward converts raw Redis Pub/Sub messages into Events.
+// It exits and closes the Events channel once the underlying subscription is closed.
+func (s *redisEventSubscription) forward() {
+	defer close(s.events)
+	for msg := range s.pubsub.Channel() {
+		roomID, username := parseEventsChannel(msg.Channel)
+		s.events <- Event{RoomID: roomID, Username: username, Payload: msg.Payload}
+	}
+}
+
+// Events returns the channel on which received events are delivered.
+func (s *redisEventSubscription) Events() <-chan Event {
+	return s.events
+}
+
+// SubscribeRoom adds a room's events channel to the subscription.
+func (s *redisEventSubscription) SubscribeRoom(ctx context.Context, roomID string) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	if err := s.pubsub.Subscribe(ctx, fmt.Sprintf(roomEventsChannelPrefix, roomID)); err != nil {
+		return fmt.Errorf("failed to subscribe to room '%s' events channel in Redis: %w", roomID, err)
+	}
+	return nil
+}
+
+// UnsubscribeRoom removes a room's events channel from the subscription.
+func (s *redisEventSubscription) UnsubscribeRoom(ctx context.Context, roomID string) error {
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	if err := s.pubsub.Unsubscribe(ctx, fmt.Sprintf(roomEventsChannelPrefix, roomID)); err != nil {
+		return fmt.Errorf("failed to unsubscribe from room '%s' events channel in Redis: %w", roomID, err)
+	}
+	return nil
+}
+
+// SubscribeUser adds a user's events channel to the subscription.
+func (s *redisEventSubscription) SubscribeUser(ctx context.Context, username string) error {
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	if err := s.pubsub.Subscribe(ctx, fmt.Sprintf(userEventsChannelPrefix, username)); err != nil {
+		return fmt.Errorf("failed to subscribe to user '%s' events channel in Redis: %w", username, err)
+	}
+	return nil
+}
+
+// UnsubscribeUser removes a user's events channel from the subscription.
+func (s *redisEventSubscription) UnsubscribeUser(ctx context.Context, username string) error {
+	if username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	if err := s.pubsub.Unsubscribe(ctx, fmt.Sprintf(userEventsChannelPrefix, username)); err != nil {
+		return fmt.Errorf("failed to unsubscribe from user '%s' events channel in Redis: %w", username, err)
+	}
+	return nil
+}
+
+// Close terminates the subscription. The Events channel is closed shortly after.
+func (s *redisEventSubscription) Close() error {
+	return s.pubsub.Close()
+}
+
+// parseEventsChannel extracts the roomID from a room events channel name, or the username
+// from a user events channel name. Both are "" for the global events channel or any
+// unrecognised channel.
+func parseEventsChannel(channel string) (roomID string, username string) {
+	if !strings.HasSuffix(channel, ":events") {
+		return "", ""
+	}
+	name := strings.TrimSuffix(channel, ":events")
+	switch {
+	case strings.HasPrefix(name, "room:"):
+		return strings.TrimPrefix(name, "room:"), ""
+	case strings.HasPrefix(name, "user:"):
+		return "", strings.TrimPrefix(name, "user:")
+	}
+	return "", ""
+}
@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// rateLimitBucketPrefix is the Redis key for the hash holding a token bucket's state: its
+// "tokens" left, possibly fractional, as of "at", in Unix milliseconds. It expires once full.
+// Format: ratelimit:<bucket key>
+const rateLimitBucketPrefix = "ratelimit:%s"
+
+// TokenBucket identifies a token bucket and its limit. The bucket holds up to Capacity tokens,
+// and starts full; it gains Capacity tokens evenly over every Period, up to Capacity.
+type TokenBucket struct {
+	Key      string        // Identifies the bucket, e.g. "text:user:alice". Buckets are shared by key.
+	Capacity int           // The most tokens the bucket holds, which is the largest burst it allows.
+	Period   time.Duration // How long the bucket takes to refill from empty.
+}
+
+// validate checks that the bucket can be taken from.
+func (b TokenBucket) validate() error {
+	if b.Key == "" {
+		return fmt.Errorf("token bucket key cannot be empty")
+	}
+	if b.Capacity <= 0 || b.Period <= 0 {
+		return fmt.Errorf("token bucket '%s' must have a positive capacity and period", b.Key)
+	}
+	return nil
+}
+
+// refill returns how many tokens the bucket has at now, if it had tokens at at, in Unix milliseconds.
+func (b TokenBucket) refill(tokens float64, at int64, now int64) float64 {
+	elapsed := math.Max(0, float64(now-at))
+	return math.Min(float64(b.Capacity), tokens+elapsed*float64(b.Capacity)/float64(b.Period.Milliseconds()))
+}
+
+// wait returns how long a bucket with tokens left takes to hold one whole token, in milliseconds.
+func (b TokenBucket) wait(tokens float64) int64 {
+	return int64(math.Ceil((1 - tokens) * float64(b.Period.Milliseconds()) / float64(b.Capacity)))
+}
+
+// untilFull returns how long a bucket with tokens left takes to be full again.
+func (b TokenBucket) untilFull(tokens float64) time.Duration {
+	return time.Duration(math.Ceil((float64(b.Capacity)-tokens)*float64(b.Period.Milliseconds())/float64(b.Capacity))) * time.Millisecond
+}
+
+// takeTokensScript takes one token from each bucket in KEYS, as of ARGV[1] (Unix milliseconds),
+// if every one of them has a whole token; bucket i has a capacity of ARGV[2i] tokens and refills
+// over ARGV[2i+1] milliseconds. Buckets that do not exist are full. Each bucket taken from expires
+// once it is full again. Returns 0 if the tokens were taken, or else, changing nothing, how many
+// milliseconds until they all have a token.
+var takeTokensScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local tokens = {}
+local wait = 0
+for i, key in ipairs(KEYS) do
+	local capacity, period = tonumber(ARGV[i * 2]), tonumber(ARGV[i * 2 + 1])
+	local state = redis.call('HMGET', key, 'tokens', 'at')
+	tokens[i] = capacity
+	if state[1] then
+		local elapsed = math.max(0, now - tonumber(state[2]))
+		tokens[i] = math.min(capacity, tonumber(state[1]) + elapsed * capacity / period)
+	end
+	if tokens[i] < 1 then
+		wait = math.max(wait, math.ceil((1 - tokens[i]) * period / capacity))
+	end
+end
+if wait > 0 then
+	return wait
+end
+for i, key in ipairs(KEYS) do
+	local capacity, period = tonumber(ARGV[i * 2]), tonumber(ARGV[i * 2 + 1])
+	redis.call('HSET', key, 'tokens', tostring(tokens[i] - 1), 'at', ARGV[1])
+	redis.call('PEXPIRE', key, math.ceil((capacity - tokens[i] + 1) * period / capacity))
+end
+return 0
+`)
+
+// --- Rate Limit Operations ---
+
+// TakeTokens takes one token from each of the given buckets, as of now, provided they all have
+// one; otherwise it takes none and returns how long until they all would. It returns 0 if the
+// tokens were taken. Buckets live in Redis, so every instance taking from the same key shares
+// its limit.
+func (rc *RedisClient) TakeTokens(ctx context.Context, buckets []TokenBucket, now time.Time) (time.Duration, error) {
+	ctx = withRedisMethod(ctx, "TakeTokens")
+	if len(buckets) == 0 {
+		return 0, nil
+	}
+	keys := make([]string, len(buckets))
+	args := []interface{}{now.UnixMilli()}
+	for i, bucket := range buckets {
+		if err := bucket.validate(); err != nil {
+			return 0, err
+		}
+		keys[i] = fmt.Sprintf(rateLimitBucketPrefix, bucket.Key)
+		args = append(args, bucket.Capacity, bucket.Period.Milliseconds())
+	}
+	wait, err := takeTokensScript.Run(ctx, rc.client, keys, args...).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to take tokens from bucket '%s': %w", buckets[0].Key, err)
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// messageReactionsPrefix is the Redis key for the reaction counts of a room's message:
+	// a hash of emoji to the number of users who reacted with it. Like the log, it has no TTL.
+	// Format: room:<roomID>:reactions:<messageID>
+	messageReactionsPrefix = "room:%s:reactions:%d"
+
+	// messageReactorsPrefix is the Redis key for the set of users who reacted to a room's message
+	// with one emoji. It keeps each user's reaction from being counted twice.
+	// Format: room:<roomID>:reactions:<messageID>:<emoji>
+	messageReactorsPrefix = "room:%s:reactions:%d:%s"
+)
+
+// --- Reaction Operations ---
+
+// addReactionScript adds ARGV[2] to the reactors set at KEYS[2] and, if it was not there,
+// increments the count of emoji ARGV[1] in the hash at KEYS[1]. A new emoji is refused if the
+// hash already holds ARGV[3] (if > 0) different ones.
+// Returns {1, count} if the reaction was added, {0, count} if the user had already reacted
+// with the emoji, or {0, 0} if the message has too many different reactions.
+var addReactionScript = redis.NewScript(`
+if redis.call('SISMEMBER', KEYS[2], ARGV[2]) == 1 then
+	return {0, tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or 0)}
+end
+local maxEmojis = tonumber(ARGV[3])
+if maxEmojis > 0 and redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 and redis.call('HLEN', KEYS[1]) >= maxEmojis then
+	return {0, 0}
+end
+redis.call('SADD', KEYS[2], ARGV[2])
+return {1, redis.call('HINCRBY', KEYS[1], ARGV[1], 1)}
+`)
+
+// removeReactionScript removes ARGV[2] from the reactors set at KEYS[2] and, if it was there,
+// decrements the count of emoji ARGV[1] in the hash at KEYS[1], dropping the emoji at zero.
+// Returns {1, count} if the reaction was removed, or {0, count} if there was none.
+var removeReactionScript = redis.NewScript(`
+if redis.call('SREM', KEYS[2], ARGV[2]) == 0 then
+	return {0, tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or 0)}
+end
+local count = redis.call('HINCRBY', KEYS[1], ARGV[1], -1)
+if count <= 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	count = 0
+end
+return {1, count}
+`)
+
+// deleteReactionsScript deletes the reaction counts hash at KEYS[1] and the reactors set of each
+// of its emoji, whose keys are KEYS[1] followed by ':' and the emoji.
+var deleteReactionsScript = redis.NewScript(`
+for _, emoji in ipairs(redis.call('HKEYS', KEYS[1])) do
+	redis.call('DEL', KEYS[1] .. ':' .. emoji)
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// AddReaction records username's reaction with emoji to message id of a room. It returns
+// whether the reaction was added (false if the user had already reacted with that emoji) and
+// the emoji's resulting count. If maxEmojis > 0 and the message already has that many different
+// reactions, a new emoji is refused: it returns false and a zero count.
+func (rc *RedisClient) AddReaction(ctx context.Context, roomID string, id int64, emoji string, username string, maxEmojis int) (bool, int64, error) {
+	ctx = withRedisMethod(ctx, "AddReaction")
+	if roomID == "" || emoji == "" || username == "" {
+		return false, 0, fmt.Errorf("roomID, emoji and username cannot be empty")
+	}
+	keys := []string{fmt.Sprintf(messageReactionsPrefix, roomID, id), fmt.Sprintf(messageReactorsPrefix, roomID, id, emoji)}
+	result, err := addReactionScript.Run(ctx, rc.client, keys, emoji, username, maxEmojis).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to add reaction '%s' of user '%s' to message %d of room '%s': %w", emoji, username, id, roomID, err)
+	}
+	return result[0] == 1, result[1], nil
+}
+
+// RemoveReaction withdraws username's reaction with emoji to message id of a room. It returns
+// whether there was such a reaction and the emoji's resulting count.
+func (rc *RedisClient) RemoveReaction(ctx context.Context, roomID string, id int64, emoji string, username string) (bool, int64, error) {
+	ctx = withRedisMethod(ctx, "RemoveReaction")
+	if roomID == "" || emoji == "" || username == "" {
+		return false, 0, fmt.Errorf("roomID, emoji and username cannot be empty")
+	}
+	keys := []string{fmt.Sprintf(messageReactionsPrefix, roomID, id), fmt.Sprintf(messageReactorsPrefix, roomID, id, emoji)}
+	result, err := removeReactionScript.Run(ctx, rc.client, keys, emoji, username).Int64Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to remove reaction '%s' of user '%s' from message %d of room '%s': %w", emoji, username, id, roomID, err)
+	}
+	return result[0] == 1, result[1], nil
+}
+
+// GetReactions returns the reaction counts (emoji to count) of the given messages of a room,
+// fetched in one pipeline. Messages without reactions are left out of the result.
+func (rc *RedisClient) GetReactions(ctx context.Context, roomID string, ids []int64) (map[int64]map[string]int64, error) {
+	ctx = withRedisMethod(ctx, "GetReactions")
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	reactions := make(map[int64]map[string]int64)
+	if len(ids) == 0 {
+		return reactions, nil
+	}
+	pipe := rc.client.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, fmt.Sprintf(messageReactionsPrefix, roomID, id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get reactions of room '%s': %w", roomID, err)
+	}
+	for i, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			continue
+		}
+		counts := make(map[string]int64, len(cmd.Val()))
+		for emoji, raw := range cmd.Val() {
+			count, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse count of reaction '%s' to message %d of room '%s': %w", emoji, ids[i], roomID, err)
+			}
+			counts[emoji] = count
+		}
+		reactions[ids[i]] = counts
+	}
+	return reactions, nil
+}
+
+// DeleteReactions drops every reaction to message id of a room, e.g. once the message is deleted.
+func (rc *RedisClient) DeleteReactions(ctx context.Context, roomID string, id int64) error {
+	ctx = withRedisMethod(ctx, "DeleteReactions")
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	keys := []string{fmt.Sprintf(messageReactionsPrefix, roomID, id)}
+	if err := deleteReactionsScript.Run(ctx, rc.client, keys).Err(); err != nil {
+		return fmt.Errorf("failed to delete reactions of message %d of room '%s': %w", id, roomID, err)
+	}
+	return nil
+}
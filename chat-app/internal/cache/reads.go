@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// userReadMarkersPrefix is the Redis key for a user's read markers: a hash of room ID to the ID
+	// of the last message of that room the user has read. Like the message log, it has no TTL.
+	// Format: user:<username>:reads
+	userReadMarkersPrefix = "user:%s:reads"
+
+	// roomTimelinePrefix is the Redis key for a room's timeline index: a sorted set of the IDs of
+	// the room's top-level messages that are not deleted, scored by ID, on which unread messages
+	// are counted. Thread replies and IDs that were reserved but never stored are not in it.
+	// Like the message log, it has no TTL.
+	// Format: room:<roomID>:timeline
+	roomTimelinePrefix = "room:%s:timeline"
+)
+
+// --- Read Marker Operations ---
+
+// markReadScript sets field ARGV[1] of the hash at KEYS[1] to ARGV[2] unless it already holds
+// that ID or a higher one, so read markers never move backwards.
+// Returns 1 if the marker was set or moved, 0 otherwise.
+var markReadScript = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], ARGV[1])
+if current and tonumber(current) >= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// MarkRead records that username has read a room up to message id. Markers only move forward:
+// it returns false, changing nothing, if the user had already read that far. A marker at zero
+// tracks a room in which nothing has been read yet.
+func (rc *RedisClient) MarkRead(ctx context.Context, username string, roomID string, id int64) (bool, error) {
+	ctx = withRedisMethod(ctx, "MarkRead")
+	if username == "" || roomID == "" {
+		return false, fmt.Errorf("username and roomID cannot be empty")
+	}
+	moved, err := markReadScript.Run(ctx, rc.client, []string{fmt.Sprintf(userReadMarkersPrefix, username)}, roomID, id).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to mark room '%s' read up to %d for user '%s': %w", roomID, id, username, err)
+	}
+	return moved == 1, nil
+}
+
+// GetReadMarkers returns the ID of the last message username has read in each room they have
+// marked as read, by room ID.
+func (rc *RedisClient) GetReadMarkers(ctx context.Context, username string) (map[string]int64, error) {
+	ctx = withRedisMethod(ctx, "GetReadMarkers")
+	if username == "" {
+		return nil, fmt.Errorf("username cannot be empty")
+	}
+	raw, err := rc.client.HGetAll(ctx, fmt.Sprintf(userReadMarkersPrefix, username)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get read markers of user '%s': %w", username, err)
+	}
+	markers := make(map[string]int64, len(raw))
+	for roomID, value := range raw {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse read marker of user '%s' in room '%s': %w", username, roomID, err)
+		}
+		markers[roomID] = id
+	}
+	return markers, nil
+}
+
+// AddToTimeline indexes message id of a room, already stored in the room's log, in the room's
+// timeline, and trims the timeline to its newest maxMessages IDs (if > 0), like the log.
+func (rc *RedisClient) AddToTimeline(ctx context.Context, roomID string, id int64, maxMessages int) error {
+	ctx = withRedisMethod(ctx, "AddToTimeline")
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	timelineKey := fmt.Sprintf(roomTimelinePrefix, roomID)
+	pipe := rc.client.TxPipeline()
+	pipe.ZAdd(ctx, timelineKey, &redis.Z{Score: float64(id), Member: strconv.FormatInt(id, 10)})
+	if maxMessages > 0 {
+		pipe.ZRemRangeByRank(ctx, timelineKey, 0, int64(-maxMessages-1))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to add message %d to timeline of room '%s': %w", id, roomID, err)
+	}
+	return nil
+}
+
+// RemoveFromTimeline drops message id of a room from the room's timeline, e.g. once it is deleted.
+func (rc *RedisClient) RemoveFromTimeline(ctx context.Context, roomID string, id int64) error {
+	ctx = withRedisMethod(ctx, "RemoveFromTimeline")
+	if roomID == "" {
+		return fmt.Errorf("roomID cannot be empty")
+	}
+	if err := rc.client.ZRem(ctx, fmt.Sprintf(roomTimelinePrefix, roomID), strconv.FormatInt(id, 10)).Err(); err != nil {
+		return fmt.Errorf("failed to remove message %d from timeline of room '%s': %w", id, roomID, err)
+	}
+	return nil
+}
+
+// CountTimelineAfter counts, for each room ID in afterIDs, the messages of the room's timeline
+// with an ID greater than the one given, with one ZCOUNT per room in a single pipeline.
+func (rc *RedisClient) CountTimelineAfter(ctx context.Context, afterIDs map[string]int64) (map[string]int64, error) {
+	ctx = withRedisMethod(ctx, "CountTimelineAfter")
+	counts := make(map[string]int64, len(afterIDs))
+	if len(afterIDs) == 0 {
+		return counts, nil
+	}
+	pipe := rc.client.Pipeline()
+	cmds := make(map[string]*redis.IntCmd, len(afterIDs))
+	for roomID, afterID := range afterIDs {
+		cmds[roomID] = pipe.ZCount(ctx, fmt.Sprintf(roomTimelinePrefix, roomID), "("+strconv.FormatInt(afterID, 10), "+inf")
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to count timeline messages of %d room(s): %w", len(afterIDs), err)
+	}
+	for roomID, cmd := range cmds {
+		counts[roomID] = cmd.Val()
+	}
+	return counts, nil
+}
@@ -3,6 +3,7 @@ package cache
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"strconv"
 	"time"
 
@@ -22,9 +23,35 @@ const (
 	// Format: room:<roomID>:message_count
 	roomMessageCountPrefix = "room:%s:message_count"
 
+	// roomUserConnectionsPrefix is the Redis key prefix for the hash counting each user's open
+	// connections in a room. A user stays in the room's user set while their count is above zero.
+	// Format: room:<roomID>:user_connections
+	roomUserConnectionsPrefix = "room:%s:user_connections"
+
 	// globalUsersSetKey is the Redis key for the global set of all active users.
 	globalUsersSetKey = "global:users"
 
+	// globalUserConnectionsKey is the Redis key for the hash counting each user's open connections
+	// across all instances. A user stays in the global set while their count is above zero.
+	globalUserConnectionsKey = "global:user_connections"
+
+	// usernameClaimPrefix is the Redis key holding the ID of the session that currently owns a username.
+	// Format: user:<username>:session
+	usernameClaimPrefix = "user:%s:session"
+
+	// roomEventsChannelPrefix is the Redis Pub/Sub channel used to fan out a room's events
+	// to every server instance with members in that room.
+	// Format: room:<roomID>:events
+	roomEventsChannelPrefix = "room:%s:events"
+
+	// globalEventsChannel is the Redis Pub/Sub channel for events addressed to every instance.
+	globalEventsChannel = "global:events"
+
+	// userEventsChannelPrefix is the Redis Pub/Sub channel used to reach a user's connections
+	// on every server instance where the user is connected.
+	// Format: user:<username>:events
+	userEventsChannelPrefix = "user:%s:events"
+
 	// Default TTL for a room's user set if no users are active, making the room entry ephemeral.
 	// This helps in cleaning up empty/inactive room user sets from Redis.
 	defaultRoomUserSetTTL = 2 * time.Hour
@@ -37,13 +64,14 @@ const (
 // RedisClient wraps the go-redis client, providing chat-specific caching operations.
 type RedisClient struct {
 	client *redis.Client
+	log    *slog.Logger // Logs with component=redis, as does the client's instrumentationHook.
 }
 
 // NewRedisClient creates and returns a new RedisClient.
 // It takes a redisURL string (e.g., "redis://localhost:6379/0"),
 // parses it, creates a new Redis client instance, and pings the server
-// to verify the connection.
-func NewRedisClient(redisURL string) (*RedisClient, error) {
+// to verify the connection. The client logs with logger, or slog.Default() if it is nil.
+func NewRedisClient(redisURL string, logger *slog.Logger) (*RedisClient, error) {
 	if redisURL == "" {
 		return nil, fmt.Errorf("redis URL cannot be empty")
 	}
@@ -64,8 +92,14 @@ func NewRedisClient(redisURL string) (*RedisClient, error) {
 		client.Close() // Close client if ping fails.
 		return nil, fmt.Errorf("failed to ping redis at '%s': %w", redisURL, err)
 	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger = logger.With("component", "redis")
+	client.AddHook(instrumentationHook{log: logger}) // Time, trace and log every call, by RedisClient method.
+	logger.Info("Connected to Redis", "addr", opts.Addr, "db", opts.DB)
 
-	return &RedisClient{client: client}, nil
+	return &RedisClient{client: client, log: logger}, nil
 }
 
 // --- Message Operations ---
@@ -74,6 +108,7 @@ func NewRedisClient(redisURL string) (*RedisClient, error) {
 // It uses LPUSH to add to the head of the list and LTRIM to keep the list at maxMessages.
 // If messageTTL is greater than 0, it sets an EXPIRE on the list key.
 func (rc *RedisClient) AddRecentMessage(ctx context.Context, roomID string, messageJSON string, maxMessages int, messageTTL time.Duration) error {
+	ctx = withRedisMethod(ctx, "AddRecentMessage")
 	if roomID == "" {
 		return fmt.Errorf("roomID cannot be empty")
 	}
@@ -108,6 +143,7 @@ func (rc *RedisClient) AddRecentMessage(ctx context.Context, roomID string, mess
 // If count is invalid (<=0), it defaults to 10.
 // Returns an empty slice if the room has no messages or the key doesn't exist.
 func (rc *RedisClient) GetRecentMessages(ctx context.Context, roomID string, count int) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetRecentMessages")
 	if roomID == "" {
 		return nil, fmt.Errorf("roomID cannot be empty")
 	}
@@ -128,49 +164,82 @@ func (rc *RedisClient) GetRecentMessages(ctx context.Context, roomID string, cou
 
 // --- User Operations ---
 
-// AddActiveUserToRoom adds a username to a room's active user set in Redis.
-// If userTTL is greater than 0, it sets an EXPIRE on the room's user set key.
-// This helps in making the user set ephemeral if the room becomes inactive.
-func (rc *RedisClient) AddActiveUserToRoom(ctx context.Context, roomID string, username string, userTTL time.Duration) error {
+// addUserConnectionScript increments a user's connection count in a hash (KEYS[1]) and makes
+// sure the user is in the matching set (KEYS[2]). If ARGV[2] (milliseconds) is positive, both
+// keys get that TTL. The connection is also counted in field ARGV[3] of the owning instance's
+// hash (KEYS[3]), so it can be reaped if the instance dies. Returns the user's new connection count.
+var addUserConnectionScript = redis.NewScript(`
+local count = redis.call('HINCRBY', KEYS[1], ARGV[1], 1)
+redis.call('SADD', KEYS[2], ARGV[1])
+redis.call('HINCRBY', KEYS[3], ARGV[3], 1)
+local ttl = tonumber(ARGV[2])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+return count
+`)
+
+// removeUserConnectionScript decrements a user's connection count in a hash (KEYS[1]) and removes
+// the user from the matching set (KEYS[2]) once no connections remain. The connection is also
+// uncounted from field ARGV[2] of the owning instance's hash (KEYS[3]). Returns the remaining count.
+var removeUserConnectionScript = redis.NewScript(`
+if redis.call('HINCRBY', KEYS[3], ARGV[2], -1) <= 0 then
+	redis.call('HDEL', KEYS[3], ARGV[2])
+end
+local count = redis.call('HINCRBY', KEYS[1], ARGV[1], -1)
+if count <= 0 then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	redis.call('SREM', KEYS[2], ARGV[1])
+	count = 0
+end
+return count
+`)
+
+// AddActiveUserToRoom records one more connection of username in a room and adds the user
+// to the room's active user set. The user stays in the set until every one of their
+// connections has been removed with RemoveActiveUserFromRoom.
+// The room keys get userTTL (or the default TTL if userTTL <= 0), which keeps them ephemeral if the room becomes inactive.
+// The connection is owned by instanceID, which keeps it alive with Heartbeat.
+// Returns the number of connections the user now has in the room; 1 means the user just joined.
+func (rc *RedisClient) AddActiveUserToRoom(ctx context.Context, instanceID string, roomID string, username string, userTTL time.Duration) (int64, error) {
+	ctx = withRedisMethod(ctx, "AddActiveUserToRoom")
 	if roomID == "" || username == "" {
-		return fmt.Errorf("roomID and username cannot be empty")
+		return 0, fmt.Errorf("roomID and username cannot be empty")
 	}
-	setKey := fmt.Sprintf(roomUsersPrefix, roomID)
-
-	pipe := rc.client.TxPipeline()
-	pipe.SAdd(ctx, setKey, username)
-	if userTTL > 0 {
-		pipe.Expire(ctx, setKey, userTTL)
-	} else { // Default TTL for the room user set
-		pipe.Expire(ctx, setKey, defaultRoomUserSetTTL)
+	if userTTL <= 0 {
+		userTTL = defaultRoomUserSetTTL
 	}
+	keys := []string{fmt.Sprintf(roomUserConnectionsPrefix, roomID), fmt.Sprintf(roomUsersPrefix, roomID), fmt.Sprintf(instanceRoomUsersPrefix, instanceID)}
 
-	_, err := pipe.Exec(ctx)
+	count, err := addUserConnectionScript.Run(ctx, rc.client, keys, username, userTTL.Milliseconds(), instanceRoomUserField(roomID, username)).Int64()
 	if err != nil {
-		return fmt.Errorf("failed to execute Redis pipeline for adding user '%s' to room '%s': %w", username, roomID, err)
+		return 0, fmt.Errorf("failed to add user '%s' connection to room '%s' in Redis: %w", username, roomID, err)
 	}
-	return nil
+	return count, nil
 }
 
-// RemoveActiveUserFromRoom removes a username from a room's active user set in Redis.
-func (rc *RedisClient) RemoveActiveUserFromRoom(ctx context.Context, roomID string, username string) error {
+// RemoveActiveUserFromRoom records that one connection of username left a room.
+// The user is removed from the room's active user set when their last connection leaves.
+// Returns the number of connections the user still has in the room; 0 means the user left.
+func (rc *RedisClient) RemoveActiveUserFromRoom(ctx context.Context, instanceID string, roomID string, username string) (int64, error) {
+	ctx = withRedisMethod(ctx, "RemoveActiveUserFromRoom")
 	if roomID == "" || username == "" {
-		return fmt.Errorf("roomID and username cannot be empty")
+		return 0, fmt.Errorf("roomID and username cannot be empty")
 	}
-	setKey := fmt.Sprintf(roomUsersPrefix, roomID)
+	keys := []string{fmt.Sprintf(roomUserConnectionsPrefix, roomID), fmt.Sprintf(roomUsersPrefix, roomID), fmt.Sprintf(instanceRoomUsersPrefix, instanceID)}
 
-	err := rc.client.SRem(ctx, setKey, username).Err()
-	// SRem does not return redis.Nil if the key does not exist or member not in set.
-	// It returns the number of members removed (0 or 1).
+	count, err := removeUserConnectionScript.Run(ctx, rc.client, keys, username, instanceRoomUserField(roomID, username)).Int64()
 	if err != nil {
-		return fmt.Errorf("failed to remove user '%s' from room '%s' set in Redis: %w", username, roomID, err)
+		return 0, fmt.Errorf("failed to remove user '%s' connection from room '%s' in Redis: %w", username, roomID, err)
 	}
-	return nil
+	return count, nil
 }
 
 // GetActiveUsersInRoom retrieves all usernames from a room's active user set in Redis.
 // Returns an empty slice if the room has no active users or the key doesn't exist.
 func (rc *RedisClient) GetActiveUsersInRoom(ctx context.Context, roomID string) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetActiveUsersInRoom")
 	if roomID == "" {
 		return nil, fmt.Errorf("roomID cannot be empty")
 	}
@@ -187,33 +256,97 @@ func (rc *RedisClient) GetActiveUsersInRoom(ctx context.Context, roomID string)
 	return users, nil
 }
 
-// AddUserToGlobalSet adds a username to the global set of all currently active users.
-// This set does not have a TTL; users are removed explicitly on unregistration/disconnect.
-func (rc *RedisClient) AddUserToGlobalSet(ctx context.Context, username string) error {
+// AddUserToGlobalSet records one more connection of username, on any instance, and adds the
+// user to the global set of active users. This set does not have a TTL; users are removed
+// explicitly when their last connection is removed with RemoveUserFromGlobalSet.
+// The connection is owned by instanceID, which keeps it alive with Heartbeat.
+// Returns the user's total number of connections; 1 means the user just came online.
+func (rc *RedisClient) AddUserToGlobalSet(ctx context.Context, instanceID string, username string) (int64, error) {
+	ctx = withRedisMethod(ctx, "AddUserToGlobalSet")
 	if username == "" {
-		return fmt.Errorf("username cannot be empty")
+		return 0, fmt.Errorf("username cannot be empty")
 	}
-	err := rc.client.SAdd(ctx, globalUsersSetKey, username).Err()
+	keys := []string{globalUserConnectionsKey, globalUsersSetKey, fmt.Sprintf(instanceUsersPrefix, instanceID)}
+	count, err := addUserConnectionScript.Run(ctx, rc.client, keys, username, 0, username).Int64()
 	if err != nil {
-		return fmt.Errorf("failed to add user '%s' to global set in Redis: %w", username, err)
+		return 0, fmt.Errorf("failed to add user '%s' to global set in Redis: %w", username, err)
 	}
-	return nil
+	return count, nil
 }
 
-// RemoveUserFromGlobalSet removes a username from the global set of active users.
-func (rc *RedisClient) RemoveUserFromGlobalSet(ctx context.Context, username string) error {
+// RemoveUserFromGlobalSet records that one connection of username closed, and removes the
+// user from the global set of active users once they have no connections left.
+// Returns the user's remaining number of connections; 0 means the user went offline.
+func (rc *RedisClient) RemoveUserFromGlobalSet(ctx context.Context, instanceID string, username string) (int64, error) {
+	ctx = withRedisMethod(ctx, "RemoveUserFromGlobalSet")
 	if username == "" {
-		return fmt.Errorf("username cannot be empty")
+		return 0, fmt.Errorf("username cannot be empty")
 	}
-	err := rc.client.SRem(ctx, globalUsersSetKey, username).Err()
+	keys := []string{globalUserConnectionsKey, globalUsersSetKey, fmt.Sprintf(instanceUsersPrefix, instanceID)}
+	count, err := removeUserConnectionScript.Run(ctx, rc.client, keys, username, username).Int64()
 	if err != nil {
-		return fmt.Errorf("failed to remove user '%s' from global set in Redis: %w", username, err)
+		return 0, fmt.Errorf("failed to remove user '%s' from global set in Redis: %w", username, err)
+	}
+	return count, nil
+}
+
+// --- Session Operations ---
+
+// claimUsernameScript sets KEYS[1] to the session ID in ARGV[1] with a TTL of ARGV[2] milliseconds,
+// unless the key is already held by a different session. Returns 1 on success, 0 otherwise.
+var claimUsernameScript = redis.NewScript(`
+local owner = redis.call('GET', KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// releaseUsernameScript deletes KEYS[1] only if it is still held by the session ID in ARGV[1].
+var releaseUsernameScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// ClaimUsername reserves username for sessionID for the given TTL.
+// Claiming a username already held by the same session refreshes the TTL.
+// Returns false, without error, if the username is held by a different session.
+func (rc *RedisClient) ClaimUsername(ctx context.Context, username string, sessionID string, ttl time.Duration) (bool, error) {
+	ctx = withRedisMethod(ctx, "ClaimUsername")
+	if username == "" || sessionID == "" {
+		return false, fmt.Errorf("username and sessionID cannot be empty")
+	}
+	if ttl <= 0 {
+		return false, fmt.Errorf("ttl must be positive")
+	}
+	key := fmt.Sprintf(usernameClaimPrefix, username)
+	claimed, err := claimUsernameScript.Run(ctx, rc.client, []string{key}, sessionID, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim username '%s' in Redis: %w", username, err)
+	}
+	return claimed == 1, nil
+}
+
+// ReleaseUsername frees username if it is still held by sessionID. Releasing a username
+// held by another session (or by nobody) is a no-op.
+func (rc *RedisClient) ReleaseUsername(ctx context.Context, username string, sessionID string) error {
+	ctx = withRedisMethod(ctx, "ReleaseUsername")
+	if username == "" || sessionID == "" {
+		return fmt.Errorf("username and sessionID cannot be empty")
+	}
+	key := fmt.Sprintf(usernameClaimPrefix, username)
+	if err := releaseUsernameScript.Run(ctx, rc.client, []string{key}, sessionID).Err(); err != nil {
+		return fmt.Errorf("failed to release username '%s' in Redis: %w", username, err)
 	}
 	return nil
 }
 
 // GetGlobalActiveUserCount retrieves the total number of users in the global active set.
 func (rc *RedisClient) GetGlobalActiveUserCount(ctx context.Context) (int64, error) {
+	ctx = withRedisMethod(ctx, "GetGlobalActiveUserCount")
 	count, err := rc.client.SCard(ctx, globalUsersSetKey).Result()
 	// SCard returns 0 if the key does not exist, not redis.Nil.
 	if err != nil {
@@ -227,6 +360,7 @@ func (rc *RedisClient) GetGlobalActiveUserCount(ctx context.Context) (int64, err
 // IncrementMessageCounter increments the total message count for a specific room in Redis.
 // Returns the new count after incrementing.
 func (rc *RedisClient) IncrementMessageCounter(ctx context.Context, roomID string) (int64, error) {
+	ctx = withRedisMethod(ctx, "IncrementMessageCounter")
 	if roomID == "" {
 		return 0, fmt.Errorf("roomID cannot be empty")
 	}
@@ -242,6 +376,7 @@ func (rc *RedisClient) IncrementMessageCounter(ctx context.Context, roomID strin
 // GetRoomMessageCount retrieves the total message count for a specific room from Redis.
 // Returns 0 if the counter key does not exist (i.e., no messages counted yet for the room).
 func (rc *RedisClient) GetRoomMessageCount(ctx context.Context, roomID string) (int64, error) {
+	ctx = withRedisMethod(ctx, "GetRoomMessageCount")
 	if roomID == "" {
 		return 0, fmt.Errorf("roomID cannot be empty")
 	}
@@ -268,6 +403,7 @@ func (rc *RedisClient) GetRoomMessageCount(ctx context.Context, roomID string) (
 // GetRoomStats retrieves a map of statistics for a room from Redis.
 // This includes the count of active users in the room and the total message count for the room.
 func (rc *RedisClient) GetRoomStats(ctx context.Context, roomID string) (map[string]int64, error) {
+	ctx = withRedisMethod(ctx, "GetRoomStats")
 	if roomID == "" {
 		return nil, fmt.Errorf("roomID cannot be empty")
 	}
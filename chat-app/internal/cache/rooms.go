@@ -0,0 +1,495 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// roomRegistryKey is the Redis key for the room registry: a hash mapping each registered
+	// room ID to its Room record as JSON. Unlike a room's presence and recent messages, it has no TTL.
+	roomRegistryKey = "rooms:registry"
+
+	// roomMembersPrefix is the Redis key for the set of a room's members.
+	// Format: room:<roomID>:members
+	roomMembersPrefix = "room:%s:members"
+
+	// roomBansPrefix is the Redis key for the set of users banned from a room.
+	// Format: room:<roomID>:bans
+	roomBansPrefix = "room:%s:bans"
+
+	// roomRolesPrefix is the Redis key for a room's roles: a hash mapping each user holding a
+	// role other than RoomRoleMember to that role. A room's owner is its creator and is not stored.
+	// Format: room:<roomID>:roles
+	roomRolesPrefix = "room:%s:roles"
+
+	// roomMutesPrefix is the Redis key for a room's mutes: a hash mapping each muted user to the
+	// Unix time, in milliseconds, at which their mute ends. Ended mutes are ignored.
+	// Format: room:<roomID>:mutes
+	roomMutesPrefix = "room:%s:mutes"
+
+	// roomPinsPrefix is the Redis key for a room's pinned messages: a sorted set of message IDs
+	// scored by the Unix time, in milliseconds, at which they were pinned.
+	// Format: room:<roomID>:pins
+	roomPinsPrefix = "room:%s:pins"
+
+	// userRoomsPrefix is the Redis key for the set of rooms a user is a member of,
+	// the reverse index of roomMembersPrefix.
+	// Format: user:<username>:rooms
+	userRoomsPrefix = "user:%s:rooms"
+)
+
+// Room visibilities.
+const (
+	// RoomVisibilityPublic rooms are listed to, and can be joined by, every user.
+	RoomVisibilityPublic = "public"
+	// RoomVisibilityInviteOnly rooms are listed to every user, but only their members can join them.
+	RoomVisibilityInviteOnly = "invite-only"
+	// RoomVisibilityPrivate rooms are only listed to, and can only be joined by, their members.
+	RoomVisibilityPrivate = "private"
+)
+
+// Room roles, from least to most privileged.
+const (
+	// RoomRoleMember is the role of every user without another role in the room.
+	RoomRoleMember = "member"
+	// RoomRoleModerator users can mute, kick, ban and unban members, invite users, delete any
+	// message and pin messages.
+	RoomRoleModerator = "moderator"
+	// RoomRoleOwner is the role of a room's creator, who can also appoint moderators and change
+	// the room's settings.
+	RoomRoleOwner = "owner"
+)
+
+// Room is the registry record of a chat room.
+type Room struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Topic      string    `json:"topic,omitempty"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	Visibility string    `json:"visibility"`
+	Archived   bool      `json:"archived,omitempty"`
+}
+
+// RoomAccess is a room's registry record together with a user's standing in the room.
+type RoomAccess struct {
+	Room   *Room // Nil if the room is not registered.
+	Member bool
+	Banned bool
+}
+
+// --- Room Registry Operations ---
+
+// CreateRoom registers a room, unless a room with the same ID is already registered.
+// It returns false, without changing anything, if the room already exists.
+func (rc *RedisClient) CreateRoom(ctx context.Context, room Room) (bool, error) {
+	ctx = withRedisMethod(ctx, "CreateRoom")
+	if room.ID == "" {
+		return false, fmt.Errorf("roomID cannot be empty")
+	}
+	roomJSON, err := json.Marshal(room)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal room '%s': %w", room.ID, err)
+	}
+	created, err := rc.client.HSetNX(ctx, roomRegistryKey, room.ID, roomJSON).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to register room '%s' in Redis: %w", room.ID, err)
+	}
+	return created, nil
+}
+
+// GetRoom returns the registry record of a room, or nil if the room is not registered.
+func (rc *RedisClient) GetRoom(ctx context.Context, roomID string) (*Room, error) {
+	ctx = withRedisMethod(ctx, "GetRoom")
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	roomJSON, err := rc.client.HGet(ctx, roomRegistryKey, roomID).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room '%s' from Redis: %w", roomID, err)
+	}
+	return decodeRoom(roomID, roomJSON)
+}
+
+// ListRooms returns every registered room, oldest first.
+func (rc *RedisClient) ListRooms(ctx context.Context) ([]Room, error) {
+	ctx = withRedisMethod(ctx, "ListRooms")
+	entries, err := rc.client.HGetAll(ctx, roomRegistryKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rooms from Redis: %w", err)
+	}
+	return decodeRooms(entries)
+}
+
+// updateRoomScript replaces field ARGV[1] of hash KEYS[1] with ARGV[2], only if the field exists.
+// Returns 1 if it was replaced, 0 otherwise.
+var updateRoomScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 1 then
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// UpdateRoom replaces the registry record of an already registered room.
+// It returns false, without changing anything, if the room is not registered.
+func (rc *RedisClient) UpdateRoom(ctx context.Context, room Room) (bool, error) {
+	ctx = withRedisMethod(ctx, "UpdateRoom")
+	if room.ID == "" {
+		return false, fmt.Errorf("roomID cannot be empty")
+	}
+	roomJSON, err := json.Marshal(room)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal room '%s': %w", room.ID, err)
+	}
+	updated, err := updateRoomScript.Run(ctx, rc.client, []string{roomRegistryKey}, room.ID, roomJSON).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to update room '%s' in Redis: %w", room.ID, err)
+	}
+	return updated == 1, nil
+}
+
+// decodeRoom parses the registry record of a room.
+func decodeRoom(roomID string, roomJSON string) (*Room, error) {
+	var room Room
+	if err := json.Unmarshal([]byte(roomJSON), &room); err != nil {
+		return nil, fmt.Errorf("failed to decode registry record of room '%s': %w", roomID, err)
+	}
+	return &room, nil
+}
+
+// decodeRooms parses a set of registry records (room ID -> JSON) and sorts them oldest first.
+func decodeRooms(entries map[string]string) ([]Room, error) {
+	rooms := make([]Room, 0, len(entries))
+	for roomID, roomJSON := range entries {
+		room, err := decodeRoom(roomID, roomJSON)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, *room)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if !rooms[i].CreatedAt.Equal(rooms[j].CreatedAt) {
+			return rooms[i].CreatedAt.Before(rooms[j].CreatedAt)
+		}
+		return rooms[i].ID < rooms[j].ID
+	})
+	return rooms, nil
+}
+
+// --- Room Membership Operations ---
+
+// AddRoomMember makes username a member of a room.
+func (rc *RedisClient) AddRoomMember(ctx context.Context, roomID string, username string) error {
+	ctx = withRedisMethod(ctx, "AddRoomMember")
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	pipe := rc.client.TxPipeline()
+	pipe.SAdd(ctx, fmt.Sprintf(roomMembersPrefix, roomID), username)
+	pipe.SAdd(ctx, fmt.Sprintf(userRoomsPrefix, username), roomID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to add user '%s' to members of room '%s': %w", username, roomID, err)
+	}
+	return nil
+}
+
+// RemoveRoomMember removes username from a room's members, if present, and clears their role.
+func (rc *RedisClient) RemoveRoomMember(ctx context.Context, roomID string, username string) error {
+	ctx = withRedisMethod(ctx, "RemoveRoomMember")
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	pipe := rc.client.TxPipeline()
+	pipe.SRem(ctx, fmt.Sprintf(roomMembersPrefix, roomID), username)
+	pipe.SRem(ctx, fmt.Sprintf(userRoomsPrefix, username), roomID)
+	pipe.HDel(ctx, fmt.Sprintf(roomRolesPrefix, roomID), username)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to remove user '%s' from members of room '%s': %w", username, roomID, err)
+	}
+	return nil
+}
+
+// BanFromRoom removes username from a room's members, clears their role and bans them from the room.
+func (rc *RedisClient) BanFromRoom(ctx context.Context, roomID string, username string) error {
+	ctx = withRedisMethod(ctx, "BanFromRoom")
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	pipe := rc.client.TxPipeline()
+	pipe.SRem(ctx, fmt.Sprintf(roomMembersPrefix, roomID), username)
+	pipe.SRem(ctx, fmt.Sprintf(userRoomsPrefix, username), roomID)
+	pipe.HDel(ctx, fmt.Sprintf(roomRolesPrefix, roomID), username)
+	pipe.SAdd(ctx, fmt.Sprintf(roomBansPrefix, roomID), username)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to ban user '%s' from room '%s': %w", username, roomID, err)
+	}
+	return nil
+}
+
+// UnbanFromRoom lifts a user's ban from a room, if any. It does not restore their membership.
+func (rc *RedisClient) UnbanFromRoom(ctx context.Context, roomID string, username string) error {
+	ctx = withRedisMethod(ctx, "UnbanFromRoom")
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	if err := rc.client.SRem(ctx, fmt.Sprintf(roomBansPrefix, roomID), username).Err(); err != nil {
+		return fmt.Errorf("failed to unban user '%s' from room '%s': %w", username, roomID, err)
+	}
+	return nil
+}
+
+// GetRoomAccess reports whether username is a member of a room and whether they are banned from it.
+func (rc *RedisClient) GetRoomAccess(ctx context.Context, roomID string, username string) (member bool, banned bool, err error) {
+	ctx = withRedisMethod(ctx, "GetRoomAccess")
+	if roomID == "" || username == "" {
+		return false, false, fmt.Errorf("roomID and username cannot be empty")
+	}
+	pipe := rc.client.Pipeline()
+	memberCmd := pipe.SIsMember(ctx, fmt.Sprintf(roomMembersPrefix, roomID), username)
+	bannedCmd := pipe.SIsMember(ctx, fmt.Sprintf(roomBansPrefix, roomID), username)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, false, fmt.Errorf("failed to get access of user '%s' to room '%s': %w", username, roomID, err)
+	}
+	return memberCmd.Val(), bannedCmd.Val(), nil
+}
+
+// GetRoomsAccess returns the registry record of each of the given rooms and whether username is
+// a member of it and banned from it, fetched in one pipeline.
+func (rc *RedisClient) GetRoomsAccess(ctx context.Context, roomIDs []string, username string) (map[string]RoomAccess, error) {
+	ctx = withRedisMethod(ctx, "GetRoomsAccess")
+	if username == "" {
+		return nil, fmt.Errorf("username cannot be empty")
+	}
+	access := make(map[string]RoomAccess, len(roomIDs))
+	if len(roomIDs) == 0 {
+		return access, nil
+	}
+	pipe := rc.client.Pipeline()
+	roomsCmd := pipe.HMGet(ctx, roomRegistryKey, roomIDs...)
+	memberCmds := make([]*redis.BoolCmd, len(roomIDs))
+	bannedCmds := make([]*redis.BoolCmd, len(roomIDs))
+	for i, roomID := range roomIDs {
+		memberCmds[i] = pipe.SIsMember(ctx, fmt.Sprintf(roomMembersPrefix, roomID), username)
+		bannedCmds[i] = pipe.SIsMember(ctx, fmt.Sprintf(roomBansPrefix, roomID), username)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get access of user '%s' to %d room(s): %w", username, len(roomIDs), err)
+	}
+	for i, roomID := range roomIDs {
+		entry := RoomAccess{Member: memberCmds[i].Val(), Banned: bannedCmds[i].Val()}
+		if roomJSON, ok := roomsCmd.Val()[i].(string); ok {
+			room, err := decodeRoom(roomID, roomJSON)
+			if err != nil {
+				return nil, err
+			}
+			entry.Room = room
+		}
+		access[roomID] = entry
+	}
+	return access, nil
+}
+
+// GetRoomMembers returns the members of a room, in no particular order.
+func (rc *RedisClient) GetRoomMembers(ctx context.Context, roomID string) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetRoomMembers")
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	members, err := rc.client.SMembers(ctx, fmt.Sprintf(roomMembersPrefix, roomID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get members of room '%s': %w", roomID, err)
+	}
+	return members, nil
+}
+
+// GetRoomBans returns the users banned from a room, in no particular order.
+func (rc *RedisClient) GetRoomBans(ctx context.Context, roomID string) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetRoomBans")
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	banned, err := rc.client.SMembers(ctx, fmt.Sprintf(roomBansPrefix, roomID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bans of room '%s': %w", roomID, err)
+	}
+	return banned, nil
+}
+
+// GetUserRooms returns the IDs of the rooms username is a member of, in no particular order.
+func (rc *RedisClient) GetUserRooms(ctx context.Context, username string) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetUserRooms")
+	if username == "" {
+		return nil, fmt.Errorf("username cannot be empty")
+	}
+	rooms, err := rc.client.SMembers(ctx, fmt.Sprintf(userRoomsPrefix, username)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rooms of user '%s': %w", username, err)
+	}
+	return rooms, nil
+}
+
+// --- Room Moderation Operations ---
+
+// SetRoomRole gives username a role in a room. RoomRoleMember (or "") clears any role they hold.
+func (rc *RedisClient) SetRoomRole(ctx context.Context, roomID string, username string, role string) error {
+	ctx = withRedisMethod(ctx, "SetRoomRole")
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	rolesKey := fmt.Sprintf(roomRolesPrefix, roomID)
+	var err error
+	if role == "" || role == RoomRoleMember {
+		err = rc.client.HDel(ctx, rolesKey, username).Err()
+	} else {
+		err = rc.client.HSet(ctx, rolesKey, username, role).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set role of user '%s' in room '%s': %w", username, roomID, err)
+	}
+	return nil
+}
+
+// GetRoomRole returns username's role in a room, or "" if they hold none.
+func (rc *RedisClient) GetRoomRole(ctx context.Context, roomID string, username string) (string, error) {
+	ctx = withRedisMethod(ctx, "GetRoomRole")
+	if roomID == "" || username == "" {
+		return "", fmt.Errorf("roomID and username cannot be empty")
+	}
+	role, err := rc.client.HGet(ctx, fmt.Sprintf(roomRolesPrefix, roomID), username).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get role of user '%s' in room '%s': %w", username, roomID, err)
+	}
+	return role, nil
+}
+
+// GetRoomRoles maps each user holding a role in a room to that role.
+func (rc *RedisClient) GetRoomRoles(ctx context.Context, roomID string) (map[string]string, error) {
+	ctx = withRedisMethod(ctx, "GetRoomRoles")
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	roles, err := rc.client.HGetAll(ctx, fmt.Sprintf(roomRolesPrefix, roomID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get roles of room '%s': %w", roomID, err)
+	}
+	return roles, nil
+}
+
+// MuteInRoom mutes username in a room until the given time, replacing any earlier mute.
+func (rc *RedisClient) MuteInRoom(ctx context.Context, roomID string, username string, until time.Time) error {
+	ctx = withRedisMethod(ctx, "MuteInRoom")
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	if err := rc.client.HSet(ctx, fmt.Sprintf(roomMutesPrefix, roomID), username, until.UnixMilli()).Err(); err != nil {
+		return fmt.Errorf("failed to mute user '%s' in room '%s': %w", username, roomID, err)
+	}
+	return nil
+}
+
+// UnmuteInRoom lifts username's mute in a room, if any.
+func (rc *RedisClient) UnmuteInRoom(ctx context.Context, roomID string, username string) error {
+	ctx = withRedisMethod(ctx, "UnmuteInRoom")
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	if err := rc.client.HDel(ctx, fmt.Sprintf(roomMutesPrefix, roomID), username).Err(); err != nil {
+		return fmt.Errorf("failed to unmute user '%s' in room '%s': %w", username, roomID, err)
+	}
+	return nil
+}
+
+// GetMutedUntil returns when username's mute in a room ends, or the zero time if they are not
+// muted (or their mute has already ended).
+func (rc *RedisClient) GetMutedUntil(ctx context.Context, roomID string, username string) (time.Time, error) {
+	ctx = withRedisMethod(ctx, "GetMutedUntil")
+	if roomID == "" || username == "" {
+		return time.Time{}, fmt.Errorf("roomID and username cannot be empty")
+	}
+	untilMillis, err := rc.client.HGet(ctx, fmt.Sprintf(roomMutesPrefix, roomID), username).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get mute of user '%s' in room '%s': %w", username, roomID, err)
+	}
+	return mutedUntil(untilMillis, time.Now()), nil
+}
+
+// mutedUntil converts a stored mute deadline to a time, or the zero time if it has passed by now.
+func mutedUntil(untilMillis int64, now time.Time) time.Time {
+	until := time.UnixMilli(untilMillis).UTC()
+	if !until.After(now) {
+		return time.Time{}
+	}
+	return until
+}
+
+// PinMessage pins message id of a room, recording when. It returns false if it was already pinned.
+func (rc *RedisClient) PinMessage(ctx context.Context, roomID string, id int64, at time.Time) (bool, error) {
+	ctx = withRedisMethod(ctx, "PinMessage")
+	if roomID == "" {
+		return false, fmt.Errorf("roomID cannot be empty")
+	}
+	added, err := rc.client.ZAddNX(ctx, fmt.Sprintf(roomPinsPrefix, roomID), &redis.Z{
+		Score:  float64(at.UnixMilli()),
+		Member: strconv.FormatInt(id, 10),
+	}).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to pin message %d of room '%s': %w", id, roomID, err)
+	}
+	return added == 1, nil
+}
+
+// UnpinMessage unpins message id of a room. It returns false if it was not pinned.
+func (rc *RedisClient) UnpinMessage(ctx context.Context, roomID string, id int64) (bool, error) {
+	ctx = withRedisMethod(ctx, "UnpinMessage")
+	if roomID == "" {
+		return false, fmt.Errorf("roomID cannot be empty")
+	}
+	removed, err := rc.client.ZRem(ctx, fmt.Sprintf(roomPinsPrefix, roomID), strconv.FormatInt(id, 10)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to unpin message %d of room '%s': %w", id, roomID, err)
+	}
+	return removed == 1, nil
+}
+
+// GetPinnedMessageIDs returns the IDs of a room's pinned messages, in the order they were pinned.
+func (rc *RedisClient) GetPinnedMessageIDs(ctx context.Context, roomID string) ([]int64, error) {
+	ctx = withRedisMethod(ctx, "GetPinnedMessageIDs")
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	members, err := rc.client.ZRange(ctx, fmt.Sprintf(roomPinsPrefix, roomID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pinned messages of room '%s': %w", roomID, err)
+	}
+	return parseMessageIDs(roomID, members)
+}
+
+// parseMessageIDs parses the message IDs stored as the members of a room's sorted set.
+func parseMessageIDs(roomID string, members []string) ([]int64, error) {
+	ids := make([]int64, 0, len(members))
+	for _, member := range members {
+		id, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message ID '%s' stored for room '%s': %w", member, roomID, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
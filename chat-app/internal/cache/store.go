@@ -0,0 +1,300 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the persistence contract used by the Hub and the HTTP handlers.
+// RedisClient is the production implementation; MemoryStore offers identical
+// semantics in-process, for running a single instance without Redis and for tests.
+type Store interface {
+	MessageStore
+	MessageLogStore
+	DirectMessageStore
+	RoomStore
+	ReactionStore
+	ThreadStore
+	ReadStore
+	PresenceStore
+	UserPresenceStore
+	SessionStore
+	CounterStore
+	RateLimitStore
+	EventBus
+
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// MessageStore keeps a bounded list of recent messages per room.
+type MessageStore interface {
+	// AddRecentMessage pushes a message to the head of a room's recent list, trims the list
+	// to maxMessages (if > 0) and refreshes its TTL (or the default TTL if messageTTL <= 0).
+	AddRecentMessage(ctx context.Context, roomID string, messageJSON string, maxMessages int, messageTTL time.Duration) error
+	// GetRecentMessages returns up to count messages, newest first. count <= 0 defaults to 10.
+	GetRecentMessages(ctx context.Context, roomID string, count int) ([]string, error)
+}
+
+// MessageLogStore keeps the durable, ordered log of the messages posted to each room.
+// Messages are addressed by a per-room sequence number that serves as their stable ID,
+// so paging through history is unaffected by new messages arriving meanwhile.
+// IDs always increase but may have gaps (e.g. when a duplicate message is discarded).
+type MessageLogStore interface {
+	// NextMessageID reserves the next message ID of a room. IDs start at 1 and only increase.
+	NextMessageID(ctx context.Context, roomID string) (int64, error)
+	// AppendToMessageLog stores a message under its ID, replacing any message already stored
+	// under it. If maxMessages > 0, the oldest entries beyond that many are dropped.
+	AppendToMessageLog(ctx context.Context, roomID string, id int64, messageJSON string, maxMessages int) error
+	// GetMessagesBefore returns up to limit messages with an ID lower than beforeID, newest first.
+	// beforeID <= 0 starts from the newest message. limit <= 0 defaults to 10.
+	GetMessagesBefore(ctx context.Context, roomID string, beforeID int64, limit int) ([]string, error)
+	// GetMessagesAfter returns up to limit messages with an ID greater than afterID, oldest first.
+	// limit <= 0 defaults to 10.
+	GetMessagesAfter(ctx context.Context, roomID string, afterID int64, limit int) ([]string, error)
+	// GetMessage returns the message stored under id, or "" if it is not in the log.
+	GetMessage(ctx context.Context, roomID string, id int64) (string, error)
+	// GetLatestMessageIDs returns the latest message ID reserved in each of the given rooms.
+	// Rooms without messages are left out.
+	GetLatestMessageIDs(ctx context.Context, roomIDs []string) (map[string]int64, error)
+	// ReplaceMessage rewrites a logged message in place, in the log and in the room's recent
+	// messages list, provided it is still oldJSON. It returns false, changing nothing, if the
+	// message is not in the log or has changed.
+	ReplaceMessage(ctx context.Context, roomID string, id int64, oldJSON string, messageJSON string) (bool, error)
+	// AddMessageEdit appends an earlier version of a message to its edit history. If maxEdits > 0,
+	// only the newest maxEdits versions are kept.
+	AddMessageEdit(ctx context.Context, roomID string, id int64, versionJSON string, maxEdits int) error
+	// GetMessageEdits returns the earlier versions of a message, oldest first.
+	GetMessageEdits(ctx context.Context, roomID string, id int64) ([]string, error)
+	// DeleteMessageEdits drops the edit history of a message.
+	DeleteMessageEdits(ctx context.Context, roomID string, id int64) error
+
+	// RecordClientMessageID remembers, for ttl, that a user's message with clientMsgID is stored as id.
+	// If the clientMsgID was already recorded, it returns the earlier message's ID and false instead.
+	RecordClientMessageID(ctx context.Context, username string, clientMsgID string, id int64, ttl time.Duration) (int64, bool, error)
+	// ForgetClientMessageID drops a record made by RecordClientMessageID.
+	ForgetClientMessageID(ctx context.Context, username string, clientMsgID string) error
+}
+
+// ReactionStore keeps the emoji reactions to the messages of each room: per message, how many
+// users reacted with each emoji, and which ones, so that nobody is counted twice.
+type ReactionStore interface {
+	// AddReaction records username's reaction with emoji to a message. It returns whether the
+	// reaction was added (false if the user had already reacted with that emoji) and the emoji's
+	// resulting count. If maxEmojis > 0 and the message already has that many different emoji,
+	// a new one is refused: it returns false and a zero count.
+	AddReaction(ctx context.Context, roomID string, id int64, emoji string, username string, maxEmojis int) (bool, int64, error)
+	// RemoveReaction withdraws username's reaction with emoji to a message. It returns whether
+	// there was such a reaction and the emoji's resulting count.
+	RemoveReaction(ctx context.Context, roomID string, id int64, emoji string, username string) (bool, int64, error)
+	// GetReactions returns the reaction counts (emoji to count) of the given messages.
+	// Messages without reactions are left out.
+	GetReactions(ctx context.Context, roomID string, ids []int64) (map[int64]map[string]int64, error)
+	// DeleteReactions drops every reaction to a message.
+	DeleteReactions(ctx context.Context, roomID string, id int64) error
+}
+
+// ThreadStore keeps the threads of replies to the messages of each room. Replies are stored in
+// the room's log like any message; a thread indexes the IDs of its replies and keeps the set of
+// users following it. A thread is identified by its parent message's ID.
+type ThreadStore interface {
+	// AddThreadReply indexes a logged message as a reply in a thread and returns the thread's
+	// resulting reply count.
+	AddThreadReply(ctx context.Context, roomID string, parentID int64, replyID int64) (int64, error)
+	// GetThreadRepliesBefore returns up to limit replies of a thread with an ID lower than
+	// beforeID, newest first. beforeID <= 0 starts from the newest reply. limit <= 0 defaults to 10.
+	GetThreadRepliesBefore(ctx context.Context, roomID string, parentID int64, beforeID int64, limit int) ([]string, error)
+	// FollowThread and UnfollowThread add or remove a user from a thread's followers.
+	FollowThread(ctx context.Context, roomID string, parentID int64, username string) error
+	UnfollowThread(ctx context.Context, roomID string, parentID int64, username string) error
+	// GetThreadFollowers returns the users following a thread.
+	GetThreadFollowers(ctx context.Context, roomID string, parentID int64) ([]string, error)
+}
+
+// ReadStore keeps each user's read markers: per room, the ID of the last message they have
+// read. Unread messages are counted on each room's timeline, an index of the IDs of the room's
+// top-level messages that are not deleted.
+type ReadStore interface {
+	// MarkRead sets a user's read marker in a room, or moves it forward, to id. It returns false,
+	// changing nothing, if the marker was already at id or beyond.
+	MarkRead(ctx context.Context, username string, roomID string, id int64) (bool, error)
+	// GetReadMarkers returns a user's read markers by room ID.
+	GetReadMarkers(ctx context.Context, username string) (map[string]int64, error)
+
+	// AddToTimeline indexes a logged message in its room's timeline. If maxMessages > 0, only the
+	// newest maxMessages IDs are kept.
+	AddToTimeline(ctx context.Context, roomID string, id int64, maxMessages int) error
+	// RemoveFromTimeline drops a message from its room's timeline.
+	RemoveFromTimeline(ctx context.Context, roomID string, id int64) error
+	// CountTimelineAfter returns, for each room ID in afterIDs, how many messages of the room's
+	// timeline have an ID greater than the one given.
+	CountTimelineAfter(ctx context.Context, afterIDs map[string]int64) (map[string]int64, error)
+}
+
+// DirectMessageStore keeps the durable log of each one-to-one conversation and each user's
+// list of conversations. A conversation is identified by its two participants, in any order.
+type DirectMessageStore interface {
+	// NextDirectMessageID reserves the next message ID of a conversation. IDs start at 1 and only increase.
+	NextDirectMessageID(ctx context.Context, userA string, userB string) (int64, error)
+	// AppendDirectMessage stores a message under its ID, replacing any message already stored
+	// under it. If maxMessages > 0, the oldest entries beyond that many are dropped.
+	AppendDirectMessage(ctx context.Context, userA string, userB string, id int64, messageJSON string, maxMessages int) error
+	// GetDirectMessagesBefore returns up to limit messages with an ID lower than beforeID, newest first.
+	// beforeID <= 0 starts from the newest message. limit <= 0 defaults to 10.
+	GetDirectMessagesBefore(ctx context.Context, userA string, userB string, beforeID int64, limit int) ([]string, error)
+
+	// RecordConversation marks the conversation as last active at the given time, for both participants.
+	RecordConversation(ctx context.Context, userA string, userB string, at time.Time) error
+	// GetConversations returns up to limit of a user's conversations, most recently active first.
+	// limit <= 0 defaults to 50.
+	GetConversations(ctx context.Context, username string, limit int) ([]Conversation, error)
+}
+
+// RoomStore is the registry of chat rooms, their metadata, their membership lists and the
+// moderation state of each room: member roles, mutes and pinned messages.
+// Registered rooms are permanent; archiving a room marks its record rather than deleting it.
+type RoomStore interface {
+	// CreateRoom registers a room. It returns false, changing nothing, if the ID is already registered.
+	CreateRoom(ctx context.Context, room Room) (bool, error)
+	// GetRoom returns a room's record, or nil if the room is not registered.
+	GetRoom(ctx context.Context, roomID string) (*Room, error)
+	// ListRooms returns every registered room, archived or not, oldest first.
+	ListRooms(ctx context.Context) ([]Room, error)
+	// UpdateRoom replaces a room's record. It returns false, changing nothing, if the room is not registered.
+	UpdateRoom(ctx context.Context, room Room) (bool, error)
+
+	// AddRoomMember and RemoveRoomMember change a room's members. Both are idempotent.
+	AddRoomMember(ctx context.Context, roomID string, username string) error
+	RemoveRoomMember(ctx context.Context, roomID string, username string) error
+	// BanFromRoom removes a user from a room's members and bans them; UnbanFromRoom lifts the ban.
+	BanFromRoom(ctx context.Context, roomID string, username string) error
+	UnbanFromRoom(ctx context.Context, roomID string, username string) error
+	// GetRoomAccess reports whether a user is a member of a room, and whether they are banned from it.
+	GetRoomAccess(ctx context.Context, roomID string, username string) (member bool, banned bool, err error)
+	// GetRoomsAccess returns, for each of the given rooms, its record and a user's access to it,
+	// like GetRoom and GetRoomAccess for all of them at once.
+	GetRoomsAccess(ctx context.Context, roomIDs []string, username string) (map[string]RoomAccess, error)
+	GetRoomMembers(ctx context.Context, roomID string) ([]string, error)
+	GetRoomBans(ctx context.Context, roomID string) ([]string, error)
+	// GetUserRooms returns the IDs of the rooms a user is a member of.
+	GetUserRooms(ctx context.Context, username string) ([]string, error)
+
+	// SetRoomRole gives a user a role in a room (see the RoomRole constants). RoomRoleMember
+	// clears any role. Removing a user from a room's members, or banning them, also clears it.
+	SetRoomRole(ctx context.Context, roomID string, username string, role string) error
+	// GetRoomRole returns a user's role in a room, or "" if they have none.
+	GetRoomRole(ctx context.Context, roomID string, username string) (string, error)
+	// GetRoomRoles maps each user holding a role in a room to that role.
+	GetRoomRoles(ctx context.Context, roomID string) (map[string]string, error)
+
+	// MuteInRoom mutes a user in a room until the given time; UnmuteInRoom lifts the mute early.
+	MuteInRoom(ctx context.Context, roomID string, username string, until time.Time) error
+	UnmuteInRoom(ctx context.Context, roomID string, username string) error
+	// GetMutedUntil returns when a user's mute in a room ends, or the zero time if they are not muted.
+	GetMutedUntil(ctx context.Context, roomID string, username string) (time.Time, error)
+
+	// PinMessage pins a message of a room. It returns false if the message was already pinned.
+	PinMessage(ctx context.Context, roomID string, id int64, at time.Time) (bool, error)
+	// UnpinMessage unpins a message. It returns false if the message was not pinned.
+	UnpinMessage(ctx context.Context, roomID string, id int64) (bool, error)
+	// GetPinnedMessageIDs returns the IDs of a room's pinned messages, in the order they were pinned.
+	GetPinnedMessageIDs(ctx context.Context, roomID string) ([]int64, error)
+}
+
+// PresenceStore tracks which users are active, per room and globally.
+// Presence is reference-counted per connection: a user with several open connections
+// (tabs, devices) stays present until the last one is removed. The Add and Remove
+// methods return the user's resulting connection count.
+// Each connection is owned by the instance that serves it. Instances renew a lease on all of
+// their connections with Heartbeat; the connections of an instance whose lease ran out (because
+// it crashed) are removed by ReapInstance.
+type PresenceStore interface {
+	// AddActiveUserToRoom adds a connection of a user to a room and refreshes the room's TTL
+	// (or the default TTL if userTTL <= 0).
+	AddActiveUserToRoom(ctx context.Context, instanceID string, roomID string, username string, userTTL time.Duration) (int64, error)
+	RemoveActiveUserFromRoom(ctx context.Context, instanceID string, roomID string, username string) (int64, error)
+	GetActiveUsersInRoom(ctx context.Context, roomID string) ([]string, error)
+
+	// AddUserToGlobalSet adds a connection of a user to the global set. The global set has no TTL.
+	AddUserToGlobalSet(ctx context.Context, instanceID string, username string) (int64, error)
+	RemoveUserFromGlobalSet(ctx context.Context, instanceID string, username string) (int64, error)
+	GetGlobalActiveUserCount(ctx context.Context) (int64, error)
+
+	// Heartbeat records that an instance is alive at time at, which renews its lease on its
+	// connections. It returns false if the instance had no heartbeat recorded, either because it
+	// is starting or because it was reaped meanwhile, and so has no connections recorded.
+	Heartbeat(ctx context.Context, instanceID string, at time.Time) (bool, error)
+	// GetStaleInstances returns the instances whose last heartbeat is older than before.
+	GetStaleInstances(ctx context.Context, before time.Time) ([]string, error)
+	// ReapInstance removes all the connections of an instance whose last heartbeat is older than
+	// before, along with its lease. It returns nil, changing nothing, if the instance heartbeat
+	// since, or was already reaped.
+	ReapInstance(ctx context.Context, instanceID string, before time.Time) (*ReapedInstance, error)
+}
+
+// UserPresenceStore keeps each user's presence record: the status they chose, their custom
+// status text, whether they are idle and when they were last seen, none of which expire.
+type UserPresenceStore interface {
+	// SetUserStatus records the status a user chose and their custom status text.
+	SetUserStatus(ctx context.Context, username string, status string, text string) error
+	// SetUserIdle records whether a user is away for being idle.
+	SetUserIdle(ctx context.Context, username string, idle bool) error
+	// TouchUserLastSeen moves a user's last-seen time forward to at. Earlier times are ignored.
+	TouchUserLastSeen(ctx context.Context, username string, at time.Time) error
+	// GetUserPresences returns the presence of each of the given users, by username. Whether a
+	// user is connected comes from the global set of active users.
+	GetUserPresences(ctx context.Context, usernames []string) (map[string]*UserPresence, error)
+}
+
+// SessionStore guarantees that a username belongs to at most one login session at a time.
+type SessionStore interface {
+	// ClaimUsername reserves a username for a session, or refreshes the TTL of an existing claim
+	// by the same session. It returns false if another session holds the username.
+	ClaimUsername(ctx context.Context, username string, sessionID string, ttl time.Duration) (bool, error)
+	// ReleaseUsername frees a username if, and only if, it is held by the given session.
+	ReleaseUsername(ctx context.Context, username string, sessionID string) error
+}
+
+// CounterStore keeps per-room message counters and derived statistics.
+type CounterStore interface {
+	IncrementMessageCounter(ctx context.Context, roomID string) (int64, error)
+	GetRoomMessageCount(ctx context.Context, roomID string) (int64, error)
+	// GetRoomStats returns "active_users" and "message_count" for a room.
+	GetRoomStats(ctx context.Context, roomID string) (map[string]int64, error)
+}
+
+// RateLimitStore keeps token buckets, so that rate limits hold across every server instance
+// sharing the store.
+type RateLimitStore interface {
+	// TakeTokens takes one token from each of the given buckets, as of now, if they all have one,
+	// and returns 0. Otherwise it takes none, and returns how long until they all would.
+	TakeTokens(ctx context.Context, buckets []TokenBucket, now time.Time) (time.Duration, error)
+}
+
+// EventBus fans events out to every server instance sharing the store.
+// Publishers receive their own events too; subscribers are expected to de-duplicate.
+type EventBus interface {
+	PublishRoomEvent(ctx context.Context, roomID string, payload string) error
+	PublishGlobalEvent(ctx context.Context, payload string) error
+	PublishUserEvent(ctx context.Context, username string, payload string) error
+	// SubscribeEvents opens a subscription that is always subscribed to global events.
+	SubscribeEvents(ctx context.Context) (EventSubscription, error)
+}
+
+// EventSubscription is a live subscription to the events published on an EventBus.
+type EventSubscription interface {
+	// Events returns the channel on which received events are delivered.
+	// It is closed once the subscription is closed.
+	Events() <-chan Event
+	SubscribeRoom(ctx context.Context, roomID string) error
+	UnsubscribeRoom(ctx context.Context, roomID string) error
+	SubscribeUser(ctx context.Context, username string) error
+	UnsubscribeUser(ctx context.Context, username string) error
+	Close() error
+}
+
+// Compile-time checks that both implementations satisfy Store.
+var (
+	_ Store = (*RedisClient)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
@@ -0,0 +1,487 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// storeBackend opens an empty Store for a test, along with a function that moves the store's
+// clock forward, so that the keys whose TTL runs out meanwhile expire.
+type storeBackend struct {
+	name string
+	open func(t *testing.T) (Store, func(time.Duration))
+}
+
+// storeBackends are the Store implementations the tests in this file hold to the same behaviour:
+// MemoryStore, and RedisClient against miniredis, an in-process Redis server.
+var storeBackends = []storeBackend{
+	{name: "memory", open: func(t *testing.T) (Store, func(time.Duration)) {
+		ms := NewMemoryStore()
+		var mu sync.Mutex
+		now := time.Now()
+		ms.SetClock(func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		})
+		return ms, func(d time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			now = now.Add(d)
+		}
+	}},
+	{name: "redis", open: func(t *testing.T) (Store, func(time.Duration)) {
+		server := miniredis.RunT(t)
+		rc, err := NewRedisClient("redis://"+server.Addr(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err != nil {
+			t.Fatalf("connecting to miniredis: %v", err)
+		}
+		t.Cleanup(func() { _ = rc.Close() })
+		return rc, server.FastForward
+	}},
+}
+
+// forEachStore runs test against each of storeBackends.
+func forEachStore(t *testing.T, test func(t *testing.T, s Store, advance func(time.Duration))) {
+	for _, backend := range storeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			s, advance := backend.open(t)
+			test(t, s, advance)
+		})
+	}
+}
+
+// must returns a function that fails the test if err is not nil, and otherwise returns v, for
+// checking the results of store calls inline: must(s.GetRoom(ctx, id))(t).
+func must[T any](v T, err error) func(t *testing.T) T {
+	return func(t *testing.T) T {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+}
+
+// noErr fails the test if err is not nil.
+func noErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// equal fails the test if got is not want.
+func equal(t *testing.T, what string, got, want any) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %v, want %v", what, got, want)
+	}
+}
+
+func TestStoreRecentMessagesAreTrimmedAndExpire(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		for i := 1; i <= 5; i++ {
+			noErr(t, s.AddRecentMessage(ctx, "general", fmt.Sprint("m", i), 3, time.Minute))
+		}
+		for _, tc := range []struct {
+			count int
+			want  []string
+		}{
+			{count: 2, want: []string{"m5", "m4"}},
+			{count: 10, want: []string{"m5", "m4", "m3"}},
+			{count: 0, want: []string{"m5", "m4", "m3"}}, // Defaults to 10.
+		} {
+			equal(t, fmt.Sprintf("GetRecentMessages(%d)", tc.count), must(s.GetRecentMessages(ctx, "general", tc.count))(t), tc.want)
+		}
+
+		// Adding a message refreshes the list's TTL.
+		advance(50 * time.Second)
+		noErr(t, s.AddRecentMessage(ctx, "general", "m6", 3, time.Minute))
+		advance(50 * time.Second)
+		equal(t, "messages after refresh", must(s.GetRecentMessages(ctx, "general", 10))(t), []string{"m6", "m5", "m4"})
+		advance(11 * time.Second)
+		equal(t, "messages after TTL", must(s.GetRecentMessages(ctx, "general", 10))(t), []string{})
+
+		// A TTL <= 0 means the default TTL.
+		noErr(t, s.AddRecentMessage(ctx, "random", "m1", 3, 0))
+		advance(defaultRecentMessagesListTTL - time.Minute)
+		equal(t, "messages before default TTL", must(s.GetRecentMessages(ctx, "random", 10))(t), []string{"m1"})
+		advance(2 * time.Minute)
+		equal(t, "messages after default TTL", must(s.GetRecentMessages(ctx, "random", 10))(t), []string{})
+	})
+}
+
+func TestStoreMessageLogIsTrimmedAndPaged(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		for i := 1; i <= 6; i++ {
+			id := must(s.NextMessageID(ctx, "general"))(t)
+			equal(t, "NextMessageID", id, int64(i))
+			noErr(t, s.AppendToMessageLog(ctx, "general", id, fmt.Sprint("m", id), 4))
+		}
+		// Appending under an ID already logged replaces its message.
+		noErr(t, s.AppendToMessageLog(ctx, "general", 6, "m6'", 4))
+
+		for _, tc := range []struct {
+			name string
+			got  func() ([]string, error)
+			want []string
+		}{
+			{name: "newest", got: func() ([]string, error) { return s.GetMessagesBefore(ctx, "general", 0, 10) }, want: []string{"m6'", "m5", "m4", "m3"}},
+			{name: "before 5", got: func() ([]string, error) { return s.GetMessagesBefore(ctx, "general", 5, 1) }, want: []string{"m4"}},
+			{name: "before trimmed", got: func() ([]string, error) { return s.GetMessagesBefore(ctx, "general", 3, 10) }, want: []string{}},
+			{name: "after 0", got: func() ([]string, error) { return s.GetMessagesAfter(ctx, "general", 0, 10) }, want: []string{"m3", "m4", "m5", "m6'"}},
+			{name: "after 4", got: func() ([]string, error) { return s.GetMessagesAfter(ctx, "general", 4, 1) }, want: []string{"m5"}},
+			{name: "default limit", got: func() ([]string, error) { return s.GetMessagesAfter(ctx, "general", 0, 0) }, want: []string{"m3", "m4", "m5", "m6'"}},
+			{name: "empty room", got: func() ([]string, error) { return s.GetMessagesBefore(ctx, "random", 0, 10) }, want: []string{}},
+		} {
+			equal(t, tc.name, must(tc.got())(t), tc.want)
+		}
+		equal(t, "trimmed message", must(s.GetMessage(ctx, "general", 2))(t), "")
+		equal(t, "kept message", must(s.GetMessage(ctx, "general", 3))(t), "m3")
+
+		// The log and its sequence never expire.
+		advance(30 * 24 * time.Hour)
+		equal(t, "latest IDs", must(s.GetLatestMessageIDs(ctx, []string{"general", "random"}))(t), map[string]int64{"general": 6})
+		equal(t, "log after a month", must(s.GetMessagesBefore(ctx, "general", 0, 1))(t), []string{"m6'"})
+	})
+}
+
+func TestStoreReplaceMessageRewritesLogAndRecentList(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		noErr(t, s.AppendToMessageLog(ctx, "general", 1, "v1", 0))
+		noErr(t, s.AddRecentMessage(ctx, "general", "v1", 10, 0))
+
+		equal(t, "replace stale", must(s.ReplaceMessage(ctx, "general", 1, "v0", "v2"))(t), false)
+		equal(t, "replace missing", must(s.ReplaceMessage(ctx, "general", 2, "v1", "v2"))(t), false)
+		equal(t, "replace current", must(s.ReplaceMessage(ctx, "general", 1, "v1", "v2"))(t), true)
+		equal(t, "logged message", must(s.GetMessage(ctx, "general", 1))(t), "v2")
+		equal(t, "recent messages", must(s.GetRecentMessages(ctx, "general", 10))(t), []string{"v2"})
+
+		for i := 1; i <= 4; i++ {
+			noErr(t, s.AddMessageEdit(ctx, "general", 1, fmt.Sprint("e", i), 2))
+		}
+		equal(t, "edits", must(s.GetMessageEdits(ctx, "general", 1))(t), []string{"e3", "e4"})
+		noErr(t, s.DeleteMessageEdits(ctx, "general", 1))
+		equal(t, "deleted edits", must(s.GetMessageEdits(ctx, "general", 1))(t), []string{})
+	})
+}
+
+func TestStoreDirectMessagesAreTrimmedPerConversation(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		for i := 1; i <= 3; i++ {
+			// Either participant may come first: it is the same conversation.
+			from, to := "alice", "bob"
+			if i%2 == 0 {
+				from, to = to, from
+			}
+			id := must(s.NextDirectMessageID(ctx, from, to))(t)
+			equal(t, "NextDirectMessageID", id, int64(i))
+			noErr(t, s.AppendDirectMessage(ctx, from, to, id, fmt.Sprint("d", id), 2))
+		}
+		equal(t, "alice's view", must(s.GetDirectMessagesBefore(ctx, "alice", "bob", 0, 10))(t), []string{"d3", "d2"})
+		equal(t, "bob's page", must(s.GetDirectMessagesBefore(ctx, "bob", "alice", 3, 10))(t), []string{"d2"})
+		equal(t, "other conversation", must(s.GetDirectMessagesBefore(ctx, "alice", "carol", 0, 10))(t), []string{})
+
+		start := time.UnixMilli(time.Now().UnixMilli()).UTC()
+		noErr(t, s.RecordConversation(ctx, "alice", "bob", start))
+		noErr(t, s.RecordConversation(ctx, "carol", "alice", start.Add(time.Second)))
+		equal(t, "alice's conversations", must(s.GetConversations(ctx, "alice", 0))(t), []Conversation{
+			{Peer: "carol", LastMessageAt: start.Add(time.Second)},
+			{Peer: "bob", LastMessageAt: start},
+		})
+		equal(t, "limited conversations", len(must(s.GetConversations(ctx, "alice", 1))(t)), 1)
+	})
+}
+
+func TestStoreClientMessageIDsExpire(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		record := func(id int64) [2]any {
+			stored, recorded, err := s.RecordClientMessageID(ctx, "alice", "c1", id, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return [2]any{stored, recorded}
+		}
+		equal(t, "first record", record(5), [2]any{int64(5), true})
+		equal(t, "retry", record(6), [2]any{int64(5), false})
+		advance(59 * time.Second)
+		equal(t, "retry before TTL", record(7), [2]any{int64(5), false})
+		advance(2 * time.Second)
+		equal(t, "record after TTL", record(8), [2]any{int64(8), true})
+		noErr(t, s.ForgetClientMessageID(ctx, "alice", "c1"))
+		equal(t, "record after forgetting", record(9), [2]any{int64(9), true})
+	})
+}
+
+func TestStoreUsernameClaimsExpire(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		claim := func(session string) bool {
+			return must(s.ClaimUsername(ctx, "alice", session, time.Minute))(t)
+		}
+		equal(t, "first claim", claim("s1"), true)
+		equal(t, "claim by another session", claim("s2"), false)
+		advance(40 * time.Second)
+		equal(t, "refresh", claim("s1"), true)
+		advance(40 * time.Second)
+		equal(t, "claim before refreshed TTL", claim("s2"), false)
+		advance(21 * time.Second)
+		equal(t, "claim after TTL", claim("s2"), true)
+
+		noErr(t, s.ReleaseUsername(ctx, "alice", "s1")) // Not s1's anymore: a no-op.
+		equal(t, "claim after foreign release", claim("s1"), false)
+		noErr(t, s.ReleaseUsername(ctx, "alice", "s2"))
+		equal(t, "claim after release", claim("s1"), true)
+	})
+}
+
+func TestStorePresenceCountsConnections(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		users := func() []string {
+			users := must(s.GetActiveUsersInRoom(ctx, "general"))(t)
+			sort.Strings(users)
+			return users
+		}
+		for _, tc := range []struct {
+			op    string
+			user  string
+			want  int64
+			users []string
+		}{
+			{op: "add", user: "alice", want: 1, users: []string{"alice"}},
+			{op: "add", user: "alice", want: 2, users: []string{"alice"}},
+			{op: "add", user: "bob", want: 1, users: []string{"alice", "bob"}},
+			{op: "remove", user: "alice", want: 1, users: []string{"alice", "bob"}},
+			{op: "remove", user: "alice", want: 0, users: []string{"bob"}},
+			{op: "remove", user: "alice", want: 0, users: []string{"bob"}}, // Never below zero.
+		} {
+			var count int64
+			if tc.op == "add" {
+				count = must(s.AddActiveUserToRoom(ctx, "i1", "general", tc.user, time.Hour))(t)
+			} else {
+				count = must(s.RemoveActiveUserFromRoom(ctx, "i1", "general", tc.user))(t)
+			}
+			equal(t, tc.op+" "+tc.user, count, tc.want)
+			equal(t, "users after "+tc.op+" "+tc.user, users(), tc.users)
+		}
+		equal(t, "room stats", must(s.GetRoomStats(ctx, "general"))(t), map[string]int64{"active_users": 1, "message_count": 0})
+
+		equal(t, "global add", must(s.AddUserToGlobalSet(ctx, "i1", "alice"))(t), int64(1))
+		equal(t, "global add", must(s.AddUserToGlobalSet(ctx, "i2", "alice"))(t), int64(2))
+		equal(t, "global remove", must(s.RemoveUserFromGlobalSet(ctx, "i1", "alice"))(t), int64(1))
+
+		// Rooms expire once nobody joins them for their TTL; the global set never does.
+		advance(time.Hour + time.Second)
+		equal(t, "users after TTL", users(), []string{})
+		equal(t, "global count", must(s.GetGlobalActiveUserCount(ctx))(t), int64(1))
+	})
+}
+
+func TestStoreReapsInstancesWithoutHeartbeat(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		start := time.Now()
+		equal(t, "first heartbeat", must(s.Heartbeat(ctx, "i1", start))(t), false)
+		equal(t, "next heartbeat", must(s.Heartbeat(ctx, "i1", start.Add(time.Second)))(t), true)
+		must(s.Heartbeat(ctx, "i2", start.Add(time.Minute)))(t)
+		must(s.AddUserToGlobalSet(ctx, "i1", "alice"))(t)
+		must(s.AddActiveUserToRoom(ctx, "i1", "general", "alice", 0))(t)
+		must(s.AddActiveUserToRoom(ctx, "i2", "general", "bob", 0))(t)
+
+		equal(t, "stale instances", must(s.GetStaleInstances(ctx, start.Add(30*time.Second)))(t), []string{"i1"})
+		equal(t, "reap live instance", must(s.ReapInstance(ctx, "i2", start.Add(30*time.Second)))(t) == nil, true)
+		reaped := must(s.ReapInstance(ctx, "i1", start.Add(30*time.Second)))(t)
+		if reaped == nil {
+			t.Fatal("stale instance was not reaped")
+		}
+		equal(t, "offline users", reaped.OfflineUsers, []string{"alice"})
+		equal(t, "users after reaping", must(s.GetActiveUsersInRoom(ctx, "general"))(t), []string{"bob"})
+		equal(t, "global count after reaping", must(s.GetGlobalActiveUserCount(ctx))(t), int64(0))
+		equal(t, "reap again", must(s.ReapInstance(ctx, "i1", start.Add(30*time.Second)))(t) == nil, true)
+		equal(t, "heartbeat after reaping", must(s.Heartbeat(ctx, "i1", start.Add(time.Minute)))(t), false)
+	})
+}
+
+func TestStoreTakeTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		now := time.UnixMilli(time.Now().UnixMilli())
+		buckets := []TokenBucket{
+			{Key: "text:conn:c1", Capacity: 2, Period: 2 * time.Second},
+			{Key: "text:user:alice", Capacity: 3, Period: 3 * time.Second},
+		}
+		for _, tc := range []struct {
+			at   time.Duration
+			want time.Duration
+		}{
+			{at: 0, want: 0},
+			{at: 0, want: 0},
+			{at: 0, want: time.Second}, // The connection's bucket is empty.
+			{at: 500 * time.Millisecond, want: 500 * time.Millisecond},
+			{at: time.Second, want: 0},           // Refilled by one token.
+			{at: time.Second, want: time.Second}, // The user's bucket is empty now too.
+		} {
+			equal(t, fmt.Sprintf("TakeTokens at +%s", tc.at), must(s.TakeTokens(ctx, buckets, now.Add(tc.at)))(t), tc.want)
+		}
+		if _, err := s.TakeTokens(ctx, []TokenBucket{{Key: "", Capacity: 1, Period: time.Second}}, now); err == nil {
+			t.Error("TakeTokens accepted a bucket without a key")
+		}
+	})
+}
+
+func TestStoreReadMarkersOnlyMoveForward(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		for _, tc := range []struct {
+			id   int64
+			want bool
+		}{
+			{id: 3, want: true},
+			{id: 3, want: false},
+			{id: 2, want: false},
+			{id: 5, want: true},
+		} {
+			equal(t, fmt.Sprintf("MarkRead(%d)", tc.id), must(s.MarkRead(ctx, "alice", "general", tc.id))(t), tc.want)
+		}
+		equal(t, "markers", must(s.GetReadMarkers(ctx, "alice"))(t), map[string]int64{"general": 5})
+	})
+}
+
+func TestStoreTimelineCountsIndexedMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		for _, id := range []int64{1, 2, 4, 5, 7} {
+			noErr(t, s.AddToTimeline(ctx, "general", id, 4))
+		}
+		noErr(t, s.RemoveFromTimeline(ctx, "general", 5))
+		// Message 1 was trimmed, 3 and 6 were never indexed and 5 was removed.
+		equal(t, "counts", must(s.CountTimelineAfter(ctx, map[string]int64{"general": 0, "random": 0}))(t), map[string]int64{"general": 3, "random": 0})
+		equal(t, "counts after 2", must(s.CountTimelineAfter(ctx, map[string]int64{"general": 2}))(t), map[string]int64{"general": 2})
+		equal(t, "counts after 7", must(s.CountTimelineAfter(ctx, map[string]int64{"general": 7}))(t), map[string]int64{"general": 0})
+	})
+}
+
+func TestStoreRoomsAccess(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		room := Room{ID: "club", Name: "Club", CreatedBy: "alice", CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Visibility: RoomVisibilityPrivate}
+		equal(t, "created", must(s.CreateRoom(ctx, room))(t), true)
+		noErr(t, s.AddRoomMember(ctx, "club", "bob"))
+		noErr(t, s.BanFromRoom(ctx, "general", "bob"))
+		equal(t, "access", must(s.GetRoomsAccess(ctx, []string{"club", "general"}, "bob"))(t), map[string]RoomAccess{
+			"club":    {Room: &room, Member: true},
+			"general": {Banned: true},
+		})
+		equal(t, "no rooms", must(s.GetRoomsAccess(ctx, nil, "bob"))(t), map[string]RoomAccess{})
+	})
+}
+
+func TestStoreReactionsLimitEmojis(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		react := func(emoji, user string) [2]any {
+			added, count, err := s.AddReaction(ctx, "general", 1, emoji, user, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return [2]any{added, count}
+		}
+		equal(t, "first reaction", react("👍", "alice"), [2]any{true, int64(1)})
+		equal(t, "same reaction", react("👍", "alice"), [2]any{false, int64(1)})
+		equal(t, "another user", react("👍", "bob"), [2]any{true, int64(2)})
+		equal(t, "second emoji", react("🎉", "alice"), [2]any{true, int64(1)})
+		equal(t, "third emoji", react("😂", "alice"), [2]any{false, int64(0)})
+
+		removed, count, err := s.RemoveReaction(ctx, "general", 1, "🎉", "alice")
+		equal(t, "remove", [3]any{removed, count, err}, [3]any{true, int64(0), nil})
+		equal(t, "reactions", must(s.GetReactions(ctx, "general", []int64{1, 2}))(t), map[int64]map[string]int64{1: {"👍": 2}})
+	})
+}
+
+func TestStorePubSubDeliversToSubscribers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store, advance func(time.Duration)) {
+		ctx := context.Background()
+		sub := must(s.SubscribeEvents(ctx))(t)
+		defer sub.Close()
+		noErr(t, sub.SubscribeRoom(ctx, "general"))
+		noErr(t, sub.SubscribeUser(ctx, "alice"))
+		awaitSubscription(t, s, sub, func(p string) error { return s.PublishRoomEvent(ctx, "general", p) }, true)
+		awaitSubscription(t, s, sub, func(p string) error { return s.PublishUserEvent(ctx, "alice", p) }, true)
+
+		noErr(t, s.PublishRoomEvent(ctx, "random", "not subscribed"))
+		noErr(t, s.PublishRoomEvent(ctx, "general", "room"))
+		noErr(t, s.PublishUserEvent(ctx, "bob", "not subscribed"))
+		noErr(t, s.PublishUserEvent(ctx, "alice", "user"))
+		noErr(t, s.PublishGlobalEvent(ctx, "global"))
+		for _, want := range []Event{{RoomID: "general", Payload: "room"}, {Username: "alice", Payload: "user"}, {Payload: "global"}} {
+			equal(t, "event", nextEvent(t, sub, false), want)
+		}
+
+		noErr(t, sub.UnsubscribeRoom(ctx, "general"))
+		noErr(t, sub.UnsubscribeUser(ctx, "alice"))
+		awaitSubscription(t, s, sub, func(p string) error { return s.PublishRoomEvent(ctx, "general", p) }, false)
+		awaitSubscription(t, s, sub, func(p string) error { return s.PublishUserEvent(ctx, "alice", p) }, false)
+		noErr(t, s.PublishRoomEvent(ctx, "general", "unsubscribed"))
+		noErr(t, s.PublishUserEvent(ctx, "alice", "unsubscribed"))
+		noErr(t, s.PublishGlobalEvent(ctx, "last"))
+		equal(t, "event after unsubscribing", nextEvent(t, sub, false), Event{Payload: "last"})
+	})
+}
+
+// awaitSubscription waits until sub is subscribed, or unsubscribed, to the channel publish
+// publishes to. Redis applies (un)subscriptions asynchronously: until it has, a subscriber may
+// still miss the events of a channel it joined, or receive those of a channel it left. Each probe
+// published to the channel is followed by one to the global channel, which sub always receives,
+// and after the first.
+func awaitSubscription(t *testing.T, s Store, sub EventSubscription, publish func(payload string) error, subscribed bool) {
+	t.Helper()
+	for i := 0; ; i++ {
+		probe := fmt.Sprint("probe-", i)
+		noErr(t, publish(probe))
+		noErr(t, s.PublishGlobalEvent(context.Background(), probe+"-global"))
+		received := false
+		for event := nextEvent(t, sub, true); event.Payload != probe+"-global"; event = nextEvent(t, sub, true) {
+			received = received || event.Payload == probe
+		}
+		if received == subscribed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// nextEvent returns the next event sub receives, skipping awaitSubscription's probes unless
+// probes is set.
+func nextEvent(t *testing.T, sub EventSubscription, probes bool) Event {
+	t.Helper()
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				t.Fatal("subscription closed")
+			}
+			if probes || !strings.HasPrefix(event.Payload, "probe-") {
+				return event
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no event received")
+		}
+	}
+}
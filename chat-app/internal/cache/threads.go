@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// threadRepliesPrefix is the Redis key for the replies of a thread: a sorted set of the reply
+	// IDs, scored by ID, indexing into the room's log where the replies themselves are stored.
+	// The parent message's ID identifies the thread. Like the log, it has no TTL.
+	// Format: room:<roomID>:thread:<parentID>
+	threadRepliesPrefix = "room:%s:thread:%d"
+
+	// threadFollowersPrefix is the Redis key for the set of users following a thread, who are
+	// sent its new replies.
+	// Format: room:<roomID>:thread:<parentID>:followers
+	threadFollowersPrefix = "room:%s:thread:%d:followers"
+)
+
+// --- Thread Operations ---
+
+// AddThreadReply indexes message replyID of a room, already stored in the room's log, as a
+// reply in the thread of message parentID. It returns the thread's resulting reply count.
+func (rc *RedisClient) AddThreadReply(ctx context.Context, roomID string, parentID int64, replyID int64) (int64, error) {
+	ctx = withRedisMethod(ctx, "AddThreadReply")
+	if roomID == "" {
+		return 0, fmt.Errorf("roomID cannot be empty")
+	}
+	threadKey := fmt.Sprintf(threadRepliesPrefix, roomID, parentID)
+	pipe := rc.client.TxPipeline()
+	pipe.ZAdd(ctx, threadKey, &redis.Z{Score: float64(replyID), Member: strconv.FormatInt(replyID, 10)})
+	count := pipe.ZCard(ctx, threadKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to add reply %d to thread %d of room '%s': %w", replyID, parentID, roomID, err)
+	}
+	return count.Val(), nil
+}
+
+// threadRepliesBeforeScript reads up to ARGV[2] reply IDs from the thread index at KEYS[1] below
+// the score bound ARGV[1], newest first, and returns the matching messages from the room's log
+// at KEYS[2]. Replies that have been trimmed from the log are skipped.
+var threadRepliesBeforeScript = redis.NewScript(`
+local ids = redis.call('ZREVRANGEBYSCORE', KEYS[1], ARGV[1], '-inf', 'LIMIT', 0, tonumber(ARGV[2]))
+local replies = {}
+for _, id in ipairs(ids) do
+	local message = redis.call('ZRANGEBYSCORE', KEYS[2], id, id)
+	if #message > 0 then
+		table.insert(replies, message[1])
+	end
+end
+return replies
+`)
+
+// GetThreadRepliesBefore returns up to limit replies of the thread of message parentID with an
+// ID lower than beforeID (or from the newest reply if beforeID <= 0), newest first.
+// If limit is invalid (<=0), it defaults to 10.
+func (rc *RedisClient) GetThreadRepliesBefore(ctx context.Context, roomID string, parentID int64, beforeID int64, limit int) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetThreadRepliesBefore")
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+	max := "+inf"
+	if beforeID > 0 {
+		max = "(" + strconv.FormatInt(beforeID, 10) // Exclusive bound.
+	}
+	keys := []string{fmt.Sprintf(threadRepliesPrefix, roomID, parentID), fmt.Sprintf(roomMessageLogPrefix, roomID)}
+	replies, err := threadRepliesBeforeScript.Run(ctx, rc.client, keys, max, limit).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read thread %d of room '%s' before %d: %w", parentID, roomID, beforeID, err)
+	}
+	return replies, nil
+}
+
+// FollowThread adds username to the followers of the thread of message parentID.
+func (rc *RedisClient) FollowThread(ctx context.Context, roomID string, parentID int64, username string) error {
+	ctx = withRedisMethod(ctx, "FollowThread")
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	if err := rc.client.SAdd(ctx, fmt.Sprintf(threadFollowersPrefix, roomID, parentID), username).Err(); err != nil {
+		return fmt.Errorf("failed to add user '%s' to followers of thread %d of room '%s': %w", username, parentID, roomID, err)
+	}
+	return nil
+}
+
+// UnfollowThread removes username from the followers of the thread of message parentID.
+func (rc *RedisClient) UnfollowThread(ctx context.Context, roomID string, parentID int64, username string) error {
+	ctx = withRedisMethod(ctx, "UnfollowThread")
+	if roomID == "" || username == "" {
+		return fmt.Errorf("roomID and username cannot be empty")
+	}
+	if err := rc.client.SRem(ctx, fmt.Sprintf(threadFollowersPrefix, roomID, parentID), username).Err(); err != nil {
+		return fmt.Errorf("failed to remove user '%s' from followers of thread %d of room '%s': %w", username, parentID, roomID, err)
+	}
+	return nil
+}
+
+// GetThreadFollowers returns the users following the thread of message parentID.
+func (rc *RedisClient) GetThreadFollowers(ctx context.Context, roomID string, parentID int64) ([]string, error) {
+	ctx = withRedisMethod(ctx, "GetThreadFollowers")
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	followers, err := rc.client.SMembers(ctx, fmt.Sprintf(threadFollowersPrefix, roomID, parentID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get followers of thread %d of room '%s': %w", parentID, roomID, err)
+	}
+	return followers, nil
+}
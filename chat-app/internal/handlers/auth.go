@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/auth"
+)
+
+const (
+	// maxLoginBodyBytes bounds the size of a login request body.
+	maxLoginBodyBytes = 1024
+
+	// pendingUsernameClaimTTL is how long a freshly issued session holds its username before
+	// opening a WebSocket connection. Once connected, the Hub keeps the claim alive.
+	pendingUsernameClaimTTL = 5 * time.Minute
+)
+
+// LoginHTTP handles HTTP POST requests that exchange a username for a signed session token.
+// It expects a JSON body of the form {"username": "..."} and responds with the token,
+// which the client then presents when opening the WebSocket connection.
+// A username can only be held by one session at a time: logging in with a name that
+// another session is using fails with 409 Conflict. All tabs and devices sharing one
+// token belong to the same session.
+func (ch *ChatHandler) LoginHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		ch.log.Warn("Invalid method", "handler", "LoginHTTP", "method", r.Method)
+		http.Error(w, "Only POST method is allowed for this endpoint.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Username string `json:"username"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxLoginBodyBytes)
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		ch.log.Warn("Invalid request body", "handler", "LoginHTTP", "error", err)
+		http.Error(w, "Request body must be JSON of the form {\"username\": \"...\"}.", http.StatusBadRequest)
+		return
+	}
+	username := strings.TrimSpace(request.Username)
+	if !auth.ValidUsername(username) {
+		ch.log.Warn("Rejected invalid username", "handler", "LoginHTTP", "user", username)
+		http.Error(w, "Username must be 1-32 characters of letters, digits, '.', '_' or '-'.", http.StatusBadRequest)
+		return
+	}
+
+	token, claims, err := ch.tokens.Issue(username)
+	if err != nil {
+		ch.log.Error("Issuing session token failed", "user", username, "error", err)
+		http.Error(w, "Failed to log in. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	claimed, err := ch.store.ClaimUsername(r.Context(), username, claims.SessionID, pendingUsernameClaimTTL)
+	if err != nil {
+		ch.log.Error("Claiming username failed", "handler", "LoginHTTP", "user", username, "error", err)
+		http.Error(w, "Failed to log in. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		ch.log.Warn("Username already in use by another session", "handler", "LoginHTTP", "user", username)
+		http.Error(w, "Username is already in use. Please choose another one.", http.StatusConflict)
+		return
+	}
+
+	responsePayload := struct {
+		Token     string    `json:"token"`
+		Username  string    `json:"username"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{
+		Token:     token,
+		Username:  username,
+		ExpiresAt: claims.ExpiresAt,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store") // Tokens are credentials; never cache them.
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(responsePayload); err != nil {
+		ch.log.Error("Encoding login response failed", "user", username, "error", err)
+	}
+	ch.log.Info("Issued session token", "user", username, "expires_at", claims.ExpiresAt)
+}
+
+// authenticate extracts and verifies the session token of a request.
+// The token is read from an "Authorization: Bearer <token>" header or, because browsers
+// cannot set headers on WebSocket handshakes, from the 'token' query parameter.
+func (ch *ChatHandler) authenticate(r *http.Request) (*auth.Claims, error) {
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, credentials, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			return nil, auth.ErrInvalidToken
+		}
+		token = strings.TrimSpace(credentials)
+	}
+	if token == "" {
+		return nil, errors.New("no session token provided")
+	}
+	return ch.tokens.Verify(token)
+}
+
+// writeUnauthorized sends a 401 response asking the client to authenticate with a bearer token.
+func writeUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="go-chat"`)
+	http.Error(w, message, http.StatusUnauthorized)
+}
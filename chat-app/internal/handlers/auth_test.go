@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	gwebsocket "github.com/gorilla/websocket"
+
+	"github.com/yebrai/go-chat/internal/auth"
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/websocket"
+)
+
+// testSecret is the key the test servers sign their session tokens with.
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// signedToken returns a token for alice with the claims this service issues, expiring at
+// expiresAt, signed with method and key.
+func signedToken(t *testing.T, method jwt.SigningMethod, key interface{}, expiresAt time.Time) string {
+	t.Helper()
+	claims := jwt.RegisteredClaims{
+		ID:        "session-alice",
+		Issuer:    "go-chat",
+		Subject:   "alice",
+		IssuedAt:  jwt.NewNumericDate(expiresAt.Add(-time.Hour)),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+	}
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestServeWsRejectsInvalidTokensBeforeUpgrading(t *testing.T) {
+	tokens, err := auth.NewTokenManager(testSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherTokens, err := auth.NewTokenManager([]byte("another secret of at least 32 bytes"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyToken, _, err := otherTokens.Issue("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := cache.NewMemoryStore()
+	hub := websocket.NewHub(store, websocket.HubOptions{Logger: quietLogger})
+	handler := NewChatHandler(hub, store, tokens, quietLogger)
+
+	for _, tc := range []struct {
+		name  string
+		token string
+	}{
+		{name: "missing token"},
+		{name: "alg none", token: signedToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, time.Now().Add(time.Hour))},
+		{name: "wrong signing key", token: otherKeyToken},
+		{name: "expired", token: signedToken(t, jwt.SigningMethodHS256, testSecret, time.Now().Add(-time.Minute))},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			query := url.Values{"roomID": {"general"}, "username": {"alice"}}
+			if tc.token != "" {
+				query.Set("token", tc.token)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/ws?"+query.Encode(), nil)
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+			r.Header.Set("Sec-WebSocket-Version", "13")
+			r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			w := httptest.NewRecorder() // Cannot be hijacked: an attempted upgrade would fail with a 500.
+
+			handler.ServeWs(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+				t.Errorf("WWW-Authenticate = %q, want a Bearer challenge", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestServeWsTakesUsernameFromToken(t *testing.T) {
+	tokens, err := auth.NewTokenManager(testSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startTestServer(t, cache.NewMemoryStore(), tokens)
+	token, _, err := tokens.Issue("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{"token": {token}, "roomID": {"general"}, "username": {"mallory"}}
+	conn, _, err := gwebsocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	readUntil(t, conn, websocket.RoomInfoType)
+
+	if err := conn.WriteJSON(&websocket.Message{Type: websocket.TextMessageType, RoomID: "general", Username: "mallory", Content: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readUntil(t, conn, websocket.TextMessageType); msg.Username != "alice" {
+		t.Errorf("message sent as %q, want %q", msg.Username, "alice")
+	}
+}
@@ -2,86 +2,185 @@ package handlers
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"strconv"
 	// "strings" // Not currently used, but could be for more advanced query param validation.
 
+	"github.com/yebrai/go-chat/internal/auth"
 	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/metrics"
+	"github.com/yebrai/go-chat/internal/tracing"
 	"github.com/yebrai/go-chat/internal/websocket" // Importing local websocket package
 
 	gwebsocket "github.com/gorilla/websocket" // Aliased to avoid conflict with local 'websocket'.
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// upgrader is a package-level variable that configures the WebSocket connection upgrader.
+// newUpgrader returns the WebSocket connection upgrader of a ChatHandler, which logs to logger.
 // It specifies buffer sizes and a CheckOrigin function to control cross-origin requests.
-var upgrader = gwebsocket.Upgrader{
-	ReadBufferSize:  1024, // Size of the underlying buffer for reading from the connection.
-	WriteBufferSize: 1024, // Size of the underlying buffer for writing to the connection.
-	CheckOrigin: func(r *http.Request) bool {
-		// TODO: In a production environment, validate the request's origin.
-		// For example, allow requests only from your frontend's domain:
-		// origin := r.Header.Get("Origin")
-		// return origin == "https://yourfrontend.com"
-		origin := r.Header.Get("Origin") // Get origin for logging.
-		log.Printf("HTTP_HANDLER: Upgrading WebSocket connection. Origin: '%s'. Allowing for development.", origin)
-		return true // Allow all origins for development purposes.
-	},
+func newUpgrader(logger *slog.Logger) *gwebsocket.Upgrader {
+	return &gwebsocket.Upgrader{
+		ReadBufferSize:  1024, // Size of the underlying buffer for reading from the connection.
+		WriteBufferSize: 1024, // Size of the underlying buffer for writing to the connection.
+		CheckOrigin: func(r *http.Request) bool {
+			// TODO: In a production environment, validate the request's origin.
+			// For example, allow requests only from your frontend's domain:
+			// origin := r.Header.Get("Origin")
+			// return origin == "https://yourfrontend.com"
+			origin := r.Header.Get("Origin") // Get origin for logging.
+			logger.Debug("Upgrading WebSocket connection; allowing any origin for development", "origin", origin)
+			return true // Allow all origins for development purposes.
+		},
+	}
 }
 
 // ChatHandler handles HTTP requests related to chat functionalities, primarily WebSocket connections
 // and potentially other auxiliary endpoints like fetching room statistics.
 type ChatHandler struct {
-	hub         *websocket.Hub     // Reference to the central WebSocket Hub.
-	redisClient *cache.RedisClient // Reference to the Redis client for cache/store operations.
+	hub      *websocket.Hub       // Reference to the central WebSocket Hub.
+	store    cache.Store          // Reference to the store for cache/persistence operations.
+	tokens   *auth.TokenManager   // Issues and verifies session tokens.
+	upgrader *gwebsocket.Upgrader // Upgrades WebSocket connection requests.
+	log      *slog.Logger         // Logs with component=http.
 }
 
 // NewChatHandler creates and returns a new ChatHandler instance.
-// It requires a non-nil Hub and RedisClient.
-func NewChatHandler(hub *websocket.Hub, redisClient *cache.RedisClient) *ChatHandler {
+// It requires a non-nil Hub, Store and TokenManager. A nil logger means slog.Default().
+func NewChatHandler(hub *websocket.Hub, store cache.Store, tokens *auth.TokenManager, logger *slog.Logger) *ChatHandler {
 	if hub == nil {
-		log.Fatal("HTTP_HANDLER_FATAL: Hub cannot be nil in NewChatHandler")
+		panic("handlers: Hub cannot be nil in NewChatHandler")
+	}
+	if store == nil {
+		panic("handlers: Store cannot be nil in NewChatHandler")
+	}
+	if tokens == nil {
+		panic("handlers: TokenManager cannot be nil in NewChatHandler")
 	}
-	if redisClient == nil {
-		log.Fatal("HTTP_HANDLER_FATAL: RedisClient cannot be nil in NewChatHandler")
+	if logger == nil {
+		logger = slog.Default()
 	}
+	logger = logger.With("component", "http")
 	return &ChatHandler{
-		hub:         hub,
-		redisClient: redisClient,
+		hub:      hub,
+		store:    store,
+		tokens:   tokens,
+		upgrader: newUpgrader(logger),
+		log:      logger,
 	}
 }
 
 // ServeWs handles incoming WebSocket connection requests.
-// It expects 'username' and 'roomID' as query parameters in the request URL.
+// It expects a session token (see authenticate) and 'roomID' as a query parameter.
+// A reconnecting client may add 'lastMessageID', the ID of the last message it saw in that room,
+// to be sent only the messages it missed instead of the room's recent messages.
+// The username is taken from the verified token, never from the request itself.
 // If valid, it upgrades the HTTP connection to a WebSocket connection, creates a new
 // Client instance, registers it with the Hub, and starts its read/write pumps.
+// Unauthenticated requests are rejected with 401 before any upgrade takes place, and all
+// requests with 503 once the server is shutting down.
+// The upgrade is traced as a span, continuing the trace of the request's headers if any.
 func (ch *ChatHandler) ServeWs(w http.ResponseWriter, r *http.Request) {
-	// Extract username and initial roomID from query parameters.
-	username := r.URL.Query().Get("username")
-	roomID := r.URL.Query().Get("roomID") // Client intends to join this room initially.
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Tracer().Start(ctx, "websocket.upgrade", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	// fail records why the upgrade was refused or failed.
+	fail := func(reason string) {
+		metrics.UpgradeFailures.WithLabelValues(reason).Inc()
+		span.SetStatus(codes.Error, reason)
+	}
 
-	// Validate required query parameters.
-	if username == "" {
-		log.Println("HTTP_HANDLER_WARN: ServeWs - Username missing from query parameters.")
-		http.Error(w, "Query parameter 'username' is required.", http.StatusBadRequest)
+	if ch.hub.ShuttingDown() {
+		ch.log.Warn("Refused upgrade: server is shutting down", "remote_addr", r.RemoteAddr)
+		fail("shutting_down")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Server is shutting down. Please reconnect.", http.StatusServiceUnavailable)
 		return
 	}
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated upgrade", "remote_addr", r.RemoteAddr, "error", err)
+		fail("unauthorized")
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	username := claims.Username
+	roomID := r.URL.Query().Get("roomID") // Client intends to join this room initially.
+
+	// Validate required query parameters.
 	if roomID == "" {
-		log.Println("HTTP_HANDLER_WARN: ServeWs - RoomID missing from query parameters.")
+		ch.log.Warn("Room ID missing from upgrade request", "user", username)
+		fail("bad_request")
 		http.Error(w, "Query parameter 'roomID' is required for initial room join.", http.StatusBadRequest)
 		return
 	}
 
+	var lastMessageID int64
+	if raw := r.URL.Query().Get("lastMessageID"); raw != "" {
+		lastMessageID, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || lastMessageID < 0 {
+			ch.log.Warn("Invalid lastMessageID", "user", username, "last_message_id", raw)
+			fail("bad_request")
+			http.Error(w, "Query parameter 'lastMessageID' must be a message ID.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Refuse rooms that cannot be joined before upgrading, so the client gets a meaningful status.
+	span.SetAttributes(attribute.String("chat.user", username), attribute.String("chat.room", roomID))
+	if _, err := ch.hub.CheckRoomJoinable(ctx, roomID, username); err != nil {
+		ch.log.Warn("Refused upgrade: cannot join room", "user", username, "room_id", roomID, "error", err)
+		fail("room_refused")
+		switch {
+		case errors.Is(err, websocket.ErrInvalidRoom):
+			http.Error(w, "Invalid roomID. Room IDs are 1 to 64 letters, digits, '.', '-' or '_'.", http.StatusBadRequest)
+		case errors.Is(err, websocket.ErrRoomNotFound):
+			http.Error(w, "Room not found. Rooms must be created via POST /api/rooms before they can be joined.", http.StatusNotFound)
+		case errors.Is(err, websocket.ErrRoomArchived):
+			http.Error(w, "Room is archived.", http.StatusGone)
+		case errors.Is(err, websocket.ErrBannedFromRoom):
+			http.Error(w, "You are banned from this room.", http.StatusForbidden)
+		case errors.Is(err, websocket.ErrNotRoomMember):
+			http.Error(w, "This room is only open to its members.", http.StatusForbidden)
+		default:
+			http.Error(w, "Failed to open connection. Please try again later.", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Make sure the username still belongs to this session. The claim may have lapsed while the
+	// session had no connections, in which case another user may have taken the name since.
+	claimed, err := ch.store.ClaimUsername(ctx, username, claims.SessionID, pendingUsernameClaimTTL)
+	if err != nil {
+		ch.log.Error("Claiming username failed", "handler", "ServeWs", "user", username, "error", err)
+		fail("username_claim")
+		http.Error(w, "Failed to open connection. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		ch.log.Warn("Refused upgrade: username now held by another session", "user", username)
+		fail("username_claim")
+		http.Error(w, "Username is in use by another session. Please log in again.", http.StatusConflict)
+		return
+	}
+
 	// Upgrade the HTTP connection to a WebSocket connection.
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := ch.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		// upgrader.Upgrade automatically sends an HTTP error response on failure.
-		log.Printf("HTTP_HANDLER_ERROR: Failed to upgrade WebSocket connection for user '%s', room '%s': %v", username, roomID, err)
+		ch.log.Error("WebSocket upgrade failed", "user", username, "room_id", roomID, "error", err)
+		fail("handshake")
 		return
 	}
-	log.Printf("HTTP_HANDLER: WebSocket connection successfully upgraded for user '%s', initial room '%s'.", username, roomID)
 
 	// Create a new WebSocket client instance.
-	client := websocket.NewClient(ch.hub, conn, username, roomID)
+	client := websocket.NewClient(ch.hub, conn, username, claims.SessionID, roomID, lastMessageID)
 
 	// Register the new client with the Hub.
 	// The Hub's RegisterClient method handles sending the client to the internal register channel.
@@ -92,31 +191,42 @@ func (ch *ChatHandler) ServeWs(w http.ResponseWriter, r *http.Request) {
 	go client.WritePump()
 	go client.ReadPump()
 
-	log.Printf("HTTP_HANDLER: Client '%s' registered with Hub; read/write pumps started for room '%s'.", username, roomID)
+	ch.log.Info("WebSocket connection opened", "conn_id", client.ID(), "user", username, "room_id", roomID, "last_message_id", lastMessageID)
 }
 
-// GetRoomStatsHTTP handles HTTP GET requests for retrieving statistics of a specific chat room.
-// It expects a 'roomID' as a query parameter.
+// GetRoomStatsHTTP handles HTTP GET requests for retrieving statistics of a specific chat room,
+// at /api/stats/rooms. It expects a 'roomID' as a query parameter and a session token (see authenticate); the caller
+// must have access to the room (see websocket.Hub.CheckRoomAccess).
 // Responds with a JSON containing active user count and total message count for the room.
 func (ch *ChatHandler) GetRoomStatsHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		log.Printf("HTTP_HANDLER_WARN: GetRoomStatsHTTP - Invalid method: %s. Only GET allowed.", r.Method)
+		ch.log.Warn("Invalid method", "handler", "GetRoomStatsHTTP", "method", r.Method)
 		http.Error(w, "Only GET method is allowed for this endpoint.", http.StatusMethodNotAllowed)
 		return
 	}
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "GetRoomStatsHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
 
 	roomID := r.URL.Query().Get("roomID")
 	if roomID == "" {
-		log.Println("HTTP_HANDLER_WARN: GetRoomStatsHTTP - RoomID missing from query parameters.")
+		ch.log.Warn("Room ID missing from query parameters", "handler", "GetRoomStatsHTTP")
 		http.Error(w, "Query parameter 'roomID' is required.", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("HTTP_HANDLER: Received request for room stats: RoomID '%s'.", roomID)
-	ctx := r.Context() // Use request context for Redis operation.
-	stats, err := ch.redisClient.GetRoomStats(ctx, roomID)
+	ch.log.Debug("Room stats requested", "room_id", roomID, "user", claims.Username)
+	ctx := r.Context() // Use request context for the store operation.
+	if _, err := ch.hub.CheckRoomAccess(ctx, roomID, claims.Username); err != nil {
+		ch.writeRoomError(w, "GetRoomStatsHTTP", err)
+		return
+	}
+	stats, err := ch.store.GetRoomStats(ctx, roomID)
 	if err != nil {
-		log.Printf("HTTP_HANDLER_ERROR: Fetching stats for room '%s': %v", roomID, err)
+		ch.log.Error("Fetching room stats failed", "room_id", roomID, "error", err)
 		// Avoid exposing detailed internal errors to the client.
 		http.Error(w, "Failed to fetch room statistics. Please try again later.", http.StatusInternalServerError)
 		return
@@ -137,8 +247,159 @@ func (ch *ChatHandler) GetRoomStatsHTTP(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusOK) // Explicitly set StatusOK.
 	if err := json.NewEncoder(w).Encode(responsePayload); err != nil {
 		// This error occurs if writing to ResponseWriter fails after headers are set.
-		log.Printf("HTTP_HANDLER_ERROR: Encoding room stats JSON response for room '%s': %v", roomID, err)
+		ch.log.Error("Encoding room stats response failed", "room_id", roomID, "error", err)
 		// Cannot send http.Error here as headers/status might have been written.
 	}
-	log.Printf("HTTP_HANDLER: Successfully sent stats for room '%s'. Users: %d, Msgs: %d", roomID, responsePayload.ActiveUsers, responsePayload.MessageCount)
+	ch.log.Debug("Sent room stats", "room_id", roomID, "active_users", responsePayload.ActiveUsers, "message_count", responsePayload.MessageCount)
+}
+
+// GetRoomMessagesHTTP handles HTTP GET requests for paging back through a room's message history.
+// It is served at /api/rooms/{id}/messages, requires a session token (see authenticate) and access
+// to the room (403 for non-members of a private or invite-only room, or banned users). It accepts
+// two optional query parameters: 'before', the next_cursor of a previous page (omit it for the
+// newest page), and 'limit', the page size (default websocket.DefaultHistoryPageSize, capped at
+// websocket.MaxHistoryPageSize). Messages are returned oldest first.
+func (ch *ChatHandler) GetRoomMessagesHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		ch.log.Warn("Invalid method", "handler", "GetRoomMessagesHTTP", "method", r.Method)
+		http.Error(w, "Only GET method is allowed for this endpoint.", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "GetRoomMessagesHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+
+	roomID := r.PathValue("id")
+	if roomID == "" {
+		ch.log.Warn("Room ID missing from path", "handler", "GetRoomMessagesHTTP")
+		http.Error(w, "Room ID is required in the path.", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	limit, ok := ch.parseHistoryLimit(w, query.Get("limit"))
+	if !ok {
+		return
+	}
+
+	if _, err := ch.hub.CheckRoomAccess(r.Context(), roomID, claims.Username); err != nil {
+		ch.writeRoomError(w, "GetRoomMessagesHTTP", err)
+		return
+	}
+	page, err := websocket.LoadHistory(r.Context(), ch.store, ch.log, roomID, query.Get("before"), limit)
+	if errors.Is(err, websocket.ErrInvalidCursor) {
+		ch.log.Warn("Invalid history cursor", "handler", "GetRoomMessagesHTTP", "room_id", roomID, "user", claims.Username, "error", err)
+		http.Error(w, "Query parameter 'before' is not a valid cursor.", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		ch.log.Error("Fetching message history failed", "room_id", roomID, "error", err)
+		http.Error(w, "Failed to fetch message history. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		ch.log.Error("Encoding message history response failed", "room_id", roomID, "error", err)
+	}
+	ch.log.Debug("Sent message history", "room_id", roomID, "user", claims.Username, "count", len(page.Messages))
+}
+
+// GetMessageEditsHTTP handles HTTP GET requests for the edit history of a room's message.
+// It is served at /api/rooms/{id}/messages/{messageID}/edits, requires a session token and
+// access to the room, and returns the message's earlier versions, oldest first. The current
+// version is the one in the room's history. Deleted messages have no edit history.
+func (ch *ChatHandler) GetMessageEditsHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "GetMessageEditsHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	roomID := r.PathValue("id")
+	messageID, err := strconv.ParseInt(r.PathValue("messageID"), 10, 64)
+	if err != nil || messageID <= 0 {
+		http.Error(w, "Message ID in the path must be a positive integer.", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := ch.hub.CheckRoomAccess(r.Context(), roomID, claims.Username); err != nil {
+		ch.writeRoomError(w, "GetMessageEditsHTTP", err)
+		return
+	}
+	messageJSON, err := ch.store.GetMessage(r.Context(), roomID, messageID)
+	if err != nil {
+		ch.writeRoomError(w, "GetMessageEditsHTTP", err)
+		return
+	}
+	if messageJSON == "" {
+		ch.writeRoomError(w, "GetMessageEditsHTTP", fmt.Errorf("%w: %d", websocket.ErrMessageNotFound, messageID))
+		return
+	}
+	edits, err := websocket.GetMessageEdits(r.Context(), ch.store, ch.log, roomID, messageID)
+	if err != nil {
+		ch.writeRoomError(w, "GetMessageEditsHTTP", err)
+		return
+	}
+	ch.writeJSON(w, http.StatusOK, edits)
+}
+
+// GetThreadRepliesHTTP handles HTTP GET requests for paging back through the thread of replies
+// to a room's message. It is served at /api/rooms/{id}/messages/{messageID}/replies, requires a
+// session token and access to the room, and accepts the same 'before' and 'limit' query
+// parameters as GetRoomMessagesHTTP. The first page also carries the parent message.
+func (ch *ChatHandler) GetThreadRepliesHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "GetThreadRepliesHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	roomID := r.PathValue("id")
+	parentID, err := strconv.ParseInt(r.PathValue("messageID"), 10, 64)
+	if err != nil || parentID <= 0 {
+		http.Error(w, "Message ID in the path must be a positive integer.", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	limit, ok := ch.parseHistoryLimit(w, query.Get("limit"))
+	if !ok {
+		return
+	}
+
+	if _, err := ch.hub.CheckRoomAccess(r.Context(), roomID, claims.Username); err != nil {
+		ch.writeRoomError(w, "GetThreadRepliesHTTP", err)
+		return
+	}
+	page, err := websocket.LoadThread(r.Context(), ch.store, ch.log, roomID, parentID, query.Get("before"), limit)
+	if errors.Is(err, websocket.ErrInvalidCursor) {
+		ch.log.Warn("Invalid history cursor", "handler", "GetThreadRepliesHTTP", "room_id", roomID, "user", claims.Username, "error", err)
+		http.Error(w, "Query parameter 'before' is not a valid cursor.", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		ch.writeRoomError(w, "GetThreadRepliesHTTP", err)
+		return
+	}
+	ch.writeJSON(w, http.StatusOK, page)
+	ch.log.Debug("Sent thread replies", "room_id", roomID, "parent_id", parentID, "user", claims.Username, "count", len(page.Messages))
+}
+
+// parseHistoryLimit parses the optional 'limit' query parameter of the history endpoints.
+// An empty value returns 0, letting the history loader apply its default. If the value is
+// invalid, it writes a 400 response and returns false.
+func (ch *ChatHandler) parseHistoryLimit(w http.ResponseWriter, rawLimit string) (int, bool) {
+	if rawLimit == "" {
+		return 0, true
+	}
+	limit, err := strconv.Atoi(rawLimit)
+	if err != nil || limit <= 0 {
+		ch.log.Warn("Invalid history limit", "limit", rawLimit)
+		http.Error(w, "Query parameter 'limit' must be a positive integer.", http.StatusBadRequest)
+		return 0, false
+	}
+	return limit, true
 }
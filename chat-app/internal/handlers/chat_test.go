@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	gwebsocket "github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yebrai/go-chat/internal/auth"
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/tracing"
+	"github.com/yebrai/go-chat/internal/websocket"
+)
+
+// testTimeout bounds how long tests wait for the server to do something.
+const testTimeout = 2 * time.Second
+
+// quietLogger discards what the servers under test log.
+var quietLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestServeWsTracesMessagesThroughHubAndRedis(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	provider := tracing.Init(exporter, "go-chat-test")
+	t.Cleanup(func() {
+		_ = provider.Shutdown(context.Background())
+		otel.SetTracerProvider(previous)
+	})
+
+	redisServer := miniredis.RunT(t)
+	store, err := cache.NewRedisClient("redis://"+redisServer.Addr(), quietLogger)
+	if err != nil {
+		t.Fatalf("connecting to miniredis: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	tokens, err := auth.NewTokenManager(testSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Alice and Bob are connected to two instances sharing the store.
+	conn := dialTestServer(t, startTestServer(t, store, tokens), tokens, "alice", "general")
+	bob := dialTestServer(t, startTestServer(t, store, tokens), tokens, "bob", "general")
+
+	// The client sends its message as part of its own trace, which the server continues.
+	clientSpan := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(trace.ContextWithRemoteSpanContext(context.Background(), clientSpan), carrier)
+	if err := conn.WriteJSON(&websocket.Message{Type: websocket.TextMessageType, RoomID: "general", Content: "hello", Trace: carrier}); err != nil {
+		t.Fatal(err)
+	}
+	broadcast := readUntil(t, conn, websocket.TextMessageType)
+	readUntil(t, bob, websocket.TextMessageType)
+
+	upgrade := waitForSpan(t, provider, exporter, "websocket.upgrade", trace.SpanContext{})
+	waitForSpan(t, provider, exporter, "redis.ClaimUsername", upgrade)
+	message := waitForSpan(t, provider, exporter, "websocket.message", clientSpan)
+	worker := waitForSpan(t, provider, exporter, "hub.room_worker", message)
+	waitForSpan(t, provider, exporter, "redis.AppendToMessageLog", worker)
+	broadcastSpan := waitForSpan(t, provider, exporter, "hub.broadcast", message)
+	waitForSpan(t, provider, exporter, "redis.PublishRoomEvent", broadcastSpan)
+	waitForSpan(t, provider, exporter, "hub.remote_event", broadcastSpan) // Bob's instance delivering it.
+	if message.TraceID() != clientSpan.TraceID() {
+		t.Errorf("message traced in trace %s, want the client's trace %s", message.TraceID(), clientSpan.TraceID())
+	}
+
+	// The broadcast carries the context of the span that handled the message, for the spans that
+	// deliver it on other instances.
+	received := trace.SpanContextFromContext(propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier(broadcast.Trace)))
+	if received.TraceID() != clientSpan.TraceID() || received.SpanID() != message.SpanID() {
+		t.Errorf("broadcast message carries trace %s span %s, want trace %s span %s", received.TraceID(), received.SpanID(), clientSpan.TraceID(), message.SpanID())
+	}
+}
+
+// startTestServer starts a Hub on store, and a server upgrading connections to it, which are both
+// shut down once the test is over.
+func startTestServer(t *testing.T, store cache.Store, tokens *auth.TokenManager) *httptest.Server {
+	t.Helper()
+	hub := websocket.NewHub(store, websocket.HubOptions{Logger: quietLogger})
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(NewChatHandler(hub, store, tokens, quietLogger).ServeWs))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		if err := hub.Shutdown(ctx); err != nil {
+			t.Errorf("shutting down hub: %v", err)
+		}
+		server.Close()
+	})
+	return server
+}
+
+// dialTestServer connects to server as username, and waits until the connection has joined roomID.
+func dialTestServer(t *testing.T, server *httptest.Server, tokens *auth.TokenManager, username string, roomID string) *gwebsocket.Conn {
+	t.Helper()
+	token, _, err := tokens.Issue(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{"token": {token}, "roomID": {roomID}}
+	conn, _, err := gwebsocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("connecting as %s: %v", username, err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	readUntil(t, conn, websocket.RoomInfoType)
+	return conn
+}
+
+// waitForSpan waits until exporter holds an ended span called name that is a child of parent, or
+// a root span if parent is invalid, and returns its span context.
+func waitForSpan(t *testing.T, provider *sdktrace.TracerProvider, exporter *tracetest.InMemoryExporter, name string, parent trace.SpanContext) trace.SpanContext {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		if err := provider.ForceFlush(context.Background()); err != nil {
+			t.Fatalf("flushing spans: %v", err)
+		}
+		for _, span := range exporter.GetSpans() {
+			if span.Name == name && span.Parent.SpanID() == parent.SpanID() && span.Parent.TraceID() == parent.TraceID() {
+				return span.SpanContext
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no %s span with parent %s", name, parent.SpanID())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readUntil reads messages from conn until one of type typ arrives, and returns it.
+func readUntil(t *testing.T, conn *gwebsocket.Conn, typ websocket.MessageType) *websocket.Message {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		var msg websocket.Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for a %s: %v", typ, err)
+		}
+		if msg.Type == typ {
+			return &msg
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/yebrai/go-chat/internal/auth"
+	"github.com/yebrai/go-chat/internal/websocket"
+)
+
+// GetConversationsHTTP handles HTTP GET requests for the authenticated user's direct message
+// conversations. It is served at /api/conversations, requires a session token (see authenticate)
+// and responds with the conversations most recently active first.
+func (ch *ChatHandler) GetConversationsHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "GetConversationsHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+
+	list, err := websocket.ListConversations(r.Context(), ch.store, claims.Username)
+	if err != nil {
+		ch.log.Error("Fetching conversations failed", "user", claims.Username, "error", err)
+		http.Error(w, "Failed to fetch conversations. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		ch.log.Error("Encoding conversations response failed", "user", claims.Username, "error", err)
+	}
+	ch.log.Debug("Sent conversations", "user", claims.Username, "count", len(list.Conversations))
+}
+
+// GetConversationMessagesHTTP handles HTTP GET requests for paging back through the authenticated
+// user's direct conversation with another user. It is served at /api/conversations/{peer}/messages
+// and takes the same 'before' and 'limit' query parameters as GetRoomMessagesHTTP.
+// A user can only ever read conversations they take part in.
+func (ch *ChatHandler) GetConversationMessagesHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "GetConversationMessagesHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+
+	peer := r.PathValue("peer")
+	if !auth.ValidUsername(peer) {
+		ch.log.Warn("Invalid peer", "handler", "GetConversationMessagesHTTP", "user", claims.Username, "peer", peer)
+		http.Error(w, "A valid username is required in the path.", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	limit, ok := ch.parseHistoryLimit(w, query.Get("limit"))
+	if !ok {
+		return
+	}
+
+	page, err := websocket.LoadDirectHistory(r.Context(), ch.store, claims.Username, peer, query.Get("before"), limit)
+	if errors.Is(err, websocket.ErrInvalidCursor) {
+		ch.log.Warn("Invalid history cursor", "handler", "GetConversationMessagesHTTP", "user", claims.Username, "error", err)
+		http.Error(w, "Query parameter 'before' is not a valid cursor.", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		ch.log.Error("Fetching conversation failed", "user", claims.Username, "peer", peer, "error", err)
+		http.Error(w, "Failed to fetch conversation. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		ch.log.Error("Encoding conversation response failed", "user", claims.Username, "error", err)
+	}
+	ch.log.Debug("Sent direct messages", "user", claims.Username, "peer", peer, "count", len(page.Messages))
+}
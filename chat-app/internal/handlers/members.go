@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/yebrai/go-chat/internal/websocket"
+)
+
+// roomMemberRequest is the JSON body accepted by InviteToRoomHTTP and BanFromRoomHTTP.
+type roomMemberRequest struct {
+	Username string `json:"username"`
+}
+
+// ListRoomMembersHTTP handles HTTP GET requests for the members of a room, at /api/rooms/{id}/members.
+// It requires a session token and access to the room. The room's moderators are also shown who is banned.
+func (ch *ChatHandler) ListRoomMembersHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "ListRoomMembersHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	members, err := websocket.ListRoomMembers(r.Context(), ch.store, r.PathValue("id"), claims.Username)
+	if err != nil {
+		ch.writeRoomError(w, "ListRoomMembersHTTP", err)
+		return
+	}
+	ch.writeJSON(w, http.StatusOK, members)
+}
+
+// InviteToRoomHTTP handles HTTP POST requests inviting a user to a room, at /api/rooms/{id}/members.
+// The JSON body names the invited user: {"username": "alice"}. Only the room's moderators may invite.
+func (ch *ChatHandler) InviteToRoomHTTP(w http.ResponseWriter, r *http.Request) {
+	ch.changeRoomMembership(w, r, "InviteToRoomHTTP", ch.hub.InviteToRoom)
+}
+
+// KickFromRoomHTTP handles HTTP DELETE requests removing a user from a room's members, at
+// /api/rooms/{id}/members/{username}. Only the room's moderators may kick, and only users below them.
+func (ch *ChatHandler) KickFromRoomHTTP(w http.ResponseWriter, r *http.Request) {
+	ch.changeRoomMembership(w, r, "KickFromRoomHTTP", ch.hub.KickFromRoom)
+}
+
+// BanFromRoomHTTP handles HTTP POST requests banning a user from a room, at /api/rooms/{id}/bans.
+// The JSON body names the banned user: {"username": "alice"}. Only the room's moderators may ban,
+// and only users below them.
+func (ch *ChatHandler) BanFromRoomHTTP(w http.ResponseWriter, r *http.Request) {
+	ch.changeRoomMembership(w, r, "BanFromRoomHTTP", ch.hub.BanFromRoom)
+}
+
+// UnbanFromRoomHTTP handles HTTP DELETE requests lifting a user's ban from a room, at
+// /api/rooms/{id}/bans/{username}. Only the room's moderators may unban.
+func (ch *ChatHandler) UnbanFromRoomHTTP(w http.ResponseWriter, r *http.Request) {
+	ch.changeRoomMembership(w, r, "UnbanFromRoomHTTP", ch.hub.UnbanFromRoom)
+}
+
+// ListPinnedMessagesHTTP handles HTTP GET requests for the pinned messages of a room, at
+// /api/rooms/{id}/pins. It requires a session token and access to the room.
+func (ch *ChatHandler) ListPinnedMessagesHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "ListPinnedMessagesHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	roomID := r.PathValue("id")
+	if _, err := ch.hub.CheckRoomAccess(r.Context(), roomID, claims.Username); err != nil {
+		ch.writeRoomError(w, "ListPinnedMessagesHTTP", err)
+		return
+	}
+	pinned, err := websocket.ListPinnedMessages(r.Context(), ch.store, roomID)
+	if err != nil {
+		ch.writeRoomError(w, "ListPinnedMessagesHTTP", err)
+		return
+	}
+	ch.writeJSON(w, http.StatusOK, pinned)
+}
+
+// changeRoomMembership authenticates a room membership request, reads the target user from the
+// {username} path value or, if absent, from the JSON body, and applies change to it.
+// Responds 204 on success.
+func (ch *ChatHandler) changeRoomMembership(w http.ResponseWriter, r *http.Request, handler string, change func(ctx context.Context, roomID string, actor string, target string) error) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", handler, "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	target := r.PathValue("username")
+	if target == "" {
+		var request roomMemberRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRoomBodyBytes)).Decode(&request); err != nil {
+			http.Error(w, "Request body must be JSON like {\"username\": \"alice\"}.", http.StatusBadRequest)
+			return
+		}
+		target = request.Username
+	}
+
+	if err := change(r.Context(), r.PathValue("id"), claims.Username, target); err != nil {
+		ch.writeRoomError(w, handler, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// GetUserPresenceHTTP handles HTTP GET requests for a user's presence. It is served at
+// /api/users/{username}/presence, requires a session token (see authenticate) and responds with
+// the user's status ("online", "away", "dnd" or "offline"), custom status text and the time they
+// were last seen active. Users who never connected are offline, without a last-seen time.
+func (ch *ChatHandler) GetUserPresenceHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "GetUserPresenceHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	username := r.PathValue("username")
+
+	presences, err := ch.hub.UserPresences(r.Context(), []string{username})
+	if err != nil {
+		ch.log.Error("Fetching user presence failed", "user", claims.Username, "target", username, "error", err)
+		http.Error(w, "Failed to fetch the user's presence. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	ch.writeJSON(w, http.StatusOK, presences[0])
+	ch.log.Debug("Sent user presence", "user", claims.Username, "target", username, "status", presences[0].Status)
+}
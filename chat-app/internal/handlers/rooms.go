@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/yebrai/go-chat/internal/websocket"
+)
+
+// maxRoomBodyBytes bounds the size of a room creation or update request body.
+const maxRoomBodyBytes = 4096
+
+// createRoomRequest is the JSON body accepted by CreateRoomHTTP.
+type createRoomRequest struct {
+	ID string `json:"id"`
+	websocket.RoomSettings
+}
+
+// ListRoomsHTTP handles HTTP GET requests for the room registry. It is served at /api/rooms,
+// requires a session token (see authenticate) and lists every public and invite-only room plus
+// the private rooms the caller is a member of, oldest first. Archived rooms are included only with '?archived=true'.
+func (ch *ChatHandler) ListRoomsHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "ListRoomsHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	includeArchived := false
+	if raw := r.URL.Query().Get("archived"); raw != "" {
+		includeArchived, err = strconv.ParseBool(raw)
+		if err != nil {
+			http.Error(w, "Query parameter 'archived' must be true or false.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	list, err := websocket.ListRooms(r.Context(), ch.store, claims.Username, includeArchived)
+	if err != nil {
+		ch.log.Error("Listing rooms failed", "user", claims.Username, "error", err)
+		http.Error(w, "Failed to list rooms. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	ch.writeJSON(w, http.StatusOK, list)
+	ch.log.Debug("Sent rooms", "user", claims.Username, "count", len(list.Rooms))
+}
+
+// CreateRoomHTTP handles HTTP POST requests creating a room. It is served at /api/rooms and
+// requires a session token; the caller becomes the room's owner. The JSON body holds the room's
+// 'id' and optional 'name', 'topic' and 'visibility' ("public", "invite-only" or "private").
+// Responds 201 with the new room, or 409 if the ID is taken.
+func (ch *ChatHandler) CreateRoomHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "CreateRoomHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	var request createRoomRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRoomBodyBytes)).Decode(&request); err != nil {
+		http.Error(w, "Request body must be JSON like {\"id\": \"my-room\", \"name\": \"My room\"}.", http.StatusBadRequest)
+		return
+	}
+
+	room, err := ch.hub.CreateRoom(r.Context(), request.ID, claims.Username, request.RoomSettings)
+	if err != nil {
+		ch.writeRoomError(w, "CreateRoomHTTP", err)
+		return
+	}
+	ch.writeJSON(w, http.StatusCreated, websocket.RoomInfo(room))
+}
+
+// GetRoomHTTP handles HTTP GET requests for one room of the registry, at /api/rooms/{id}.
+// It requires a session token and responds 404 if the room was never created, or is private
+// and the caller is not a member.
+func (ch *ChatHandler) GetRoomHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "GetRoomHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	info, err := websocket.GetRoomInfo(r.Context(), ch.store, r.PathValue("id"), claims.Username)
+	if err != nil {
+		ch.writeRoomError(w, "GetRoomHTTP", err)
+		return
+	}
+	ch.writeJSON(w, http.StatusOK, info)
+}
+
+// UpdateRoomHTTP handles HTTP PATCH requests changing a room's 'name', 'topic' or 'visibility',
+// at /api/rooms/{id}. Fields missing from the JSON body are left unchanged. Only the room's
+// creator may update it (403 otherwise), and archived rooms cannot be updated (409).
+// The room's members are sent the updated room_info.
+func (ch *ChatHandler) UpdateRoomHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "UpdateRoomHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	var settings websocket.RoomSettings
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRoomBodyBytes)).Decode(&settings); err != nil {
+		http.Error(w, "Request body must be JSON like {\"topic\": \"New topic\"}.", http.StatusBadRequest)
+		return
+	}
+
+	room, err := ch.hub.UpdateRoom(r.Context(), r.PathValue("id"), claims.Username, settings)
+	if err != nil {
+		ch.writeRoomError(w, "UpdateRoomHTTP", err)
+		return
+	}
+	ch.writeJSON(w, http.StatusOK, websocket.RoomInfo(room))
+}
+
+// ArchiveRoomHTTP handles HTTP POST requests archiving a room, at /api/rooms/{id}/archive.
+// Only the room's creator may archive it. Archived rooms keep their history, which can still
+// be read, but can no longer be joined or posted to. Archiving is idempotent.
+func (ch *ChatHandler) ArchiveRoomHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "ArchiveRoomHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+	room, err := ch.hub.ArchiveRoom(r.Context(), r.PathValue("id"), claims.Username)
+	if err != nil {
+		ch.writeRoomError(w, "ArchiveRoomHTTP", err)
+		return
+	}
+	ch.writeJSON(w, http.StatusOK, websocket.RoomInfo(room))
+}
+
+// writeRoomError maps an error from the room registry, membership, moderation and message editing operations to an HTTP response.
+func (ch *ChatHandler) writeRoomError(w http.ResponseWriter, handler string, err error) {
+	var status int
+	switch {
+	case errors.Is(err, websocket.ErrInvalidRoom), errors.Is(err, websocket.ErrInvalidMember), errors.Is(err, websocket.ErrInvalidEdit):
+		status = http.StatusBadRequest
+	case errors.Is(err, websocket.ErrRoomNotFound), errors.Is(err, websocket.ErrMessageNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, websocket.ErrNotRoomOwner), errors.Is(err, websocket.ErrNotRoomMember), errors.Is(err, websocket.ErrBannedFromRoom),
+		errors.Is(err, websocket.ErrNotModerator), errors.Is(err, websocket.ErrOutranked), errors.Is(err, websocket.ErrNotMessageAuthor),
+		errors.Is(err, websocket.ErrEditWindowExpired), errors.Is(err, websocket.ErrMuted):
+		status = http.StatusForbidden
+	case errors.Is(err, websocket.ErrRoomExists), errors.Is(err, websocket.ErrRoomArchived), errors.Is(err, websocket.ErrTooManyPins):
+		status = http.StatusConflict
+	default:
+		ch.log.Error("Room request failed", "handler", handler, "error", err)
+		http.Error(w, "Failed to process room request. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	ch.log.Warn("Room request refused", "handler", handler, "status", status, "error", err)
+	http.Error(w, err.Error(), status)
+}
+
+// writeJSON writes payload as a JSON response with the given status code.
+func (ch *ChatHandler) writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		ch.log.Error("Encoding JSON response failed", "error", err)
+	}
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// GetUnreadCountsHTTP handles HTTP GET requests for the authenticated user's unread message
+// counts. It is served at /api/users/me/unread, requires a session token (see authenticate) and
+// responds with, for each room the user has read or is a member of, their last read message ID,
+// the room's latest message ID and the number of messages in between, plus the total.
+func (ch *ChatHandler) GetUnreadCountsHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := ch.authenticate(r)
+	if err != nil {
+		ch.log.Warn("Rejected unauthenticated request", "handler", "GetUnreadCountsHTTP", "remote_addr", r.RemoteAddr, "error", err)
+		writeUnauthorized(w, "A valid session token is required. Log in via POST /api/login.")
+		return
+	}
+
+	counts, err := ch.hub.UnreadCounts(r.Context(), claims.Username)
+	if err != nil {
+		ch.log.Error("Fetching unread counts failed", "user", claims.Username, "error", err)
+		http.Error(w, "Failed to fetch unread counts. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	ch.writeJSON(w, http.StatusOK, counts)
+	ch.log.Debug("Sent unread counts", "user", claims.Username, "rooms", len(counts.Rooms), "unread", counts.Total)
+}
@@ -0,0 +1,127 @@
+// Package logging builds the structured logger (log/slog) the chat server logs with, and the
+// HTTP endpoint its verbosity is adjusted through at runtime.
+//
+// Components are handed a *slog.Logger and add their own context to it with With: a "component"
+// ("main", "hub", "http" or "redis"), the Hub its "instance_id", each Client its "conn_id" and
+// "user", so that every line can be traced back to the connection it concerns. Lines about a room
+// carry its "room_id", and failures their "error", so that lines from different components can
+// be filtered alike.
+//
+// Message content is sensitive, and is only logged through Content, whose value the logger
+// redacts unless Options.LogContent is set.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ContentKey is the key of the attributes made by Content.
+const ContentKey = "content"
+
+// Formats accepted by Options.Format.
+const (
+	FormatText = "text" // logfmt-style key=value lines, easy to read in a terminal.
+	FormatJSON = "json" // One JSON object per line, for log collectors.
+)
+
+// Options configures the logger built by New.
+type Options struct {
+	// Format is FormatText or FormatJSON. Empty means FormatText.
+	Format string
+
+	// Level is the minimum level logged. It can be changed at any time, for instance through
+	// LevelHandler, and takes effect immediately. Nil means slog.LevelInfo, fixed.
+	Level *slog.LevelVar
+
+	// LogContent logs message content as is. By default, attributes made by Content are
+	// replaced by the length of their value.
+	LogContent bool
+}
+
+// New returns a logger writing to w as configured by options.
+func New(w io.Writer, options Options) (*slog.Logger, error) {
+	handlerOptions := &slog.HandlerOptions{ReplaceAttr: redactContent(options.LogContent)}
+	if options.Level != nil {
+		handlerOptions.Level = options.Level
+	}
+	switch options.Format {
+	case FormatText, "":
+		return slog.New(slog.NewTextHandler(w, handlerOptions)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, handlerOptions)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format '%s'", options.Format)
+	}
+}
+
+// ParseLevel parses a level name, such as "debug" or "WARN", or an offset from one, such as
+// "info+2", case-insensitively.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("invalid log level '%s': %w", name, err)
+	}
+	return level, nil
+}
+
+// Content returns an attribute holding message content, which is redacted unless the logger
+// was built with Options.LogContent.
+func Content(content string) slog.Attr {
+	return slog.String(ContentKey, content)
+}
+
+// redactContent returns the slog.HandlerOptions.ReplaceAttr function that redacts the
+// attributes made by Content, or nil if logContent is set.
+func redactContent(logContent bool) func(groups []string, a slog.Attr) slog.Attr {
+	if logContent {
+		return nil
+	}
+	return func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == ContentKey && a.Value.Kind() == slog.KindString {
+			return slog.String(ContentKey, fmt.Sprintf("[redacted, %d bytes]", len(a.Value.String())))
+		}
+		return a
+	}
+}
+
+// levelPayload is the body of LevelHandler's requests and responses.
+type levelPayload struct {
+	Level string `json:"level"`
+}
+
+// LevelHandler returns an HTTP handler that reports the level of level as {"level": "INFO"} on
+// GET, and sets it from a body of the same shape on PUT, replying with the new level. Changes
+// are logged to logger.
+func LevelHandler(level *slog.LevelVar, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var payload levelPayload
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				http.Error(w, "Request body must be JSON like {\"level\": \"debug\"}", http.StatusBadRequest)
+				return
+			}
+			newLevel, err := ParseLevel(strings.TrimSpace(payload.Level))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if newLevel != level.Level() {
+				logger.Warn("Log level changed", "from", level.Level().String(), "to", newLevel.String())
+				level.Set(newLevel)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(levelPayload{Level: level.Level().String()})
+	})
+}
@@ -0,0 +1,28 @@
+package logging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNewRedactsContentUnlessLogContent(t *testing.T) {
+	for _, tc := range []struct {
+		options Options
+		want    string
+	}{
+		{options: Options{}, want: `content="[redacted, 6 bytes]"`},
+		{options: Options{Format: FormatJSON}, want: `"content":"[redacted, 6 bytes]"`},
+		{options: Options{LogContent: true}, want: "content=secret"},
+	} {
+		var output bytes.Buffer
+		logger, err := New(&output, tc.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger.Info("Message received", "room_id", "general", Content("secret"))
+		if got := output.String(); !strings.Contains(got, tc.want) || (!tc.options.LogContent && strings.Contains(got, "secret")) {
+			t.Errorf("with %+v, logged %q, want %s", tc.options, got, tc.want)
+		}
+	}
+}
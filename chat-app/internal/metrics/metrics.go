@@ -0,0 +1,117 @@
+// Package metrics defines the Prometheus metrics the chat server exposes on /metrics.
+// Collectors are registered with the default Prometheus registry when the package is loaded,
+// so every package updating them shares one set, whatever the number of Hubs in the process.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// namespace prefixes the name of every metric of the chat server.
+const namespace = "chat"
+
+// Queues that can drop messages, as labels of DroppedMessages.
+const (
+	QueueRoute       = "route"        // The Hub's routeMessage channel, fed by every client's ReadPump.
+	QueueClientSend  = "client_send"  // A client's send channel, drained by its WritePump.
+	QueueRoomWorker  = "room_worker"  // A room worker's job queue, fed by the Hub.
+	QueueRemoteEvent = "remote_event" // The Hub's remoteEvents channel, fed by other instances. Local room evictions wait instead.
+)
+
+var (
+	// ConnectedClients is the number of WebSocket connections registered with the Hub.
+	ConnectedClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connected_clients",
+		Help:      "Number of WebSocket connections registered with this instance.",
+	})
+
+	// Rooms is the number of rooms with at least one local connection.
+	Rooms = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rooms",
+		Help:      "Number of rooms with at least one connection on this instance.",
+	})
+
+	// MessagesRouted counts the messages the Hub took off routeMessage, by message type.
+	// Types the Hub does not know are counted as "unknown".
+	MessagesRouted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_routed_total",
+		Help:      "Messages received from clients and routed by the Hub, by message type.",
+	}, []string{"type"})
+
+	// BroadcastFanout observes, for each message delivered to a room, how many local
+	// connections it was queued for.
+	BroadcastFanout = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "broadcast_fanout",
+		Help:      "Number of local connections each room broadcast was delivered to.",
+		Buckets:   []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000},
+	})
+
+	// DroppedMessages counts the messages dropped because a queue was full, by queue
+	// (one of the Queue constants).
+	DroppedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_messages_total",
+		Help:      "Messages dropped because the queue they were sent to was full, by queue.",
+	}, []string{"queue"})
+
+	// SlowConsumerOutcomes counts what the Hub did with the messages it could not queue for a
+	// client because its send buffer was full, by class of message ("chat", "ephemeral" or
+	// "reply") and outcome, which is the class's policy ("drop_newest", "drop_oldest" or "disconnect").
+	SlowConsumerOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slow_consumer_outcomes_total",
+		Help:      "Messages that found a client's send queue full, by class of message and outcome.",
+	}, []string{"class", "outcome"})
+
+	// ForcedUnregisters counts the connections the Hub scheduled for unregistration because
+	// they could not keep up with the messages sent to them.
+	ForcedUnregisters = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "forced_unregisters_total",
+		Help:      "Connections unregistered by the Hub because their send queue was full.",
+	})
+
+	// RateLimited counts the messages rejected by a rate limit, by class of message ("text",
+	// "typing" or "stats").
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_messages_total",
+		Help:      "Messages rejected because their sender exceeded a rate limit, by class of message.",
+	}, []string{"class"})
+
+	// RateLimitDisconnects counts the connections closed for exceeding their rate limits too often.
+	RateLimitDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_disconnects_total",
+		Help:      "Connections closed because they repeatedly exceeded their rate limits.",
+	})
+
+	// RedisCallDuration observes the latency of the Redis commands and pipelines issued by each
+	// RedisClient method.
+	RedisCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_call_duration_seconds",
+		Help:      "Latency of the Redis calls made by each RedisClient method.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16), // 100µs to about 3s.
+	}, []string{"method"})
+
+	// RedisCallErrors counts the Redis calls that failed, by RedisClient method. Missing keys
+	// (redis.Nil) are not errors.
+	RedisCallErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_call_errors_total",
+		Help:      "Redis calls that failed, by RedisClient method.",
+	}, []string{"method"})
+
+	// UpgradeFailures counts the WebSocket upgrade requests that were refused or failed, by reason.
+	UpgradeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_upgrade_failures_total",
+		Help:      "WebSocket upgrade requests that were refused or failed, by reason.",
+	}, []string{"reason"})
+)
@@ -0,0 +1,97 @@
+// Package tracing sets up OpenTelemetry tracing for the chat server, and gives the other
+// packages the tracer their spans are started with.
+//
+// Spans are exported by the exporter chosen at startup (see NewExporter): OTLP over HTTP to a
+// collector, JSON on standard output, or none. Tests can install an in-memory exporter, such as
+// go.opentelemetry.io/otel/sdk/trace/tracetest's InMemoryExporter, with Init, and assert on the
+// spans it recorded without a collector.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer of the chat server's spans.
+const instrumentationName = "github.com/yebrai/go-chat"
+
+// Exporters accepted by NewExporter.
+const (
+	ExporterNone   = "none"   // Spans are still created, so trace contexts propagate, but not exported.
+	ExporterOTLP   = "otlp"   // OTLP over HTTP, configured by the standard OTEL_EXPORTER_OTLP_* variables.
+	ExporterStdout = "stdout" // Pretty-printed JSON on standard output, for development.
+)
+
+// Tracer returns the tracer the chat server starts its spans with. Until Init is called, it is
+// the global no-op tracer, so spans cost next to nothing.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// NewExporter returns the span exporter named kind: ExporterOTLP, ExporterStdout, or
+// ExporterNone, for which it returns nil.
+func NewExporter(ctx context.Context, kind string) (sdktrace.SpanExporter, error) {
+	switch kind {
+	case ExporterNone:
+		return nil, nil
+	case ExporterOTLP:
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+		}
+		return exporter, nil
+	case ExporterStdout:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout trace exporter: %w", err)
+		}
+		return exporter, nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter '%s'", kind)
+	}
+}
+
+// Init installs a global tracer provider that sends every span to exporter in batches, tagged
+// with serviceName, and the W3C trace context propagator that carries traces across HTTP
+// requests, WebSocket messages and instances. A nil exporter installs only the propagator.
+// The returned provider must be shut down on exit, to flush the spans still buffered; it is
+// nil if exporter is.
+func Init(exporter sdktrace.SpanExporter, serviceName string) *sdktrace.TracerProvider {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if exporter == nil {
+		return nil
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider
+}
+
+// Inject returns the trace context of ctx as a map, to be carried by a message.
+// It returns nil if ctx has no span to propagate.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns a context carrying the trace context of carrier, as made by Inject, so that
+// spans started with it continue that trace. A nil or empty carrier gives context.Background().
+func Extract(carrier map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(carrier))
+}
@@ -2,10 +2,18 @@ package websocket
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yebrai/go-chat/internal/logging"
+	"github.com/yebrai/go-chat/internal/metrics"
+	"github.com/yebrai/go-chat/internal/tracing"
 )
 
 const (
@@ -22,25 +30,108 @@ const (
 // Client represents a connected WebSocket client. It acts as a bridge
 // between the WebSocket connection and the central Hub. Each client runs
 // in its own goroutines for reading and writing messages.
+// A user may have several Clients at once (tabs, devices), all sharing one session.
 type Client struct {
 	hub           *Hub            // Reference to the central Hub.
 	conn          *websocket.Conn // The underlying WebSocket connection.
 	send          chan *Message   // Buffered channel for outbound messages to this client.
-	username      string          // Username of the connected user.
-	currentRoomID string          // The ID of the room the client is currently active in.
+	id            string          // Unique ID of this connection.
+	username      string          // Username of the connected user, from their verified session token.
+	sessionID     string          // ID of the login session this connection belongs to.
+	resumeAfterID int64           // ID of the last message this client saw before reconnecting; 0 for a fresh connection.
+	// focus holds the ID of the room the client is focused on, which requests default to, as read
+	// with currentRoomID. The Hub's event loop sets it; ReadPump reads it too.
+	focus atomic.Pointer[string]
+	// subscriptions holds the rooms this connection receives, by ID, the focused room included.
+	// A room maps to true if it was subscribed to explicitly (SubscribeType), and so stays when the
+	// client moves its focus elsewhere, or to false if it was only entered through JoinRoomMessageType.
+	// It is only changed on the Hub's event loop, under the Hub's lock, which other goroutines read it under.
+	subscriptions map[string]bool
+	// joining counts, by room ID, the client's joins that the room workers are still checking, and
+	// revoked marks those of its rooms that its user was removed from meanwhile, which the joins
+	// are then refused. Both are only accessed on the Hub's event loop (see Hub.joinRoom).
+	joining map[string]int
+	revoked map[string]bool
+	// lastActivity is when the user last sent something on this connection, in Unix nanoseconds.
+	// ReadPump updates it; the Hub reads it to tell when the user has gone idle.
+	lastActivity atomic.Int64
+	// closeMessage is the close frame WritePump sends once the Hub closes send, as built by
+	// websocket.FormatCloseMessage. Nil sends an empty close frame. The Hub sets it before closing send.
+	closeMessage []byte
+	// log is the Hub's logger with the connection ID and username attached.
+	log *slog.Logger
+	// strikes is how many of the client's messages were rejected by rate limits since strikesSince.
+	// Only ReadPump accesses them.
+	strikes      int
+	strikesSince time.Time
+}
+
+// clientMessage is a message read from a specific client connection, as queued for the Hub.
+// Keeping the originating Client lets the Hub reply to the exact connection that sent
+// the message, rather than to whichever connection of the same user it finds first.
+type clientMessage struct {
+	client *Client
+	msg    *Message
+	span   trace.Span // Traces the message from its reception until the Hub has handled it.
+	// retryAfter is how long the client must wait before sending msg again, if a rate limit
+	// rejected it. The Hub then only tells the client so.
+	retryAfter time.Duration
 }
 
 // NewClient creates and returns a new Client instance.
-// It requires the Hub, the WebSocket connection, the client's username,
-// and the initial roomID the client intends to join.
-func NewClient(hub *Hub, conn *websocket.Conn, username string, initialRoomID string) *Client {
-	return &Client{
+// It requires the Hub, the WebSocket connection, the client's username and session ID,
+// and the initial roomID the client intends to join. A reconnecting client passes the ID of
+// the last message it saw in that room as lastMessageID, so that it is only sent the messages
+// it missed; a fresh connection passes 0 and is sent the room's recent messages.
+func NewClient(hub *Hub, conn *websocket.Conn, username string, sessionID string, initialRoomID string, lastMessageID int64) *Client {
+	client := &Client{
 		hub:           hub,
 		conn:          conn,
 		send:          make(chan *Message, 256), // Buffered channel for outbound messages.
+		id:            randomID(),
 		username:      username,
-		currentRoomID: initialRoomID, // Set upon connection, Hub handles actual join.
+		sessionID:     sessionID,
+		resumeAfterID: lastMessageID,
+		subscriptions: make(map[string]bool),
+		joining:       make(map[string]int),
+		revoked:       make(map[string]bool),
+	}
+	client.setCurrentRoomID(initialRoomID) // Set upon connection, Hub handles actual join.
+	client.log = hub.log.With("conn_id", client.id, "user", username)
+	client.lastActivity.Store(time.Now().UnixNano()) // Connecting counts as activity.
+	if conn != nil {
+		// Counted from creation, before the client can be registered, so that Shutdown never misses
+		// a WritePump that has yet to start. The caller must start WritePump.
+		hub.writePumps.Add(1)
+	}
+	return client
+}
+
+// ID returns the unique ID of the connection, which the client's log lines carry as conn_id.
+func (c *Client) ID() string {
+	return c.id
+}
+
+// currentRoomID returns the ID of the room the client is focused on, or "" if none. It may be
+// called from any goroutine.
+func (c *Client) currentRoomID() string {
+	if roomID := c.focus.Load(); roomID != nil {
+		return *roomID
 	}
+	return ""
+}
+
+// setCurrentRoomID focuses the client on roomID, or on no room if it is "". Only the Hub's event
+// loop may call it, once the client is registered.
+func (c *Client) setCurrentRoomID(roomID string) {
+	c.focus.Store(&roomID)
+}
+
+// subscribedTo reports whether the client receives the messages of roomID.
+// Only the Hub's event loop may call it.
+func (c *Client) subscribedTo(roomID string) bool {
+	_, ok := c.subscriptions[roomID]
+	return ok
 }
 
 // readPump pumps messages from the WebSocket connection to the Hub.
@@ -52,21 +143,24 @@ func (c *Client) ReadPump() {
 	defer func() {
 		// When readPump exits (due to error or connection close), unregister the client
 		// and close the WebSocket connection.
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done: // The Hub has shut down, and already let go of this client.
+		}
 		c.conn.Close()
-		log.Printf("CLIENT: User '%s' (room '%s') disconnected. readPump stopped.", c.username, c.currentRoomID)
+		c.log.Info("Client disconnected", "room_id", c.currentRoomID())
 	}()
 
 	c.conn.SetReadLimit(maxMessageSize)
 	// Set initial read deadline. This is refreshed by the pong handler.
 	if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
-		log.Printf("CLIENT: Error setting read deadline for %s: %v", c.username, err)
+		c.log.Warn("Setting read deadline failed", "error", err)
 		// Not returning here, as the connection might still be usable or close gracefully.
 	}
 	c.conn.SetPongHandler(func(string) error {
 		// When a pong is received, extend the read deadline.
 		if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
-			log.Printf("CLIENT: Error setting read deadline on pong for %s: %v", c.username, err)
+			c.log.Warn("Setting read deadline on pong failed", "error", err)
 			// Depending on strictness, might want to terminate connection here.
 		}
 		return nil
@@ -80,10 +174,10 @@ func (c *Client) ReadPump() {
 			// Log different types of errors. IsUnexpectedCloseError helps distinguish
 			// between normal closures (e.g., browser tab closed) and actual network issues.
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNormalClosure) {
-				log.Printf("CLIENT: User '%s' read error: %v", c.username, err)
+				c.log.Warn("Unexpected read error", "error", err)
 			} else {
 				// This could be a normal closure (e.g. CloseNormalClosure if client explicitly closes)
-				log.Printf("CLIENT: User '%s' connection closed (potentially normally): %v", c.username, err)
+				c.log.Debug("Connection closed", "error", err)
 			}
 			break // Exit the loop, which triggers unregistration via defer.
 		}
@@ -91,36 +185,63 @@ func (c *Client) ReadPump() {
 		// Unmarshal the raw message into our standard Message struct.
 		var msg Message
 		if err := json.Unmarshal(rawMessage, &msg); err != nil {
-			log.Printf("CLIENT: User '%s' sent invalid JSON: %v. Raw message: %s", c.username, err, string(rawMessage))
+			c.log.Warn("Invalid JSON received", "error", err, logging.Content(string(rawMessage)))
 			// Optionally, send an error message back to the client.
 			// This requires careful handling to avoid blocking if the client's send channel is full.
 			// Example: errorMsg := &Message{Type: ErrorMessageType, Content: "Invalid message format", Timestamp: time.Now()}
-			// select { case c.send <- errorMsg: default: log.Printf("CLIENT: Failed to send error to %s, send channel full", c.username)}
+			// select { case c.send <- errorMsg: default: c.log.Warn("Failed to send error, send channel full")}
 			continue // Skip processing this malformed message.
 		}
 
 		// Populate message with server-authoritative information.
-		msg.Username = c.username        // Sender's username from the authenticated client session.
+		msg.Username = c.username        // Sender's username from the verified session token; client-supplied values are ignored.
 		msg.Timestamp = time.Now().UTC() // Server-side timestamp for received message before routing.
+		if countsAsActivity(msg.Type) {
+			c.lastActivity.Store(msg.Timestamp.UnixNano())
+		}
 
 		// If the message type implies it's for the client's current room and RoomID is missing,
 		// set it. For messages like JoinRoom, RoomID is in payload/data.
 		if msg.RoomID == "" {
 			switch msg.Type {
 			case TextMessageType, UserTypingMessageType, RequestStatsType: // Types that implicitly target current room
-				msg.RoomID = c.currentRoomID
+				msg.RoomID = c.currentRoomID()
 			}
 		}
 		// Note: The Hub will ultimately decide which room a message is routed to or affects,
 		// especially for JoinRoomMessageType where msg.Data contains the target room.
 
+		// Trace the message until the Hub has handled it, as part of the client's trace if it sent
+		// one. The span's context replaces the client's on the message, for the spans that follow.
+		ctx, span := tracing.Tracer().Start(tracing.Extract(msg.Trace), "websocket.message",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("chat.message.type", string(msg.Type)), attribute.String("chat.user", c.username), attribute.String("chat.room", msg.RoomID)))
+		msg.Trace = tracing.Inject(ctx)
+
+		// Rejected messages still go to the Hub, which tells the client when to retry, unless the
+		// client keeps sending them; it is then disconnected.
+		retryAfter := c.takeRateLimitToken(ctx, msg.Type)
+		if retryAfter > 0 {
+			span.SetAttributes(attribute.Int64("chat.retry_after_ms", retryAfter.Milliseconds()))
+			c.log.Debug("Message rejected by rate limit", "type", msg.Type, "room_id", msg.RoomID, "retry_after", retryAfter.String())
+			if c.strikeRateLimit(msg.Timestamp) {
+				span.SetStatus(codes.Error, "rate limits repeatedly exceeded; client disconnected")
+				span.End()
+				c.closeForRateLimits()
+				break
+			}
+		}
+
 		// Send the structured message to the Hub for central processing.
 		select {
-		case c.hub.routeMessage <- &msg:
+		case c.hub.routeMessage <- &clientMessage{client: c, msg: &msg, span: span, retryAfter: retryAfter}:
 		default:
 			// Hub's routeMessage channel is full. This indicates a bottleneck in the Hub.
 			// Log this issue. Depending on design, might disconnect client or drop message.
-			log.Printf("CLIENT: Hub routeMessage channel full for user '%s'. Message of type '%s' dropped.", c.username, msg.Type)
+			c.log.Warn("Hub routeMessage channel full; message dropped", "type", msg.Type, "room_id", msg.RoomID)
+			metrics.DroppedMessages.WithLabelValues(metrics.QueueRoute).Inc()
+			span.SetStatus(codes.Error, "routeMessage channel full; message dropped")
+			span.End()
 			// To prevent client from being stuck if hub is overloaded, we might close connection here.
 			// For now, just dropping the message.
 		}
@@ -138,7 +259,8 @@ func (c *Client) WritePump() {
 		// When writePump exits, ensure the WebSocket connection is closed.
 		// Unregistration is handled by readPump's exit or Hub logic.
 		c.conn.Close()
-		log.Printf("CLIENT: User '%s' writePump stopped.", c.username)
+		c.log.Debug("writePump stopped")
+		c.hub.writePumps.Done() // Hub.Shutdown waits for the close frame to be written.
 	}()
 
 	for {
@@ -146,33 +268,36 @@ func (c *Client) WritePump() {
 		case message, ok := <-c.send:
 			// Set a deadline for writing the message to the peer.
 			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				log.Printf("CLIENT: Error setting write deadline for %s: %v", c.username, err)
+				c.log.Warn("Setting write deadline failed", "error", err)
 				return // Assume connection is broken.
 			}
 			if !ok {
 				// The Hub closed the client's send channel. This signifies that the client
 				// should be disconnected. Send a WebSocket close message.
-				log.Printf("CLIENT: Hub closed send channel for user '%s'. Sending close message.", c.username)
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.log.Debug("Hub closed send channel; sending close message")
+				closeMessage := c.closeMessage
+				if closeMessage == nil {
+					closeMessage = []byte{}
+				}
+				_ = c.conn.WriteMessage(websocket.CloseMessage, closeMessage)
 				return
 			}
 
 			// Write the message to the WebSocket connection as JSON.
 			if err := c.conn.WriteJSON(message); err != nil {
-				log.Printf("CLIENT: Error writing JSON to user '%s': %v", c.username, err)
+				c.log.Warn("Writing message failed", "type", message.Type, "error", err)
 				// Assume connection is broken. readPump will likely catch this and unregister.
 				return
 			}
-			log.Printf("CLIENT: Sent message type '%s' to user '%s' in room '%s'", message.Type, c.username, message.RoomID)
 
 		case <-ticker.C:
 			// Send a ping message to the peer.
 			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				log.Printf("CLIENT: Error setting write deadline for ping to %s: %v", c.username, err)
+				c.log.Warn("Setting write deadline for ping failed", "error", err)
 				return
 			}
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Printf("CLIENT: Error sending ping to user '%s': %v", c.username, err)
+				c.log.Warn("Sending ping failed", "error", err)
 				return // Assume connection is broken.
 			}
 		}
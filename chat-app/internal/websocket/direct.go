@@ -0,0 +1,127 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/auth"
+	"github.com/yebrai/go-chat/internal/cache"
+)
+
+// maxConversationsListed is the most conversations returned in a conversation list.
+const maxConversationsListed = 100
+
+// handleDirectMessage stores a direct message in the conversation between its sender and the
+// user named in msg.To, and delivers it to every connection of both users on every instance.
+// Like room messages, it is acknowledged to the sending connection once stored, and retries
+// with the same ClientMsgID are not stored twice. Message IDs are per conversation. Once
+// validated, the message is stored and delivered on the conversation's worker, which keeps the
+// conversation's messages in order.
+func (h *Hub) handleDirectMessage(client *Client, msg *Message) {
+	msg.System = false
+	msg.RoomID = "" // Direct messages belong to a conversation, not to a room.
+	if !auth.ValidUsername(msg.To) || msg.To == msg.Username {
+		client.log.Warn("Direct message to an invalid recipient; discarding", "to", msg.To)
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Direct messages need a valid recipient other than yourself in 'to'.", ClientMsgID: msg.ClientMsgID, Timestamp: time.Now().UTC()})
+		return
+	}
+	if !h.validClientMsgID(client, msg) {
+		return
+	}
+	h.runOnWorker(conversationKey(msg.Username, msg.To), client, msg, func(ctx context.Context) {
+		h.storeDirectMessage(ctx, client, msg)
+	})
+}
+
+// conversationKey identifies the conversation between two users, whichever of them sends.
+func conversationKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return "dm:" + a + ":" + b
+}
+
+// storeDirectMessage stores and delivers a direct message for handleDirectMessage, on the
+// conversation's worker.
+func (h *Hub) storeDirectMessage(ctx context.Context, client *Client, msg *Message) {
+	id, err := h.store.NextDirectMessageID(ctx, msg.Username, msg.To)
+	if err != nil {
+		client.log.Error("Reserving direct message ID failed", "to", msg.To, "error", err)
+		h.sendMessageNotStored(client, msg)
+		return
+	}
+	msg.ID = id
+
+	if h.acknowledgeIfDuplicate(ctx, client, msg) {
+		return
+	}
+
+	messageJSON, err := storedJSON(msg)
+	if err != nil {
+		client.log.Error("Marshalling direct message failed", "to", msg.To, "error", err)
+		h.forgetClientMessageID(msg)
+		h.sendMessageNotStored(client, msg)
+		return
+	}
+	if err := h.store.AppendDirectMessage(ctx, msg.Username, msg.To, msg.ID, string(messageJSON), maxMessageLogSize); err != nil {
+		client.log.Error("Storing direct message failed", "to", msg.To, "message_id", msg.ID, "error", err)
+		h.forgetClientMessageID(msg)
+		h.sendMessageNotStored(client, msg)
+		return
+	}
+	if err := h.store.RecordConversation(ctx, msg.Username, msg.To, msg.Timestamp); err != nil {
+		client.log.Error("Updating conversation lists failed", "to", msg.To, "error", err)
+	}
+
+	client.log.Debug("Direct message stored", "to", msg.To, "message_id", msg.ID)
+	h.sendAck(client, msg, msg.ID, false)
+
+	// Deliver to both participants, so that the sender's other tabs and devices see it too.
+	for _, username := range []string{msg.Username, msg.To} {
+		h.deliverToUser(username, msg)
+		h.publishUserEvent(username, msg)
+	}
+}
+
+// deliverToUser sends a message to every local connection of a user.
+// Connections that cannot keep up are handled by the slow consumer policy of the message's class.
+func (h *Hub) deliverToUser(username string, msg *Message) {
+	h.mu.RLock() // Held while sending, so that no send channel is closed meanwhile.
+	defer h.mu.RUnlock()
+	for c := range h.sessions[username] {
+		h.queueMessage(c, msg)
+	}
+}
+
+// handleListConversations answers a client's ListConversationsType request (msg), on a worker
+// of its own: the list is the user's, not a room's.
+func (h *Hub) handleListConversations(client *Client, msg *Message) {
+	h.runOnWorker("user:"+client.username, client, msg, func(ctx context.Context) {
+		list, err := ListConversations(ctx, h.store, client.username)
+		if err != nil {
+			client.log.Error("Listing conversations failed", "error", err)
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Failed to list your conversations.", Timestamp: time.Now().UTC()})
+			return
+		}
+		h.sendToClient(client, &Message{
+			Type:      ConversationListType,
+			Data:      list,
+			Timestamp: time.Now().UTC(),
+			System:    true,
+		})
+	})
+}
+
+// ListConversations returns a user's direct conversations, most recently active first.
+func ListConversations(ctx context.Context, store cache.DirectMessageStore, username string) (*ConversationListPayload, error) {
+	conversations, err := store.GetConversations(ctx, username, maxConversationsListed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conversations of user '%s': %w", username, err)
+	}
+	list := &ConversationListPayload{Conversations: make([]ConversationSummary, len(conversations))}
+	for i, c := range conversations {
+		list.Conversations[i] = ConversationSummary{Peer: c.Peer, LastMessageAt: c.LastMessageAt}
+	}
+	return list, nil
+}
@@ -0,0 +1,225 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/cache"
+)
+
+const (
+	// DefaultMessageEditWindow is how long after sending a message its author may edit or delete
+	// it, unless the Hub is configured otherwise.
+	DefaultMessageEditWindow = 15 * time.Minute
+
+	// maxMessageEdits is the most earlier versions kept in a message's edit history.
+	maxMessageEdits = 50
+
+	// maxRewriteAttempts is how many times a message rewrite is retried when the message changed
+	// concurrently, e.g. because it was edited on another instance at the same time.
+	maxRewriteAttempts = 3
+)
+
+// Errors returned by the message editing operations.
+var (
+	ErrNotMessageAuthor  = errors.New("only the message's author can do this")
+	ErrEditWindowExpired = errors.New("the message can no longer be changed")
+	ErrInvalidEdit       = errors.New("invalid message edit")
+	ErrMuted             = errors.New("muted in this room")
+)
+
+// EditMessage replaces the content of a chat message of a room on behalf of actor, who must be
+// its author, within the Hub's edit window. The previous content is kept in the message's edit
+// history and the message gets an EditedAt time. The room is notified with a MessageEditedType
+// carrying the message as now stored.
+func (h *Hub) EditMessage(ctx context.Context, roomID string, actor string, messageID int64, content string) error {
+	if strings.TrimSpace(content) == "" {
+		return fmt.Errorf("%w: content cannot be empty", ErrInvalidEdit)
+	}
+	var previous MessageVersion
+	edited, err := h.rewriteMessage(ctx, roomID, messageID, func(message *Message) (*Message, error) {
+		if message.Deleted || message.Type != TextMessageType {
+			return nil, fmt.Errorf("%w: message %d cannot be edited", ErrInvalidEdit, messageID)
+		}
+		if err := h.authorizeMessageChange(ctx, roomID, actor, message, false); err != nil {
+			return nil, err
+		}
+		if message.Content == content {
+			return nil, nil
+		}
+		previous = MessageVersion{Content: message.Content, WrittenAt: message.Timestamp}
+		if message.EditedAt != nil {
+			previous.WrittenAt = *message.EditedAt
+		}
+		now := time.Now().UTC()
+		message.Content = content
+		message.EditedAt = &now
+		return message, nil
+	})
+	if err != nil || edited == "" {
+		return err
+	}
+
+	versionJSON, err := json.Marshal(previous)
+	if err != nil {
+		h.log.Error("Marshalling previous version of message failed", "room_id", roomID, "message_id", messageID, "error", err)
+	} else if err := h.store.AddMessageEdit(ctx, roomID, messageID, string(versionJSON), maxMessageEdits); err != nil {
+		h.log.Error("Saving previous version of message failed", "room_id", roomID, "message_id", messageID, "error", err)
+	}
+	h.log.Info("Message edited", "room_id", roomID, "message_id", messageID, "actor", actor)
+	h.broadcastSystemEventToRoom(roomID, fmt.Sprintf("'%s' edited a message.", actor), actor, MessageEditedType,
+		MessageRefPayload{RoomID: roomID, MessageID: messageID, Message: json.RawMessage(edited)})
+	return nil
+}
+
+// DeleteMessage deletes a message of a room on behalf of actor, who must be its author, within
+// the Hub's edit window, or one of the room's moderators, at any time. The message is replaced
+// in the history by a tombstone that keeps its ID, author, timestamp and thread, and is
+// unpinned; its edit history and reactions are dropped. The room is notified with a MessageDeletedType.
+// Deleting a message twice is a no-op.
+func (h *Hub) DeleteMessage(ctx context.Context, roomID string, actor string, messageID int64) error {
+	var author string
+	tombstone, err := h.rewriteMessage(ctx, roomID, messageID, func(message *Message) (*Message, error) {
+		if message.Deleted {
+			return nil, nil
+		}
+		if err := h.authorizeMessageChange(ctx, roomID, actor, message, true); err != nil {
+			return nil, err
+		}
+		author = message.Username
+		return &Message{
+			ID:          message.ID,
+			Type:        message.Type,
+			Username:    message.Username,
+			RoomID:      message.RoomID,
+			Timestamp:   message.Timestamp,
+			ParentID:    message.ParentID,
+			ReplyCount:  message.ReplyCount,
+			LastReplyAt: message.LastReplyAt,
+			Deleted:     true,
+			DeletedBy:   actor,
+		}, nil
+	})
+	if err != nil || tombstone == "" {
+		return err
+	}
+
+	if _, err := h.store.UnpinMessage(ctx, roomID, messageID); err != nil {
+		h.log.Error("Unpinning deleted message failed", "room_id", roomID, "message_id", messageID, "error", err)
+	}
+	if err := h.store.DeleteMessageEdits(ctx, roomID, messageID); err != nil {
+		h.log.Error("Deleting edit history of deleted message failed", "room_id", roomID, "message_id", messageID, "error", err)
+	}
+	if err := h.store.DeleteReactions(ctx, roomID, messageID); err != nil {
+		h.log.Error("Deleting reactions to deleted message failed", "room_id", roomID, "message_id", messageID, "error", err)
+	}
+	if err := h.store.RemoveFromTimeline(ctx, roomID, messageID); err != nil {
+		h.log.Error("Removing deleted message from room timeline failed", "room_id", roomID, "message_id", messageID, "error", err)
+	}
+	h.log.Info("Message deleted", "room_id", roomID, "message_id", messageID, "author", author, "actor", actor)
+	content := fmt.Sprintf("A message by '%s' was deleted by '%s'.", author, actor)
+	if author == actor {
+		content = fmt.Sprintf("'%s' deleted a message.", actor)
+	}
+	h.broadcastSystemEventToRoom(roomID, content, actor, MessageDeletedType,
+		MessageRefPayload{RoomID: roomID, MessageID: messageID})
+	return nil
+}
+
+// rewriteMessage reads a message from a room's log, passes it to change and stores the message
+// change returns in its place, returning it as stored. If change returns nil, nothing is
+// rewritten and "" is returned. Since the message is only replaced if it is unchanged since it
+// was read, the read-change-write cycle is retried a few times if it changed concurrently.
+func (h *Hub) rewriteMessage(ctx context.Context, roomID string, messageID int64, change func(message *Message) (*Message, error)) (string, error) {
+	for attempt := 0; attempt < maxRewriteAttempts; attempt++ {
+		message, messageJSON, err := h.loggedMessage(ctx, roomID, messageID)
+		if err != nil {
+			return "", err
+		}
+		rewritten, err := change(message)
+		if err != nil || rewritten == nil {
+			return "", err
+		}
+		rewrittenJSON, err := json.Marshal(rewritten)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal message %d of room '%s': %w", messageID, roomID, err)
+		}
+		replaced, err := h.store.ReplaceMessage(ctx, roomID, messageID, messageJSON, string(rewrittenJSON))
+		if err != nil {
+			return "", fmt.Errorf("failed to rewrite message %d of room '%s': %w", messageID, roomID, err)
+		}
+		if replaced {
+			return string(rewrittenJSON), nil
+		}
+		h.log.Warn("Message changed while being rewritten; retrying", "room_id", roomID, "message_id", messageID)
+	}
+	return "", fmt.Errorf("message %d of room '%s' kept changing while being rewritten", messageID, roomID)
+}
+
+// authorizeMessageChange checks that actor may change a message of a room. Authors may change
+// their own messages within the Hub's edit window, as long as they can still access the room,
+// it is not archived and they are not muted in it. If moderatorsAllowed, the room's moderators
+// may change any message at any time.
+func (h *Hub) authorizeMessageChange(ctx context.Context, roomID string, actor string, message *Message, moderatorsAllowed bool) error {
+	if moderatorsAllowed {
+		_, err := h.moderatedRoom(ctx, roomID, actor)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrNotModerator) && !errors.Is(err, ErrRoomNotFound) {
+			return err
+		}
+		if message.Username != actor {
+			return fmt.Errorf("%w: '%s'", ErrNotModerator, roomID)
+		}
+	}
+	if message.Username != actor {
+		return fmt.Errorf("%w: message %d", ErrNotMessageAuthor, message.ID)
+	}
+
+	room, err := h.CheckRoomAccess(ctx, roomID, actor)
+	if err != nil {
+		return err
+	}
+	if room != nil && room.Archived {
+		return fmt.Errorf("%w: '%s'", ErrRoomArchived, roomID)
+	}
+	if window := h.options.MessageEditWindow; window > 0 && time.Since(message.Timestamp) > window {
+		return fmt.Errorf("%w: it was sent more than %s ago", ErrEditWindowExpired, window)
+	}
+	if room != nil {
+		reason, err := h.muteReason(ctx, roomID, actor)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			return fmt.Errorf("%w: '%s'", ErrMuted, roomID)
+		}
+	}
+	return nil
+}
+
+// GetMessageEdits returns the edit history of a message of a room: its earlier versions, oldest
+// first. Versions that cannot be decoded are skipped, and logged to logger. Callers are
+// responsible for checking the requester's access to the room.
+func GetMessageEdits(ctx context.Context, store cache.MessageLogStore, logger *slog.Logger, roomID string, messageID int64) (*MessageEditsPayload, error) {
+	versions, err := store.GetMessageEdits(ctx, roomID, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get edits of message %d of room '%s': %w", messageID, roomID, err)
+	}
+	payload := &MessageEditsPayload{RoomID: roomID, MessageID: messageID, Versions: make([]MessageVersion, 0, len(versions))}
+	for _, versionJSON := range versions {
+		var version MessageVersion
+		if err := json.Unmarshal([]byte(versionJSON), &version); err != nil {
+			logger.Warn("Skipping unreadable version of message", "room_id", roomID, "message_id", messageID, "error", err)
+			continue
+		}
+		payload.Versions = append(payload.Versions, version)
+	}
+	return payload, nil
+}
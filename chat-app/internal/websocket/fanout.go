@@ -0,0 +1,171 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yebrai/go-chat/internal/metrics"
+	"github.com/yebrai/go-chat/internal/tracing"
+)
+
+// hubEvent is the envelope a Hub publishes to the store's Pub/Sub so that other Hub
+// instances sharing the same store can deliver the wrapped message to their local clients.
+type hubEvent struct {
+	Origin  string            `json:"origin"`          // Instance ID of the publishing Hub, used to drop our own echoes.
+	Message *Message          `json:"message"`         // The message to deliver to local clients.
+	Trace   map[string]string `json:"trace,omitempty"` // Trace context of the span that published the event. Defaults to the message's.
+	User    string            `json:"-"`               // For events received on a user's channel, the user to deliver to. Set from the channel.
+}
+
+// publishRoomEvent fans a room message out to every other instance subscribed to the room.
+// Their deliveries are traced as children of the span ctx carries. Publishing is bounded by the
+// Hub's StoreTimeout, since ctx may carry no deadline of its own.
+func (h *Hub) publishRoomEvent(ctx context.Context, msg *Message) {
+	ctx, cancel := context.WithTimeout(ctx, h.options.StoreTimeout)
+	defer cancel()
+	payload, err := json.Marshal(hubEvent{Origin: h.instanceID, Message: msg, Trace: tracing.Inject(ctx)})
+	if err != nil {
+		h.log.Error("Marshalling room event failed", "room_id", msg.RoomID, "type", msg.Type, "error", err)
+		return
+	}
+	if err := h.store.PublishRoomEvent(ctx, msg.RoomID, string(payload)); err != nil {
+		h.log.Error("Publishing room event failed", "room_id", msg.RoomID, "type", msg.Type, "error", err)
+	}
+}
+
+// publishGlobalEvent fans a message addressed to all clients out to every other instance.
+func (h *Hub) publishGlobalEvent(msg *Message) {
+	ctx, cancel := h.messageContext(msg)
+	defer cancel()
+	payload, err := json.Marshal(hubEvent{Origin: h.instanceID, Message: msg})
+	if err != nil {
+		h.log.Error("Marshalling global event failed", "type", msg.Type, "error", err)
+		return
+	}
+	if err := h.store.PublishGlobalEvent(ctx, string(payload)); err != nil {
+		h.log.Error("Publishing global event failed", "type", msg.Type, "error", err)
+	}
+}
+
+// publishUserEvent fans a message addressed to one user out to every other instance where that user is connected.
+func (h *Hub) publishUserEvent(username string, msg *Message) {
+	ctx, cancel := h.messageContext(msg)
+	defer cancel()
+	payload, err := json.Marshal(hubEvent{Origin: h.instanceID, Message: msg})
+	if err != nil {
+		h.log.Error("Marshalling user event failed", "user", username, "type", msg.Type, "error", err)
+		return
+	}
+	if err := h.store.PublishUserEvent(ctx, username, string(payload)); err != nil {
+		h.log.Error("Publishing user event failed", "user", username, "type", msg.Type, "error", err)
+	}
+}
+
+// listenForRemoteEvents reads events published by other instances and hands them
+// to the Hub's event loop. Events published by this instance are discarded, since
+// they were already delivered locally when they were broadcast.
+// This method runs in its own goroutine for the lifetime of the subscription.
+func (h *Hub) listenForRemoteEvents() {
+	for event := range h.events.Events() {
+		var envelope hubEvent
+		if err := json.Unmarshal([]byte(event.Payload), &envelope); err != nil {
+			h.log.Error("Unmarshalling remote event failed", "room_id", event.RoomID, "error", err)
+			continue
+		}
+		if envelope.Origin == h.instanceID || envelope.Message == nil {
+			continue // Our own echo, or an empty envelope.
+		}
+		// Never trust the envelope to pick the room or user; the channel it arrived on is authoritative.
+		if event.Username != "" {
+			envelope.User = event.Username
+		} else {
+			envelope.Message.RoomID = event.RoomID
+		}
+
+		h.queueRemoteEvent(&envelope)
+	}
+	h.log.Info("Remote event subscription closed")
+}
+
+// queueRemoteEvent hands an event received from another instance to the Hub's event loop
+// without blocking, dropping it if the loop is too far behind, so that the Pub/Sub subscription
+// is never held up. Evictions by this instance are not dropped (see evictFromRoom).
+func (h *Hub) queueRemoteEvent(event *hubEvent) {
+	select {
+	case h.remoteEvents <- event:
+	default:
+		h.log.Warn("Remote event channel full; event dropped", "room_id", event.Message.RoomID, "user", event.User, "type", event.Message.Type)
+		metrics.DroppedMessages.WithLabelValues(metrics.QueueRemoteEvent).Inc()
+	}
+}
+
+// handleRemoteEvent delivers a message published by another instance to local clients only.
+// It must not re-publish the message, or instances would echo events back and forth.
+// The Hub also queues its own RemovedFromRoomType events here, to evict local connections.
+func (h *Hub) handleRemoteEvent(event *hubEvent) {
+	carrier := event.Trace
+	if carrier == nil {
+		carrier = event.Message.Trace
+	}
+	_, span := tracing.Tracer().Start(tracing.Extract(carrier), "hub.remote_event",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("chat.message.type", string(event.Message.Type)), attribute.String("chat.room", event.Message.RoomID), attribute.String("chat.user", event.User)))
+	defer span.End()
+	switch {
+	case event.User != "" && event.Message.Type == RemovedFromRoomType:
+		h.removeUserFromRoom(event.User, event.Message)
+	case event.User != "":
+		h.deliverToUser(event.User, event.Message)
+	case event.Message.RoomID != "":
+		span.SetAttributes(attribute.Int("chat.recipients", h.deliverToRoom(event.Message)))
+	default:
+		h.deliverToAllClients(event.Message)
+	}
+}
+
+// subscribeRoom starts receiving events other instances publish for a room.
+// It is called when the first local client joins the room.
+func (h *Hub) subscribeRoom(ctx context.Context, roomID string) {
+	if h.events == nil {
+		return
+	}
+	if err := h.events.SubscribeRoom(ctx, roomID); err != nil {
+		h.log.Error("Subscribing to room events failed", "room_id", roomID, "error", err)
+	}
+}
+
+// unsubscribeRoom stops receiving events for a room.
+// It is called when the last local client leaves the room.
+func (h *Hub) unsubscribeRoom(ctx context.Context, roomID string) {
+	if h.events == nil {
+		return
+	}
+	if err := h.events.UnsubscribeRoom(ctx, roomID); err != nil {
+		h.log.Error("Unsubscribing from room events failed", "room_id", roomID, "error", err)
+	}
+}
+
+// subscribeUser starts receiving events other instances publish for a user.
+// It is called when the user's first local connection registers.
+func (h *Hub) subscribeUser(ctx context.Context, username string) {
+	if h.events == nil {
+		return
+	}
+	if err := h.events.SubscribeUser(ctx, username); err != nil {
+		h.log.Error("Subscribing to user events failed", "user", username, "error", err)
+	}
+}
+
+// unsubscribeUser stops receiving events for a user.
+// It is called when the user's last local connection unregisters.
+func (h *Hub) unsubscribeUser(ctx context.Context, username string) {
+	if h.events == nil {
+		return
+	}
+	if err := h.events.UnsubscribeUser(ctx, username); err != nil {
+		h.log.Error("Unsubscribing from user events failed", "user", username, "error", err)
+	}
+}
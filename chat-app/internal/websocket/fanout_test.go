@@ -0,0 +1,69 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/cache"
+)
+
+// echoWait is how long tests wait to be sure a message is not delivered a second time.
+const echoWait = 200 * time.Millisecond
+
+func TestRoomMessageFansOutToOtherHubsOnce(t *testing.T) {
+	store := cache.NewMemoryStore()
+	alice := connectTestClient(t, newTestHub(t, store, HubOptions{}), "alice", "general")
+	bob := connectTestClient(t, newTestHub(t, store, HubOptions{}), "bob", "general")
+	bob.joined(t, "general") // Bob's Hub has subscribed to the room's events by then.
+
+	alice.post(&Message{Type: TextMessageType, RoomID: "general", Content: "hello", ClientMsgID: "c1"})
+	ack := alice.next(t, AckMessageType)
+	id := ack.Data.(AckPayload).MessageID
+	for _, c := range []*testClient{alice, bob} {
+		msg := c.next(t, TextMessageType)
+		if msg.ID != id || msg.Content != "hello" || msg.Username != "alice" {
+			t.Errorf("%s received message %d %q from %s, want message %d %q from alice", c.username, msg.ID, msg.Content, msg.Username, id, "hello")
+		}
+		c.none(t, TextMessageType, echoWait)
+	}
+}
+
+func TestDirectMessageFansOutToRecipientOnOtherHub(t *testing.T) {
+	store := cache.NewMemoryStore()
+	alice := connectTestClient(t, newTestHub(t, store, HubOptions{}), "alice", "")
+	bob := connectTestClient(t, newTestHub(t, store, HubOptions{}), "bob", "")
+	bob.next(t, GlobalUserCountUpdateType) // Sent once bob's Hub has subscribed to his events.
+
+	alice.post(&Message{Type: DirectMessageType, To: "bob", Content: "psst", ClientMsgID: "d1"})
+	alice.next(t, AckMessageType)
+	msg := bob.next(t, DirectMessageType)
+	if msg.Content != "psst" || msg.Username != "alice" {
+		t.Errorf("bob received %q from %s, want %q from alice", msg.Content, msg.Username, "psst")
+	}
+	bob.none(t, DirectMessageType, echoWait)
+}
+
+func TestHubDropsItsOwnEchoes(t *testing.T) {
+	store := cache.NewMemoryStore()
+	hubA := newTestHub(t, store, HubOptions{})
+	alice := connectTestClient(t, hubA, "alice", "general")
+	bob := connectTestClient(t, newTestHub(t, store, HubOptions{}), "bob", "general")
+	alice.joined(t, "general") // Both Hubs have subscribed to the room's events by then.
+	bob.joined(t, "general")
+
+	// An event hubA published reaches every Hub subscribed to the room, hubA included, which
+	// already delivered it to its own clients.
+	payload, err := json.Marshal(hubEvent{Origin: hubA.instanceID, Message: &Message{Type: TextMessageType, ID: 42, RoomID: "general", Content: "echo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PublishRoomEvent(context.Background(), "general", string(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if msg := bob.next(t, TextMessageType); msg.ID != 42 {
+		t.Errorf("bob received message %d, want 42", msg.ID)
+	}
+	alice.none(t, TextMessageType, echoWait)
+}
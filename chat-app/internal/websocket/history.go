@@ -0,0 +1,239 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/auth"
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/logging"
+)
+
+const (
+	// DefaultHistoryPageSize is the number of messages returned per history page when the client does not ask for a size.
+	DefaultHistoryPageSize = 50
+
+	// MaxHistoryPageSize is the largest history page a client may request.
+	MaxHistoryPageSize = 100
+
+	// maxResumeReplayMessages is the most messages replayed to a reconnecting client. If it missed
+	// more than that, it is told to reload the room's history instead.
+	maxResumeReplayMessages = 200
+
+	// maxMessageLogSize bounds the durable per-room message log. The oldest messages beyond it are dropped.
+	maxMessageLogSize = 10000
+)
+
+// ErrInvalidCursor is returned by LoadHistory when the 'before' cursor cannot be parsed.
+var ErrInvalidCursor = errors.New("invalid history cursor")
+
+// LoadHistory reads one page of a room's message history from the durable message log,
+// with the reactions to its messages.
+// before is a cursor returned as NextCursor by a previous page (the ID of the oldest message
+// the client already has); an empty cursor returns the newest page. Because cursors are message
+// IDs rather than offsets, pages stay stable while new messages arrive.
+// limit <= 0 means DefaultHistoryPageSize; larger values are capped at MaxHistoryPageSize.
+// Reactions that cannot be read are left out, and logged to logger.
+func LoadHistory(ctx context.Context, store cache.Store, logger *slog.Logger, roomID string, before string, limit int) (*HistoryPayload, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	page, err := loadHistoryPage(func(beforeID int64, limit int) ([]string, error) {
+		return store.GetMessagesBefore(ctx, roomID, beforeID, limit)
+	}, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load history of room '%s': %w", roomID, err)
+	}
+	page.RoomID = roomID
+	// Thread replies share the room's log but not its timeline. They are dropped after the
+	// cursor is set, so a page may hold fewer than limit messages (even none) and still HasMore.
+	page.Messages = withoutThreadReplies(page.Messages)
+	page.Reactions = messageReactions(ctx, store, logger, roomID, page.Messages)
+	return page, nil
+}
+
+// LoadDirectHistory reads one page of the direct conversation between username and peer,
+// with the same cursor and limit semantics as LoadHistory.
+func LoadDirectHistory(ctx context.Context, store cache.DirectMessageStore, username string, peer string, before string, limit int) (*HistoryPayload, error) {
+	if username == "" || peer == "" {
+		return nil, fmt.Errorf("usernames cannot be empty")
+	}
+	page, err := loadHistoryPage(func(beforeID int64, limit int) ([]string, error) {
+		return store.GetDirectMessagesBefore(ctx, username, peer, beforeID, limit)
+	}, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load conversation between '%s' and '%s': %w", username, peer, err)
+	}
+	page.Peer = peer
+	return page, nil
+}
+
+// loadHistoryPage parses a history cursor and limit, reads one page using fetch (which must
+// return messages older than beforeID, newest first) and returns it oldest first.
+func loadHistoryPage(fetch func(beforeID int64, limit int) ([]string, error), before string, limit int) (*HistoryPayload, error) {
+	var beforeID int64
+	if before != "" {
+		id, err := strconv.ParseInt(before, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("%w: '%.40s'", ErrInvalidCursor, before)
+		}
+		beforeID = id
+	}
+	if limit <= 0 {
+		limit = DefaultHistoryPageSize
+	}
+	if limit > MaxHistoryPageSize {
+		limit = MaxHistoryPageSize
+	}
+
+	// Fetch one extra message to find out whether an older page exists.
+	newestFirst, err := fetch(beforeID, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	hasMore := len(newestFirst) > limit
+	if hasMore {
+		newestFirst = newestFirst[:limit]
+	}
+
+	page := &HistoryPayload{Messages: make([]json.RawMessage, 0, len(newestFirst)), HasMore: hasMore}
+	for i := len(newestFirst) - 1; i >= 0; i-- { // Return the page oldest first, in reading order.
+		page.Messages = append(page.Messages, json.RawMessage(newestFirst[i]))
+	}
+	if hasMore {
+		var oldest struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.Unmarshal(page.Messages[0], &oldest); err != nil {
+			return nil, fmt.Errorf("failed to read ID of logged message: %w", err)
+		}
+		if oldest.ID <= 0 {
+			return nil, fmt.Errorf("logged message has no ID")
+		}
+		page.NextCursor = strconv.FormatInt(oldest.ID, 10)
+	}
+	return page, nil
+}
+
+// handleLoadHistory answers a client's LoadHistoryType request with one page of history:
+// of the direct conversation with msg.To if set, otherwise of a room, which defaults to the
+// client's current room. The page is read on the room's or the conversation's worker.
+func (h *Hub) handleLoadHistory(client *Client, msg *Message) {
+	var request LoadHistoryData
+	if msg.Content != "" {
+		if err := json.Unmarshal([]byte(msg.Content), &request); err != nil {
+			client.log.Warn("Invalid request data", "type", msg.Type, "error", err, logging.Content(msg.Content))
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Invalid load history request format.", Timestamp: time.Now().UTC()})
+			return
+		}
+	}
+	if msg.To != "" {
+		h.handleLoadDirectHistory(client, msg, request)
+		return
+	}
+	roomID := msg.RoomID
+	if roomID == "" {
+		roomID = client.currentRoomID()
+	}
+	if roomID == "" {
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "RoomID required for history request.", Timestamp: time.Now().UTC()})
+		return
+	}
+
+	h.runOnWorker(roomID, client, msg, func(ctx context.Context) {
+		if _, err := h.CheckRoomAccess(ctx, roomID, client.username); err != nil {
+			client.log.Warn("Reading history refused", "room_id", roomID, "error", err)
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: roomJoinErrorText(err), RoomID: roomID, Timestamp: time.Now().UTC()})
+			return
+		}
+		page, err := LoadHistory(ctx, h.store, client.log, roomID, request.Before, request.Limit)
+		if err != nil {
+			client.log.Error("Loading history failed", "room_id", roomID, "error", err)
+			content := "Failed to load history for " + roomID
+			if errors.Is(err, ErrInvalidCursor) {
+				content = "Invalid history cursor."
+			}
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: content, RoomID: roomID, Timestamp: time.Now().UTC()})
+			return
+		}
+		client.log.Debug("Sending history", "room_id", roomID, "count", len(page.Messages), "has_more", page.HasMore)
+		h.sendToClient(client, &Message{
+			Type:      HistoryType,
+			RoomID:    roomID,
+			Data:      page,
+			Timestamp: time.Now().UTC(),
+			System:    true,
+		})
+	})
+}
+
+// handleLoadDirectHistory answers a LoadHistoryType request (msg) for the client's direct
+// conversation with msg.To.
+func (h *Hub) handleLoadDirectHistory(client *Client, msg *Message, request LoadHistoryData) {
+	peer := msg.To
+	if !auth.ValidUsername(peer) {
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Invalid username in 'to'.", Timestamp: time.Now().UTC()})
+		return
+	}
+	h.runOnWorker(conversationKey(client.username, peer), client, msg, func(ctx context.Context) {
+		page, err := LoadDirectHistory(ctx, h.store, client.username, peer, request.Before, request.Limit)
+		if err != nil {
+			client.log.Error("Loading conversation failed", "peer", peer, "error", err)
+			content := "Failed to load your conversation with " + peer
+			if errors.Is(err, ErrInvalidCursor) {
+				content = "Invalid history cursor."
+			}
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: content, To: peer, Timestamp: time.Now().UTC()})
+			return
+		}
+		h.sendToClient(client, &Message{
+			Type:      HistoryType,
+			To:        peer,
+			Data:      page,
+			Timestamp: time.Now().UTC(),
+			System:    true,
+		})
+	})
+}
+
+// replayMissedMessages sends a reconnecting client the messages posted to roomID after the
+// last one it saw (afterID), oldest first, as a MissedMessagesType. If the gap is larger than
+// maxResumeReplayMessages, or cannot be read, the client gets a ResyncRequiredType instead and
+// is expected to discard its copy of the room and reload the history.
+func (h *Hub) replayMissedMessages(ctx context.Context, client *Client, roomID string, afterID int64) {
+	missed, err := h.store.GetMessagesAfter(ctx, roomID, afterID, maxResumeReplayMessages+1)
+	if err != nil || len(missed) > maxResumeReplayMessages {
+		if err != nil {
+			client.log.Error("Reading missed messages failed", "room_id", roomID, "after_id", afterID, "error", err)
+		} else {
+			client.log.Info("Missed too many messages; asking for a resync", "room_id", roomID, "after_id", afterID, "limit", maxResumeReplayMessages)
+		}
+		h.sendToClient(client, &Message{
+			Type:      ResyncRequiredType,
+			RoomID:    roomID,
+			Data:      ResumePayload{RoomID: roomID, AfterID: afterID},
+			Timestamp: time.Now().UTC(),
+			System:    true,
+		})
+		return
+	}
+
+	messages := make([]json.RawMessage, len(missed))
+	for i, m := range missed {
+		messages[i] = json.RawMessage(m)
+	}
+	messages = withoutThreadReplies(messages) // Followers get missed replies by loading the thread.
+	client.log.Debug("Replaying missed messages", "room_id", roomID, "after_id", afterID, "count", len(messages))
+	h.sendToClient(client, &Message{
+		Type:      MissedMessagesType,
+		RoomID:    roomID,
+		Data:      ResumePayload{RoomID: roomID, AfterID: afterID, Messages: messages, Reactions: messageReactions(ctx, h.store, client.log, roomID, messages)},
+		Timestamp: time.Now().UTC(),
+		System:    true,
+	})
+}
@@ -2,13 +2,23 @@ package websocket
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/logging"
+	"github.com/yebrai/go-chat/internal/metrics"
+	"github.com/yebrai/go-chat/internal/tracing"
 )
 
 const (
@@ -25,38 +35,156 @@ const (
 
 	// maxRecentMessagesToSend is the maximum number of recent messages sent to a client upon joining a room.
 	maxRecentMessagesToSend = 20 // Can be same or less than maxRecentMessagesToStore
+
+	// clientMsgIDTTL is how long a client-supplied message ID is remembered to de-duplicate retries.
+	clientMsgIDTTL = 10 * time.Minute
+
+	// maxClientMsgIDLength is the longest client-supplied message ID accepted, in bytes.
+	maxClientMsgIDLength = 64
+
+	// sessionClaimTTL is how long a connected session's username claim lives without being refreshed.
+	// If this instance dies, the username becomes available again after at most this long.
+	sessionClaimTTL = 5 * time.Minute
+
+	// sessionClaimRefreshInterval is how often the Hub refreshes the username claims of its sessions.
+	sessionClaimRefreshInterval = time.Minute
 )
 
+// HubOptions configures optional Hub behaviour. The zero value gives the defaults.
+type HubOptions struct {
+	// RequireRegisteredRooms forbids joining or posting to rooms that were never created
+	// through the room registry. By default, joining an unknown room registers it.
+	RequireRegisteredRooms bool
+
+	// MessageEditWindow is how long after sending a message its author may edit or delete it.
+	// Zero means DefaultMessageEditWindow; a negative value removes the limit. Moderators may
+	// delete messages at any time.
+	MessageEditWindow time.Duration
+
+	// ReadReceipts broadcasts a ReadReceiptType to a room whenever one of its users marks it as
+	// read, so authors can see who has read their messages. Read markers and unread counts are
+	// kept either way.
+	ReadReceipts bool
+
+	// AwayAfter is how long a user must be idle on all their connections before users who chose
+	// to be online are shown as away. Zero means DefaultAwayAfter; a negative value disables it.
+	AwayAfter time.Duration
+
+	// TextRateLimits limit how many text and direct messages each connection and each user may
+	// send. Zero limits mean those of DefaultTextRateLimits.
+	TextRateLimits RateLimits
+
+	// TypingRateLimits limit how many typing notifications each connection and each user may
+	// send. Zero limits mean those of DefaultTypingRateLimits.
+	TypingRateLimits RateLimits
+
+	// StatsRateLimits limit how many room stats requests each connection and each user may send.
+	// Zero limits mean those of DefaultStatsRateLimits.
+	StatsRateLimits RateLimits
+
+	// SlowConsumerPolicies decide, for each class of messages, what happens to a message for a
+	// client whose send buffer is full. Zero policies mean those of DefaultSlowConsumerPolicies.
+	SlowConsumerPolicies SlowConsumerPolicies
+
+	// RoomWorkers is how many workers run the store calls made for the messages posted to rooms
+	// and conversations, and for room stats, off the event loop. Each room is handled by one of
+	// them, so that its messages stay in order. Zero means DefaultRoomWorkers.
+	RoomWorkers int
+
+	// StoreTimeout bounds the store calls the room workers make for each message, and those the
+	// event loop makes as clients connect, disconnect, join and leave rooms. Zero means
+	// DefaultStoreTimeout.
+	StoreTimeout time.Duration
+
+	// Logger is what the Hub and its clients log with. Each client logs with its connection ID
+	// and username attached. Nil means slog.Default().
+	Logger *slog.Logger
+}
+
 // Hub maintains the set of active clients, manages chat rooms,
-// and broadcasts messages to the appropriate clients. It uses a RedisClient
-// for persisting certain data like recent messages and room user lists.
+// and broadcasts messages to the appropriate clients. It uses a cache.Store
+// (Redis in production) for persisting certain data like recent messages and
+// room user lists, and the store's Pub/Sub to share room events with other Hub instances.
 type Hub struct {
 	clients      map[*Client]bool            // Actively connected clients.
+	sessions     map[string]map[*Client]bool // Map of username to the set of that user's local connections.
 	rooms        map[string]map[*Client]bool // Map of roomID to a set of clients in that room.
 	register     chan *Client                // Channel for clients wishing to register.
 	unregister   chan *Client                // Channel for clients wishing to unregister.
-	routeMessage chan *Message               // Channel for messages from clients to be processed by the Hub.
-	redisClient  *cache.RedisClient          // Client for interacting with Redis cache/store.
-	mu           sync.RWMutex                // Mutex to protect concurrent access to `clients` and `rooms` maps.
+	routeMessage chan *clientMessage         // Channel for messages from clients to be processed by the Hub.
+	remoteEvents chan *hubEvent              // Channel for events published by other Hub instances (and room evictions by this one).
+	loopJobs     chan func()                 // Channel for the results of room worker jobs, which the event loop applies (see onLoop).
+	store        cache.Store                 // Persistence backend for messages, presence and counters.
+	events       cache.EventSubscription     // Pub/Sub subscription for events from other instances. Nil if unavailable.
+	instanceID   string                      // Unique ID of this Hub, used to ignore our own Pub/Sub echoes.
+	options      HubOptions                  // Optional behaviour, fixed at creation.
+	activity     map[string]*userActivity    // Map of username to the activity of that user's local connections. Only accessed on the event loop.
+	leased       bool                        // Whether this Hub has recorded a heartbeat. Only accessed by heartbeat.
+	shutdown     chan struct{}               // Closed to ask the event loop to disconnect every client and stop.
+	done         chan struct{}               // Closed once the event loop has stopped.
+	closing      atomic.Bool                 // Whether Shutdown was called. New connections are refused from then on.
+	workers      *roomWorkers                // Run the Hub's store calls off the event loop.
+	writePumps   sync.WaitGroup              // Counts the clients whose WritePump has not returned yet.
+	log          *slog.Logger                // Logs with the instance ID attached.
+	mu           sync.RWMutex                // Mutex to protect concurrent access to `clients`, `sessions` and `rooms` maps.
 }
 
 // NewHub creates and returns a new Hub instance.
-// It requires a `cache.RedisClient` for its operations.
+// It requires a `cache.Store` for its operations, such as a `cache.RedisClient`
+// or, for a standalone instance, a `cache.MemoryStore`, and the options to run with.
 // The Hub's `Run` method should be started as a goroutine after creation.
-func NewHub(redisClient *cache.RedisClient) *Hub {
-	if redisClient == nil {
+func NewHub(store cache.Store, options HubOptions) *Hub {
+	if store == nil {
 		// This is a critical dependency, so panic or fatal log is appropriate.
-		log.Fatal("HUB: Redis client cannot be nil for Hub initialization")
+		panic("websocket: store cannot be nil for Hub initialization")
+	}
+	if options.MessageEditWindow == 0 {
+		options.MessageEditWindow = DefaultMessageEditWindow
+	}
+	if options.AwayAfter == 0 {
+		options.AwayAfter = DefaultAwayAfter
+	}
+	options.TextRateLimits = options.TextRateLimits.withDefaults(DefaultTextRateLimits)
+	options.TypingRateLimits = options.TypingRateLimits.withDefaults(DefaultTypingRateLimits)
+	options.StatsRateLimits = options.StatsRateLimits.withDefaults(DefaultStatsRateLimits)
+	options.SlowConsumerPolicies = options.SlowConsumerPolicies.withDefaults(DefaultSlowConsumerPolicies)
+	if options.RoomWorkers <= 0 {
+		options.RoomWorkers = DefaultRoomWorkers
+	}
+	if options.StoreTimeout <= 0 {
+		options.StoreTimeout = DefaultStoreTimeout
+	}
+	if options.Logger == nil {
+		options.Logger = slog.Default()
 	}
 	h := &Hub{
 		clients:      make(map[*Client]bool),
+		sessions:     make(map[string]map[*Client]bool),
 		rooms:        make(map[string]map[*Client]bool),
-		register:     make(chan *Client),       // Unbuffered, registration should be handled promptly.
-		unregister:   make(chan *Client),       // Unbuffered.
-		routeMessage: make(chan *Message, 256), // Buffered to handle bursts of messages.
-		redisClient:  redisClient,
+		register:     make(chan *Client),             // Unbuffered, registration should be handled promptly.
+		unregister:   make(chan *Client),             // Unbuffered.
+		routeMessage: make(chan *clientMessage, 256), // Buffered to handle bursts of messages.
+		remoteEvents: make(chan *hubEvent, 256),      // Buffered to absorb bursts from other instances.
+		loopJobs:     make(chan func(), 256),         // Buffered so that room workers rarely wait for the loop.
+		store:        store,
+		instanceID:   randomID(),
+		options:      options,
+		activity:     make(map[string]*userActivity),
+		workers:      newRoomWorkers(options.RoomWorkers),
+		shutdown:     make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	h.log = options.Logger.With("component", "hub", "instance_id", h.instanceID)
+
+	// Subscribe to events from other instances. Without a subscription the Hub still works,
+	// but only clients connected to this instance will see each other's messages.
+	events, err := store.SubscribeEvents(context.Background())
+	if err != nil {
+		h.log.Error("Subscribing to store events failed; running without cross-instance fan-out", "error", err)
+	} else {
+		h.events = events
 	}
-	log.Println("HUB: Hub instance created successfully.")
+	h.log.Info("Hub created")
 	return h
 }
 
@@ -64,15 +192,19 @@ func NewHub(redisClient *cache.RedisClient) *Hub {
 // to register a new client with the Hub. It sends the client to the Hub's internal `register` channel.
 func (h *Hub) RegisterClient(client *Client) {
 	if client == nil {
-		log.Println("HUB_ERROR: Attempted to register a nil client.")
+		h.log.Error("Attempted to register a nil client")
 		return
 	}
-	log.Printf("HUB: Queuing client %s for registration.", client.username)
+	client.log.Debug("Queuing client for registration")
 	select {
 	case h.register <- client:
-		log.Printf("HUB: Client %s successfully queued for registration.", client.username)
+		client.log.Debug("Client queued for registration")
+	case <-h.done:
+		client.log.Warn("Hub has shut down; refusing client")
+		close(client.send)
+		_ = client.conn.Close()
 	case <-time.After(2 * time.Second): // Timeout to prevent blocking indefinitely if Run() isn't active.
-		log.Printf("HUB_ERROR: Registration timeout for client %s. Hub may not be running or register channel full.", client.username)
+		client.log.Error("Registration timed out; the Hub may not be running")
 		close(client.send)      // Close client's send channel to signal error and stop its writePump.
 		_ = client.conn.Close() // Close WebSocket connection.
 	}
@@ -80,355 +212,914 @@ func (h *Hub) RegisterClient(client *Client) {
 
 // Run starts the Hub's main event processing loop.
 // It listens on its channels for client registrations, unregistrations,
-// and incoming messages, and processes them accordingly.
-// This method should be run as a goroutine.
+// and incoming messages, and processes them accordingly. Apart from the first heartbeat, taken
+// before the loop starts, its store calls are all made by the room workers (see roomWorkers).
+// This method should be run as a goroutine. It returns once Shutdown has disconnected every client.
 func (h *Hub) Run() {
-	log.Println("HUB: Starting event loop...")
+	h.log.Info("Starting event loop")
+	defer close(h.done)
+	if h.events != nil {
+		go h.listenForRemoteEvents()
+	}
+	claimRefreshTicker := time.NewTicker(sessionClaimRefreshInterval)
+	defer claimRefreshTicker.Stop()
+	presenceTicker := time.NewTicker(presenceCheckInterval)
+	defer presenceTicker.Stop()
+	ctx, cancel := h.storeContext()
+	h.heartbeat(ctx) // Take the lease on our connections before accepting any.
+	cancel()
+	heartbeatTicker := time.NewTicker(instanceHeartbeatInterval)
+	defer heartbeatTicker.Stop()
 	for {
 		select {
 		case client := <-h.register:
 			h.handleClientRegistration(client)
 		case client := <-h.unregister:
 			h.handleClientUnregistration(client)
-		case message := <-h.routeMessage:
-			h.handleIncomingMessage(message)
+		case in := <-h.routeMessage:
+			h.routeClientMessage(in)
+		case event := <-h.remoteEvents:
+			h.handleRemoteEvent(event)
+		case job := <-h.loopJobs:
+			job()
+		case <-claimRefreshTicker.C:
+			h.refreshSessionClaims()
+		case <-presenceTicker.C:
+			h.checkIdleUsers()
+		case <-heartbeatTicker.C:
+			h.onRoomWorker(instanceWorkerKey, func(ctx context.Context) {
+				h.heartbeat(ctx)
+				h.reapDeadInstances(ctx)
+			})
+		case <-h.shutdown:
+			h.disconnectAll()
+			h.log.Info("Event loop stopped")
+			return
 		}
 	}
 }
 
 // handleClientRegistration processes a new client registration.
-// It adds the client to the global client list, adds the user to the global Redis set,
-// broadcasts the updated global user count, and then attempts to join the client
-// to their specified initial room.
+// It adds the client to the global client list and to its user's session, and then attempts to
+// join the client to their specified initial room. The connection is recorded in the global
+// Redis set, and the global user count updated, on the user's room worker (see recordConnection).
 func (h *Hub) handleClientRegistration(client *Client) {
 	h.mu.Lock()
 	h.clients[client] = true
+	if _, ok := h.sessions[client.username]; !ok {
+		h.sessions[client.username] = make(map[*Client]bool)
+	}
+	h.sessions[client.username][client] = true
+	localConnections := len(h.sessions[client.username])
 	h.mu.Unlock()
-	log.Printf("HUB: Client '%s' (room: '%s') registered with Hub.", client.username, client.currentRoomID)
+	metrics.ConnectedClients.Inc()
+	client.log.Info("Client registered", "room_id", client.currentRoomID(), "local_connections", localConnections)
 
-	// Add user to global set in Redis.
-	if err := h.redisClient.AddUserToGlobalSet(context.Background(), client.username); err != nil {
-		log.Printf("HUB_ERROR: Adding user '%s' to global Redis set: %v", client.username, err)
+	if localConnections == 1 {
+		h.activity[client.username] = &userActivity{}
 	}
-	h.broadcastGlobalUserCount() // Inform all clients about the new global user count.
+	h.mustRunOnWorker(userWorkerKey(client.username), func(ctx context.Context) {
+		h.recordConnection(ctx, client, localConnections == 1)
+	})
 
 	// Handle initial room join for the client.
-	if client.currentRoomID != "" {
-		h.handleClientJoinRoom(client, client.currentRoomID)
+	if roomID := client.currentRoomID(); roomID != "" {
+		h.joinRoom(client, nil, roomID, func(room *cache.Room) {
+			if client.currentRoomID() == roomID { // Unless the client joined another room meanwhile.
+				h.handleClientJoinRoom(client, room, false)
+			}
+		}, func() {
+			if client.currentRoomID() == roomID {
+				client.setCurrentRoomID("") // The room was archived or removed since the connection was accepted.
+			}
+		})
 	} else {
-		log.Printf("HUB: Client '%s' connected without specifying an initial room.", client.username)
+		client.log.Debug("Client connected without an initial room")
 		// Optionally, send a welcome message or instructions to the client.
 		// client.send <- &Message{Type: SystemMessage, Content: "Welcome! Please join a room." ...}
 	}
 }
 
+// recordConnection records a newly registered connection of client's user in the store, for
+// handleClientRegistration, on the user's room worker. firstLocal tells whether it is the user's
+// first connection to this instance.
+func (h *Hub) recordConnection(ctx context.Context, client *Client, firstLocal bool) {
+	if firstLocal {
+		h.subscribeUser(ctx, client.username) // Start receiving the user's direct messages from other instances.
+	}
+
+	// Keep the username reserved for this session for as long as it has connections.
+	if _, err := h.store.ClaimUsername(ctx, client.username, client.sessionID, sessionClaimTTL); err != nil {
+		client.log.Error("Refreshing username claim failed", "error", err)
+	}
+
+	// Add this connection of the user to the global set in Redis.
+	connections, err := h.store.AddUserToGlobalSet(ctx, h.instanceID, client.username)
+	if err != nil {
+		client.log.Error("Adding user to global set failed", "error", err)
+	}
+	if connections == 1 {
+		// The user just came online: whatever was recorded when they were last connected is stale.
+		if err := h.store.SetUserIdle(ctx, client.username, false); err != nil {
+			client.log.Error("Clearing idle state failed", "error", err)
+		}
+		if err := h.store.TouchUserLastSeen(ctx, client.username, time.Now()); err != nil {
+			client.log.Error("Recording last seen time failed", "error", err)
+		}
+	}
+	if connections == 1 || err != nil {
+		h.broadcastGlobalUserCount(ctx) // The user just came online: inform all clients about the new global user count.
+	} else if countMsg, err := h.globalUserCountMessage(ctx); err == nil {
+		h.sendToClient(client, countMsg) // Count is unchanged; only the new connection needs it.
+	}
+	if connections == 1 {
+		h.broadcastPresence(ctx, client.username)
+	}
+}
+
 // handleClientUnregistration processes a client unregistration.
-// It ensures the client is removed from any room they were in,
-// removes the user from global Redis sets, updates and broadcasts global user count,
-// closes the client's send channel, and removes the client from the Hub's active list.
+// It ensures the client is removed from any room they were in, closes the client's send channel,
+// and removes the client from the Hub's active list. This connection of the user is then removed
+// from the global Redis sets on the user's room worker (see forgetConnection).
 func (h *Hub) handleClientUnregistration(client *Client) {
 	h.mu.Lock()
 	isRegistered := h.clients[client] // Check if client is actually in the map.
+	lastLocalConnection := false
 	if isRegistered {
 		delete(h.clients, client)
+		delete(h.sessions[client.username], client)
+		if len(h.sessions[client.username]) == 0 {
+			delete(h.sessions, client.username)
+			lastLocalConnection = true
+		}
 		close(client.send) // Important: Close the send channel to stop writePump and signal cleanup.
-		log.Printf("HUB: Client '%s' unregistered from Hub.", client.username)
+		metrics.ConnectedClients.Dec()
+		client.log.Info("Client unregistered")
 	}
 	h.mu.Unlock() // Unlock before potentially long-running or lock-acquiring operations.
 
 	if isRegistered { // Only proceed if client was part of the hub.
-		// Ensure client leaves their current room. `true` indicates a full disconnect.
-		if client.currentRoomID != "" {
-			h.handleClientLeaveRoom(client, client.currentRoomID, true)
+		// Ensure client leaves every room it is subscribed to. `true` indicates a full disconnect.
+		rooms := client.subscribedRooms()
+		for _, roomID := range rooms {
+			h.handleClientLeaveRoom(client, roomID, true)
+		}
+		if lastLocalConnection {
+			delete(h.activity, client.username)
 		}
+		h.mustRunOnWorker(userWorkerKey(client.username), func(ctx context.Context) {
+			h.forgetConnection(ctx, client, lastLocalConnection, rooms)
+		})
+	}
+}
+
+// forgetConnection removes an unregistered connection of client's user from the store, for
+// handleClientUnregistration, on the user's room worker. lastLocal tells whether it was the user's
+// last connection to this instance, and rooms are those it was subscribed to. The user only goes
+// offline (and their username is released) once their last connection, on any instance, is gone.
+func (h *Hub) forgetConnection(ctx context.Context, client *Client, lastLocal bool, rooms []string) {
+	if lastLocal {
+		h.unsubscribeUser(ctx, client.username)
+	}
 
-		// Remove user from global set in Redis.
-		if err := h.redisClient.RemoveUserFromGlobalSet(context.Background(), client.username); err != nil {
-			log.Printf("HUB_ERROR: Removing user '%s' from global Redis set: %v", client.username, err)
+	// Remove this connection of the user from the global set in Redis.
+	remaining, err := h.store.RemoveUserFromGlobalSet(ctx, h.instanceID, client.username)
+	if err != nil {
+		client.log.Error("Removing user from global set failed", "error", err)
+		return
+	}
+	if remaining > 0 {
+		client.log.Debug("User still has open connections", "connections", remaining)
+		return
+	}
+
+	// That was the user's last connection: free their username and update the global count.
+	if err := h.store.ReleaseUsername(ctx, client.username, client.sessionID); err != nil {
+		client.log.Error("Releasing username failed", "error", err)
+	}
+	h.broadcastGlobalUserCount(ctx) // Update global user count for all remaining clients.
+
+	// The user went offline: they were last seen now, and so are shown to their rooms.
+	if err := h.store.TouchUserLastSeen(ctx, client.username, time.Now()); err != nil {
+		client.log.Error("Recording last seen time failed", "error", err)
+	}
+	if err := h.store.SetUserIdle(ctx, client.username, false); err != nil {
+		client.log.Error("Clearing idle state failed", "error", err)
+	}
+	h.broadcastPresence(ctx, client.username, rooms...)
+}
+
+// refreshSessionClaims extends the username claims of every session with a local connection,
+// so that usernames stay reserved while in use and lapse soon after an instance dies.
+func (h *Hub) refreshSessionClaims() {
+	h.mu.RLock()
+	sessions := make(map[string]string, len(h.sessions)) // username -> sessionID
+	for username, conns := range h.sessions {
+		for c := range conns {
+			sessions[username] = c.sessionID
+			break
 		}
-		h.broadcastGlobalUserCount() // Update global user count for all remaining clients.
 	}
+	h.mu.RUnlock()
+	if len(sessions) == 0 {
+		return
+	}
+
+	h.onRoomWorker(instanceWorkerKey, func(context.Context) {
+		for username, sessionID := range sessions {
+			ctx, cancel := h.storeContext() // Each claim gets its own StoreTimeout, however many there are.
+			claimed, err := h.store.ClaimUsername(ctx, username, sessionID, sessionClaimTTL)
+			cancel()
+			if err != nil {
+				h.log.Error("Refreshing username claim failed", "user", username, "error", err)
+			} else if !claimed {
+				h.log.Warn("Username is now claimed by another session", "user", username)
+			}
+		}
+	})
 }
 
 // handleIncomingMessage processes a message received from a client via the `routeMessage` channel.
-// It routes the message based on its `Type`.
-func (h *Hub) handleIncomingMessage(msg *Message) {
-	log.Printf("HUB: Routing message type '%s' from user '%s' for room '%s'. Content: '%.50s'", msg.Type, msg.Username, msg.RoomID, msg.Content)
+// It routes the message based on its `Type`. Replies go to the connection that sent the message.
+func (h *Hub) handleIncomingMessage(client *Client, msg *Message) {
+	client.log.Debug("Routing message", "type", msg.Type, "room_id", msg.RoomID, logging.Content(msg.Content))
 
 	// Server should always set the timestamp for messages it processes or broadcasts.
 	msg.Timestamp = time.Now().UTC()
 
-	client := h.findClientByUsername(msg.Username) // Find the client instance.
-	if client == nil && msg.Type != "" {           // Allow empty type for potential internal messages? No, client messages must have type.
-		log.Printf("HUB_WARN: Message received from unknown or unregistered user '%s'. Type: '%s'. Discarding.", msg.Username, msg.Type)
+	h.mu.RLock()
+	isRegistered := h.clients[client]
+	h.mu.RUnlock()
+	if !isRegistered { // The connection may have been unregistered while its message was queued.
+		client.log.Warn("Message received from unregistered connection; discarding", "type", msg.Type)
 		return
 	}
+	if countsAsActivity(msg.Type) {
+		h.noteActivity(client)
+	}
+	routedType := string(msg.Type) // Counted once routed; unknown types share one label.
+	defer func() { metrics.MessagesRouted.WithLabelValues(routedType).Inc() }()
 
 	switch msg.Type {
 	case TextMessageType:
 		if msg.RoomID == "" || msg.Username == "" {
-			log.Printf("HUB_WARN: Text message missing RoomID ('%s') or Username ('%s'). Discarding.", msg.RoomID, msg.Username)
+			client.log.Warn("Text message missing room ID or username; discarding", "room_id", msg.RoomID)
 			if client != nil {
-				client.send <- &Message{Type: ErrorMessageType, Content: "Your message could not be sent: RoomID or Username was missing.", Timestamp: time.Now().UTC()}
+				h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Your message could not be sent: RoomID or Username was missing.", Timestamp: time.Now().UTC()})
 			}
 			return
 		}
-		msg.System = false // Ensure it's marked as a user-generated message.
-
-		messageJSON, err := json.Marshal(msg) // Serialize the websocket.Message for storage.
-		if err != nil {
-			log.Printf("HUB_ERROR: Marshalling text message to JSON for Redis (user '%s', room '%s'): %v", msg.Username, msg.RoomID, err)
-			return // Don't proceed if we can't store it.
-		}
-
-		// Persist message to Redis recent messages list.
-		err = h.redisClient.AddRecentMessage(context.Background(), msg.RoomID, string(messageJSON), maxRecentMessagesToStore, 0) // Use default TTL from cache pkg
-		if err != nil {
-			log.Printf("HUB_ERROR: Adding message to Redis for room '%s' by user '%s': %v", msg.RoomID, msg.Username, err)
-		}
-
-		// Increment room message counter.
-		if _, err = h.redisClient.IncrementMessageCounter(context.Background(), msg.RoomID); err != nil {
-			log.Printf("HUB_ERROR: Incrementing message counter for room '%s': %v", msg.RoomID, err)
-		}
-
-		h.broadcastToRoom(msg)           // Broadcast the live message.
-		h.broadcastRoomStats(msg.RoomID) // Update and broadcast room stats (e.g., new message count).
+		h.handleTextMessage(client, msg)
 
 	case JoinRoomMessageType:
 		var joinData JoinRoomData
 		// Assuming client sends JoinRoomData as JSON string in msg.Content
 		if err := json.Unmarshal([]byte(msg.Content), &joinData); err != nil {
-			log.Printf("HUB_ERROR: Unmarshalling join_room data from user '%s': %v. Raw content: '%s'", msg.Username, err, msg.Content)
+			client.log.Warn("Invalid join_room data", "error", err, logging.Content(msg.Content))
 			if client != nil {
-				client.send <- &Message{Type: ErrorMessageType, Content: "Invalid join room request format.", Timestamp: time.Now().UTC()}
+				h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Invalid join room request format.", Timestamp: time.Now().UTC()})
 			}
 			return
 		}
 		if client == nil { // Should have been caught earlier, but double check.
-			log.Printf("HUB_ERROR: Client '%s' not found for join_room request to room '%s'.", msg.Username, joinData.RoomID)
+			h.log.Error("Client not found for join_room request", "user", msg.Username, "room_id", joinData.RoomID)
 			return
 		}
 		if joinData.RoomID == "" {
-			log.Printf("HUB_WARN: User '%s' attempted to join an empty RoomID.", msg.Username)
-			client.send <- &Message{Type: ErrorMessageType, Content: "Cannot join an empty RoomID.", Timestamp: time.Now().UTC()}
+			client.log.Warn("Attempted to join an empty room ID")
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Cannot join an empty RoomID.", Timestamp: time.Now().UTC()})
 			return
 		}
-
-		if client.currentRoomID != "" && client.currentRoomID != joinData.RoomID {
-			log.Printf("HUB: Client '%s' leaving room '%s' to join '%s'.", client.username, client.currentRoomID, joinData.RoomID)
-			h.handleClientLeaveRoom(client, client.currentRoomID, false) // `false` means not a full disconnect.
-		}
-		h.handleClientJoinRoom(client, joinData.RoomID)
+		// Check before leaving, so a refused join keeps the client where it was.
+		h.joinRoom(client, msg, joinData.RoomID, func(room *cache.Room) {
+			// join_room moves the client's focus. The room it leaves is only unsubscribed from if it
+			// was entered through join_room too, as single-room clients expect.
+			previous := client.currentRoomID()
+			if previous != "" && previous != room.ID && !client.subscriptions[previous] {
+				client.log.Debug("Client leaving room to join another", "room_id", previous, "next_room_id", room.ID)
+				h.handleClientLeaveRoom(client, previous, false) // `false` means not a full disconnect.
+			}
+			h.handleClientJoinRoom(client, room, false)
+			h.focusRoom(client, room.ID)
+		}, nil)
 
 	case LeaveRoomMessageType: // Client explicitly wants to leave current room.
-		if client != nil && client.currentRoomID != "" {
-			log.Printf("HUB: Client '%s' leaving room '%s' by request.", client.username, client.currentRoomID)
-			h.handleClientLeaveRoom(client, client.currentRoomID, false)
-			client.currentRoomID = "" // Clear client's current room as they've left it.
+		if client != nil && client.currentRoomID() != "" {
+			client.log.Debug("Client leaving room by request", "room_id", client.currentRoomID())
+			h.handleClientLeaveRoom(client, client.currentRoomID(), false) // Also clears the client's focus.
 			// Optionally send confirmation to client: client.send <- &Message{Type: SystemMessage, Content: "You have left the room." ...}
 		}
 
 	case UserTypingMessageType:
-		if msg.RoomID != "" && msg.Username != "" {
+		if msg.RoomID != "" && msg.Username != "" && client.subscribedTo(msg.RoomID) {
 			// Content should be "start" or "stop". This is broadcast to others in the room.
-			log.Printf("HUB: User '%s' typing status '%s' in room '%s'.", msg.Username, msg.Content, msg.RoomID)
-			h.broadcastToRoom(msg) // The message itself contains all necessary info (type, username, room, content).
+			client.log.Debug("Typing status", "room_id", msg.RoomID, logging.Content(msg.Content))
+			h.broadcastFromLoop(msg) // The message itself contains all necessary info (type, username, room, content).
 		}
 
+	case LoadHistoryType:
+		h.handleLoadHistory(client, msg)
+
+	case DirectMessageType:
+		h.handleDirectMessage(client, msg)
+
+	case ListConversationsType:
+		h.handleListConversations(client, msg)
+
+	case InviteToRoomType, KickFromRoomType, BanFromRoomType, UnbanFromRoomType, SetRoomRoleType, MuteUserType, UnmuteUserType:
+		h.handleRoomMembership(client, msg)
+
+	case EditMessageType, DeleteMessageType, PinMessageType, UnpinMessageType:
+		h.handleMessageAction(client, msg)
+
+	case ListPinnedMessagesType:
+		h.handleListPinnedMessages(client, msg)
+
+	case AddReactionType, RemoveReactionType:
+		h.handleReaction(client, msg)
+
+	case LoadThreadType, FollowThreadType, UnfollowThreadType:
+		h.handleThreadRequest(client, msg)
+
+	case MarkReadType:
+		h.handleMarkRead(client, msg)
+
+	case SubscribeType, UnsubscribeType:
+		h.handleSubscription(client, msg)
+
+	case SetPresenceType:
+		h.handleSetPresence(client, msg)
+
 	case RequestStatsType:
 		if client == nil {
 			return
 		} // Should not happen if check at start of function is good.
 		targetRoomID := msg.RoomID
 		if targetRoomID == "" { // If client requests stats for their current room without specifying
-			targetRoomID = client.currentRoomID
+			targetRoomID = client.currentRoomID()
 		}
 		if targetRoomID == "" {
-			log.Printf("HUB_WARN: User '%s' requested stats for an unspecified room.", msg.Username)
-			client.send <- &Message{Type: ErrorMessageType, Content: "RoomID required for stats request.", Timestamp: time.Now().UTC()}
+			client.log.Warn("Stats requested for an unspecified room")
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "RoomID required for stats request.", Timestamp: time.Now().UTC()})
 			return
 		}
 
-		stats, err := h.redisClient.GetRoomStats(context.Background(), targetRoomID)
-		if err != nil {
-			log.Printf("HUB_ERROR: Getting room stats for '%s' (requested by '%s'): %v", targetRoomID, msg.Username, err)
-			client.send <- &Message{Type: ErrorMessageType, Content: "Failed to get room stats for " + targetRoomID, RoomID: targetRoomID, Timestamp: time.Now().UTC()}
-			return
-		}
-		log.Printf("HUB: Sending stats for room '%s' to user '%s'. Users: %d, Msgs: %d", targetRoomID, msg.Username, stats["active_users"], stats["message_count"])
-		client.send <- &Message{
-			Type:   RoomStatsUpdateType, // Send as a stats update.
-			RoomID: targetRoomID,
-			Data: RoomStatsPayload{
-				RoomID:       targetRoomID,
-				ActiveUsers:  stats["active_users"],
-				MessageCount: stats["message_count"],
-			},
-			Timestamp: time.Now().UTC(),
-			System:    true, // Stats are system-generated info.
-		}
+		// Look the stats up on the room's worker, so that the event loop does not wait on the store.
+		h.runOnWorker(targetRoomID, client, msg, func(ctx context.Context) {
+			if _, err := h.CheckRoomAccess(ctx, targetRoomID, client.username); err != nil {
+				client.log.Warn("Stats refused", "room_id", targetRoomID, "error", err)
+				h.sendToClient(client, &Message{Type: ErrorMessageType, Content: roomJoinErrorText(err), RoomID: targetRoomID, Timestamp: time.Now().UTC()})
+				return
+			}
+			stats, err := h.store.GetRoomStats(ctx, targetRoomID)
+			if err != nil {
+				client.log.Error("Getting room stats failed", "room_id", targetRoomID, "error", err)
+				h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Failed to get room stats for " + targetRoomID, RoomID: targetRoomID, Timestamp: time.Now().UTC()})
+				return
+			}
+			client.log.Debug("Sending room stats", "room_id", targetRoomID, "active_users", stats["active_users"], "message_count", stats["message_count"])
+			h.sendToClient(client, &Message{
+				Type:   RoomStatsUpdateType, // Send as a stats update.
+				RoomID: targetRoomID,
+				Data: RoomStatsPayload{
+					RoomID:       targetRoomID,
+					ActiveUsers:  stats["active_users"],
+					MessageCount: stats["message_count"],
+				},
+				Timestamp: time.Now().UTC(),
+				System:    true, // Stats are system-generated info.
+			})
+		})
 
 	default:
-		log.Printf("HUB_WARN: Unknown message type '%s' received from user '%s'. Discarding.", msg.Type, msg.Username)
+		routedType = "unknown"
+		client.log.Warn("Unknown message type; discarding", "type", msg.Type)
 		if client != nil {
 			errorMsg := &Message{
 				Type:      ErrorMessageType,
 				Content:   fmt.Sprintf("Unknown message type received: %s", msg.Type),
 				Timestamp: time.Now().UTC(),
 			}
-			client.send <- errorMsg
+			h.sendToClient(client, errorMsg)
 		}
 	}
 }
 
-// handleClientJoinRoom manages adding a client to a specific room.
-// It updates Hub's internal state, Redis store, and broadcasts relevant updates.
-func (h *Hub) handleClientJoinRoom(client *Client, roomID string) {
-	if roomID == "" {
-		log.Printf("HUB_WARN: Client '%s' attempted to join an empty/invalid roomID. Aborting join.", client.username)
-		client.send <- &Message{Type: ErrorMessageType, Content: "Invalid RoomID. Cannot join.", Timestamp: time.Now().UTC()}
+// handleTextMessage stores a chat message and broadcasts it to its room.
+// The message is assigned its stable ID, persisted to the room's log and then acknowledged to
+// the sending connection with an AckMessageType echoing the client's ClientMsgID, if any.
+// A message retried with a ClientMsgID that was already stored is acknowledged again with the
+// original ID, but not stored or broadcast a second time. If the message cannot be stored,
+// the sender gets an ErrorMessageType carrying its ClientMsgID instead and nothing is broadcast.
+// Once checked against the client's subscriptions, the message is stored and broadcast on the
+// room's worker.
+func (h *Hub) handleTextMessage(client *Client, msg *Message) {
+	msg.System = false // Ensure it's marked as a user-generated message.
+	msg.To = ""        // Room messages have no single recipient.
+	// Edits, deletions and thread summaries are managed by the server, never set by clients.
+	msg.ReplyCount, msg.LastReplyAt, msg.EditedAt = 0, nil, nil
+	msg.Deleted, msg.DeletedBy = false, ""
+	if !h.validClientMsgID(client, msg) {
+		return
+	}
+	if !client.subscribedTo(msg.RoomID) {
+		client.log.Warn("Posted to a room without being subscribed to it", "room_id", msg.RoomID)
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Join or subscribe to the room before posting to it.", RoomID: msg.RoomID, ClientMsgID: msg.ClientMsgID, Timestamp: time.Now().UTC()})
+		return
+	}
+	h.runOnWorker(msg.RoomID, client, msg, func(ctx context.Context) {
+		h.storeTextMessage(ctx, client, msg)
+	})
+}
+
+// storeTextMessage stores and broadcasts a text message for handleTextMessage, on the room's worker.
+func (h *Hub) storeTextMessage(ctx context.Context, client *Client, msg *Message) {
+	if !h.roomAcceptsMessages(ctx, client, msg) {
+		return
+	}
+	var parentAuthor string
+	if msg.ParentID != 0 {
+		parent, err := h.threadParent(ctx, msg.RoomID, msg.ParentID)
+		if err != nil {
+			client.log.Warn("Invalid reply", "room_id", msg.RoomID, "parent_id", msg.ParentID, "error", err)
+			content := "Failed to store your message. Please try again."
+			if errors.Is(err, ErrMessageNotFound) || errors.Is(err, ErrInvalidThread) {
+				content = err.Error()
+			}
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: content, RoomID: msg.RoomID, ClientMsgID: msg.ClientMsgID, Timestamp: time.Now().UTC()})
+			return
+		}
+		parentAuthor = parent.Username
+	}
+
+	// Assign the message its stable, per-room ID before it is stored or broadcast.
+	id, err := h.store.NextMessageID(ctx, msg.RoomID)
+	if err != nil {
+		client.log.Error("Reserving message ID failed", "room_id", msg.RoomID, "error", err)
+		h.sendMessageNotStored(client, msg)
+		return
+	}
+	msg.ID = id
+
+	if h.acknowledgeIfDuplicate(ctx, client, msg) {
+		return
+	}
+
+	messageJSON, err := storedJSON(msg) // Serialize the websocket.Message for storage.
+	if err != nil {
+		client.log.Error("Marshalling text message failed", "room_id", msg.RoomID, "error", err)
+		h.forgetClientMessageID(msg)
+		h.sendMessageNotStored(client, msg)
+		return // Don't proceed if we can't store it.
+	}
+
+	// Persist message to the room's durable log, which backs paginated history.
+	if err := h.store.AppendToMessageLog(ctx, msg.RoomID, msg.ID, string(messageJSON), maxMessageLogSize); err != nil {
+		client.log.Error("Appending message to room log failed", "room_id", msg.RoomID, "message_id", msg.ID, "error", err)
+		h.forgetClientMessageID(msg)
+		h.sendMessageNotStored(client, msg)
+		return
+	}
+
+	// Persist message to Redis recent messages list and index it in the room's timeline, on
+	// which unread messages are counted. Thread replies stay out of the room's timeline; they
+	// are only read through their thread.
+	if msg.ParentID == 0 {
+		err = h.store.AddRecentMessage(ctx, msg.RoomID, string(messageJSON), maxRecentMessagesToStore, 0) // Use default TTL from cache pkg
+		if err != nil {
+			client.log.Error("Adding recent message failed", "room_id", msg.RoomID, "message_id", msg.ID, "error", err)
+		}
+		if err := h.store.AddToTimeline(ctx, msg.RoomID, msg.ID, maxMessageLogSize); err != nil {
+			client.log.Error("Adding message to room timeline failed", "room_id", msg.RoomID, "message_id", msg.ID, "error", err)
+		}
+	}
+
+	// The sender has read the room up to their own message.
+	if _, err := h.store.MarkRead(ctx, msg.Username, msg.RoomID, msg.ID); err != nil {
+		client.log.Error("Marking own message as read failed", "room_id", msg.RoomID, "message_id", msg.ID, "error", err)
+	}
+
+	// Increment room message counter.
+	if _, err = h.store.IncrementMessageCounter(ctx, msg.RoomID); err != nil {
+		h.log.Error("Incrementing message counter failed", "room_id", msg.RoomID, "error", err)
+	}
+
+	h.sendAck(client, msg, msg.ID, false) // Tell the sender its message is stored.
+	if msg.ParentID != 0 {
+		h.deliverThreadReply(ctx, msg, parentAuthor) // Deliver the reply to the thread's followers.
+	} else {
+		h.broadcastToRoom(msg) // Broadcast the live message.
+	}
+	h.broadcastRoomStats(ctx, msg.RoomID) // Update and broadcast room stats (e.g., new message count).
+}
+
+// validClientMsgID checks the length of a message's ClientMsgID, telling the sender if it is too long.
+func (h *Hub) validClientMsgID(client *Client, msg *Message) bool {
+	if len(msg.ClientMsgID) <= maxClientMsgIDLength {
+		return true
+	}
+	client.log.Warn("client_msg_id too long; discarding message", "room_id", msg.RoomID, "length", len(msg.ClientMsgID))
+	h.sendToClient(client, &Message{Type: ErrorMessageType, Content: fmt.Sprintf("client_msg_id must be at most %d characters.", maxClientMsgIDLength), RoomID: msg.RoomID, Timestamp: time.Now().UTC()})
+	return false
+}
+
+// acknowledgeIfDuplicate de-duplicates retries: a client that did not see the ack for a message
+// resends it with the same ClientMsgID. It records msg.ID for the ClientMsgID and, if an earlier
+// message already holds it, acknowledges that message again and returns true.
+func (h *Hub) acknowledgeIfDuplicate(ctx context.Context, client *Client, msg *Message) bool {
+	if msg.ClientMsgID == "" {
+		return false
+	}
+	storedID, recorded, err := h.store.RecordClientMessageID(ctx, msg.Username, msg.ClientMsgID, msg.ID, clientMsgIDTTL)
+	if err != nil {
+		client.log.Error("Recording client message ID failed", "client_msg_id", msg.ClientMsgID, "error", err)
+		return false
+	}
+	if recorded {
+		return false
+	}
+	client.log.Info("Duplicate message; acknowledging again", "room_id", msg.RoomID, "message_id", storedID, "client_msg_id", msg.ClientMsgID)
+	h.sendAck(client, msg, storedID, true)
+	return true
+}
+
+// roomAcceptsMessages checks that a text message's room, which the sender is subscribed to, may
+// be posted to: the sender must still have access to it (see CheckRoomAccess), since they may have
+// been banned or removed from its members while their message waited for the room's worker, or
+// before their eviction reached the event loop; they must not be muted in it, and it must not be
+// archived. If not, the sender is sent an ErrorMessageType carrying the message's ClientMsgID.
+func (h *Hub) roomAcceptsMessages(ctx context.Context, client *Client, msg *Message) bool {
+	room, err := h.CheckRoomAccess(ctx, msg.RoomID, client.username)
+	var reason string
+	switch {
+	case errors.Is(err, ErrRoomNotFound):
+		reason = "This room does not exist."
+	case errors.Is(err, ErrBannedFromRoom):
+		reason = "You are banned from this room."
+	case errors.Is(err, ErrNotRoomMember):
+		reason = "This room is only open to its members."
+	case err != nil:
+		client.log.Error("Checking access to room failed", "room_id", msg.RoomID, "error", err)
+		h.sendMessageNotStored(client, msg)
+		return false
+	case room != nil && room.Archived:
+		reason = "This room is archived and can no longer be posted to."
+	case room != nil:
+		reason, err = h.muteReason(ctx, msg.RoomID, client.username)
+		if err != nil {
+			client.log.Error("Checking mute failed", "room_id", msg.RoomID, "error", err)
+			h.sendMessageNotStored(client, msg)
+			return false
+		}
+		if reason == "" {
+			return true
+		}
+	default:
+		return true
+	}
+	client.log.Warn("Cannot post to room", "room_id", msg.RoomID, "reason", reason)
+	h.sendToClient(client, &Message{Type: ErrorMessageType, Content: reason, RoomID: msg.RoomID, ClientMsgID: msg.ClientMsgID, Timestamp: time.Now().UTC()})
+	return false
+}
+
+// sendAck acknowledges a stored message to the connection that sent it.
+func (h *Hub) sendAck(client *Client, msg *Message, messageID int64, duplicate bool) {
+	h.sendToClient(client, &Message{
+		Type:        AckMessageType,
+		RoomID:      msg.RoomID,
+		To:          msg.To,
+		ClientMsgID: msg.ClientMsgID,
+		Data:        AckPayload{ClientMsgID: msg.ClientMsgID, MessageID: messageID, RoomID: msg.RoomID, To: msg.To, Duplicate: duplicate},
+		Timestamp:   time.Now().UTC(),
+		System:      true,
+	})
+}
+
+// sendMessageNotStored tells the sender that its message was neither stored nor delivered, so it may retry.
+func (h *Hub) sendMessageNotStored(client *Client, msg *Message) {
+	h.sendToClient(client, &Message{
+		Type:        ErrorMessageType,
+		Content:     "Your message could not be saved. Please try again.",
+		RoomID:      msg.RoomID,
+		To:          msg.To,
+		ClientMsgID: msg.ClientMsgID,
+		Timestamp:   time.Now().UTC(),
+	})
+}
+
+// forgetClientMessageID drops the de-duplication record of a message that could not be stored,
+// so that the client can retry it under the same ClientMsgID.
+func (h *Hub) forgetClientMessageID(msg *Message) {
+	if msg.ClientMsgID == "" {
 		return
 	}
-	// If client was in another room, they should be removed by caller (e.g. handleIncomingMessage for JoinRoomType)
-	// This function focuses on the "join" part.
+	// The message's own context may have expired already, which may be why it was not stored.
+	ctx, cancel := h.storeContext()
+	defer cancel()
+	if err := h.store.ForgetClientMessageID(ctx, msg.Username, msg.ClientMsgID); err != nil {
+		h.log.Error("Forgetting client message ID failed", "user", msg.Username, "client_msg_id", msg.ClientMsgID, "error", err)
+	}
+}
+
+// joinRoom checks, on the room's worker, that client may join roomID (see roomForJoin), then has
+// the event loop call admit with the room's registry record, unless the client unregistered or
+// its user was removed from the room meanwhile. If the join is refused, the client is told why
+// and refused, if not nil, is called on the event loop instead. msg is the client's request, or nil
+// for the join of the room the connection was opened with, which is checked however busy the
+// room's worker is. Only the Hub's event loop may call it.
+func (h *Hub) joinRoom(client *Client, msg *Message, roomID string, admit func(room *cache.Room), refused func()) {
+	client.joining[roomID]++
+	check := func(ctx context.Context) {
+		room, ok := h.roomForJoin(ctx, client, roomID)
+		h.onLoop(func() {
+			revoked := h.endJoin(client, roomID)
+			h.mu.RLock()
+			registered := h.clients[client]
+			h.mu.RUnlock()
+			switch {
+			case !registered:
+				return
+			case ok && revoked:
+				client.log.Info("Join refused; user was removed from the room meanwhile", "room_id", roomID)
+				h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "You were removed from this room.", RoomID: roomID, Timestamp: time.Now().UTC()})
+			case ok:
+				admit(room)
+				return
+			}
+			if refused != nil {
+				refused()
+			}
+		})
+	}
+	if msg == nil {
+		h.mustRunOnWorker(roomID, check)
+	} else if !h.runOnWorker(roomID, client, msg, check) {
+		h.endJoin(client, roomID)
+		if refused != nil {
+			refused()
+		}
+	}
+}
+
+// endJoin records that one of client's joins of roomID was decided, and reports whether its user
+// was removed from the room since the join was checked. Only the Hub's event loop may call it.
+func (h *Hub) endJoin(client *Client, roomID string) (revoked bool) {
+	revoked = client.revoked[roomID]
+	if client.joining[roomID]--; client.joining[roomID] <= 0 {
+		delete(client.joining, roomID)
+		delete(client.revoked, roomID)
+	}
+	return revoked
+}
 
-	log.Printf("HUB: Client '%s' joining room '%s'.", client.username, roomID)
+// handleClientJoinRoom manages subscribing a client to a specific room, whose registry record
+// joinRoom has obtained. explicit marks a SubscribeType subscription, which outlasts the client
+// moving its focus elsewhere; the caller sets the focus.
+// It updates Hub's internal state and sends the client the room's info; the Redis store is updated,
+// and the room told, on the room's worker (see recordJoin). A client that is already subscribed to
+// the room is only sent the room's info, recent messages and user list again.
+func (h *Hub) handleClientJoinRoom(client *Client, room *cache.Room, explicit bool) {
+	roomID := room.ID
+	client.log.Info("Joining room", "room_id", roomID)
 
 	h.mu.Lock()
-	if _, ok := h.rooms[roomID]; !ok {
+	_, roomExists := h.rooms[roomID]
+	if !roomExists {
 		h.rooms[roomID] = make(map[*Client]bool)
-		log.Printf("HUB: Room '%s' created dynamically in Hub.", roomID)
+		metrics.Rooms.Inc()
+		h.log.Debug("Room now has local clients", "room_id", roomID)
 	}
 	h.rooms[roomID][client] = true
-	client.currentRoomID = roomID // Critical: Update client's state.
+	alreadySubscribed := client.subscribedTo(roomID)
+	client.subscriptions[roomID] = explicit || client.subscriptions[roomID] // Critical: Update client's state.
 	h.mu.Unlock()
 
-	// Add user to Redis set for the room with a TTL.
-	if err := h.redisClient.AddActiveUserToRoom(context.Background(), roomID, client.username, 0); err != nil { // Use default TTL from cache pkg
-		log.Printf("HUB_ERROR: Adding user '%s' to Redis room set '%s': %v", client.username, roomID, err)
+	h.sendToClient(client, roomInfoMessage(room))
+
+	var resumeAfterID int64
+	if !alreadySubscribed {
+		resumeAfterID = client.resumeAfterID
+		client.resumeAfterID = 0 // Only the initial join resumes; later room switches start afresh.
 	}
+	h.mustRunOnWorker(roomID, func(ctx context.Context) {
+		h.recordJoin(ctx, client, roomID, !roomExists, alreadySubscribed, resumeAfterID)
+	})
+}
 
-	// Send recent messages to the newly joined client.
-	recentMsgJSONs, err := h.redisClient.GetRecentMessages(context.Background(), roomID, maxRecentMessagesToSend)
-	if err != nil {
-		log.Printf("HUB_ERROR: Getting recent messages for room '%s': %v", roomID, err)
-	} else if len(recentMsgJSONs) > 0 {
-		client.send <- &Message{
-			Type:      RecentMessagesType,
-			RoomID:    roomID,
-			Data:      RecentMessagesPayload{RoomID: roomID, Messages: recentMsgJSONs},
-			Timestamp: time.Now().UTC(),
-			System:    true,
+// recordJoin records client joining roomID in the store, for handleClientJoinRoom, on the room's
+// worker, and sends the client the room's messages. firstLocal tells whether the client is the
+// room's first local member, and resumeAfterID is the ID of the last message the client saw.
+func (h *Hub) recordJoin(ctx context.Context, client *Client, roomID string, firstLocal bool, alreadySubscribed bool, resumeAfterID int64) {
+	if firstLocal {
+		h.subscribeRoom(ctx, roomID) // First local member: start receiving the room's events from other instances.
+	}
+	if alreadySubscribed {
+		h.sendRecentMessages(ctx, client, roomID)
+		h.sendUnreadCounts(ctx, client)
+		if userListMsg, err := h.userListMessage(ctx, roomID); err == nil {
+			h.sendToClient(client, userListMsg)
 		}
-		log.Printf("HUB: Sent %d recent messages to user '%s' for room '%s'.", len(recentMsgJSONs), client.username, roomID)
+		return
+	}
+
+	// Add this connection of the user to the Redis set for the room with a TTL.
+	connections, err := h.store.AddActiveUserToRoom(ctx, h.instanceID, roomID, client.username, 0) // Use default TTL from cache pkg
+	if err != nil {
+		client.log.Error("Adding user to room set failed", "room_id", roomID, "error", err)
+	}
+
+	if resumeAfterID > 0 {
+		// A reconnecting client already has the history up to resumeAfterID: send only what it missed.
+		h.replayMissedMessages(ctx, client, roomID, resumeAfterID)
 	} else {
-		log.Printf("HUB: No recent messages in room '%s' for user '%s'.", roomID, client.username)
+		h.sendRecentMessages(ctx, client, roomID) // Send recent messages to the newly joined client.
+	}
+	h.trackRoomReads(ctx, client.username, roomID)
+	h.sendUnreadCounts(ctx, client) // Let the client badge the rooms it has unread messages in.
+
+	if connections > 1 {
+		// The user was already in the room from another connection: nothing changed for the
+		// other members, so only this connection needs the current user list and stats.
+		client.log.Debug("User already in room from other connections", "room_id", roomID, "connections", connections-1)
+		if userListMsg, err := h.userListMessage(ctx, roomID); err == nil {
+			h.sendToClient(client, userListMsg)
+		}
+		if statsMsg, err := h.roomStatsMessage(ctx, roomID); err == nil {
+			h.sendToClient(client, statsMsg)
+		}
+		return
 	}
 
 	// Broadcast updates to all clients in the room.
 	h.broadcastSystemMessageToRoom(roomID, fmt.Sprintf("User '%s' joined the room.", client.username), client.username, UserJoinedMessageType)
-	h.broadcastUserList(roomID)  // Send updated user list to everyone in the room.
-	h.broadcastRoomStats(roomID) // Send updated room stats to everyone in the room.
+	h.broadcastUserList(ctx, roomID)  // Send updated user list to everyone in the room.
+	h.broadcastRoomStats(ctx, roomID) // Send updated room stats to everyone in the room.
+}
+
+// sendRecentMessages sends a client the most recent messages of a room, and their reactions,
+// as a RecentMessagesType.
+func (h *Hub) sendRecentMessages(ctx context.Context, client *Client, roomID string) {
+	recentMsgJSONs, err := h.store.GetRecentMessages(ctx, roomID, maxRecentMessagesToSend)
+	if err != nil {
+		client.log.Error("Getting recent messages failed", "room_id", roomID, "error", err)
+		return
+	}
+	if len(recentMsgJSONs) == 0 {
+		client.log.Debug("No recent messages", "room_id", roomID)
+		return
+	}
+	messages := make([]json.RawMessage, len(recentMsgJSONs))
+	for i, m := range recentMsgJSONs {
+		messages[i] = json.RawMessage(m)
+	}
+	reactions := messageReactions(ctx, h.store, client.log, roomID, messages)
+	h.sendToClient(client, &Message{
+		Type:      RecentMessagesType,
+		RoomID:    roomID,
+		Data:      RecentMessagesPayload{RoomID: roomID, Messages: recentMsgJSONs, Reactions: reactions},
+		Timestamp: time.Now().UTC(),
+		System:    true,
+	})
+	client.log.Debug("Sent recent messages", "room_id", roomID, "count", len(recentMsgJSONs))
 }
 
 // handleClientLeaveRoom manages removing a client from a specific room.
 // `isDisconnect` is true if the client is fully disconnecting from the Hub.
-// It updates Hub's internal state, Redis store, and broadcasts relevant updates.
+// It updates Hub's internal state; the Redis store is updated, and the room told, on the room's
+// worker (see recordLeave).
 func (h *Hub) handleClientLeaveRoom(client *Client, roomID string, isDisconnect bool) {
 	if roomID == "" {
 		// Client might not be in any room if currentRoomID is empty.
-		// log.Printf("HUB: Client '%s' attempted to leave an empty roomID. isDisconnect: %t", client.username, isDisconnect)
+		// client.log.Debug("Attempted to leave an empty room ID", "disconnecting", isDisconnect)
 		return
 	}
-	log.Printf("HUB: Client '%s' leaving room '%s'. Disconnecting: %t", client.username, roomID, isDisconnect)
+	client.log.Info("Leaving room", "room_id", roomID, "disconnecting", isDisconnect)
 
-	var clientWasInRoomMap bool
+	var clientWasInRoomMap, roomNowEmpty bool
 	h.mu.Lock()
+	delete(client.subscriptions, roomID) // Important: Update client's state.
+	if !isDisconnect && client.currentRoomID() == roomID {
+		client.setCurrentRoomID("") // The client left the room it was focused on.
+	}
 	roomClients, roomExistsInHub := h.rooms[roomID]
 	if roomExistsInHub {
 		if _, clientFound := roomClients[client]; clientFound {
 			clientWasInRoomMap = true
 			delete(h.rooms[roomID], client)
 			if len(h.rooms[roomID]) == 0 {
-				log.Printf("HUB: Room '%s' is now empty, removing from Hub's active room list.", roomID)
+				h.log.Debug("Room has no more local clients", "room_id", roomID)
 				delete(h.rooms, roomID) // Clean up empty room from Hub's map.
+				metrics.Rooms.Dec()
+				roomNowEmpty = true
 			}
 		}
 	}
 	h.mu.Unlock()
 
-	if clientWasInRoomMap { // Only if client was actually removed from the Hub's room map.
-		// Remove user from Redis set for the room.
-		if err := h.redisClient.RemoveActiveUserFromRoom(context.Background(), roomID, client.username); err != nil {
-			log.Printf("HUB_ERROR: Removing user '%s' from Redis room set '%s': %v", client.username, roomID, err)
-		}
+	if !clientWasInRoomMap {
+		client.log.Warn("Client not found in room during leave", "room_id", roomID)
+		return
+	}
+	h.mustRunOnWorker(roomID, func(ctx context.Context) {
+		h.recordLeave(ctx, client, roomID, roomNowEmpty)
+	})
+}
 
-		// Broadcast updates to remaining clients in the room.
-		h.broadcastSystemMessageToRoom(roomID, fmt.Sprintf("User '%s' left the room.", client.username), client.username, UserLeftMessageType)
-		h.broadcastUserList(roomID)
-		h.broadcastRoomStats(roomID)
-	} else {
-		log.Printf("HUB_WARN: Client '%s' was not found in Hub's map for room '%s' during leave process.", client.username, roomID)
+// recordLeave records client leaving roomID in the store, for handleClientLeaveRoom, on the room's
+// worker. lastLocal tells whether the client was the room's last local member.
+func (h *Hub) recordLeave(ctx context.Context, client *Client, roomID string, lastLocal bool) {
+	if lastLocal {
+		h.unsubscribeRoom(ctx, roomID) // Last local member left: stop receiving the room's events.
 	}
 
-	// If client is just leaving the room (not disconnecting from WebSocket), clear their current room.
-	if !isDisconnect {
-		client.currentRoomID = "" // Important: Update client's state.
+	// Remove this connection of the user from the Redis set for the room.
+	remaining, err := h.store.RemoveActiveUserFromRoom(ctx, h.instanceID, roomID, client.username)
+	if err != nil {
+		client.log.Error("Removing user from room set failed", "room_id", roomID, "error", err)
+	}
+	if remaining > 0 {
+		// The user is still in the room from another connection; nothing changed for the other members.
+		client.log.Debug("User still in room from other connections", "room_id", roomID, "connections", remaining)
+		return
 	}
+	// Broadcast updates to remaining clients in the room.
+	h.broadcastSystemMessageToRoom(roomID, fmt.Sprintf("User '%s' left the room.", client.username), client.username, UserLeftMessageType)
+	h.broadcastUserList(ctx, roomID)
+	h.broadcastRoomStats(ctx, roomID)
 }
 
-// broadcastToRoom sends a message to all clients currently in the specified room.
-// It intelligently skips sending certain self-generated messages (like typing notifications)
-// back to the originator.
+// broadcastToRoom sends a message to all clients in the specified room, on this
+// instance and, via the store's Pub/Sub, on every other instance with members in the room.
+// Clients only enter a room once admitted by CheckRoomJoinable and are removed from it when
+// kicked or banned, so non-members of a private or invite-only room never receive its messages.
 func (h *Hub) broadcastToRoom(message *Message) {
 	if message.RoomID == "" {
-		log.Printf("HUB_WARN: Attempted to broadcast message with empty RoomID: Type '%s', User '%s'", message.Type, message.Username)
+		h.log.Warn("Attempted to broadcast a message without a room ID", "type", message.Type, "user", message.Username)
 		return
 	}
+	ctx, span := tracing.Tracer().Start(tracing.Extract(message.Trace), "hub.broadcast",
+		trace.WithAttributes(attribute.String("chat.message.type", string(message.Type)), attribute.String("chat.room", message.RoomID)))
+	defer span.End()
+	span.SetAttributes(attribute.Int("chat.recipients", h.deliverToRoom(message)))
+	h.publishRoomEvent(ctx, message)
+}
+
+// broadcastFromLoop is broadcastToRoom for the Hub's event loop, which must not wait on the store:
+// the message is delivered to local clients at once, and published to the other instances on the
+// room's worker. The publication is skipped when the worker is too far behind (see onRoomWorker),
+// so it is only used for messages that soon go stale anyway, such as typing notifications.
+func (h *Hub) broadcastFromLoop(message *Message) {
+	ctx, span := tracing.Tracer().Start(tracing.Extract(message.Trace), "hub.broadcast",
+		trace.WithAttributes(attribute.String("chat.message.type", string(message.Type)), attribute.String("chat.room", message.RoomID)))
+	defer span.End()
+	span.SetAttributes(attribute.Int("chat.recipients", h.deliverToRoom(message)))
+	h.onRoomWorker(message.RoomID, func(context.Context) { h.publishRoomEvent(ctx, message) })
+}
 
-	h.mu.RLock() // Read-lock to safely access h.rooms and then individual room's client map.
+// deliverToRoom sends a message to the clients in the specified room that are connected to this instance,
+// and returns how many it was sent to.
+// It intelligently skips sending certain self-generated messages (like typing notifications)
+// back to the originator.
+func (h *Hub) deliverToRoom(message *Message) int {
+	// Read-lock to safely access h.rooms and the room's client map. The lock is held while
+	// sending, which never blocks, so that no send channel is closed meanwhile.
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 	roomClientsMap, roomExists := h.rooms[message.RoomID]
 	if !roomExists {
-		h.mu.RUnlock()
-		log.Printf("HUB_WARN: Room '%s' not found for broadcasting message type '%s'.", message.RoomID, message.Type)
-		return
+		// Not an error: the room may only have members on other instances.
+		metrics.BroadcastFanout.Observe(0)
+		h.log.Debug("Room has no local clients for message", "room_id", message.RoomID, "type", message.Type)
+		return 0
 	}
 
-	// Create a list of clients to send to, to avoid holding lock while sending,
-	// which can be slow and cause contention.
-	clientsToSend := make([]*Client, 0, len(roomClientsMap))
+	recipients := 0
 	for c := range roomClientsMap {
 		// Don't send "user_typing" message back to the user who is typing.
 		// For text messages, server broadcasts to all including sender (client can identify own messages).
 		if message.Type == UserTypingMessageType && c.username == message.Username {
 			continue
 		}
-		clientsToSend = append(clientsToSend, c)
-	}
-	h.mu.RUnlock() // Release lock before starting send operations.
-
-	log.Printf("HUB: Broadcasting message type '%s' to %d clients in room '%s'.", message.Type, len(clientsToSend), message.RoomID)
-	for _, c := range clientsToSend {
-		select {
-		case c.send <- message:
-		default:
-			// Client's send buffer is full or channel is closed.
-			// This indicates the client is slow, stuck, or disconnected.
-			// Schedule unregistration to clean up.
-			log.Printf("HUB_WARN: Client '%s' send channel full/closed for room '%s' broadcast. Scheduling unregister.", c.username, message.RoomID)
-			// Run unregistration in a new goroutine to avoid blocking the broadcast loop.
-			go func(cl *Client) { h.unregister <- cl }(c)
-		}
+		h.queueMessage(c, message) // Without blocking the broadcast loop on a slow client.
+		recipients++
 	}
+	h.log.Debug("Delivering message to room", "room_id", message.RoomID, "type", message.Type, "recipients", recipients)
+	metrics.BroadcastFanout.Observe(float64(recipients))
+	return recipients
 }
 
 // broadcastSystemMessageToRoom is a helper to construct and broadcast system messages.
 func (h *Hub) broadcastSystemMessageToRoom(roomID, content, relevantUsername string, msgType MessageType) {
+	h.broadcastSystemEventToRoom(roomID, content, relevantUsername, msgType, nil)
+}
+
+// broadcastSystemEventToRoom constructs and broadcasts a system message carrying structured data,
+// for events that clients act on rather than just display.
+func (h *Hub) broadcastSystemEventToRoom(roomID, content, relevantUsername string, msgType MessageType, data interface{}) {
 	if roomID == "" {
 		return
 	} // Basic validation
-	log.Printf("HUB: Broadcasting system message to room '%s': Type '%s', Content '%s', User '%s'", roomID, msgType, content, relevantUsername)
+	h.log.Debug("Broadcasting system message", "room_id", roomID, "type", msgType, "user", relevantUsername, "text", content)
 	sysMsg := &Message{
 		Type:      msgType,
 		Content:   content,
@@ -436,45 +1127,68 @@ func (h *Hub) broadcastSystemMessageToRoom(roomID, content, relevantUsername str
 		RoomID:    roomID,
 		Timestamp: time.Now().UTC(),
 		System:    true,
+		Data:      data,
 	}
 	h.broadcastToRoom(sysMsg)
 }
 
 // broadcastUserList fetches the current user list for a room from Redis
 // and broadcasts it to all clients in that room.
-func (h *Hub) broadcastUserList(roomID string) {
+func (h *Hub) broadcastUserList(ctx context.Context, roomID string) {
 	if roomID == "" {
 		return
 	}
-	users, err := h.redisClient.GetActiveUsersInRoom(context.Background(), roomID)
+	userListMsg, err := h.userListMessage(ctx, roomID)
 	if err != nil {
-		log.Printf("HUB_ERROR: Getting active users for room '%s' to broadcast list: %v", roomID, err)
 		return
 	}
-	log.Printf("HUB: Broadcasting user list for room '%s'. Users: %v", roomID, users)
-	userListMsg := &Message{
+	h.log.Debug("Broadcasting user list", "room_id", roomID)
+	h.broadcastToRoom(userListMsg)
+}
+
+// userListMessage builds a UserListUpdateType message from the room's current user list in Redis.
+func (h *Hub) userListMessage(ctx context.Context, roomID string) (*Message, error) {
+	users, err := h.store.GetActiveUsersInRoom(ctx, roomID)
+	if err != nil {
+		h.log.Error("Getting active users of room failed", "room_id", roomID, "error", err)
+		return nil, err
+	}
+	presence, err := h.UserPresences(ctx, users)
+	if err != nil {
+		h.log.Error("Getting presence of room users failed", "room_id", roomID, "error", err)
+		presence = nil // The list is still useful without it.
+	}
+	return &Message{
 		Type:      UserListUpdateType,
 		RoomID:    roomID,
-		Data:      UserListPayload{RoomID: roomID, Users: users},
+		Data:      UserListPayload{RoomID: roomID, Users: users, Presence: presence},
 		Timestamp: time.Now().UTC(),
 		System:    true,
-	}
-	h.broadcastToRoom(userListMsg)
+	}, nil
 }
 
 // broadcastRoomStats fetches current statistics for a room from Redis
 // and broadcasts them to all clients in that room.
-func (h *Hub) broadcastRoomStats(roomID string) {
+func (h *Hub) broadcastRoomStats(ctx context.Context, roomID string) {
 	if roomID == "" {
 		return
 	}
-	stats, err := h.redisClient.GetRoomStats(context.Background(), roomID)
+	statsMsg, err := h.roomStatsMessage(ctx, roomID)
 	if err != nil {
-		log.Printf("HUB_ERROR: Getting room stats for '%s' to broadcast: %v", roomID, err)
 		return
 	}
-	log.Printf("HUB: Broadcasting stats for room '%s'. ActiveUsers: %d, MessageCount: %d", roomID, stats["active_users"], stats["message_count"])
-	statsMsg := &Message{
+	h.log.Debug("Broadcasting room stats", "room_id", roomID)
+	h.broadcastToRoom(statsMsg)
+}
+
+// roomStatsMessage builds a RoomStatsUpdateType message from the room's current statistics in Redis.
+func (h *Hub) roomStatsMessage(ctx context.Context, roomID string) (*Message, error) {
+	stats, err := h.store.GetRoomStats(ctx, roomID)
+	if err != nil {
+		h.log.Error("Getting room stats failed", "room_id", roomID, "error", err)
+		return nil, err
+	}
+	return &Message{
 		Type:   RoomStatsUpdateType,
 		RoomID: roomID,
 		Data: RoomStatsPayload{
@@ -484,56 +1198,89 @@ func (h *Hub) broadcastRoomStats(roomID string) {
 		},
 		Timestamp: time.Now().UTC(),
 		System:    true,
-	}
-	h.broadcastToRoom(statsMsg)
+	}, nil
 }
 
 // broadcastGlobalUserCount fetches the total number of globally connected users from Redis
-// and broadcasts this count to ALL currently connected clients.
-func (h *Hub) broadcastGlobalUserCount() {
-	count, err := h.redisClient.GetGlobalActiveUserCount(context.Background())
+// and broadcasts this count to ALL connected clients, on every instance.
+func (h *Hub) broadcastGlobalUserCount(ctx context.Context) {
+	countMsg, err := h.globalUserCountMessage(ctx)
 	if err != nil {
-		log.Printf("HUB_ERROR: Getting global user count to broadcast: %v", err)
 		return
 	}
-	log.Printf("HUB: Broadcasting global user count: %d", count)
-	countMsg := &Message{
+	h.log.Debug("Broadcasting global user count")
+	h.deliverToAllClients(countMsg)
+	h.publishGlobalEvent(countMsg)
+}
+
+// globalUserCountMessage builds a GlobalUserCountUpdateType message from the global user count in Redis.
+func (h *Hub) globalUserCountMessage(ctx context.Context) (*Message, error) {
+	count, err := h.store.GetGlobalActiveUserCount(ctx)
+	if err != nil {
+		h.log.Error("Getting global user count failed", "error", err)
+		return nil, err
+	}
+	return &Message{
 		Type:      GlobalUserCountUpdateType,
 		Data:      GlobalUserCountPayload{Count: count},
 		Timestamp: time.Now().UTC(),
 		System:    true,
-	}
+	}, nil
+}
 
-	h.mu.RLock() // Read-lock h.clients to get current list of all clients.
-	// Create a list of clients to send to, to avoid holding lock while sending.
-	allClients := make([]*Client, 0, len(h.clients))
+// deliverToAllClients sends a message to every client connected to this instance.
+func (h *Hub) deliverToAllClients(msg *Message) {
+	h.mu.RLock() // Read-lock h.clients while sending, so that no send channel is closed meanwhile.
+	defer h.mu.RUnlock()
 	for c := range h.clients {
-		allClients = append(allClients, c)
+		h.queueMessage(c, msg)
 	}
-	h.mu.RUnlock()
+}
 
-	for _, c := range allClients {
-		select {
-		case c.send <- countMsg:
-		default:
-			log.Printf("HUB_WARN: Client '%s' send channel full for global user count. Scheduling unregister.", c.username)
-			go func(cl *Client) { h.unregister <- cl }(c)
-		}
+// sendToClient queues a message for a single client without blocking the Hub. It may be called
+// from any goroutine, such as the room workers; messages for a client that was unregistered
+// meanwhile are discarded.
+func (h *Hub) sendToClient(c *Client, msg *Message) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	h.queueMessage(c, msg)
+}
+
+// queueMessage queues a message for a client without blocking. Every message the Hub sends to a
+// client goes through it. If the client's send buffer is full, the slow consumer policy of the
+// message's class decides what is dropped, or whether the client is scheduled for unregistration.
+// The caller must hold h.mu, which keeps the send channels of registered clients open.
+func (h *Hub) queueMessage(c *Client, msg *Message) {
+	if !h.clients[c] { // Unregistered, and its send channel closed.
+		c.log.Debug("Message for unregistered connection; discarding", "type", msg.Type)
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		h.handleSlowConsumer(c, msg)
 	}
 }
 
-// findClientByUsername is a helper to find a client pointer by username.
-// This can be slow if there are many clients. For a system with a very large
-// number of concurrent users, maintaining a separate map[username]*Client
-// (also protected by a mutex) would be more efficient for lookups.
-// For this educational example, iterating through h.clients is acceptable.
-func (h *Hub) findClientByUsername(username string) *Client {
-	h.mu.RLock() // Use Read Lock as we are only reading h.clients.
-	defer h.mu.RUnlock()
-	for client := range h.clients {
-		if client.username == username {
-			return client
+// unregisterLater queues c for unregistration without blocking the caller, which may be the
+// event loop itself. It gives up if the Hub shuts down first, since shutting down unregisters
+// every client anyway.
+func (h *Hub) unregisterLater(c *Client) {
+	metrics.ForcedUnregisters.Inc()
+	go func() {
+		select {
+		case h.unregister <- c:
+		case <-h.done:
 		}
+	}()
+}
+
+// randomID returns a random hex identifier, used for Hub instances and client connections.
+func randomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand should never fail; fall back to a time-based ID just in case.
+		return hex.EncodeToString([]byte(time.Now().UTC().Format(time.RFC3339Nano)))
 	}
-	return nil // Return nil if client not found.
+	return hex.EncodeToString(b)
 }
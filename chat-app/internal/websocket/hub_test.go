@@ -0,0 +1,476 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/logging"
+)
+
+// testTimeout bounds how long tests wait for the Hub to do something.
+const testTimeout = 2 * time.Second
+
+// quietLogger discards what the Hubs under test log.
+var quietLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// newTestHub starts a Hub on store, which it shuts down once the test is over.
+func newTestHub(t *testing.T, store cache.Store, options HubOptions) *Hub {
+	t.Helper()
+	if options.Logger == nil {
+		options.Logger = quietLogger
+	}
+	h := NewHub(store, options)
+	go h.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+		if err := h.Shutdown(ctx); err != nil {
+			t.Errorf("shutting down hub: %v", err)
+		}
+	})
+	return h
+}
+
+// testClient is a Client without a connection: the messages the Hub sends it are queued on
+// received, and the test posts messages to the Hub as if ReadPump had read them.
+type testClient struct {
+	*Client
+	received chan *Message
+}
+
+// connectTestClient registers a client of username with h, and waits until it has joined
+// roomID, if any.
+func connectTestClient(t *testing.T, h *Hub, username string, roomID string) *testClient {
+	t.Helper()
+	c := &testClient{Client: NewClient(h, nil, username, "session-"+username, roomID, 0), received: make(chan *Message, 1024)}
+	go func() {
+		defer close(c.received)
+		for msg := range c.send {
+			c.received <- msg
+		}
+	}()
+	h.register <- c.Client
+	if roomID != "" {
+		c.next(t, RoomInfoType)
+	}
+	return c
+}
+
+// post has the Hub handle msg as a message from the client.
+func (c *testClient) post(msg *Message) {
+	msg.Username = c.username
+	msg.Timestamp = time.Now().UTC()
+	c.hub.routeMessage <- &clientMessage{client: c.Client, msg: msg, span: trace.SpanFromContext(context.Background())}
+}
+
+// next returns the next message of type typ the client receives, skipping those of other types.
+func (c *testClient) next(t *testing.T, typ MessageType) *Message {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case msg, ok := <-c.received:
+			if !ok {
+				t.Fatalf("%s was disconnected while waiting for a %s", c.username, typ)
+			}
+			if msg.Type == typ {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("%s received no %s", c.username, typ)
+		}
+	}
+}
+
+// none fails the test if the client receives a message of type typ within d.
+func (c *testClient) none(t *testing.T, typ MessageType, d time.Duration) {
+	t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case msg, ok := <-c.received:
+			if !ok {
+				return
+			}
+			if msg.Type == typ {
+				t.Fatalf("%s received an unexpected %s: %q", c.username, typ, msg.Content)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// joined waits until the client's user is listed in roomID's user list, which the room's worker
+// records after the client has joined the room.
+func (c *testClient) joined(t *testing.T, roomID string) {
+	t.Helper()
+	for {
+		msg := c.next(t, UserListUpdateType)
+		if msg.RoomID == roomID && slices.Contains(msg.Data.(UserListPayload).Users, c.username) {
+			return
+		}
+	}
+}
+
+// contents decodes stored messages and returns their contents, in order.
+func contents[T string | json.RawMessage](t *testing.T, messages []T) []string {
+	t.Helper()
+	contents := make([]string, len(messages))
+	for i, raw := range messages {
+		var msg Message
+		if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+			t.Fatalf("decoding stored message: %v", err)
+		}
+		contents[i] = msg.Content
+	}
+	return contents
+}
+
+func TestHubStoresMessagesAndServesHistory(t *testing.T) {
+	h := newTestHub(t, cache.NewMemoryStore(), HubOptions{})
+	alice := connectTestClient(t, h, "alice", "general")
+
+	for i := 1; i <= 3; i++ {
+		alice.post(&Message{Type: TextMessageType, RoomID: "general", Content: fmt.Sprint("m", i), ClientMsgID: fmt.Sprint("c", i)})
+		ack := alice.next(t, AckMessageType).Data.(AckPayload)
+		if ack.MessageID != int64(i) || ack.ClientMsgID != fmt.Sprint("c", i) || ack.Duplicate {
+			t.Errorf("ack %d = %+v", i, ack)
+		}
+		if msg := alice.next(t, TextMessageType); msg.ID != int64(i) {
+			t.Errorf("broadcast message %d has ID %d", i, msg.ID)
+		}
+	}
+	// A retry is acknowledged under the original ID, but not stored or broadcast again.
+	alice.post(&Message{Type: TextMessageType, RoomID: "general", Content: "m3", ClientMsgID: "c3"})
+	if ack := alice.next(t, AckMessageType).Data.(AckPayload); ack.MessageID != 3 || !ack.Duplicate {
+		t.Errorf("ack of retry = %+v, want a duplicate of message 3", ack)
+	}
+	alice.none(t, TextMessageType, echoWait)
+
+	// Clients joining later are sent the room's recent messages, newest first.
+	bob := connectTestClient(t, h, "bob", "general")
+	recent := bob.next(t, RecentMessagesType).Data.(RecentMessagesPayload)
+	if got := contents(t, recent.Messages); !reflect.DeepEqual(got, []string{"m3", "m2", "m1"}) {
+		t.Errorf("recent messages = %v", got)
+	}
+
+	// History is paged back from the newest message, each page oldest first.
+	for _, tc := range []struct {
+		before     string
+		want       []string
+		nextCursor string
+	}{
+		{before: "", want: []string{"m2", "m3"}, nextCursor: "2"},
+		{before: "2", want: []string{"m1"}},
+	} {
+		alice.post(&Message{Type: LoadHistoryType, RoomID: "general", Content: fmt.Sprintf(`{"before":%q,"limit":2}`, tc.before)})
+		page := alice.next(t, HistoryType).Data.(*HistoryPayload)
+		if got := contents(t, page.Messages); !reflect.DeepEqual(got, tc.want) || page.NextCursor != tc.nextCursor || page.HasMore != (tc.nextCursor != "") {
+			t.Errorf("history before %q = %v, cursor %q, has more %t; want %v, cursor %q", tc.before, got, page.NextCursor, page.HasMore, tc.want, tc.nextCursor)
+		}
+	}
+}
+
+// logBuffer collects what a logger writes, which may be from several goroutines at once.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestHubRedactsMessageContentInLogs(t *testing.T) {
+	var output logBuffer
+	level := new(slog.LevelVar)
+	level.Set(slog.LevelDebug)
+	logger, err := logging.New(&output, logging.Options{Level: level})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHub(t, cache.NewMemoryStore(), HubOptions{Logger: logger})
+	alice := connectTestClient(t, h, "alice", "general")
+
+	alice.post(&Message{Type: UserTypingMessageType, RoomID: "general", Content: "secret typing"})
+	alice.post(&Message{Type: JoinRoomMessageType, Content: "secret join"})
+	alice.next(t, ErrorMessageType)
+	alice.post(&Message{Type: SetPresenceType, Content: `{"status":"away","status_text":"secret status"}`})
+	alice.next(t, PresenceUpdateType)
+	alice.post(&Message{Type: SetPresenceType, Content: "secret presence"})
+	alice.next(t, ErrorMessageType)
+
+	logged := output.String()
+	for _, line := range []string{"Typing status", "Invalid join_room data", "Status set", "Invalid request data"} {
+		if !strings.Contains(logged, line) {
+			t.Errorf("no %q line logged", line)
+		}
+	}
+	if strings.Contains(logged, "secret") {
+		t.Errorf("message content logged in clear:\n%s", logged)
+	}
+	if !strings.Contains(logged, `content="[redacted, 13 bytes]"`) {
+		t.Errorf("typing content not logged redacted:\n%s", logged)
+	}
+}
+
+// slowStore is a MemoryStore whose calls storing room messages, and recording users' connections
+// and room joins, each take delay, like a Redis server under load.
+type slowStore struct {
+	cache.Store
+	delay time.Duration
+}
+
+func (s *slowStore) wait(ctx context.Context) error {
+	select {
+	case <-time.After(s.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *slowStore) NextMessageID(ctx context.Context, roomID string) (int64, error) {
+	if err := s.wait(ctx); err != nil {
+		return 0, err
+	}
+	return s.Store.NextMessageID(ctx, roomID)
+}
+
+func (s *slowStore) AppendToMessageLog(ctx context.Context, roomID string, id int64, messageJSON string, maxMessages int) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	return s.Store.AppendToMessageLog(ctx, roomID, id, messageJSON, maxMessages)
+}
+
+func (s *slowStore) AddUserToGlobalSet(ctx context.Context, instanceID string, username string) (int64, error) {
+	if err := s.wait(ctx); err != nil {
+		return 0, err
+	}
+	return s.Store.AddUserToGlobalSet(ctx, instanceID, username)
+}
+
+func (s *slowStore) AddActiveUserToRoom(ctx context.Context, instanceID string, roomID string, username string, ttl time.Duration) (int64, error) {
+	if err := s.wait(ctx); err != nil {
+		return 0, err
+	}
+	return s.Store.AddActiveUserToRoom(ctx, instanceID, roomID, username, ttl)
+}
+
+// BenchmarkHubSlowStore measures how many requests per second a Hub completes when the store is
+// slow, with the requests spread over 1 or 16 rooms:
+//
+//   - messages: text messages, stored and acknowledged, each costing two slow store calls;
+//   - joins: a client per room moving between two rooms of its own, each join costing a slow
+//     call to record the client in the room, and complete once the client is sent the room's
+//     user list;
+//   - registrations: new connections of a user per room, each costing a slow call to record the
+//     connection and another to record it in its room, and complete once the connection is sent
+//     the global user count and its room's user list.
+//
+// With a single room worker, the store calls are made one at a time, as if on the event loop; more
+// workers make those of different rooms and users concurrently. Each room's messages must still be
+// broadcast in the order of their IDs. Like clients waiting for their replies, the benchmark keeps
+// at most benchmarkInFlight requests unanswered, which the room workers' queues hold.
+func BenchmarkHubSlowStore(b *testing.B) {
+	for _, op := range []struct {
+		name string
+		run  func(b *testing.B, h *Hub, rooms int)
+	}{
+		{name: "messages", run: benchmarkMessages},
+		{name: "joins", run: benchmarkJoins},
+		{name: "registrations", run: benchmarkRegistrations},
+	} {
+		for _, workers := range []int{1, DefaultRoomWorkers} {
+			for _, rooms := range []int{1, 16} {
+				b.Run(fmt.Sprintf("%s/workers=%d/rooms=%d", op.name, workers, rooms), func(b *testing.B) {
+					store := &slowStore{Store: cache.NewMemoryStore(), delay: time.Millisecond}
+					h := NewHub(store, HubOptions{RoomWorkers: workers, Logger: quietLogger})
+					go h.Run()
+					op.run(b, h, rooms)
+					b.StopTimer()
+					b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), op.name+"/s")
+
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+					if err := h.Shutdown(ctx); err != nil {
+						b.Fatalf("shutting down hub: %v", err)
+					}
+				})
+			}
+		}
+	}
+}
+
+const benchmarkInFlight = roomWorkerQueueSize / 2
+
+// benchmarkWait waits until done is closed, then stops the benchmark's timer.
+func benchmarkWait(b *testing.B, done <-chan struct{}, completed *atomic.Int64, what string) {
+	b.Helper()
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		b.Fatalf("only %d of %d %s completed", completed.Load(), b.N, what)
+	}
+	b.StopTimer()
+}
+
+func benchmarkMessages(b *testing.B, h *Hub, rooms int) {
+	var acked atomic.Int64
+	done := make(chan struct{})
+	inFlight := make(chan struct{}, benchmarkInFlight)
+	joined := make(chan struct{}, rooms)
+	clients := make([]*Client, rooms)
+	for i := range clients {
+		username := fmt.Sprintf("user%d", i)
+		clients[i] = NewClient(h, nil, username, "session-"+username, fmt.Sprintf("room%d", i), 0)
+		h.register <- clients[i]
+		go func(c *Client) {
+			var lastID int64
+			inRoom := false
+			for msg := range c.send {
+				if !inRoom && benchmarkJoinedRoom(c, msg) != "" {
+					inRoom = true
+					joined <- struct{}{}
+				}
+				switch msg.Type {
+				case TextMessageType:
+					if msg.ID <= lastID {
+						b.Errorf("room %s: message %d broadcast after message %d", msg.RoomID, msg.ID, lastID)
+					}
+					lastID = msg.ID
+				case AckMessageType:
+					<-inFlight
+					if acked.Add(1) == int64(b.N) {
+						close(done)
+					}
+				case ErrorMessageType:
+					b.Errorf("room %s: message refused: %s", msg.RoomID, msg.Content)
+					<-inFlight
+				}
+			}
+		}(clients[i])
+	}
+	for range clients {
+		<-joined // Messages are only accepted from clients in the room.
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		inFlight <- struct{}{}
+		c := clients[i%rooms]
+		h.routeMessage <- &clientMessage{
+			client: c,
+			msg:    &Message{Type: TextMessageType, RoomID: c.currentRoomID(), Username: c.username, Content: "hello", Timestamp: time.Now().UTC()},
+			span:   trace.SpanFromContext(context.Background()),
+		}
+	}
+	benchmarkWait(b, done, &acked, "messages")
+}
+
+// benchmarkJoinedRoom returns the ID of the room a client sent msg has completed joining, if msg
+// is the user list the room's worker sends it last, listing its user.
+func benchmarkJoinedRoom(c *Client, msg *Message) string {
+	if msg.Type != UserListUpdateType || !slices.Contains(msg.Data.(UserListPayload).Users, c.username) {
+		return ""
+	}
+	return msg.RoomID
+}
+
+func benchmarkJoins(b *testing.B, h *Hub, rooms int) {
+	var joined atomic.Int64
+	done := make(chan struct{})
+	started := make(chan struct{})
+	var next atomic.Int64 // Joins handed out to the clients so far.
+	for i := 0; i < rooms; i++ {
+		username := fmt.Sprintf("user%d", i)
+		roomIDs := [2]string{fmt.Sprintf("room%d-a", i), fmt.Sprintf("room%d-b", i)}
+		c := NewClient(h, nil, username, "session-"+username, roomIDs[0], 0)
+		h.register <- c
+		go func() {
+			joins := 0
+			for msg := range c.send {
+				if msg.Type == ErrorMessageType {
+					b.Errorf("%s: join refused: %s", c.username, msg.Content)
+				}
+				if roomID := benchmarkJoinedRoom(c, msg); roomID == "" || roomID != roomIDs[joins%2] {
+					continue
+				}
+				if joins++; joins == 1 {
+					<-started // Joined its first room: wait for the timer.
+				} else if joined.Add(1) == int64(b.N) {
+					close(done)
+				}
+				if next.Add(1) <= int64(b.N) {
+					h.routeMessage <- &clientMessage{
+						client: c,
+						msg:    &Message{Type: JoinRoomMessageType, Username: c.username, Content: fmt.Sprintf(`{"roomID":%q}`, roomIDs[joins%2]), Timestamp: time.Now().UTC()},
+						span:   trace.SpanFromContext(context.Background()),
+					}
+				}
+			}
+		}()
+	}
+
+	b.ResetTimer()
+	close(started)
+	benchmarkWait(b, done, &joined, "joins")
+}
+
+func benchmarkRegistrations(b *testing.B, h *Hub, rooms int) {
+	var registered atomic.Int64
+	done := make(chan struct{})
+	inFlight := make(chan struct{}, benchmarkInFlight)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		inFlight <- struct{}{}
+		username := fmt.Sprintf("user%d", i%rooms)
+		c := NewClient(h, nil, username, "session-"+username, fmt.Sprintf("room%d", i%rooms), 0)
+		h.register <- c
+		go func() {
+			counted, joined := false, false
+			for msg := range c.send {
+				if msg.Type == ErrorMessageType {
+					b.Errorf("%s: connection refused: %s", c.username, msg.Content)
+				}
+				counted = counted || msg.Type == GlobalUserCountUpdateType
+				joined = joined || benchmarkJoinedRoom(c, msg) != ""
+				if counted && joined {
+					break
+				}
+			}
+			<-inFlight
+			if registered.Add(1) == int64(b.N) {
+				close(done)
+			}
+			for range c.send { // Keep the connection from becoming a slow consumer.
+			}
+		}()
+	}
+	benchmarkWait(b, done, &registered, "registrations")
+}
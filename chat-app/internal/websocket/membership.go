@@ -0,0 +1,354 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/auth"
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/logging"
+)
+
+// Errors returned by the room membership operations and access checks.
+var (
+	ErrNotRoomMember  = errors.New("not a member of this room")
+	ErrBannedFromRoom = errors.New("banned from this room")
+	ErrInvalidMember  = errors.New("invalid member")
+)
+
+// CheckRoomAccess returns the registry record of a room that username wants to join or read:
+// its history, its stats or its member list. Users banned from the room are refused with
+// ErrBannedFromRoom, and only members may access rooms that are not public (ErrNotRoomMember).
+// Rooms that were never created are open to everyone, unless the Hub requires rooms to be created
+// before use (ErrRoomNotFound); for those the returned record is nil.
+func (h *Hub) CheckRoomAccess(ctx context.Context, roomID string, username string) (*cache.Room, error) {
+	room, err := h.store.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room '%s': %w", roomID, err)
+	}
+	if room == nil {
+		if h.options.RequireRegisteredRooms {
+			return nil, fmt.Errorf("%w: '%s'", ErrRoomNotFound, roomID)
+		}
+		return nil, nil
+	}
+	if err := checkMembership(ctx, h.store, room, username); err != nil {
+		return nil, err
+	}
+	return room, nil
+}
+
+// checkMembership enforces a registered room's access rules for username. The room's creator
+// always has access.
+func checkMembership(ctx context.Context, store cache.RoomStore, room *cache.Room, username string) error {
+	if room.CreatedBy != "" && room.CreatedBy == username {
+		return nil
+	}
+	member, banned, err := store.GetRoomAccess(ctx, room.ID, username)
+	if err != nil {
+		return fmt.Errorf("failed to check access of user '%s' to room '%s': %w", username, room.ID, err)
+	}
+	return accessError(room, username, member, banned)
+}
+
+// accessError applies a registered room's access rules to username, given whether they are a
+// member of the room and whether they are banned from it.
+func accessError(room *cache.Room, username string, member bool, banned bool) error {
+	if room.CreatedBy != "" && room.CreatedBy == username {
+		return nil
+	}
+	if banned {
+		return fmt.Errorf("%w: '%s'", ErrBannedFromRoom, room.ID)
+	}
+	if room.Visibility != cache.RoomVisibilityPublic && !member {
+		return fmt.Errorf("%w: '%s'", ErrNotRoomMember, room.ID)
+	}
+	return nil
+}
+
+// ListRoomMembers returns the members and moderators of a registered room, which username must
+// have access to. The room's moderators (and owner) are also shown who is banned from it.
+func ListRoomMembers(ctx context.Context, store cache.RoomStore, roomID string, username string) (*RoomMembersPayload, error) {
+	room, err := store.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room '%s': %w", roomID, err)
+	}
+	if room == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrRoomNotFound, roomID)
+	}
+	if err := checkMembership(ctx, store, room, username); err != nil {
+		return nil, err
+	}
+	members, err := store.GetRoomMembers(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members of room '%s': %w", roomID, err)
+	}
+	sort.Strings(members)
+	roles, err := store.GetRoomRoles(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list roles of room '%s': %w", roomID, err)
+	}
+	payload := &RoomMembersPayload{RoomID: roomID, Members: members}
+	for member, role := range roles {
+		if role == cache.RoomRoleModerator {
+			payload.Moderators = append(payload.Moderators, member)
+		}
+	}
+	sort.Strings(payload.Moderators)
+	if room.CreatedBy == username || roles[username] == cache.RoomRoleModerator {
+		banned, err := store.GetRoomBans(ctx, roomID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list bans of room '%s': %w", roomID, err)
+		}
+		sort.Strings(banned)
+		payload.Banned = banned
+	}
+	return payload, nil
+}
+
+// InviteToRoom makes target a member of a room on behalf of actor, who must be one of the room's
+// moderators. Members may join the room even if it is private or invite-only. The invited user
+// is sent a RoomInvitationType and the room's members a RoomMemberUpdateType.
+// Banned users must be unbanned before they can be invited.
+func (h *Hub) InviteToRoom(ctx context.Context, roomID string, actor string, target string) error {
+	room, err := h.managedRoom(ctx, roomID, actor, target)
+	if err != nil {
+		return err
+	}
+	_, banned, err := h.store.GetRoomAccess(ctx, roomID, target)
+	if err != nil {
+		return fmt.Errorf("failed to check access of user '%s' to room '%s': %w", target, roomID, err)
+	}
+	if banned {
+		return fmt.Errorf("%w: '%s' must be unbanned first", ErrBannedFromRoom, target)
+	}
+	if err := h.store.AddRoomMember(ctx, roomID, target); err != nil {
+		return fmt.Errorf("failed to invite user '%s' to room '%s': %w", target, roomID, err)
+	}
+	h.log.Info("User invited to room", "room_id", roomID, "user", target, "actor", actor)
+
+	invitation := &Message{
+		Type:      RoomInvitationType,
+		RoomID:    roomID,
+		Username:  actor,
+		Content:   fmt.Sprintf("'%s' invited you to the room '%s'.", actor, room.Name),
+		Data:      RoomInfo(room),
+		Timestamp: time.Now().UTC(),
+		System:    true,
+	}
+	h.deliverToUser(target, invitation)
+	h.publishUserEvent(target, invitation)
+	h.broadcastSystemMessageToRoom(roomID, fmt.Sprintf("User '%s' was invited by '%s'.", target, actor), target, RoomMemberUpdateType)
+	return nil
+}
+
+// KickFromRoom removes target from a room's members on behalf of actor, who must be one of the
+// room's moderators and outrank target, and removes all of target's connections from the room.
+// Target loses any role in the room, and may rejoin it only if it is public, or once invited again.
+func (h *Hub) KickFromRoom(ctx context.Context, roomID string, actor string, target string) error {
+	room, err := h.managedRoom(ctx, roomID, actor, target)
+	if err != nil {
+		return err
+	}
+	if err := h.checkOutranks(ctx, room, actor, target); err != nil {
+		return err
+	}
+	if err := h.store.RemoveRoomMember(ctx, roomID, target); err != nil {
+		return fmt.Errorf("failed to kick user '%s' from room '%s': %w", target, roomID, err)
+	}
+	h.log.Info("User kicked from room", "room_id", roomID, "user", target, "actor", actor)
+	h.evictFromRoom(roomID, target, fmt.Sprintf("You were kicked from the room '%s' by '%s'.", room.Name, actor))
+	h.broadcastSystemMessageToRoom(roomID, fmt.Sprintf("User '%s' was kicked by '%s'.", target, actor), target, RoomMemberUpdateType)
+	return nil
+}
+
+// BanFromRoom removes target from a room's members on behalf of actor, who must be one of the
+// room's moderators and outrank target, bans them from the room and removes all of their
+// connections from it.
+func (h *Hub) BanFromRoom(ctx context.Context, roomID string, actor string, target string) error {
+	room, err := h.managedRoom(ctx, roomID, actor, target)
+	if err != nil {
+		return err
+	}
+	if err := h.checkOutranks(ctx, room, actor, target); err != nil {
+		return err
+	}
+	if err := h.store.BanFromRoom(ctx, roomID, target); err != nil {
+		return fmt.Errorf("failed to ban user '%s' from room '%s': %w", target, roomID, err)
+	}
+	h.log.Info("User banned from room", "room_id", roomID, "user", target, "actor", actor)
+	h.evictFromRoom(roomID, target, fmt.Sprintf("You were banned from the room '%s' by '%s'.", room.Name, actor))
+	h.broadcastSystemMessageToRoom(roomID, fmt.Sprintf("User '%s' was banned by '%s'.", target, actor), target, RoomMemberUpdateType)
+	return nil
+}
+
+// UnbanFromRoom lifts target's ban from a room on behalf of actor, who must be one of the room's moderators.
+// It does not make target a member again.
+func (h *Hub) UnbanFromRoom(ctx context.Context, roomID string, actor string, target string) error {
+	if _, err := h.managedRoom(ctx, roomID, actor, target); err != nil {
+		return err
+	}
+	if err := h.store.UnbanFromRoom(ctx, roomID, target); err != nil {
+		return fmt.Errorf("failed to unban user '%s' from room '%s': %w", target, roomID, err)
+	}
+	h.log.Info("User unbanned from room", "room_id", roomID, "user", target, "actor", actor)
+	return nil
+}
+
+// managedRoom returns the registry record of a room whose membership actor may change with
+// regard to target: actor must be one of the room's moderators (see moderatedRoom) and target
+// must be a valid username other than actor's.
+func (h *Hub) managedRoom(ctx context.Context, roomID string, actor string, target string) (*cache.Room, error) {
+	if !auth.ValidUsername(target) {
+		return nil, fmt.Errorf("%w: '%.40s' is not a valid username", ErrInvalidMember, target)
+	}
+	if target == actor {
+		return nil, fmt.Errorf("%w: you cannot change your own membership", ErrInvalidMember)
+	}
+	return h.moderatedRoom(ctx, roomID, actor)
+}
+
+// evictFromRoom removes every connection of username, on every instance, from roomID and sends
+// them a RemovedFromRoomType explaining why. Local connections are removed on the Hub's event
+// loop, like remote ones, since this may be called from an HTTP handler or a room worker. Unlike
+// the events of other instances, the eviction is never dropped when the loop is behind: this
+// waits until the loop takes it, or until the Hub shuts down, which disconnects everyone anyway
+// (the loop waits for the room workers then, so waiting for it to stop could deadlock). It must
+// not be called on the event loop.
+func (h *Hub) evictFromRoom(roomID string, username string, reason string) {
+	msg := &Message{
+		Type:      RemovedFromRoomType,
+		RoomID:    roomID,
+		Username:  username,
+		Content:   reason,
+		Timestamp: time.Now().UTC(),
+		System:    true,
+	}
+	h.publishUserEvent(username, msg)
+	select {
+	case h.remoteEvents <- &hubEvent{Origin: h.instanceID, Message: msg, User: username}:
+	case <-h.shutdown:
+		h.log.Warn("Hub shutting down; local eviction skipped", "room_id", roomID, "user", username)
+	}
+}
+
+// removeUserFromRoom makes the local connections of username that are subscribed to msg.RoomID
+// leave the room, and refuses the joins of the room the room workers are still checking for them
+// (see joinRoom), then delivers msg (a RemovedFromRoomType) to all of the user's local connections.
+func (h *Hub) removeUserFromRoom(username string, msg *Message) {
+	h.mu.RLock()
+	inRoom := make([]*Client, 0, len(h.sessions[username]))
+	for c := range h.sessions[username] {
+		if c.subscribedTo(msg.RoomID) {
+			inRoom = append(inRoom, c)
+		}
+		if c.joining[msg.RoomID] > 0 {
+			c.revoked[msg.RoomID] = true
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, c := range inRoom {
+		c.log.Info("Removing connection from room", "room_id", msg.RoomID)
+		h.handleClientLeaveRoom(c, msg.RoomID, false)
+	}
+	h.deliverToUser(username, msg)
+}
+
+// handleRoomMembership answers a client's InviteToRoomType, KickFromRoomType, BanFromRoomType,
+// UnbanFromRoomType, SetRoomRoleType, MuteUserType or UnmuteUserType request. Message.Content
+// carries a JSON-encoded RoomMemberData whose room defaults to the client's current room.
+// The request is carried out on the room's worker.
+func (h *Hub) handleRoomMembership(client *Client, msg *Message) {
+	var request RoomMemberData
+	if err := json.Unmarshal([]byte(msg.Content), &request); err != nil {
+		client.log.Warn("Invalid request data", "type", msg.Type, "error", err, logging.Content(msg.Content))
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Invalid room membership request format.", Timestamp: time.Now().UTC()})
+		return
+	}
+	roomID := request.RoomID
+	if roomID == "" {
+		roomID = client.currentRoomID()
+	}
+	if roomID == "" {
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "RoomID required for room membership request.", Timestamp: time.Now().UTC()})
+		return
+	}
+
+	// Whether the client sees the room's announcements is only known on the event loop.
+	subscribed := client.subscribedTo(roomID)
+	h.runOnWorker(roomID, client, msg, func(ctx context.Context) {
+		var err error
+		var done string
+		switch msg.Type {
+		case InviteToRoomType:
+			done = "invited"
+			err = h.InviteToRoom(ctx, roomID, client.username, request.Username)
+		case KickFromRoomType:
+			done = "kicked"
+			err = h.KickFromRoom(ctx, roomID, client.username, request.Username)
+		case BanFromRoomType:
+			done = "banned"
+			err = h.BanFromRoom(ctx, roomID, client.username, request.Username)
+		case UnbanFromRoomType:
+			done = "unbanned"
+			err = h.UnbanFromRoom(ctx, roomID, client.username, request.Username)
+		case SetRoomRoleType:
+			done = "made a " + request.Role
+			err = h.SetRoomRole(ctx, roomID, client.username, request.Username, request.Role)
+		case MuteUserType:
+			done = "muted"
+			err = h.MuteUser(ctx, roomID, client.username, request.Username, time.Duration(request.DurationSeconds)*time.Second)
+		case UnmuteUserType:
+			done = "unmuted"
+			err = h.UnmuteUser(ctx, roomID, client.username, request.Username)
+		}
+		if err != nil {
+			client.log.Warn("Membership request failed", "type", msg.Type, "room_id", roomID, "error", err)
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: moderationErrorText(err), RoomID: roomID, Timestamp: time.Now().UTC()})
+			return
+		}
+		if msg.Type == UnbanFromRoomType || !subscribed {
+			// Not announced to the room, or the client is not there to see the announcement.
+			h.sendToClient(client, &Message{
+				Type:      RoomMemberUpdateType,
+				RoomID:    roomID,
+				Username:  request.Username,
+				Content:   fmt.Sprintf("User '%s' was %s.", request.Username, done),
+				Timestamp: time.Now().UTC(),
+				System:    true,
+			})
+		}
+	})
+}
+
+// moderationErrorText explains to a client why a room membership or moderation request failed.
+func moderationErrorText(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidMember), errors.Is(err, ErrBannedFromRoom), errors.Is(err, ErrOutranked),
+		errors.Is(err, ErrMessageNotFound), errors.Is(err, ErrTooManyPins), errors.Is(err, ErrInvalidEdit),
+		errors.Is(err, ErrEditWindowExpired), errors.Is(err, ErrInvalidReaction), errors.Is(err, ErrTooManyReactions),
+		errors.Is(err, ErrMessageNotReactable):
+		return err.Error()
+	case errors.Is(err, ErrRoomNotFound):
+		return "This room does not exist."
+	case errors.Is(err, ErrNotModerator):
+		return "Only the room's moderators can do this."
+	case errors.Is(err, ErrNotRoomOwner):
+		return "Only the room's owner can do this."
+	case errors.Is(err, ErrNotMessageAuthor):
+		return "Only the message's author can do this."
+	case errors.Is(err, ErrNotRoomMember):
+		return "You are no longer a member of this room."
+	case errors.Is(err, ErrMuted):
+		return "You are muted in this room."
+	case errors.Is(err, ErrRoomArchived):
+		return "This room is archived."
+	default:
+		return "Failed to moderate the room. Please try again later."
+	}
+}
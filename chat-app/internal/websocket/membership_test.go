@@ -0,0 +1,130 @@
+package websocket
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/cache"
+)
+
+func TestBanEvictsLocalConnectionsWhileRemoteEventsAreBacklogged(t *testing.T) {
+	h := newTestHub(t, cache.NewMemoryStore(), HubOptions{})
+	ctx := context.Background()
+	if _, err := h.CreateRoom(ctx, "club", "alice", RoomSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	alice := connectTestClient(t, h, "alice", "club")
+	bob := connectTestClient(t, h, "bob", "club")
+
+	// Other instances flood the event loop, which is held up on the Hub's lock meanwhile: it takes
+	// the first event and waits, and the others fill remoteEvents.
+	h.mu.Lock()
+	flood := &hubEvent{Origin: "other-instance", Message: &Message{Type: TextMessageType, RoomID: "elsewhere", Content: "flood"}}
+	for i := 0; i <= cap(h.remoteEvents); i++ {
+		h.remoteEvents <- flood
+	}
+	banned := make(chan error, 1)
+	go func() { banned <- h.BanFromRoom(ctx, "club", "alice", "bob") }()
+	time.Sleep(echoWait) // Let the ban get as far as evicting Bob before the loop catches up.
+	h.mu.Unlock()
+	if err := <-banned; err != nil {
+		t.Fatalf("banning bob: %v", err)
+	}
+
+	if msg := bob.next(t, RemovedFromRoomType); msg.RoomID != "club" {
+		t.Errorf("bob removed from room %q, want %q", msg.RoomID, "club")
+	}
+	alice.post(&Message{Type: TextMessageType, RoomID: "club", Content: "bob is gone", ClientMsgID: "c1"})
+	alice.next(t, AckMessageType)
+	bob.none(t, TextMessageType, echoWait)
+}
+
+// postBehindSlowMessage has alice post a message to roomID, which the slow store holds up on the
+// room's worker, then has poster post a message with clientMsgID, and returns once the event loop
+// has queued it behind alice's.
+func postBehindSlowMessage(t *testing.T, alice *testClient, poster *testClient, roomID string, clientMsgID string) {
+	t.Helper()
+	alice.post(&Message{Type: TextMessageType, RoomID: roomID, Content: "first", ClientMsgID: "slow"})
+	poster.post(&Message{Type: TextMessageType, RoomID: roomID, Content: "queued", ClientMsgID: clientMsgID})
+	poster.post(&Message{Type: UserTypingMessageType, RoomID: roomID, Content: "start"})
+	alice.next(t, UserTypingMessageType) // The loop handled poster's message before their typing.
+}
+
+// wantRefused waits until c is told that its message with clientMsgID was refused with reason,
+// and checks that only alice's message was stored in roomID.
+func wantRefused(t *testing.T, store cache.Store, c *testClient, roomID string, clientMsgID string, reason string) {
+	t.Helper()
+	if msg := c.next(t, ErrorMessageType); msg.ClientMsgID != clientMsgID || msg.Content != reason {
+		t.Errorf("%s got error %q about %q, want %q about %q", c.username, msg.Content, msg.ClientMsgID, reason, clientMsgID)
+	}
+	stored, err := store.GetMessagesBefore(context.Background(), roomID, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(t, stored); !reflect.DeepEqual(got, []string{"first"}) {
+		t.Errorf("stored messages = %v, want [first]", got)
+	}
+}
+
+func TestBannedUserCannotPostMessagesQueuedBeforeTheBan(t *testing.T) {
+	store := &slowStore{Store: cache.NewMemoryStore(), delay: 100 * time.Millisecond}
+	h := newTestHub(t, store, HubOptions{})
+	ctx := context.Background()
+	if _, err := h.CreateRoom(ctx, "club", "alice", RoomSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	alice := connectTestClient(t, h, "alice", "club")
+	bob := connectTestClient(t, h, "bob", "club")
+
+	postBehindSlowMessage(t, alice, bob, "club", "b1")
+	if err := h.BanFromRoom(ctx, "club", "alice", "bob"); err != nil {
+		t.Fatalf("banning bob: %v", err)
+	}
+	wantRefused(t, store, bob, "club", "b1", "You are banned from this room.")
+}
+
+func TestRemovedMemberCannotPostMessagesQueuedBeforeTheRemoval(t *testing.T) {
+	private := cache.RoomVisibilityPrivate
+	for _, tc := range []struct {
+		name     string
+		settings RoomSettings
+		remove   func(h *Hub) error
+	}{
+		{
+			name:     "kicked from private room",
+			settings: RoomSettings{Visibility: &private},
+			remove:   func(h *Hub) error { return h.KickFromRoom(context.Background(), "club", "alice", "carol") },
+		},
+		{
+			name: "room made private",
+			remove: func(h *Hub) error {
+				_, err := h.UpdateRoom(context.Background(), "club", "alice", RoomSettings{Visibility: &private})
+				return err
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &slowStore{Store: cache.NewMemoryStore(), delay: 100 * time.Millisecond}
+			h := newTestHub(t, store, HubOptions{})
+			ctx := context.Background()
+			if _, err := h.CreateRoom(ctx, "club", "alice", tc.settings); err != nil {
+				t.Fatal(err)
+			}
+			if tc.settings.Visibility != nil {
+				if err := h.InviteToRoom(ctx, "club", "alice", "carol"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			alice := connectTestClient(t, h, "alice", "club")
+			carol := connectTestClient(t, h, "carol", "club")
+
+			postBehindSlowMessage(t, alice, carol, "club", "c1")
+			if err := tc.remove(h); err != nil {
+				t.Fatalf("removing carol: %v", err)
+			}
+			wantRefused(t, store, carol, "club", "c1", "This room is only open to its members.")
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package websocket
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // MessageType is a string type representing the various types of messages
 // that can be sent over a WebSocket connection in the chat application.
@@ -57,12 +60,200 @@ const (
 	// RequestStatsType is sent by a client to request current statistics for a specific room.
 	// Direction: Client to Server (C2S).
 	RequestStatsType MessageType = "request_room_stats" // Changed from "request_stats" for clarity
+
+	// LoadHistoryType is sent by a client to page back through a room's message history or,
+	// if Message.To names a user, through its direct conversation with that user.
+	// Message.Content carries a JSON-encoded LoadHistoryData.
+	// Direction: Client to Server (C2S).
+	LoadHistoryType MessageType = "load_history"
+
+	// DirectMessageType is a private, one-to-one message addressed to the user named in Message.To.
+	// It is delivered to every connection of both the sender and the recipient.
+	// Direction: Client to Server (C2S) and Server to Client (S2C).
+	DirectMessageType MessageType = "direct_message"
+
+	// ListConversationsType is sent by a client to request its list of direct conversations.
+	// Direction: Client to Server (C2S).
+	ListConversationsType MessageType = "list_conversations"
+
+	// ConversationListType answers a ListConversationsType request.
+	// Direction: Server to Client (S2C).
+	ConversationListType MessageType = "conversation_list"
+
+	// MissedMessagesType replays to a reconnecting client the messages it missed while disconnected.
+	// Direction: Server to Client (S2C).
+	MissedMessagesType MessageType = "missed_messages"
+
+	// ResyncRequiredType tells a reconnecting client that it missed too many messages to replay,
+	// and must discard its copy of the room and reload the history.
+	// Direction: Server to Client (S2C).
+	ResyncRequiredType MessageType = "resync_required"
+
+	// AckMessageType confirms to the sender that its text message was stored, and under which ID.
+	// Direction: Server to Client (S2C).
+	AckMessageType MessageType = "ack"
+
+	// HistoryType answers a LoadHistoryType request with one page of older messages.
+	// Direction: Server to Client (S2C).
+	HistoryType MessageType = "history"
+
+	// RoomInfoType describes a room from the room registry: its name, topic, creator and visibility.
+	// It is sent to a client when it joins a room, and to a room's members whenever the room is
+	// updated or archived.
+	// Direction: Server to Client (S2C).
+	RoomInfoType MessageType = "room_info"
+
+	// InviteToRoomType, KickFromRoomType, BanFromRoomType and UnbanFromRoomType are sent by a
+	// room's owner to manage its members. Message.Content carries a JSON-encoded RoomMemberData.
+	// Direction: Client to Server (C2S).
+	InviteToRoomType  MessageType = "invite_to_room"
+	KickFromRoomType  MessageType = "kick_from_room"
+	BanFromRoomType   MessageType = "ban_from_room"
+	UnbanFromRoomType MessageType = "unban_from_room"
+
+	// RoomInvitationType tells a user they were made a member of a room. Data holds a RoomInfoPayload.
+	// Direction: Server to Client (S2C).
+	RoomInvitationType MessageType = "room_invitation"
+
+	// RemovedFromRoomType tells a user they were kicked or banned from a room, and no longer in it.
+	// Direction: Server to Client (S2C).
+	RemovedFromRoomType MessageType = "removed_from_room"
+
+	// RoomMemberUpdateType announces a change to a room's members, such as an invitation or a ban.
+	// Message.Username names the affected user.
+	// Direction: Server to Client (S2C).
+	RoomMemberUpdateType MessageType = "room_member_update"
+
+	// SetRoomRoleType is sent by a room's owner to make a user a moderator of the room, or a plain
+	// member again. MuteUserType and UnmuteUserType are sent by moderators to stop a user from
+	// posting to the room for a while, or to lift that early. All three carry a RoomMemberData.
+	// Direction: Client to Server (C2S).
+	SetRoomRoleType MessageType = "set_room_role"
+	MuteUserType    MessageType = "mute_user"
+	UnmuteUserType  MessageType = "unmute_user"
+
+	// EditMessageType and DeleteMessageType are sent by a message's author to change or retract
+	// it, within the Hub's edit window; moderators may also delete any message. PinMessageType and
+	// UnpinMessageType are sent by moderators to pin or unpin a message. Message.Content carries a
+	// JSON-encoded MessageActionData.
+	// Direction: Client to Server (C2S).
+	EditMessageType   MessageType = "edit_message"
+	DeleteMessageType MessageType = "delete_message"
+	PinMessageType    MessageType = "pin_message"
+	UnpinMessageType  MessageType = "unpin_message"
+
+	// ListPinnedMessagesType asks for the pinned messages of a room (Message.RoomID, defaulting
+	// to the current room). The server answers with a PinnedMessagesType.
+	// Direction: Client to Server (C2S).
+	ListPinnedMessagesType MessageType = "list_pinned_messages"
+
+	// RoomRoleChangedType, UserMutedType and UserUnmutedType announce moderation of a room's members.
+	// Message.Username names the affected user.
+	// Direction: Server to Client (S2C).
+	RoomRoleChangedType MessageType = "room_role_changed"
+	UserMutedType       MessageType = "user_muted"
+	UserUnmutedType     MessageType = "user_unmuted"
+
+	// MessageEditedType, MessageDeletedType, MessagePinnedType and MessageUnpinnedType announce
+	// changes to a room's messages. Data holds a MessageRefPayload; Message.Username names the
+	// user who made the change.
+	// Direction: Server to Client (S2C).
+	MessageEditedType   MessageType = "message_edited"
+	MessageDeletedType  MessageType = "message_deleted"
+	MessagePinnedType   MessageType = "message_pinned"
+	MessageUnpinnedType MessageType = "message_unpinned"
+
+	// PinnedMessagesType answers a ListPinnedMessagesType. Data holds a PinnedMessagesPayload.
+	// Direction: Server to Client (S2C).
+	PinnedMessagesType MessageType = "pinned_messages"
+
+	// AddReactionType and RemoveReactionType add or withdraw the sender's emoji reaction to a
+	// message of a room. Message.Content carries a JSON-encoded ReactionData.
+	// Direction: Client to Server (C2S).
+	AddReactionType    MessageType = "add_reaction"
+	RemoveReactionType MessageType = "remove_reaction"
+
+	// ReactionUpdatedType announces a reaction added to or withdrawn from a message of a room.
+	// Data holds a ReactionUpdatePayload; Message.Username names the user who reacted.
+	// Direction: Server to Client (S2C).
+	ReactionUpdatedType MessageType = "reaction_updated"
+
+	// LoadThreadType asks for one page of the replies to a message. Message.Content carries a
+	// JSON-encoded ThreadRequestData. The server answers with a ThreadHistoryType.
+	// FollowThreadType and UnfollowThreadType start or stop the delivery of a thread's new
+	// replies to the sender. Posting a reply follows its thread, and the author of a message
+	// follows its thread once it gets its first reply.
+	// Direction: Client to Server (C2S).
+	LoadThreadType     MessageType = "load_thread"
+	FollowThreadType   MessageType = "follow_thread"
+	UnfollowThreadType MessageType = "unfollow_thread"
+
+	// ThreadHistoryType answers a LoadThreadType. Data holds a HistoryPayload with ParentID set.
+	// Direction: Server to Client (S2C).
+	ThreadHistoryType MessageType = "thread_history"
+
+	// ThreadUpdatedType tells a whole room that a message got a new reply, without the reply
+	// itself, which only the thread's followers receive. Data holds a ThreadSummaryPayload.
+	// Direction: Server to Client (S2C).
+	ThreadUpdatedType MessageType = "thread_updated"
+
+	// MarkReadType records that the sender has read a room up to a message. Message.Content
+	// carries a JSON-encoded MarkReadData. Read markers only move forward.
+	// Direction: Client to Server (C2S).
+	MarkReadType MessageType = "mark_read"
+
+	// UnreadCountsType tells a user how many unread messages they have in their rooms. It is sent
+	// on joining a room, and to all of the user's connections when they mark a room as read.
+	// Data holds an UnreadCountsPayload.
+	// Direction: Server to Client (S2C).
+	UnreadCountsType MessageType = "unread_counts"
+
+	// ReadReceiptType tells a room how far one of its users has read, if the Hub's
+	// ReadReceipts option is enabled. Data holds a ReadReceiptPayload.
+	// Direction: Server to Client (S2C).
+	ReadReceiptType MessageType = "read_receipt"
+
+	// SubscribeType and UnsubscribeType add a room to, or remove it from, the rooms a connection
+	// receives, without moving its focus (see JoinRoomMessageType). Message.Content carries a
+	// JSON-encoded JoinRoomData. The server answers with a SubscriptionsType.
+	// Direction: Client to Server (C2S).
+	SubscribeType   MessageType = "subscribe"
+	UnsubscribeType MessageType = "unsubscribe"
+
+	// SubscriptionsType lists the rooms a connection is subscribed to and the one it is focused on.
+	// Data holds a SubscriptionsPayload.
+	// Direction: Server to Client (S2C).
+	SubscriptionsType MessageType = "subscriptions"
+
+	// SetPresenceType is sent by a client to choose its user's status and custom status text.
+	// Message.Content carries a JSON-encoded SetPresenceData.
+	// Direction: Client to Server (C2S).
+	SetPresenceType MessageType = "set_presence"
+
+	// PresenceUpdateType tells that a user's presence changed: they came online or went offline,
+	// went idle or came back, or chose another status. It is sent to the rooms the user is in or a
+	// member of, and to the user's own connections. Data holds a PresencePayload.
+	// Direction: Server to Client (S2C).
+	PresenceUpdateType MessageType = "presence_update"
+
+	// ServerShutdownType tells a client that the server is shutting down and is about to close
+	// its connection. Clients should reconnect, possibly to another instance, after the delay in
+	// Data, a ServerShutdownPayload.
+	// Direction: Server to Client (S2C).
+	ServerShutdownType MessageType = "server_shutdown"
 )
 
 // Message is the primary structure for messages exchanged over WebSocket.
 // It defines a common format for various types of information, including
 // chat texts, system notifications, and data payloads.
 type Message struct {
+	// ID is the server-assigned, per-room sequence number of a chat message. IDs only increase,
+	// so they double as history cursors. Zero (omitted) for messages that are not logged.
+	ID int64 `json:"id,omitempty"`
+	// ClientMsgID is an optional ID chosen by the sending client for a text message. It is echoed
+	// back in the AckMessageType (or ErrorMessageType) for that message, and retries carrying the
+	// same ClientMsgID are not stored twice.
+	ClientMsgID string `json:"client_msg_id,omitempty"`
 	// Type indicates the kind of message, determining how payload/data should be interpreted.
 	Type MessageType `json:"type"`
 	// Content is primarily used for text messages or simple string payloads (e.g., system notifications).
@@ -71,11 +262,30 @@ type Message struct {
 	Username string `json:"username,omitempty"`
 	// RoomID specifies the room this message pertains to. For global messages, this might be empty.
 	RoomID string `json:"roomID,omitempty"`
+	// To names the recipient of a DirectMessageType. Direct messages have no RoomID.
+	To string `json:"to,omitempty"`
 	// Timestamp records when the message was generated, typically set by the server for S2C messages.
 	Timestamp time.Time `json:"timestamp"`
 	// System is a boolean flag indicating if this is a system-generated message (e.g., join/leave notifications)
 	// rather than a user-generated chat message.
 	System bool `json:"system,omitempty"`
+	// ParentID is the ID of the message a thread reply answers, in the same room. Replies are sent
+	// to the thread's followers instead of the whole room. Zero (omitted) for top-level messages.
+	ParentID int64 `json:"parent_id,omitempty"`
+	// ReplyCount and LastReplyAt summarize the thread of replies to a chat message, if it has one.
+	ReplyCount  int64      `json:"reply_count,omitempty"`
+	LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+	// EditedAt is when a chat message was last edited. Nil (omitted) for messages never edited.
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// Deleted marks the tombstone left in the history in place of a deleted chat message.
+	// Tombstones keep the message's ID, author and timestamp but not its content.
+	Deleted bool `json:"deleted,omitempty"`
+	// DeletedBy names the user who deleted the message.
+	DeletedBy string `json:"deleted_by,omitempty"`
+	// Trace is the W3C trace context (traceparent and tracestate) of the span that handled the
+	// message, so that its delivery can be traced across the Hub, Redis and other instances.
+	// Clients may set it to have the server continue their own trace. It is not stored.
+	Trace map[string]string `json:"trace,omitempty"`
 	// Data is a flexible field for more complex payloads, such as lists of messages, user lists, or structured stats.
 	// The actual type of Data depends on the MessageType.
 	Data interface{} `json:"data,omitempty"`
@@ -94,16 +304,187 @@ type RoomStatsPayload struct {
 // UserListPayload defines the structured data for UserListUpdateType messages.
 // It provides a list of usernames currently active in a specific room.
 type UserListPayload struct {
-	RoomID string   `json:"roomID"` // The ID of the room this user list is for.
-	Users  []string `json:"users"`  // A slice of usernames.
+	RoomID   string            `json:"roomID"`             // The ID of the room this user list is for.
+	Users    []string          `json:"users"`              // A slice of usernames.
+	Presence []PresencePayload `json:"presence,omitempty"` // The presence of each user, in the same order.
+}
+
+// PresencePayload defines the structured data for PresenceUpdateType messages, and a user's
+// presence in a UserListPayload.
+type PresencePayload struct {
+	Username   string     `json:"username"`
+	Status     string     `json:"status"`                // "online", "away", "dnd" or "offline".
+	StatusText string     `json:"status_text,omitempty"` // The user's custom status text.
+	LastSeen   *time.Time `json:"last_seen,omitempty"`   // When the user was last seen active. Nil if never.
 }
 
 // RecentMessagesPayload defines the structured data for RecentMessagesType messages.
 // It contains a list of recent messages, where each message is a JSON string
 // (typically a serialized domain.Message or another websocket.Message of TextMessageType).
 type RecentMessagesPayload struct {
-	RoomID   string   `json:"roomID"`   // The room these messages belong to.
-	Messages []string `json:"messages"` // Slice of serialized message objects.
+	RoomID    string                     `json:"roomID"`              // The room these messages belong to.
+	Messages  []string                   `json:"messages"`            // Slice of serialized message objects.
+	Reactions map[int64]map[string]int64 `json:"reactions,omitempty"` // Reaction counts of these messages, by message ID and emoji.
+}
+
+// AckPayload defines the structured data for AckMessageType messages.
+type AckPayload struct {
+	ClientMsgID string `json:"client_msg_id,omitempty"` // The ClientMsgID the client sent the message with, if any.
+	MessageID   int64  `json:"id"`                      // The server-assigned ID the message was stored under.
+	RoomID      string `json:"roomID,omitempty"`        // The room the message was posted to, for room messages.
+	To          string `json:"to,omitempty"`            // The recipient, for direct messages.
+	Duplicate   bool   `json:"duplicate,omitempty"`     // True if this acknowledges a retry of an already stored message.
+}
+
+// HistoryPayload defines the structured data for HistoryType messages and for the
+// GET /api/rooms/{id}/messages endpoint. It holds one page of a room's history.
+type HistoryPayload struct {
+	RoomID     string            `json:"roomID,omitempty"`      // The room these messages belong to, for room history.
+	Peer       string            `json:"peer,omitempty"`        // The other participant, for direct conversation history.
+	ParentID   int64             `json:"parent_id,omitempty"`   // The thread's parent message ID, for thread history.
+	Parent     json.RawMessage   `json:"parent,omitempty"`      // The thread's parent message, on the first page of thread history.
+	Messages   []json.RawMessage `json:"messages"`              // Serialized messages, oldest first.
+	NextCursor string            `json:"next_cursor,omitempty"` // Cursor for the next (older) page. Empty if there is none.
+	HasMore    bool              `json:"has_more"`              // Whether older messages exist beyond this page.
+
+	// Reactions holds the reaction counts of a room's messages in this page, by message ID and emoji.
+	Reactions map[int64]map[string]int64 `json:"reactions,omitempty"`
+}
+
+// ResumePayload defines the structured data for MissedMessagesType and ResyncRequiredType messages.
+type ResumePayload struct {
+	RoomID   string            `json:"roomID"`             // The room being resumed.
+	AfterID  int64             `json:"after_id"`           // The last message ID the client reported having seen.
+	Messages []json.RawMessage `json:"messages,omitempty"` // Serialized missed messages, oldest first. Empty for ResyncRequiredType.
+
+	// Reactions holds the reaction counts of the missed messages, by message ID and emoji.
+	Reactions map[int64]map[string]int64 `json:"reactions,omitempty"`
+}
+
+// ConversationSummary describes one direct conversation in a ConversationListPayload.
+type ConversationSummary struct {
+	Peer          string    `json:"peer"`            // The other participant.
+	LastMessageAt time.Time `json:"last_message_at"` // When the last message was exchanged.
+}
+
+// ConversationListPayload defines the structured data for ConversationListType messages and for
+// the GET /api/conversations endpoint. Conversations are listed most recently active first.
+type ConversationListPayload struct {
+	Conversations []ConversationSummary `json:"conversations"`
+}
+
+// RoomInfoPayload defines the structured data for RoomInfoType messages and for the /api/rooms endpoints.
+type RoomInfoPayload struct {
+	RoomID     string    `json:"roomID"`             // The room's ID.
+	Name       string    `json:"name"`               // The room's display name.
+	Topic      string    `json:"topic,omitempty"`    // The room's topic, if set.
+	CreatedBy  string    `json:"created_by"`         // The user who created the room. Empty for rooms created by the server.
+	CreatedAt  time.Time `json:"created_at"`         // When the room was created.
+	Visibility string    `json:"visibility"`         // "public", "invite-only" or "private". See the cache.RoomVisibility constants.
+	Archived   bool      `json:"archived,omitempty"` // Archived rooms can no longer be joined or posted to.
+}
+
+// RoomListPayload defines the structured data for the GET /api/rooms endpoint.
+type RoomListPayload struct {
+	Rooms []RoomInfoPayload `json:"rooms"` // Rooms listed oldest first.
+}
+
+// RoomMembersPayload defines the structured data for the GET /api/rooms/{id}/members endpoint.
+type RoomMembersPayload struct {
+	RoomID     string   `json:"roomID"`               // The room these members belong to.
+	Members    []string `json:"members"`              // The room's members, sorted.
+	Moderators []string `json:"moderators,omitempty"` // The room's moderators, sorted. The owner is the room's creator.
+	Banned     []string `json:"banned,omitempty"`     // The users banned from the room. Only shown to moderators.
+}
+
+// MessageRefPayload defines the structured data for MessageEditedType, MessageDeletedType,
+// MessagePinnedType and MessageUnpinnedType: the message concerned, by ID and, when edited or
+// pinned, in full.
+type MessageRefPayload struct {
+	RoomID    string          `json:"roomID"`
+	MessageID int64           `json:"message_id"`
+	Message   json.RawMessage `json:"message,omitempty"` // The edited or pinned message, as stored in the history.
+}
+
+// MessageVersion is an earlier version of an edited message, as kept in its edit history.
+type MessageVersion struct {
+	Content   string    `json:"content"`
+	WrittenAt time.Time `json:"written_at"` // When this version was sent, or written by an edit.
+}
+
+// MessageEditsPayload defines the structured data for the GET /api/rooms/{id}/messages/{messageID}/edits endpoint.
+type MessageEditsPayload struct {
+	RoomID    string           `json:"roomID"`
+	MessageID int64            `json:"message_id"`
+	Versions  []MessageVersion `json:"versions"` // The message's earlier versions, oldest first. The current one is in the history.
+}
+
+// PinnedMessagesPayload defines the structured data for PinnedMessagesType and the
+// GET /api/rooms/{id}/pins endpoint.
+type PinnedMessagesPayload struct {
+	RoomID   string            `json:"roomID"`
+	Messages []json.RawMessage `json:"messages"` // In the order they were pinned.
+}
+
+// ReactionUpdatePayload defines the structured data for ReactionUpdatedType messages: one
+// reaction added or withdrawn, and the emoji's resulting count on the message.
+type ReactionUpdatePayload struct {
+	RoomID    string `json:"roomID"`
+	MessageID int64  `json:"message_id"`
+	Emoji     string `json:"emoji"`
+	Username  string `json:"username"` // The user who reacted.
+	Added     bool   `json:"added"`    // True if the reaction was added, false if it was withdrawn.
+	Count     int64  `json:"count"`    // How many users now react to the message with this emoji.
+}
+
+// ThreadSummaryPayload defines the structured data for ThreadUpdatedType messages.
+type ThreadSummaryPayload struct {
+	RoomID      string    `json:"roomID"`
+	ParentID    int64     `json:"parent_id"`
+	ReplyCount  int64     `json:"reply_count"`
+	LastReplyAt time.Time `json:"last_reply_at"`
+	LastReplyBy string    `json:"last_reply_by"`
+}
+
+// UnreadCountsPayload defines the structured data for UnreadCountsType messages and for the
+// response of GET /api/users/me/unread.
+type UnreadCountsPayload struct {
+	Rooms []RoomUnreadCount `json:"rooms"` // Sorted by room ID.
+	Total int64             `json:"total"` // Sum of the rooms' unread counts.
+}
+
+// RoomUnreadCount is a user's read state in one room.
+type RoomUnreadCount struct {
+	RoomID          string `json:"roomID"`
+	LastReadID      int64  `json:"last_read_id"`      // The last message the user has read. Zero if none.
+	LatestMessageID int64  `json:"latest_message_id"` // The room's latest message ID.
+	Unread          int64  `json:"unread"`            // Messages after LastReadID, thread replies included.
+}
+
+// ReadReceiptPayload defines the structured data for ReadReceiptType messages.
+type ReadReceiptPayload struct {
+	RoomID     string `json:"roomID"`
+	Username   string `json:"username"`     // The reader.
+	LastReadID int64  `json:"last_read_id"` // The reader has read every message up to this ID.
+}
+
+// SetPresenceData is the structure expected in Message.Content for SetPresenceType messages.
+type SetPresenceData struct {
+	Status     string `json:"status"`      // "online", "away" or "dnd". Online shows as away while idle.
+	StatusText string `json:"status_text"` // Custom status text. Empty clears it.
+}
+
+// SubscriptionsPayload defines the structured data for SubscriptionsType messages.
+type SubscriptionsPayload struct {
+	Rooms []string `json:"rooms"`           // The rooms the connection receives, sorted by ID.
+	Focus string   `json:"focus,omitempty"` // The room its requests default to. Empty if none.
+}
+
+// ServerShutdownPayload defines the structured data for ServerShutdownType messages.
+type ServerShutdownPayload struct {
+	// ReconnectAfterMs is how long the client should wait before reconnecting, in milliseconds.
+	// It is randomized per connection, so that clients do not all reconnect at once.
+	ReconnectAfterMs int64 `json:"reconnect_after_ms"`
 }
 
 // GlobalUserCountPayload defines the structured data for GlobalUserCountUpdateType messages.
@@ -115,8 +496,10 @@ type GlobalUserCountPayload struct {
 // ErrorPayload defines structured data for ErrorMessageType messages.
 // It allows sending a more detailed error back to the client.
 type ErrorPayload struct {
-	Code    int    `json:"code,omitempty"` // An optional application-specific error code.
+	Code    int    `json:"code,omitempty"` // An optional application-specific error code, e.g. ErrorCodeRateLimited.
 	Message string `json:"message"`        // A descriptive error message.
+	// RetryAfterMs is how long the client should wait before retrying, in milliseconds, if it may.
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
 }
 
 // JoinRoomData is the expected structure within Message.Content or Message.Data
@@ -125,6 +508,12 @@ type JoinRoomData struct {
 	RoomID string `json:"roomID"` // The ID of the room the client wishes to join.
 }
 
+// LoadHistoryData is the expected structure within Message.Content when a client sends a LoadHistoryType.
+type LoadHistoryData struct {
+	Before string `json:"before,omitempty"` // Cursor: only messages older than this are returned. Empty for the newest page.
+	Limit  int    `json:"limit,omitempty"`  // Page size. Defaults to DefaultHistoryPageSize, capped at MaxHistoryPageSize.
+}
+
 // TypingData is the expected structure for UserTypingMessageType, typically in Message.Data.
 // Alternatively, Message.Content could be "start" or "stop".
 // Using a struct in Data allows for more extensibility if needed.
@@ -139,3 +528,44 @@ type TypingData struct {
 func PlaceholderMessage() string {
 	return "WebSocket message definitions are structured here."
 }
+
+// RoomMemberData is the expected structure within Message.Content for the room membership
+// requests (InviteToRoomType, KickFromRoomType, BanFromRoomType and UnbanFromRoomType).
+type RoomMemberData struct {
+	RoomID   string `json:"roomID,omitempty"` // The room to act on. Defaults to the client's current room.
+	Username string `json:"username"`         // The user to invite, kick, ban, unban, mute or unmute.
+	// Role is the user's new role, for SetRoomRoleType: "moderator" or "member".
+	Role string `json:"role,omitempty"`
+	// DurationSeconds is how long a MuteUserType lasts. Zero means the default duration.
+	DurationSeconds int `json:"duration_seconds,omitempty"`
+}
+
+// MessageActionData is the expected structure within Message.Content for EditMessageType,
+// DeleteMessageType, PinMessageType and UnpinMessageType.
+type MessageActionData struct {
+	RoomID    string `json:"roomID,omitempty"`  // The message's room. Defaults to the client's current room.
+	MessageID int64  `json:"message_id"`        // The message's ID.
+	Content   string `json:"content,omitempty"` // The message's new content, for EditMessageType.
+}
+
+// ReactionData is the expected structure within Message.Content for AddReactionType and RemoveReactionType.
+type ReactionData struct {
+	RoomID    string `json:"roomID,omitempty"` // The message's room. Defaults to the client's current room.
+	MessageID int64  `json:"message_id"`       // The message's ID.
+	Emoji     string `json:"emoji"`            // The reaction, e.g. "👍".
+}
+
+// MarkReadData is the expected structure within Message.Content for MarkReadType.
+type MarkReadData struct {
+	RoomID    string `json:"roomID,omitempty"` // The room read. Defaults to the client's current room.
+	MessageID int64  `json:"message_id"`       // The last message read. Zero means the room's latest message.
+}
+
+// ThreadRequestData is the expected structure within Message.Content for LoadThreadType,
+// FollowThreadType and UnfollowThreadType.
+type ThreadRequestData struct {
+	RoomID   string `json:"roomID,omitempty"` // The thread's room. Defaults to the client's current room.
+	ParentID int64  `json:"parent_id"`        // The thread's parent message ID.
+	Before   string `json:"before,omitempty"` // For LoadThreadType: the next_cursor of a previous page. Empty for the newest page.
+	Limit    int    `json:"limit,omitempty"`  // For LoadThreadType: the page size. Zero means DefaultHistoryPageSize.
+}
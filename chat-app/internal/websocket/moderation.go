@@ -0,0 +1,350 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/logging"
+)
+
+const (
+	// defaultMuteDuration is how long a mute lasts when the moderator does not say.
+	defaultMuteDuration = 10 * time.Minute
+
+	// maxMuteDuration is the longest a user can be muted for. Longer-lasting trouble calls for a ban.
+	maxMuteDuration = 7 * 24 * time.Hour
+
+	// maxPinnedMessages is the most messages a room can have pinned at once.
+	maxPinnedMessages = 50
+)
+
+// Errors returned by the room moderation operations.
+var (
+	ErrNotModerator    = errors.New("only the room's moderators can do this")
+	ErrOutranked       = errors.New("cannot moderate a user whose role is equal to or above yours")
+	ErrMessageNotFound = errors.New("message not found")
+	ErrTooManyPins     = errors.New("too many pinned messages")
+)
+
+// roleRanks orders the room roles by privilege.
+var roleRanks = map[string]int{
+	cache.RoomRoleMember:    0,
+	cache.RoomRoleModerator: 1,
+	cache.RoomRoleOwner:     2,
+}
+
+// roomRole returns username's role in a registered room. The room's creator is its owner;
+// users without a stored role are plain members.
+func roomRole(ctx context.Context, store cache.RoomStore, room *cache.Room, username string) (string, error) {
+	if room.CreatedBy != "" && room.CreatedBy == username {
+		return cache.RoomRoleOwner, nil
+	}
+	role, err := store.GetRoomRole(ctx, room.ID, username)
+	if err != nil {
+		return "", fmt.Errorf("failed to get role of user '%s' in room '%s': %w", username, room.ID, err)
+	}
+	if _, known := roleRanks[role]; !known {
+		return cache.RoomRoleMember, nil
+	}
+	return role, nil
+}
+
+// moderatedRoom returns the registry record of a room that actor may moderate: the room must
+// be registered and not archived, and actor must be one of its moderators or its owner.
+func (h *Hub) moderatedRoom(ctx context.Context, roomID string, actor string) (*cache.Room, error) {
+	room, err := h.store.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room '%s': %w", roomID, err)
+	}
+	if room == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrRoomNotFound, roomID)
+	}
+	if room.Archived {
+		return nil, fmt.Errorf("%w: '%s'", ErrRoomArchived, roomID)
+	}
+	role, err := roomRole(ctx, h.store, room, actor)
+	if err != nil {
+		return nil, err
+	}
+	if roleRanks[role] < roleRanks[cache.RoomRoleModerator] {
+		return nil, fmt.Errorf("%w: '%s'", ErrNotModerator, roomID)
+	}
+	return room, nil
+}
+
+// checkOutranks fails with ErrOutranked unless actor's role in the room is above target's,
+// so that moderators cannot act against each other or against the room's owner.
+func (h *Hub) checkOutranks(ctx context.Context, room *cache.Room, actor string, target string) error {
+	actorRole, err := roomRole(ctx, h.store, room, actor)
+	if err != nil {
+		return err
+	}
+	targetRole, err := roomRole(ctx, h.store, room, target)
+	if err != nil {
+		return err
+	}
+	if roleRanks[actorRole] <= roleRanks[targetRole] {
+		return fmt.Errorf("%w: '%s' is the room's %s", ErrOutranked, target, targetRole)
+	}
+	return nil
+}
+
+// SetRoomRole makes target a moderator of a room, or a plain member again, on behalf of actor,
+// who must be the room's owner. Moderators are also made members, so that they can access
+// private and invite-only rooms. The room is notified with a RoomRoleChangedType.
+func (h *Hub) SetRoomRole(ctx context.Context, roomID string, actor string, target string, role string) error {
+	if role != cache.RoomRoleModerator && role != cache.RoomRoleMember {
+		return fmt.Errorf("%w: role must be '%s' or '%s'", ErrInvalidMember, cache.RoomRoleModerator, cache.RoomRoleMember)
+	}
+	room, err := h.managedRoom(ctx, roomID, actor, target)
+	if err != nil {
+		return err
+	}
+	if actorRole, err := roomRole(ctx, h.store, room, actor); err != nil {
+		return err
+	} else if actorRole != cache.RoomRoleOwner {
+		return fmt.Errorf("%w: '%s'", ErrNotRoomOwner, roomID)
+	}
+	if role == cache.RoomRoleModerator {
+		_, banned, err := h.store.GetRoomAccess(ctx, roomID, target)
+		if err != nil {
+			return fmt.Errorf("failed to check access of user '%s' to room '%s': %w", target, roomID, err)
+		}
+		if banned {
+			return fmt.Errorf("%w: '%s' must be unbanned first", ErrBannedFromRoom, target)
+		}
+		if err := h.store.AddRoomMember(ctx, roomID, target); err != nil {
+			return fmt.Errorf("failed to add moderator '%s' to members of room '%s': %w", target, roomID, err)
+		}
+	}
+	if err := h.store.SetRoomRole(ctx, roomID, target, role); err != nil {
+		return fmt.Errorf("failed to make user '%s' a %s of room '%s': %w", target, role, roomID, err)
+	}
+	h.log.Info("Room role changed", "room_id", roomID, "user", target, "role", role, "actor", actor)
+	h.broadcastSystemMessageToRoom(roomID, fmt.Sprintf("User '%s' is now a %s of this room.", target, role), target, RoomRoleChangedType)
+	return nil
+}
+
+// MuteUser stops target from posting to a room for duration (defaultMuteDuration if zero), on
+// behalf of actor, who must be one of the room's moderators and outrank target. Muting an
+// already muted user replaces their mute. The room is notified with a UserMutedType.
+func (h *Hub) MuteUser(ctx context.Context, roomID string, actor string, target string, duration time.Duration) error {
+	if duration == 0 {
+		duration = defaultMuteDuration
+	}
+	if duration < time.Second || duration > maxMuteDuration {
+		return fmt.Errorf("%w: mutes last from 1 second to %s", ErrInvalidMember, maxMuteDuration)
+	}
+	room, err := h.managedRoom(ctx, roomID, actor, target)
+	if err != nil {
+		return err
+	}
+	if err := h.checkOutranks(ctx, room, actor, target); err != nil {
+		return err
+	}
+	until := time.Now().UTC().Add(duration)
+	if err := h.store.MuteInRoom(ctx, roomID, target, until); err != nil {
+		return fmt.Errorf("failed to mute user '%s' in room '%s': %w", target, roomID, err)
+	}
+	h.log.Info("User muted", "room_id", roomID, "user", target, "actor", actor, "until", until)
+	h.broadcastSystemMessageToRoom(roomID, fmt.Sprintf("User '%s' was muted by '%s' for %s.", target, actor, duration), target, UserMutedType)
+	return nil
+}
+
+// UnmuteUser lifts target's mute in a room on behalf of actor, who must be one of the room's
+// moderators. The room is notified with a UserUnmutedType.
+func (h *Hub) UnmuteUser(ctx context.Context, roomID string, actor string, target string) error {
+	if _, err := h.managedRoom(ctx, roomID, actor, target); err != nil {
+		return err
+	}
+	if err := h.store.UnmuteInRoom(ctx, roomID, target); err != nil {
+		return fmt.Errorf("failed to unmute user '%s' in room '%s': %w", target, roomID, err)
+	}
+	h.log.Info("User unmuted", "room_id", roomID, "user", target, "actor", actor)
+	h.broadcastSystemMessageToRoom(roomID, fmt.Sprintf("User '%s' was unmuted by '%s'.", target, actor), target, UserUnmutedType)
+	return nil
+}
+
+// PinMessage pins a message of a room on behalf of actor, who must be one of the room's
+// moderators. A room has at most maxPinnedMessages pinned messages; deleted messages cannot be
+// pinned. The room is notified with a MessagePinnedType. Pinning a message twice is a no-op.
+func (h *Hub) PinMessage(ctx context.Context, roomID string, actor string, messageID int64) error {
+	if _, err := h.moderatedRoom(ctx, roomID, actor); err != nil {
+		return err
+	}
+	message, messageJSON, err := h.loggedMessage(ctx, roomID, messageID)
+	if err != nil {
+		return err
+	}
+	if message.Deleted {
+		return fmt.Errorf("%w: %d was deleted", ErrMessageNotFound, messageID)
+	}
+	pinned, err := h.store.GetPinnedMessageIDs(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to list pinned messages of room '%s': %w", roomID, err)
+	}
+	if len(pinned) >= maxPinnedMessages {
+		return fmt.Errorf("%w: unpin one of the room's %d pinned messages first", ErrTooManyPins, len(pinned))
+	}
+	added, err := h.store.PinMessage(ctx, roomID, messageID, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("failed to pin message %d of room '%s': %w", messageID, roomID, err)
+	}
+	if !added {
+		return nil
+	}
+	h.log.Info("Message pinned", "room_id", roomID, "message_id", messageID, "actor", actor)
+	h.broadcastSystemEventToRoom(roomID, fmt.Sprintf("'%s' pinned a message by '%s'.", actor, message.Username), actor, MessagePinnedType,
+		MessageRefPayload{RoomID: roomID, MessageID: messageID, Message: json.RawMessage(messageJSON)})
+	return nil
+}
+
+// UnpinMessage unpins a message of a room on behalf of actor, who must be one of the room's
+// moderators. The room is notified with a MessageUnpinnedType. Unpinning a message that is not
+// pinned is a no-op.
+func (h *Hub) UnpinMessage(ctx context.Context, roomID string, actor string, messageID int64) error {
+	if _, err := h.moderatedRoom(ctx, roomID, actor); err != nil {
+		return err
+	}
+	removed, err := h.store.UnpinMessage(ctx, roomID, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to unpin message %d of room '%s': %w", messageID, roomID, err)
+	}
+	if !removed {
+		return nil
+	}
+	h.log.Info("Message unpinned", "room_id", roomID, "message_id", messageID, "actor", actor)
+	h.broadcastSystemEventToRoom(roomID, fmt.Sprintf("'%s' unpinned a message.", actor), actor, MessageUnpinnedType,
+		MessageRefPayload{RoomID: roomID, MessageID: messageID})
+	return nil
+}
+
+// loggedMessage reads a message from a room's log, both decoded and as stored, failing with
+// ErrMessageNotFound if it is not there.
+func (h *Hub) loggedMessage(ctx context.Context, roomID string, messageID int64) (*Message, string, error) {
+	if messageID <= 0 {
+		return nil, "", fmt.Errorf("%w: %d", ErrMessageNotFound, messageID)
+	}
+	messageJSON, err := h.store.GetMessage(ctx, roomID, messageID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get message %d of room '%s': %w", messageID, roomID, err)
+	}
+	if messageJSON == "" {
+		return nil, "", fmt.Errorf("%w: %d", ErrMessageNotFound, messageID)
+	}
+	var message Message
+	if err := json.Unmarshal([]byte(messageJSON), &message); err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal message %d of room '%s': %w", messageID, roomID, err)
+	}
+	return &message, messageJSON, nil
+}
+
+// ListPinnedMessages returns the pinned messages of a room, in the order they were pinned.
+// Pinned messages that have since been trimmed from the room's log are left out.
+// Callers are responsible for checking the requester's access to the room.
+func ListPinnedMessages(ctx context.Context, store cache.Store, roomID string) (*PinnedMessagesPayload, error) {
+	ids, err := store.GetPinnedMessageIDs(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pinned messages of room '%s': %w", roomID, err)
+	}
+	payload := &PinnedMessagesPayload{RoomID: roomID, Messages: make([]json.RawMessage, 0, len(ids))}
+	for _, id := range ids {
+		messageJSON, err := store.GetMessage(ctx, roomID, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pinned message %d of room '%s': %w", id, roomID, err)
+		}
+		if messageJSON != "" {
+			payload.Messages = append(payload.Messages, json.RawMessage(messageJSON))
+		}
+	}
+	return payload, nil
+}
+
+// handleMessageAction answers a client's EditMessageType, DeleteMessageType, PinMessageType or
+// UnpinMessageType request. Message.Content carries a JSON-encoded MessageActionData whose
+// room defaults to the client's current room. The request is carried out on the room's worker,
+// after the messages posted to the room before it are stored.
+func (h *Hub) handleMessageAction(client *Client, msg *Message) {
+	var request MessageActionData
+	if err := json.Unmarshal([]byte(msg.Content), &request); err != nil {
+		client.log.Warn("Invalid request data", "type", msg.Type, "error", err, logging.Content(msg.Content))
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Invalid message request format.", Timestamp: time.Now().UTC()})
+		return
+	}
+	roomID := request.RoomID
+	if roomID == "" {
+		roomID = client.currentRoomID()
+	}
+	if roomID == "" {
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "RoomID required for message request.", Timestamp: time.Now().UTC()})
+		return
+	}
+
+	h.runOnWorker(roomID, client, msg, func(ctx context.Context) {
+		var err error
+		switch msg.Type {
+		case EditMessageType:
+			err = h.EditMessage(ctx, roomID, client.username, request.MessageID, request.Content)
+		case DeleteMessageType:
+			err = h.DeleteMessage(ctx, roomID, client.username, request.MessageID)
+		case PinMessageType:
+			err = h.PinMessage(ctx, roomID, client.username, request.MessageID)
+		case UnpinMessageType:
+			err = h.UnpinMessage(ctx, roomID, client.username, request.MessageID)
+		}
+		if err != nil {
+			client.log.Warn("Message action failed", "type", msg.Type, "room_id", roomID, "message_id", request.MessageID, "error", err)
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: moderationErrorText(err), RoomID: roomID, Timestamp: time.Now().UTC()})
+		}
+	})
+}
+
+// handleListPinnedMessages answers a client's ListPinnedMessagesType request for the pinned
+// messages of msg.RoomID, or of its current room, on the room's worker.
+func (h *Hub) handleListPinnedMessages(client *Client, msg *Message) {
+	roomID := msg.RoomID
+	if roomID == "" {
+		roomID = client.currentRoomID()
+	}
+	if roomID == "" {
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "RoomID required for pinned messages request.", Timestamp: time.Now().UTC()})
+		return
+	}
+	h.runOnWorker(roomID, client, msg, func(ctx context.Context) {
+		if _, err := h.CheckRoomAccess(ctx, roomID, client.username); err != nil {
+			client.log.Warn("Listing pinned messages refused", "room_id", roomID, "error", err)
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: roomJoinErrorText(err), RoomID: roomID, Timestamp: time.Now().UTC()})
+			return
+		}
+		pinned, err := ListPinnedMessages(ctx, h.store, roomID)
+		if err != nil {
+			client.log.Error("Listing pinned messages failed", "room_id", roomID, "error", err)
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Failed to list pinned messages of " + roomID, RoomID: roomID, Timestamp: time.Now().UTC()})
+			return
+		}
+		h.sendToClient(client, &Message{
+			Type:      PinnedMessagesType,
+			RoomID:    roomID,
+			Data:      pinned,
+			Timestamp: time.Now().UTC(),
+			System:    true,
+		})
+	})
+}
+
+// muteReason explains to username why they cannot post to a room if they are muted in it,
+// or returns "" if they are not.
+func (h *Hub) muteReason(ctx context.Context, roomID string, username string) (string, error) {
+	until, err := h.store.GetMutedUntil(ctx, roomID, username)
+	if err != nil {
+		return "", fmt.Errorf("failed to get mute of user '%s' in room '%s': %w", username, roomID, err)
+	}
+	if until.IsZero() {
+		return "", nil
+	}
+	return fmt.Sprintf("You are muted in this room until %s UTC.", until.Format("2006-01-02 15:04:05")), nil
+}
@@ -0,0 +1,244 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/logging"
+)
+
+const (
+	// DefaultAwayAfter is how long a user must be idle on all their connections to be shown as
+	// away, unless the Hub is configured otherwise.
+	DefaultAwayAfter = 5 * time.Minute
+
+	// presenceCheckInterval is how often the Hub records its users' activity in the store and
+	// looks for users who became idle or active again.
+	presenceCheckInterval = 15 * time.Second
+
+	// maxStatusTextLength is the longest custom status text accepted, in characters.
+	maxStatusTextLength = 100
+)
+
+// userActivity is what a Hub knows about the activity of a user with local connections.
+// It is only accessed on the Hub's event loop; the presence checks of the room workers post what
+// they find back to it.
+type userActivity struct {
+	lastActive time.Time // Latest activity of the user's local connections recorded in the store.
+	idle       bool      // Whether the user was idle on every connection at the last presence check.
+}
+
+// countsAsActivity reports whether a client sending a message of type t shows that its user is
+// active. Clients send MarkReadType on their own as messages arrive, so it does not.
+func countsAsActivity(t MessageType) bool {
+	return t != MarkReadType
+}
+
+// UserPresences returns the current presence of each of the given users, in the same order.
+func (h *Hub) UserPresences(ctx context.Context, usernames []string) ([]PresencePayload, error) {
+	stored, err := h.store.GetUserPresences(ctx, usernames)
+	if err != nil {
+		return nil, err
+	}
+	presences := make([]PresencePayload, 0, len(usernames))
+	for _, username := range usernames {
+		presences = append(presences, presencePayload(username, stored[username]))
+	}
+	return presences, nil
+}
+
+// presencePayload derives a user's presence from what the store knows about it: offline without
+// connections, otherwise the status they chose, except that online shows as away while they are idle.
+func presencePayload(username string, stored *cache.UserPresence) PresencePayload {
+	presence := PresencePayload{Username: username, Status: stored.Status, StatusText: stored.StatusText}
+	switch {
+	case !stored.Connected:
+		presence.Status = cache.PresenceOffline
+	case stored.Status == cache.PresenceOnline && stored.Idle:
+		presence.Status = cache.PresenceAway
+	}
+	if !stored.LastSeen.IsZero() {
+		lastSeen := stored.LastSeen
+		presence.LastSeen = &lastSeen
+	}
+	return presence
+}
+
+// broadcastPresence sends username's current presence as a PresenceUpdateType to every room
+// they are a member of or subscribed to, plus leftRooms (rooms they have just left), and to all
+// of their own connections, on every instance.
+func (h *Hub) broadcastPresence(ctx context.Context, username string, leftRooms ...string) {
+	presences, err := h.UserPresences(ctx, []string{username})
+	if err != nil {
+		h.log.Error("Getting presence of user failed", "user", username, "error", err)
+		return
+	}
+	presence := presences[0]
+
+	rooms := make(map[string]bool)
+	for _, roomID := range leftRooms {
+		rooms[roomID] = true
+	}
+	memberOf, err := h.store.GetUserRooms(ctx, username)
+	if err != nil {
+		h.log.Error("Getting rooms of user to share their presence failed", "user", username, "error", err)
+	}
+	for _, roomID := range memberOf {
+		rooms[roomID] = true
+	}
+	h.mu.RLock()
+	for client := range h.sessions[username] {
+		for roomID := range client.subscriptions {
+			rooms[roomID] = true
+		}
+	}
+	h.mu.RUnlock()
+
+	for roomID := range rooms {
+		h.broadcastToRoom(&Message{Type: PresenceUpdateType, Username: username, RoomID: roomID, Data: presence, Timestamp: time.Now().UTC(), System: true})
+	}
+	update := &Message{Type: PresenceUpdateType, Username: username, Data: presence, Timestamp: time.Now().UTC(), System: true}
+	h.deliverToUser(username, update) // Keep the user's other tabs and devices in step.
+	h.publishUserEvent(username, update)
+	h.log.Debug("Presence shared", "user", username, "status", presence.Status, "rooms", len(rooms))
+}
+
+// checkIdleUsers runs every presenceCheckInterval. It has each user with local connections
+// checked on the user's room worker (see checkIdleUser), with the latest activity of their
+// connections, as seen by their ReadPump.
+func (h *Hub) checkIdleUsers() {
+	h.mu.RLock()
+	latest := make(map[string]time.Time, len(h.sessions))
+	for username, connections := range h.sessions {
+		for client := range connections {
+			if at := time.Unix(0, client.lastActivity.Load()); at.After(latest[username]) {
+				latest[username] = at
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for username, at := range latest {
+		activity := h.activity[username]
+		if activity == nil {
+			continue
+		}
+		lastActive := activity.lastActive
+		h.onRoomWorker(userWorkerKey(username), func(ctx context.Context) {
+			h.checkIdleUser(ctx, username, at, lastActive)
+		})
+	}
+}
+
+// checkIdleUser records in the store that username was last active at, unless that is no later
+// than lastActive, the activity recorded before. It then marks the user idle once the store's
+// last-seen time, which covers their connections on every instance, is AwayAfter old, and marks
+// them active again once it is not. Users who chose to be online are shown as away while idle.
+// What it finds is written back to the user's activity on the event loop.
+func (h *Hub) checkIdleUser(ctx context.Context, username string, at time.Time, lastActive time.Time) {
+	if at.After(lastActive) {
+		if err := h.store.TouchUserLastSeen(ctx, username, at); err != nil {
+			h.log.Error("Recording last seen time failed", "user", username, "error", err)
+		} else {
+			lastActive = at
+		}
+	}
+	stored, err := h.store.GetUserPresences(ctx, []string{username})
+	if err != nil {
+		h.log.Error("Getting presence of local user failed", "user", username, "error", err)
+		return
+	}
+
+	now := time.Now()
+	presence := stored[username]
+	idle := h.options.AwayAfter > 0 && now.Sub(presence.LastSeen) >= h.options.AwayAfter
+	h.onLoop(func() {
+		if activity := h.activity[username]; activity != nil { // Unless the user disconnected meanwhile.
+			if lastActive.After(activity.lastActive) {
+				activity.lastActive = lastActive
+			}
+			activity.idle = idle
+		}
+	})
+	if idle == presence.Idle {
+		return
+	}
+	if err := h.store.SetUserIdle(ctx, username, idle); err != nil {
+		h.log.Error("Updating idle state failed", "user", username, "idle", idle, "error", err)
+		return
+	}
+	if idle {
+		h.log.Debug("User is idle", "user", username, "idle_for", now.Sub(presence.LastSeen).Round(time.Second))
+	} else {
+		h.log.Debug("User is active again", "user", username)
+	}
+	if presence.Status == cache.PresenceOnline {
+		h.broadcastPresence(ctx, username)
+	}
+}
+
+// noteActivity brings a user who was idle back as soon as one of their local connections shows
+// activity, rather than at the next presence check. The store is updated on the user's room worker.
+func (h *Hub) noteActivity(client *Client) {
+	activity := h.activity[client.username]
+	if activity == nil || !activity.idle {
+		return
+	}
+	activity.idle = false
+	activity.lastActive = time.Now()
+	lastActive := activity.lastActive
+	h.onRoomWorker(userWorkerKey(client.username), func(ctx context.Context) {
+		if err := h.store.TouchUserLastSeen(ctx, client.username, lastActive); err != nil {
+			client.log.Error("Recording last seen time failed", "error", err)
+		}
+		if err := h.store.SetUserIdle(ctx, client.username, false); err != nil {
+			client.log.Error("Clearing idle state failed", "error", err)
+			return
+		}
+		client.log.Debug("User is active again")
+		stored, err := h.store.GetUserPresences(ctx, []string{client.username})
+		if err == nil && stored[client.username].Status != cache.PresenceOnline {
+			return // Their chosen status hid that they were idle.
+		}
+		h.broadcastPresence(ctx, client.username)
+	})
+}
+
+// handleSetPresence answers a client's SetPresenceType request. Message.Content carries a
+// JSON-encoded SetPresenceData. The new status is kept across the user's connections and
+// sessions until they choose another one.
+func (h *Hub) handleSetPresence(client *Client, msg *Message) {
+	var request SetPresenceData
+	if err := json.Unmarshal([]byte(msg.Content), &request); err != nil {
+		client.log.Warn("Invalid request data", "type", msg.Type, "error", err, logging.Content(msg.Content))
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Invalid set_presence request format.", Timestamp: time.Now().UTC()})
+		return
+	}
+	switch request.Status {
+	case cache.PresenceOnline, cache.PresenceAway, cache.PresenceDoNotDisturb:
+	default:
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Status must be one of 'online', 'away' or 'dnd'.", Timestamp: time.Now().UTC()})
+		return
+	}
+	text := strings.TrimSpace(request.StatusText)
+	if utf8.RuneCountInString(text) > maxStatusTextLength {
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: fmt.Sprintf("Status text cannot be longer than %d characters.", maxStatusTextLength), Timestamp: time.Now().UTC()})
+		return
+	}
+
+	// The status is set on the user's room worker, in step with their connecting and disconnecting.
+	h.runOnWorker(userWorkerKey(client.username), client, msg, func(ctx context.Context) {
+		if err := h.store.SetUserStatus(ctx, client.username, request.Status, text); err != nil {
+			client.log.Error("Setting status failed", "status", request.Status, "error", err)
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Failed to set your status. Please try again later.", Timestamp: time.Now().UTC()})
+			return
+		}
+		client.log.Info("Status set", "status", request.Status, logging.Content(text))
+		h.broadcastPresence(ctx, client.username)
+	})
+}
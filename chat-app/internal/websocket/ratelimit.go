@@ -0,0 +1,223 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/metrics"
+)
+
+// ErrorCodeRateLimited is the ErrorPayload code of the errors sent for messages rejected by a
+// rate limit, after the HTTP status for the same condition.
+const ErrorCodeRateLimited = 429
+
+const (
+	// rateLimitTimeout bounds how long ReadPump waits on the store to check a rate limit. If the
+	// store does not answer in time, the message is let through rather than held up.
+	rateLimitTimeout = 500 * time.Millisecond
+
+	// rateLimitStrikeWindow is how long a connection's rejected messages count against it.
+	rateLimitStrikeWindow = time.Minute
+
+	// maxRateLimitStrikes is how many of its messages may be rejected by rate limits within
+	// rateLimitStrikeWindow before a connection is closed.
+	maxRateLimitStrikes = 20
+)
+
+// Classes of rate-limited messages, each limited separately. They prefix the keys of the
+// token buckets counting them, and label metrics.RateLimited.
+const (
+	rateLimitText   = "text"   // TextMessageType and DirectMessageType.
+	rateLimitTyping = "typing" // UserTypingMessageType.
+	rateLimitStats  = "stats"  // RequestStatsType.
+)
+
+// Default rate limits, unless the Hub is configured otherwise.
+var (
+	DefaultTextRateLimits   = RateLimits{PerConnection: RateLimit{Count: 10, Period: 10 * time.Second}, PerUser: RateLimit{Count: 20, Period: 10 * time.Second}}
+	DefaultTypingRateLimits = RateLimits{PerConnection: RateLimit{Count: 10, Period: 10 * time.Second}, PerUser: RateLimit{Count: 20, Period: 10 * time.Second}}
+	DefaultStatsRateLimits  = RateLimits{PerConnection: RateLimit{Count: 5, Period: 10 * time.Second}, PerUser: RateLimit{Count: 10, Period: 10 * time.Second}}
+)
+
+// RateLimit allows bursts of up to Count messages, and Count messages per Period on average.
+// The zero value means the default limit; a negative Count disables the limit.
+type RateLimit struct {
+	Count  int
+	Period time.Duration
+}
+
+// Disabled reports whether the limit lets every message through.
+func (l RateLimit) Disabled() bool {
+	return l.Count < 0
+}
+
+// String formats the limit as ParseRateLimit accepts it.
+func (l RateLimit) String() string {
+	if l.Disabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", l.Count, l.Period)
+}
+
+// ParseRateLimit parses a limit written as "<count>/<period>", e.g. "10/10s", or "off".
+func ParseRateLimit(s string) (RateLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "off" {
+		return RateLimit{Count: -1}, nil
+	}
+	count, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit '%s': expected '<count>/<period>' or 'off'", s)
+	}
+	limit := RateLimit{}
+	var err error
+	if limit.Count, err = strconv.Atoi(count); err != nil || limit.Count <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit '%s': count must be a positive integer", s)
+	}
+	if limit.Period, err = time.ParseDuration(period); err != nil || limit.Period < time.Millisecond {
+		return RateLimit{}, fmt.Errorf("invalid rate limit '%s': period must be a duration of at least 1ms", s)
+	}
+	return limit, nil
+}
+
+// RateLimits are the limits on one class of messages. A message must be allowed by both.
+type RateLimits struct {
+	PerConnection RateLimit // Counts the messages of each connection.
+	PerUser       RateLimit // Counts the messages of all of a user's connections, on every instance.
+}
+
+// String formats the limits as ParseRateLimits accepts them.
+func (l RateLimits) String() string {
+	return l.PerConnection.String() + "," + l.PerUser.String()
+}
+
+// ParseRateLimits parses limits written as "<per connection>,<per user>", each as accepted by
+// ParseRateLimit, e.g. "10/10s,20/10s" or "off,30/1m".
+func ParseRateLimits(s string) (RateLimits, error) {
+	perConnection, perUser, ok := strings.Cut(s, ",")
+	if !ok {
+		return RateLimits{}, fmt.Errorf("invalid rate limits '%s': expected '<per connection>,<per user>'", s)
+	}
+	var limits RateLimits
+	var err error
+	if limits.PerConnection, err = ParseRateLimit(perConnection); err != nil {
+		return RateLimits{}, err
+	}
+	if limits.PerUser, err = ParseRateLimit(perUser); err != nil {
+		return RateLimits{}, err
+	}
+	return limits, nil
+}
+
+// withDefaults replaces the zero limits of l with those of defaults.
+func (l RateLimits) withDefaults(defaults RateLimits) RateLimits {
+	if l.PerConnection == (RateLimit{}) {
+		l.PerConnection = defaults.PerConnection
+	}
+	if l.PerUser == (RateLimit{}) {
+		l.PerUser = defaults.PerUser
+	}
+	return l
+}
+
+// rateLimitClass returns the class of rate limits applying to messages of type t, or "" if
+// they are not rate-limited.
+func rateLimitClass(t MessageType) string {
+	switch t {
+	case TextMessageType, DirectMessageType:
+		return rateLimitText
+	case UserTypingMessageType:
+		return rateLimitTyping
+	case RequestStatsType:
+		return rateLimitStats
+	default:
+		return ""
+	}
+}
+
+// rateLimits returns the Hub's rate limits for a class of messages.
+func (h *Hub) rateLimits(class string) RateLimits {
+	switch class {
+	case rateLimitText:
+		return h.options.TextRateLimits
+	case rateLimitTyping:
+		return h.options.TypingRateLimits
+	default:
+		return h.options.StatsRateLimits
+	}
+}
+
+// takeRateLimitToken counts a message of type t against the rate limits of the client and its
+// user, and returns how long the client must wait before sending it, or 0 if it may be routed.
+// Only ReadPump may call it. If the store cannot be reached, the message is let through.
+func (c *Client) takeRateLimitToken(ctx context.Context, t MessageType) time.Duration {
+	class := rateLimitClass(t)
+	if class == "" {
+		return 0
+	}
+	limits := c.hub.rateLimits(class)
+	var buckets []cache.TokenBucket
+	if !limits.PerConnection.Disabled() {
+		buckets = append(buckets, cache.TokenBucket{Key: class + ":conn:" + c.id, Capacity: limits.PerConnection.Count, Period: limits.PerConnection.Period})
+	}
+	if !limits.PerUser.Disabled() {
+		buckets = append(buckets, cache.TokenBucket{Key: class + ":user:" + c.username, Capacity: limits.PerUser.Count, Period: limits.PerUser.Period})
+	}
+	if len(buckets) == 0 {
+		return 0
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rateLimitTimeout)
+	defer cancel()
+	retryAfter, err := c.hub.store.TakeTokens(ctx, buckets, time.Now())
+	if err != nil {
+		c.log.Warn("Checking rate limit failed; letting message through", "type", t, "error", err)
+		return 0
+	}
+	if retryAfter > 0 {
+		metrics.RateLimited.WithLabelValues(class).Inc()
+	}
+	return retryAfter
+}
+
+// strikeRateLimit records that a message of the client was rejected by a rate limit, and
+// reports whether the client has now been rejected too often to stay connected. Only ReadPump
+// may call it.
+func (c *Client) strikeRateLimit(now time.Time) bool {
+	if now.Sub(c.strikesSince) > rateLimitStrikeWindow {
+		c.strikesSince = now
+		c.strikes = 0
+	}
+	c.strikes++
+	return c.strikes > maxRateLimitStrikes
+}
+
+// closeForRateLimits closes the connection of a client that kept exceeding its rate limits,
+// telling it why. ReadPump returns once it has, which unregisters the client.
+func (c *Client) closeForRateLimits() {
+	c.log.Warn("Disconnecting client for repeatedly exceeding rate limits", "strikes", c.strikes)
+	metrics.RateLimitDisconnects.Inc()
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Rate limit exceeded")
+	_ = c.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait))
+}
+
+// sendRateLimited tells a client that its message was rejected by a rate limit, and when it
+// may send it again. The error carries the message's RoomID and ClientMsgID, so that the client
+// knows which message to retry.
+func (h *Hub) sendRateLimited(client *Client, msg *Message, retryAfter time.Duration) {
+	h.sendToClient(client, &Message{
+		Type:        ErrorMessageType,
+		Content:     fmt.Sprintf("You are sending messages too fast. Please wait %.1f seconds.", retryAfter.Seconds()),
+		RoomID:      msg.RoomID,
+		To:          msg.To,
+		ClientMsgID: msg.ClientMsgID,
+		Data:        ErrorPayload{Code: ErrorCodeRateLimited, Message: "Rate limit exceeded", RetryAfterMs: retryAfter.Milliseconds()},
+		Timestamp:   time.Now().UTC(),
+	})
+}
@@ -0,0 +1,219 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/metrics"
+)
+
+// rateLimitStores are the stores the rate limits are tested on, as in the cache package's tests:
+// MemoryStore, and RedisClient against miniredis, an in-process Redis server.
+var rateLimitStores = []struct {
+	name string
+	open func(t *testing.T) cache.Store
+}{
+	{name: "memory", open: func(t *testing.T) cache.Store { return cache.NewMemoryStore() }},
+	{name: "redis", open: func(t *testing.T) cache.Store {
+		server := miniredis.RunT(t)
+		rc, err := cache.NewRedisClient("redis://"+server.Addr(), quietLogger)
+		if err != nil {
+			t.Fatalf("connecting to miniredis: %v", err)
+		}
+		t.Cleanup(func() { _ = rc.Close() })
+		return rc
+	}},
+}
+
+// forEachRateLimitStore runs test against a Hub on each of rateLimitStores, configured with options.
+func forEachRateLimitStore(t *testing.T, options HubOptions, test func(t *testing.T, h *Hub)) {
+	for _, store := range rateLimitStores {
+		t.Run(store.name, func(t *testing.T) {
+			test(t, newTestHub(t, store.open(t), options))
+		})
+	}
+}
+
+// testConn is a connection to a Hub over a WebSocket, read from and written to by the test, so
+// that its messages go through ReadPump and its rate limits.
+type testConn struct {
+	*websocket.Conn
+}
+
+// dialTestConn connects a client of username to h, in the general room, as the handlers package
+// does once it has authenticated the client, and waits until it has joined the room.
+func dialTestConn(t *testing.T, h *Hub, username string) *testConn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(h, conn, username, "session-"+username, "general", 0)
+		h.register <- client
+		go client.WritePump()
+		go client.ReadPump()
+	}))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("connecting %s: %v", username, err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	c := &testConn{Conn: conn}
+	c.next(t, string(RoomInfoType), func(msg *testReply) bool { return msg.Type == RoomInfoType })
+	return c
+}
+
+// testReply is a message as a connection reads it, whose Data is decoded as needed.
+type testReply struct {
+	Type        MessageType     `json:"type"`
+	ClientMsgID string          `json:"client_msg_id"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// rateLimited returns the ErrorPayload of a rate limit error, or nil if msg is not one.
+func (msg *testReply) rateLimited(t *testing.T) *ErrorPayload {
+	t.Helper()
+	if msg.Type != ErrorMessageType {
+		return nil
+	}
+	var payload ErrorPayload
+	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+		t.Fatalf("decoding error payload %s: %v", msg.Data, err)
+	}
+	if payload.Code != ErrorCodeRateLimited {
+		return nil
+	}
+	return &payload
+}
+
+// next returns the next message the connection reads that matches, skipping the others.
+func (c *testConn) next(t *testing.T, what string, matches func(msg *testReply) bool) *testReply {
+	t.Helper()
+	if err := c.SetReadDeadline(time.Now().Add(testTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var msg testReply
+		if err := c.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", what, err)
+		}
+		if matches(&msg) {
+			return &msg
+		}
+	}
+}
+
+// send writes a text message to the general room, and returns the ack or error answering it.
+func (c *testConn) send(t *testing.T, clientMsgID string) *testReply {
+	t.Helper()
+	if err := c.WriteJSON(&Message{Type: TextMessageType, RoomID: "general", Content: clientMsgID, ClientMsgID: clientMsgID}); err != nil {
+		t.Fatal(err)
+	}
+	return c.next(t, "an answer to "+clientMsgID, func(msg *testReply) bool {
+		return (msg.Type == AckMessageType || msg.Type == ErrorMessageType) && msg.ClientMsgID == clientMsgID
+	})
+}
+
+func TestRateLimitUserBucketIsSharedByConnections(t *testing.T) {
+	options := HubOptions{TextRateLimits: RateLimits{PerConnection: RateLimit{Count: -1}, PerUser: RateLimit{Count: 3, Period: time.Minute}}}
+	forEachRateLimitStore(t, options, func(t *testing.T, h *Hub) {
+		first := dialTestConn(t, h, "alice")
+		second := dialTestConn(t, h, "alice")
+
+		// Each connection has sent fewer messages than the limit, but together they reach it.
+		for i, c := range []*testConn{first, second, first} {
+			if reply := c.send(t, fmt.Sprint("m", i)); reply.Type != AckMessageType {
+				t.Fatalf("message m%d refused: %s", i, reply.Data)
+			}
+		}
+		if reply := second.send(t, "m3"); reply.rateLimited(t) == nil {
+			t.Errorf("message m3 answered with %s %s, want a rate limit error", reply.Type, reply.Data)
+		}
+	})
+}
+
+func TestRateLimitErrorCarriesRetryAfter(t *testing.T) {
+	options := HubOptions{TextRateLimits: RateLimits{PerConnection: RateLimit{Count: 1, Period: time.Minute}, PerUser: RateLimit{Count: -1}}}
+	forEachRateLimitStore(t, options, func(t *testing.T, h *Hub) {
+		alice := dialTestConn(t, h, "alice")
+		if reply := alice.send(t, "m0"); reply.Type != AckMessageType {
+			t.Fatalf("message m0 refused: %s", reply.Data)
+		}
+
+		// The bucket refills one token a minute, which has barely started.
+		reply := alice.send(t, "m1")
+		payload := reply.rateLimited(t)
+		if payload == nil {
+			t.Fatalf("message m1 answered with %s %s, want a rate limit error", reply.Type, reply.Data)
+		}
+		if retryAfter := time.Duration(payload.RetryAfterMs) * time.Millisecond; retryAfter <= time.Minute-testTimeout || retryAfter > time.Minute {
+			t.Errorf("retry after %s, want just under %s", retryAfter, time.Minute)
+		}
+	})
+}
+
+func TestRateLimitStrikesDisconnect(t *testing.T) {
+	options := HubOptions{TextRateLimits: RateLimits{PerConnection: RateLimit{Count: 1, Period: time.Hour}, PerUser: RateLimit{Count: -1}}}
+	forEachRateLimitStore(t, options, func(t *testing.T, h *Hub) {
+		alice := dialTestConn(t, h, "alice")
+		disconnectsBefore := testutil.ToFloat64(metrics.RateLimitDisconnects)
+
+		// The first message takes the only token; each one after it is a strike, and the one
+		// beyond maxRateLimitStrikes closes the connection.
+		for i := 0; i <= maxRateLimitStrikes+1; i++ {
+			if err := alice.WriteJSON(&Message{Type: TextMessageType, RoomID: "general", Content: "spam", ClientMsgID: fmt.Sprint("m", i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := alice.SetReadDeadline(time.Now().Add(testTimeout)); err != nil {
+			t.Fatal(err)
+		}
+		rejected := 0
+		for {
+			var msg testReply
+			err := alice.ReadJSON(&msg)
+			if err != nil {
+				if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+					t.Fatalf("connection closed with %v, want a policy violation", err)
+				}
+				break
+			}
+			if msg.rateLimited(t) != nil {
+				rejected++
+			}
+		}
+		if rejected > maxRateLimitStrikes {
+			t.Errorf("%d messages rejected before the connection was closed, want at most %d", rejected, maxRateLimitStrikes)
+		}
+		if got := testutil.ToFloat64(metrics.RateLimitDisconnects) - disconnectsBefore; got != 1 {
+			t.Errorf("rate limit disconnects counted %v times, want once", got)
+		}
+	})
+}
+
+func TestRateLimitStrikesExpire(t *testing.T) {
+	c := &Client{}
+	start := time.Now()
+	for i := 0; i < maxRateLimitStrikes; i++ {
+		if c.strikeRateLimit(start) {
+			t.Fatalf("disconnected after %d strikes", i+1)
+		}
+	}
+	// The strikes so far are forgotten once the window has passed.
+	if c.strikeRateLimit(start.Add(rateLimitStrikeWindow + time.Second)) {
+		t.Error("disconnected for strikes older than the strike window")
+	}
+}
@@ -0,0 +1,164 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/logging"
+)
+
+const (
+	// maxReactionLength bounds the size of a reaction in bytes. It leaves room for emoji
+	// sequences (skin tones, families, flags) and short codes like ":thumbsup:".
+	maxReactionLength = 32
+
+	// maxReactionsPerMessage is the most different emoji a message can be reacted to with.
+	maxReactionsPerMessage = 20
+)
+
+// Errors returned by the reaction operations.
+var (
+	ErrInvalidReaction     = errors.New("invalid reaction")
+	ErrTooManyReactions    = errors.New("too many different reactions to this message")
+	ErrMessageNotReactable = errors.New("deleted messages cannot be reacted to")
+)
+
+// validReaction reports whether emoji is acceptable as a reaction: a short, printable string
+// without spaces.
+func validReaction(emoji string) bool {
+	if emoji == "" || len(emoji) > maxReactionLength || !utf8.ValidString(emoji) {
+		return false
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// React adds (or, if add is false, withdraws) actor's reaction with emoji to a message of a
+// room. Actor must have access to the room; adding a reaction also requires the room not to be
+// archived and actor not to be muted in it. Reacting twice with the same emoji, or withdrawing
+// a reaction that is not there, is a no-op. Otherwise the room is notified with a
+// ReactionUpdatedType carrying the emoji's new count.
+func (h *Hub) React(ctx context.Context, roomID string, actor string, messageID int64, emoji string, add bool) error {
+	if !validReaction(emoji) {
+		return fmt.Errorf("%w: '%.40s'", ErrInvalidReaction, emoji)
+	}
+	room, err := h.CheckRoomAccess(ctx, roomID, actor)
+	if err != nil {
+		return err
+	}
+	if add {
+		if room != nil && room.Archived {
+			return fmt.Errorf("%w: '%s'", ErrRoomArchived, roomID)
+		}
+		if room != nil {
+			reason, err := h.muteReason(ctx, roomID, actor)
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				return fmt.Errorf("%w: '%s'", ErrMuted, roomID)
+			}
+		}
+		message, _, err := h.loggedMessage(ctx, roomID, messageID)
+		if err != nil {
+			return err
+		}
+		if message.Deleted {
+			return fmt.Errorf("%w: %d", ErrMessageNotReactable, messageID)
+		}
+	}
+
+	var changed bool
+	var count int64
+	if add {
+		changed, count, err = h.store.AddReaction(ctx, roomID, messageID, emoji, actor, maxReactionsPerMessage)
+		if err == nil && !changed && count == 0 {
+			return fmt.Errorf("%w: %d", ErrTooManyReactions, messageID)
+		}
+	} else {
+		changed, count, err = h.store.RemoveReaction(ctx, roomID, messageID, emoji, actor)
+	}
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	h.log.Debug("Reaction changed", "room_id", roomID, "message_id", messageID, "user", actor, "emoji", emoji, "added", add, "count", count)
+	h.broadcastToRoom(&Message{
+		Type:      ReactionUpdatedType,
+		Username:  actor,
+		RoomID:    roomID,
+		Timestamp: time.Now().UTC(),
+		System:    true,
+		Data:      ReactionUpdatePayload{RoomID: roomID, MessageID: messageID, Emoji: emoji, Username: actor, Added: add, Count: count},
+	})
+	return nil
+}
+
+// messageReactions returns the reaction counts of the given serialized messages of a room, by
+// message ID and emoji, or nil if none of them has reactions. Reactions are an embellishment of
+// the history, so failures to read them are logged to logger and yield nil rather than an error.
+func messageReactions(ctx context.Context, store cache.ReactionStore, logger *slog.Logger, roomID string, messages []json.RawMessage) map[int64]map[string]int64 {
+	ids := make([]int64, 0, len(messages))
+	for _, messageJSON := range messages {
+		var message struct {
+			ID      int64 `json:"id"`
+			Deleted bool  `json:"deleted"`
+		}
+		if err := json.Unmarshal(messageJSON, &message); err != nil || message.ID <= 0 || message.Deleted {
+			continue
+		}
+		ids = append(ids, message.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	reactions, err := store.GetReactions(ctx, roomID, ids)
+	if err != nil {
+		logger.Error("Getting reactions of messages failed", "room_id", roomID, "messages", len(ids), "error", err)
+		return nil
+	}
+	if len(reactions) == 0 {
+		return nil
+	}
+	return reactions
+}
+
+// handleReaction answers a client's AddReactionType or RemoveReactionType request.
+// Message.Content carries a JSON-encoded ReactionData whose room defaults to the client's
+// current room. Like other changes to the room's messages, the reaction is stored on the room's worker.
+func (h *Hub) handleReaction(client *Client, msg *Message) {
+	var request ReactionData
+	if err := json.Unmarshal([]byte(msg.Content), &request); err != nil {
+		client.log.Warn("Invalid request data", "type", msg.Type, "error", err, logging.Content(msg.Content))
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Invalid reaction request format.", Timestamp: time.Now().UTC()})
+		return
+	}
+	roomID := request.RoomID
+	if roomID == "" {
+		roomID = client.currentRoomID()
+	}
+	if roomID == "" {
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "RoomID required for reaction request.", Timestamp: time.Now().UTC()})
+		return
+	}
+
+	h.runOnWorker(roomID, client, msg, func(ctx context.Context) {
+		if err := h.React(ctx, roomID, client.username, request.MessageID, request.Emoji, msg.Type == AddReactionType); err != nil {
+			client.log.Warn("Reaction failed", "type", msg.Type, "room_id", roomID, "message_id", request.MessageID, "error", err)
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: moderationErrorText(err), RoomID: roomID, Timestamp: time.Now().UTC()})
+		}
+	})
+}
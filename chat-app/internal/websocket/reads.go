@@ -0,0 +1,200 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/logging"
+)
+
+// MarkRead moves actor's read marker in a room forward to messageID, or to the room's latest
+// message if messageID is zero or beyond it. Actor must have access to the room. If the marker
+// moved, all of actor's connections are sent the room's new UnreadCountsType and, if the Hub's
+// ReadReceipts option is enabled, the room is sent a ReadReceiptType. Marking messages that
+// were already read is a no-op.
+func (h *Hub) MarkRead(ctx context.Context, roomID string, actor string, messageID int64) error {
+	if messageID < 0 {
+		return fmt.Errorf("%w: %d", ErrMessageNotFound, messageID)
+	}
+	if _, err := h.CheckRoomAccess(ctx, roomID, actor); err != nil {
+		return err
+	}
+	latest, err := h.store.GetLatestMessageIDs(ctx, []string{roomID})
+	if err != nil {
+		return err
+	}
+	if messageID == 0 || messageID > latest[roomID] {
+		messageID = latest[roomID] // Nothing can be read beyond the latest message.
+	}
+	if messageID == 0 {
+		return nil // The room has no messages yet.
+	}
+	moved, err := h.store.MarkRead(ctx, actor, roomID, messageID)
+	if err != nil || !moved {
+		return err
+	}
+	h.log.Debug("Room read", "room_id", roomID, "user", actor, "message_id", messageID)
+
+	counts, err := h.store.CountTimelineAfter(ctx, map[string]int64{roomID: messageID})
+	if err != nil {
+		return err
+	}
+	unread := counts[roomID]
+	update := &Message{
+		Type:      UnreadCountsType,
+		Username:  actor,
+		Timestamp: time.Now().UTC(),
+		System:    true,
+		Data: UnreadCountsPayload{
+			Rooms: []RoomUnreadCount{{RoomID: roomID, LastReadID: messageID, LatestMessageID: latest[roomID], Unread: unread}},
+			Total: unread,
+		},
+	}
+	h.deliverToUser(actor, update) // Keep the user's other tabs and devices in step.
+	h.publishUserEvent(actor, update)
+
+	if h.options.ReadReceipts {
+		h.broadcastToRoom(&Message{
+			Type:      ReadReceiptType,
+			Username:  actor,
+			RoomID:    roomID,
+			Timestamp: time.Now().UTC(),
+			System:    true,
+			Data:      ReadReceiptPayload{RoomID: roomID, Username: actor, LastReadID: messageID},
+		})
+	}
+	return nil
+}
+
+// UnreadCounts returns how many messages username has not read in each room they have a read
+// marker in or are a member of: the top-level messages after their marker that are not deleted,
+// as indexed in the rooms' timelines. Rooms username can no longer access are left out.
+func (h *Hub) UnreadCounts(ctx context.Context, username string) (*UnreadCountsPayload, error) {
+	markers, err := h.store.GetReadMarkers(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	memberOf, err := h.store.GetUserRooms(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	for _, roomID := range memberOf {
+		if _, ok := markers[roomID]; !ok {
+			markers[roomID] = 0 // Joined or invited, but never read.
+		}
+	}
+
+	candidates := make([]string, 0, len(markers))
+	for roomID := range markers {
+		candidates = append(candidates, roomID)
+	}
+	access, err := h.store.GetRoomsAccess(ctx, candidates, username)
+	if err != nil {
+		return nil, err
+	}
+	roomIDs := make([]string, 0, len(candidates))
+	for _, roomID := range candidates {
+		if h.canAccess(access[roomID], username) {
+			roomIDs = append(roomIDs, roomID)
+		} else {
+			delete(markers, roomID)
+		}
+	}
+	sort.Strings(roomIDs)
+	latest, err := h.store.GetLatestMessageIDs(ctx, roomIDs)
+	if err != nil {
+		return nil, err
+	}
+	unread, err := h.store.CountTimelineAfter(ctx, markers)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := &UnreadCountsPayload{Rooms: make([]RoomUnreadCount, 0, len(roomIDs))}
+	for _, roomID := range roomIDs {
+		count := RoomUnreadCount{RoomID: roomID, LastReadID: markers[roomID], LatestMessageID: latest[roomID], Unread: unread[roomID]}
+		counts.Rooms = append(counts.Rooms, count)
+		counts.Total += count.Unread
+	}
+	return counts, nil
+}
+
+// canAccess reports whether username may access a room, given the room's record and their
+// standing in it as fetched by GetRoomsAccess, by the rules of CheckRoomAccess.
+func (h *Hub) canAccess(access cache.RoomAccess, username string) bool {
+	if access.Room == nil {
+		return !h.options.RequireRegisteredRooms
+	}
+	return accessError(access.Room, username, access.Member, access.Banned) == nil
+}
+
+// trackRoomReads starts keeping username's read marker in a room they join for the first time,
+// at the room's latest message: what was posted before they ever came is not unread for them.
+func (h *Hub) trackRoomReads(ctx context.Context, username string, roomID string) {
+	markers, err := h.store.GetReadMarkers(ctx, username)
+	if err != nil {
+		h.log.Error("Getting read markers failed", "user", username, "error", err)
+		return
+	}
+	if _, tracked := markers[roomID]; tracked {
+		return
+	}
+	latest, err := h.store.GetLatestMessageIDs(ctx, []string{roomID})
+	if err != nil {
+		h.log.Error("Getting latest message ID failed", "room_id", roomID, "error", err)
+		return
+	}
+	if _, err := h.store.MarkRead(ctx, username, roomID, latest[roomID]); err != nil {
+		h.log.Error("Starting read marker failed", "room_id", roomID, "user", username, "error", err)
+	}
+}
+
+// sendUnreadCounts sends a client the unread counts of all of its user's rooms. It runs on a
+// room worker.
+func (h *Hub) sendUnreadCounts(ctx context.Context, client *Client) {
+	counts, err := h.UnreadCounts(ctx, client.username)
+	if err != nil {
+		client.log.Error("Getting unread counts failed", "error", err)
+		return
+	}
+	h.sendToClient(client, &Message{Type: UnreadCountsType, Username: client.username, Data: counts, Timestamp: time.Now().UTC(), System: true})
+}
+
+// handleMarkRead answers a client's MarkReadType request. Message.Content carries a
+// JSON-encoded MarkReadData whose room defaults to the client's current room. The marker is
+// moved on the room's worker.
+func (h *Hub) handleMarkRead(client *Client, msg *Message) {
+	var request MarkReadData
+	if err := json.Unmarshal([]byte(msg.Content), &request); err != nil {
+		client.log.Warn("Invalid request data", "type", msg.Type, "error", err, logging.Content(msg.Content))
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Invalid mark_read request format.", Timestamp: time.Now().UTC()})
+		return
+	}
+	roomID := request.RoomID
+	if roomID == "" {
+		roomID = client.currentRoomID()
+	}
+	if roomID == "" {
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "RoomID required for mark_read request.", Timestamp: time.Now().UTC()})
+		return
+	}
+
+	h.runOnWorker(roomID, client, msg, func(ctx context.Context) {
+		if err := h.MarkRead(ctx, roomID, client.username, request.MessageID); err != nil {
+			client.log.Warn("Marking room read failed", "type", msg.Type, "room_id", roomID, "message_id", request.MessageID, "error", err)
+			content := "Failed to mark the room as read. Please try again later."
+			switch {
+			case errors.Is(err, ErrMessageNotFound):
+				content = err.Error()
+			case errors.Is(err, ErrRoomNotFound), errors.Is(err, ErrNotRoomMember), errors.Is(err, ErrBannedFromRoom):
+				content = roomJoinErrorText(err)
+			}
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: content, RoomID: roomID, Timestamp: time.Now().UTC()})
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/yebrai/go-chat/internal/cache"
+)
+
+func TestUnreadCountsSkipThreadRepliesAndDeletedMessages(t *testing.T) {
+	h := newTestHub(t, cache.NewMemoryStore(), HubOptions{})
+	bob := connectTestClient(t, h, "bob", "general")
+	bob.next(t, UnreadCountsType) // Bob starts reading the room before anything is posted.
+	alice := connectTestClient(t, h, "alice", "general")
+
+	for i, msg := range []*Message{
+		{Content: "m1"},
+		{Content: "m2"},
+		{Content: "m3"},
+		{Content: "reply to m1", ParentID: 1},
+	} {
+		msg.Type, msg.RoomID, msg.ClientMsgID = TextMessageType, "general", fmt.Sprint("c", i)
+		alice.post(msg)
+		if ack := alice.next(t, AckMessageType).Data.(AckPayload); ack.MessageID != int64(i+1) {
+			t.Fatalf("message %q stored as %d, want %d", msg.Content, ack.MessageID, i+1)
+		}
+	}
+	ctx := context.Background()
+	if err := h.DeleteMessage(ctx, "general", "alice", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only m1 and m2 are unread: the reply is in a thread and m3 was deleted.
+	counts, err := h.UnreadCounts(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RoomUnreadCount{RoomID: "general", LatestMessageID: 4, Unread: 2}
+	if len(counts.Rooms) != 1 || counts.Rooms[0] != want || counts.Total != 2 {
+		t.Errorf("unread counts = %+v, want %+v", counts, want)
+	}
+
+	if err := h.MarkRead(ctx, "general", "bob", 1); err != nil {
+		t.Fatal(err)
+	}
+	update := bob.next(t, UnreadCountsType).Data.(UnreadCountsPayload)
+	want = RoomUnreadCount{RoomID: "general", LastReadID: 1, LatestMessageID: 4, Unread: 1}
+	if len(update.Rooms) != 1 || update.Rooms[0] != want || update.Total != 1 {
+		t.Errorf("unread counts after reading m1 = %+v, want %+v", update, want)
+	}
+}
@@ -0,0 +1,120 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/cache"
+)
+
+const (
+	// instanceHeartbeatInterval is how often the Hub renews its lease on the connections it
+	// recorded in the store's presence sets, and looks for dead instances to reap.
+	instanceHeartbeatInterval = 10 * time.Second
+
+	// instanceLeaseTTL is how long an instance may go without a heartbeat before it is presumed
+	// dead and its connections are removed from the presence sets.
+	instanceLeaseTTL = 3 * instanceHeartbeatInterval
+)
+
+// heartbeat renews this Hub's lease on its connections. If the store had no heartbeat of this
+// Hub although it recorded one before, the Hub was presumed dead and reaped while it was merely
+// unable to reach the store, so it records its connections again. The Hub calls it once before
+// its event loop starts, then periodically on the room worker of instanceWorkerKey.
+func (h *Hub) heartbeat(ctx context.Context) {
+	known, err := h.store.Heartbeat(ctx, h.instanceID, time.Now())
+	if err != nil {
+		h.log.Error("Recording heartbeat failed", "error", err)
+		return
+	}
+	if !known && h.leased {
+		h.log.Warn("Instance was reaped while alive; recording its connections again")
+		h.restoreConnections(ctx)
+	}
+	h.leased = true
+}
+
+// restoreConnections records every local connection again, in the global set of active users
+// and in the user set of each room it is subscribed to, and corrects the counts shown to clients.
+func (h *Hub) restoreConnections(ctx context.Context) {
+	h.mu.RLock()
+	clients := make(map[*Client][]string, len(h.clients))
+	for client := range h.clients {
+		clients[client] = client.subscribedRooms()
+	}
+	h.mu.RUnlock()
+
+	rooms := make(map[string]bool)
+	for client, subscriptions := range clients {
+		if _, err := h.store.AddUserToGlobalSet(ctx, h.instanceID, client.username); err != nil {
+			client.log.Error("Restoring user in global set failed", "error", err)
+		}
+		for _, roomID := range subscriptions {
+			if _, err := h.store.AddActiveUserToRoom(ctx, h.instanceID, roomID, client.username, 0); err != nil {
+				client.log.Error("Restoring user in room failed", "room_id", roomID, "error", err)
+			}
+			rooms[roomID] = true
+		}
+	}
+	for roomID := range rooms {
+		h.broadcastUserList(ctx, roomID)
+		h.onRoomWorker(roomID, func(ctx context.Context) { h.broadcastRoomStats(ctx, roomID) })
+	}
+	h.broadcastGlobalUserCount(ctx)
+	h.log.Info("Restored connections", "connections", len(clients), "rooms", len(rooms))
+}
+
+// reapDeadInstances removes from the presence sets the connections of every instance that has
+// not sent a heartbeat for instanceLeaseTTL, typically because its process crashed, and tells
+// clients about it (see announceReaped). Several instances may reap at once: each dead instance
+// is reaped by only one. The Hub calls it on the room worker of instanceWorkerKey.
+func (h *Hub) reapDeadInstances(ctx context.Context) {
+	deadline := time.Now().Add(-instanceLeaseTTL)
+	instances, err := h.store.GetStaleInstances(ctx, deadline)
+	if err != nil {
+		h.log.Error("Getting stale instances failed", "error", err)
+		return
+	}
+
+	for _, instanceID := range instances {
+		if instanceID == h.instanceID {
+			continue // We are alive, if late: our next heartbeat renews the lease.
+		}
+		reaped, err := h.store.ReapInstance(ctx, instanceID, deadline)
+		if err != nil {
+			h.log.Error("Reaping instance failed", "dead_instance_id", instanceID, "error", err)
+			continue
+		}
+		if reaped == nil {
+			continue // Another instance reaped it first, or it is heartbeating again.
+		}
+		h.log.Warn("Reaped dead instance", "dead_instance_id", instanceID, "silent_since", deadline.UTC(), "users", len(reaped.OfflineUsers), "rooms", len(reaped.LeftRooms))
+		h.announceReaped(ctx, reaped)
+	}
+}
+
+// announceReaped tells clients, on every instance, about the connections a reaped instance had:
+// the rooms those users were left out of are told they left and sent their corrected user list
+// and stats, users left without connections are shown as offline, and every client gets the new
+// global user count.
+func (h *Hub) announceReaped(ctx context.Context, reaped *cache.ReapedInstance) {
+	leftRooms := make(map[string][]string) // username -> rooms they were left out of
+	for roomID, usernames := range reaped.LeftRooms {
+		for _, username := range usernames {
+			h.broadcastSystemMessageToRoom(roomID, fmt.Sprintf("User '%s' left the room.", username), username, UserLeftMessageType)
+			leftRooms[username] = append(leftRooms[username], roomID)
+		}
+		h.broadcastUserList(ctx, roomID)
+		h.onRoomWorker(roomID, func(ctx context.Context) { h.broadcastRoomStats(ctx, roomID) })
+	}
+	for _, username := range reaped.OfflineUsers {
+		if err := h.store.SetUserIdle(ctx, username, false); err != nil {
+			h.log.Error("Clearing idle state failed", "user", username, "error", err)
+		}
+		h.broadcastPresence(ctx, username, leftRooms[username]...)
+	}
+	if len(reaped.OfflineUsers) > 0 {
+		h.broadcastGlobalUserCount(ctx)
+	}
+}
@@ -0,0 +1,340 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+	"unicode/utf8"
+
+	"github.com/yebrai/go-chat/internal/cache"
+)
+
+const (
+	// maxRoomNameLength is the longest room display name accepted, in characters.
+	maxRoomNameLength = 64
+
+	// maxRoomTopicLength is the longest room topic accepted, in characters.
+	maxRoomTopicLength = 256
+)
+
+// Errors returned by the room registry operations.
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrRoomExists   = errors.New("room already exists")
+	ErrRoomArchived = errors.New("room is archived")
+	ErrInvalidRoom  = errors.New("invalid room")
+	ErrNotRoomOwner = errors.New("only the room's creator can change it")
+)
+
+// roomIDPattern restricts room IDs to short, URL- and key-safe identifiers.
+var roomIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// ValidRoomID reports whether roomID is acceptable as a room ID.
+func ValidRoomID(roomID string) bool {
+	return roomIDPattern.MatchString(roomID)
+}
+
+// RoomSettings holds the editable metadata of a room. Nil fields are left unchanged on
+// update, or take their defaults on creation (the room ID as name, no topic, public).
+type RoomSettings struct {
+	Name       *string `json:"name"`
+	Topic      *string `json:"topic"`
+	Visibility *string `json:"visibility"`
+}
+
+// apply validates the settings and copies the ones that are set onto room.
+func (s RoomSettings) apply(room *cache.Room) error {
+	if s.Name != nil {
+		if *s.Name == "" || utf8.RuneCountInString(*s.Name) > maxRoomNameLength {
+			return fmt.Errorf("%w: name must be 1 to %d characters", ErrInvalidRoom, maxRoomNameLength)
+		}
+		room.Name = *s.Name
+	}
+	if s.Topic != nil {
+		if utf8.RuneCountInString(*s.Topic) > maxRoomTopicLength {
+			return fmt.Errorf("%w: topic must be at most %d characters", ErrInvalidRoom, maxRoomTopicLength)
+		}
+		room.Topic = *s.Topic
+	}
+	if s.Visibility != nil {
+		switch *s.Visibility {
+		case cache.RoomVisibilityPublic, cache.RoomVisibilityInviteOnly, cache.RoomVisibilityPrivate:
+		default:
+			return fmt.Errorf("%w: visibility must be '%s', '%s' or '%s'", ErrInvalidRoom, cache.RoomVisibilityPublic, cache.RoomVisibilityInviteOnly, cache.RoomVisibilityPrivate)
+		}
+		room.Visibility = *s.Visibility
+	}
+	return nil
+}
+
+// CreateRoom registers a new room in the room registry on behalf of createdBy, who becomes
+// its owner and first member. An empty createdBy registers a room owned by the server, which cannot be changed
+// through the API. Returns ErrRoomExists if the ID is already registered, archived or not.
+func (h *Hub) CreateRoom(ctx context.Context, roomID string, createdBy string, settings RoomSettings) (*cache.Room, error) {
+	if !ValidRoomID(roomID) {
+		return nil, fmt.Errorf("%w: ID must be 1 to 64 letters, digits, '.', '-' or '_'", ErrInvalidRoom)
+	}
+	room := &cache.Room{
+		ID:         roomID,
+		Name:       roomID,
+		CreatedBy:  createdBy,
+		CreatedAt:  time.Now().UTC(),
+		Visibility: cache.RoomVisibilityPublic,
+	}
+	if err := settings.apply(room); err != nil {
+		return nil, err
+	}
+	created, err := h.store.CreateRoom(ctx, *room)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create room '%s': %w", roomID, err)
+	}
+	if !created {
+		return nil, fmt.Errorf("%w: '%s'", ErrRoomExists, roomID)
+	}
+	if createdBy != "" {
+		if err := h.store.AddRoomMember(ctx, roomID, createdBy); err != nil {
+			// The creator keeps access to the room as its owner regardless.
+			h.log.Error("Adding creator to room members failed", "room_id", roomID, "user", createdBy, "error", err)
+		}
+	}
+	h.log.Info("Room created", "room_id", roomID, "user", createdBy, "visibility", room.Visibility)
+	return room, nil
+}
+
+// UpdateRoom changes the metadata of a room on behalf of username, who must be its creator,
+// and sends the updated RoomInfoType to the room's members. When a public room becomes
+// invite-only or private, the users in it who are not its members are removed from it.
+func (h *Hub) UpdateRoom(ctx context.Context, roomID string, username string, settings RoomSettings) (*cache.Room, error) {
+	room, err := h.ownedRoom(ctx, roomID, username)
+	if err != nil {
+		return nil, err
+	}
+	if room.Archived {
+		return nil, fmt.Errorf("%w: '%s'", ErrRoomArchived, roomID)
+	}
+	wasPublic := room.Visibility == cache.RoomVisibilityPublic
+	if err := settings.apply(room); err != nil {
+		return nil, err
+	}
+	if err := h.saveRoom(ctx, room); err != nil {
+		return nil, err
+	}
+	h.log.Info("Room updated", "room_id", roomID, "user", username)
+	h.broadcastRoomInfo(room)
+	if wasPublic && room.Visibility != cache.RoomVisibilityPublic {
+		h.evictNonMembers(ctx, room)
+	}
+	return room, nil
+}
+
+// evictNonMembers removes the users in a room, on every instance, who no longer have access to it.
+func (h *Hub) evictNonMembers(ctx context.Context, room *cache.Room) {
+	users, err := h.store.GetActiveUsersInRoom(ctx, room.ID)
+	if err != nil {
+		h.log.Error("Getting users to remove from room failed", "room_id", room.ID, "error", err)
+		return
+	}
+	for _, username := range users {
+		err := checkMembership(ctx, h.store, room, username)
+		switch {
+		case errors.Is(err, ErrNotRoomMember), errors.Is(err, ErrBannedFromRoom):
+			h.evictFromRoom(room.ID, username, fmt.Sprintf("The room '%s' is now only open to its members.", room.Name))
+		case err != nil:
+			h.log.Error("Checking access to room failed", "room_id", room.ID, "user", username, "error", err)
+		}
+	}
+}
+
+// ArchiveRoom archives a room on behalf of username, who must be its creator. Archived rooms
+// keep their history but can no longer be joined or posted to. Their members are sent the
+// updated RoomInfoType. Archiving an archived room is a no-op.
+func (h *Hub) ArchiveRoom(ctx context.Context, roomID string, username string) (*cache.Room, error) {
+	room, err := h.ownedRoom(ctx, roomID, username)
+	if err != nil {
+		return nil, err
+	}
+	if room.Archived {
+		return room, nil
+	}
+	room.Archived = true
+	if err := h.saveRoom(ctx, room); err != nil {
+		return nil, err
+	}
+	h.log.Info("Room archived", "room_id", roomID, "user", username)
+	h.broadcastRoomInfo(room)
+	return room, nil
+}
+
+// ownedRoom returns the registry record of a room that username is allowed to change.
+func (h *Hub) ownedRoom(ctx context.Context, roomID string, username string) (*cache.Room, error) {
+	room, err := h.store.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room '%s': %w", roomID, err)
+	}
+	if room == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrRoomNotFound, roomID)
+	}
+	if room.CreatedBy == "" || room.CreatedBy != username {
+		return nil, fmt.Errorf("%w: '%s'", ErrNotRoomOwner, roomID)
+	}
+	return room, nil
+}
+
+// saveRoom writes back the registry record of a room read from the store.
+func (h *Hub) saveRoom(ctx context.Context, room *cache.Room) error {
+	updated, err := h.store.UpdateRoom(ctx, *room)
+	if err != nil {
+		return fmt.Errorf("failed to update room '%s': %w", room.ID, err)
+	}
+	if !updated {
+		return fmt.Errorf("%w: '%s'", ErrRoomNotFound, room.ID)
+	}
+	return nil
+}
+
+// GetRoomInfo returns the registry record of a room as a RoomInfoPayload. Private rooms are
+// reported as not found to users who are not their members.
+func GetRoomInfo(ctx context.Context, store cache.RoomStore, roomID string, username string) (*RoomInfoPayload, error) {
+	room, err := store.GetRoom(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room '%s': %w", roomID, err)
+	}
+	if room == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrRoomNotFound, roomID)
+	}
+	if room.Visibility == cache.RoomVisibilityPrivate {
+		if err := checkMembership(ctx, store, room, username); errors.Is(err, ErrNotRoomMember) {
+			return nil, fmt.Errorf("%w: '%s'", ErrRoomNotFound, roomID)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	info := RoomInfo(room)
+	return &info, nil
+}
+
+// ListRooms returns the rooms visible to username, oldest first: every public and invite-only
+// room, and the private rooms username is a member of. Archived rooms are only included if
+// includeArchived is set.
+func ListRooms(ctx context.Context, store cache.RoomStore, username string, includeArchived bool) (*RoomListPayload, error) {
+	rooms, err := store.ListRooms(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rooms: %w", err)
+	}
+	memberOf, err := store.GetUserRooms(ctx, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rooms of user '%s': %w", username, err)
+	}
+	isMember := make(map[string]bool, len(memberOf))
+	for _, roomID := range memberOf {
+		isMember[roomID] = true
+	}
+
+	list := &RoomListPayload{Rooms: make([]RoomInfoPayload, 0, len(rooms))}
+	for i := range rooms {
+		room := &rooms[i]
+		if room.Archived && !includeArchived {
+			continue
+		}
+		if room.Visibility == cache.RoomVisibilityPrivate && !isMember[room.ID] && room.CreatedBy != username {
+			continue
+		}
+		list.Rooms = append(list.Rooms, RoomInfo(room))
+	}
+	return list, nil
+}
+
+// CheckRoomJoinable returns the registry record of a room that username is about to join.
+// On top of the checks of CheckRoomAccess, it fails with ErrInvalidRoom if the ID is malformed
+// and ErrRoomArchived if the room is archived. The record may be nil for a room that was never
+// created: it will be registered when it is joined.
+func (h *Hub) CheckRoomJoinable(ctx context.Context, roomID string, username string) (*cache.Room, error) {
+	if !ValidRoomID(roomID) {
+		return nil, fmt.Errorf("%w: '%.64s'", ErrInvalidRoom, roomID)
+	}
+	room, err := h.CheckRoomAccess(ctx, roomID, username)
+	if err != nil {
+		return nil, err
+	}
+	if room != nil && room.Archived {
+		return nil, fmt.Errorf("%w: '%s'", ErrRoomArchived, roomID)
+	}
+	return room, nil
+}
+
+// roomForJoin checks that client may join roomID (see CheckRoomJoinable), registering the room
+// if it was never created and the Hub allows that. On failure the client is sent an
+// ErrorMessageType and ok is false.
+func (h *Hub) roomForJoin(ctx context.Context, client *Client, roomID string) (room *cache.Room, ok bool) {
+	room, err := h.CheckRoomJoinable(ctx, roomID, client.username)
+	if err != nil {
+		client.log.Warn("Cannot join room", "room_id", roomID, "error", err)
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: roomJoinErrorText(err), RoomID: roomID, Timestamp: time.Now().UTC()})
+		return nil, false
+	}
+	if room != nil {
+		return room, true
+	}
+
+	// Rooms that were never created are registered implicitly as server-owned rooms: the first
+	// user to type an ID must not become the owner of a room that anyone may be about to use.
+	room, err = h.CreateRoom(ctx, roomID, "", RoomSettings{})
+	if errors.Is(err, ErrRoomExists) {
+		room, err = h.store.GetRoom(ctx, roomID) // Someone else registered it meanwhile.
+	}
+	if err != nil || room == nil {
+		client.log.Error("Registering joined room failed", "room_id", roomID, "error", err)
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Failed to join room " + roomID, RoomID: roomID, Timestamp: time.Now().UTC()})
+		return nil, false
+	}
+	return room, true
+}
+
+// roomJoinErrorText explains to a client why CheckRoomJoinable refused a join.
+func roomJoinErrorText(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidRoom):
+		return "Invalid RoomID. Room IDs are 1 to 64 letters, digits, '.', '-' or '_'."
+	case errors.Is(err, ErrRoomNotFound):
+		return "This room does not exist. Rooms must be created before they can be joined."
+	case errors.Is(err, ErrRoomArchived):
+		return "This room is archived and can no longer be joined."
+	case errors.Is(err, ErrBannedFromRoom):
+		return "You are banned from this room."
+	case errors.Is(err, ErrNotRoomMember):
+		return "This room is only open to its members. Ask one of its moderators for an invitation."
+	default:
+		return "Failed to join room. Please try again later."
+	}
+}
+
+// roomInfoMessage builds the RoomInfoType message describing a room.
+func roomInfoMessage(room *cache.Room) *Message {
+	return &Message{
+		Type:      RoomInfoType,
+		RoomID:    room.ID,
+		Data:      RoomInfo(room),
+		Timestamp: time.Now().UTC(),
+		System:    true,
+	}
+}
+
+// broadcastRoomInfo sends a room's current RoomInfoType to all of its members.
+func (h *Hub) broadcastRoomInfo(room *cache.Room) {
+	h.broadcastToRoom(roomInfoMessage(room))
+}
+
+// RoomInfo converts a room's registry record into its RoomInfoPayload.
+func RoomInfo(room *cache.Room) RoomInfoPayload {
+	return RoomInfoPayload{
+		RoomID:     room.ID,
+		Name:       room.Name,
+		Topic:      room.Topic,
+		CreatedBy:  room.CreatedBy,
+		CreatedAt:  room.CreatedAt,
+		Visibility: room.Visibility,
+		Archived:   room.Archived,
+	}
+}
@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/yebrai/go-chat/internal/cache"
+)
+
+func TestJoiningUnregisteredRoomRegistersServerOwnedRoom(t *testing.T) {
+	for _, how := range []string{"connect", string(JoinRoomMessageType), string(SubscribeType)} {
+		t.Run(how, func(t *testing.T) {
+			store := cache.NewMemoryStore()
+			h := newTestHub(t, store, HubOptions{})
+			var alice *testClient
+			if how == "connect" {
+				alice = connectTestClient(t, h, "alice", "lobby") // The room the connection was opened with.
+			} else {
+				alice = connectTestClient(t, h, "alice", "")
+				alice.post(&Message{Type: MessageType(how), Content: `{"roomID":"lobby"}`})
+				alice.next(t, RoomInfoType)
+			}
+
+			room, err := store.GetRoom(context.Background(), "lobby")
+			if err != nil || room == nil {
+				t.Fatalf("room not registered on join: %v", err)
+			}
+			if room.CreatedBy != "" || room.Visibility != cache.RoomVisibilityPublic {
+				t.Errorf("implicitly registered room = %+v, want a public room without an owner", room)
+			}
+
+			// Nobody owns the room, so its first user cannot take it over.
+			private := cache.RoomVisibilityPrivate
+			if _, err := h.UpdateRoom(context.Background(), "lobby", alice.username, RoomSettings{Visibility: &private}); !errors.Is(err, ErrNotRoomOwner) {
+				t.Errorf("first user updating the room: got %v, want %v", err, ErrNotRoomOwner)
+			}
+		})
+	}
+}
+
+func TestMakingRoomPrivateRemovesNonMembersOnEveryHub(t *testing.T) {
+	store := cache.NewMemoryStore()
+	hubA := newTestHub(t, store, HubOptions{})
+	hubB := newTestHub(t, store, HubOptions{})
+	ctx := context.Background()
+	if _, err := hubA.CreateRoom(ctx, "club", "alice", RoomSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hubA.InviteToRoom(ctx, "club", "alice", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	alice := connectTestClient(t, hubA, "alice", "club")
+	bob := connectTestClient(t, hubA, "bob", "club")
+	carol := connectTestClient(t, hubB, "carol", "club")
+	dave := connectTestClient(t, hubB, "dave", "club")
+	for _, c := range []*testClient{alice, bob, carol, dave} {
+		c.joined(t, "club") // Only users in the room's user list are removed.
+	}
+
+	private := cache.RoomVisibilityPrivate
+	if _, err := hubA.UpdateRoom(ctx, "club", "alice", RoomSettings{Visibility: &private}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*testClient{bob, dave} {
+		if msg := c.next(t, RemovedFromRoomType); msg.RoomID != "club" {
+			t.Errorf("%s removed from room %q, want %q", c.username, msg.RoomID, "club")
+		}
+	}
+	for _, c := range []*testClient{alice, carol} {
+		c.none(t, RemovedFromRoomType, echoWait)
+	}
+	users, err := store.GetActiveUsersInRoom(ctx, "club")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(users)
+	if !reflect.DeepEqual(users, []string{"alice", "carol"}) {
+		t.Errorf("users in room = %v, want [alice carol]", users)
+	}
+}
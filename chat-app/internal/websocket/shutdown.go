@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxShutdownReconnectDelay bounds the random delay clients are told to wait before reconnecting
+// when the server shuts down, which spreads their reconnections over time and over the remaining
+// instances.
+const maxShutdownReconnectDelay = 5 * time.Second
+
+// Shutdown stops the Hub. From the moment it is called, new connections are refused (see
+// ShuttingDown). The event loop then handles the messages clients already sent, tells every
+// client the server is shutting down, closes its connection with a going-away close frame and
+// removes it from the store as if it had disconnected, and stops. Shutdown waits for all this,
+// and for every client's WritePump to write out what it was sent and the close frame, until ctx
+// is done, in which case it returns ctx's error and the Hub carries on in the background; other
+// instances reap whatever presence it leaves behind once its heartbeat lapses.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	if h.closing.CompareAndSwap(false, true) {
+		h.log.Info("Shutting down")
+		close(h.shutdown)
+	}
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return fmt.Errorf("hub did not finish shutting down: %w", ctx.Err())
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		h.writePumps.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("hub did not finish closing client connections: %w", ctx.Err())
+	}
+}
+
+// ShuttingDown reports whether Shutdown was called. Handlers should refuse new connections then.
+func (h *Hub) ShuttingDown() bool {
+	return h.closing.Load()
+}
+
+// disconnectAll runs on the event loop once Shutdown is called, and is the last thing it does.
+// Messages clients sent before the shutdown are handled first, and the room workers finish with
+// them, so that they are stored and acknowledged before clients are told to go. Each client is then sent a
+// ServerShutdownType and unregistered, which closes its connection and updates its rooms and
+// presence for the other instances. Lastly, anything the store still counts for this instance,
+// left behind by failed store calls, is reaped along with its heartbeat.
+func (h *Hub) disconnectAll() {
+	if drained := h.drainMessages(); drained > 0 {
+		h.log.Info("Handled pending messages before shutting down", "count", drained)
+	}
+	h.workers.stop()
+
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mu.RUnlock()
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down")
+	for _, client := range clients {
+		delay := rand.N(maxShutdownReconnectDelay)
+		h.sendToClient(client, &Message{
+			Type:      ServerShutdownType,
+			Content:   "The server is shutting down. Please reconnect.",
+			Data:      ServerShutdownPayload{ReconnectAfterMs: delay.Milliseconds()},
+			Timestamp: time.Now().UTC(),
+			System:    true,
+		})
+		client.closeMessage = closeMessage
+		h.handleClientUnregistration(client)
+	}
+	h.log.Info("Disconnected clients", "count", len(clients))
+
+	if h.events != nil {
+		if err := h.events.Close(); err != nil {
+			h.log.Error("Closing remote event subscription failed", "error", err)
+		}
+	}
+
+	// Our last heartbeat is older than now, so this always reaps our own instance.
+	ctx, cancel := h.storeContext()
+	defer cancel()
+	reaped, err := h.store.ReapInstance(ctx, h.instanceID, time.Now())
+	if err != nil {
+		h.log.Error("Reaping own instance failed", "error", err)
+		return
+	}
+	if reaped != nil && (len(reaped.OfflineUsers) > 0 || len(reaped.LeftRooms) > 0) {
+		h.log.Warn("Reaped users and rooms that disconnecting clients left behind", "users", len(reaped.OfflineUsers), "rooms", len(reaped.LeftRooms))
+		h.announceReaped(ctx, reaped)
+	}
+}
+
+// drainMessages handles the messages queued on routeMessage, without waiting for more, and
+// returns how many there were.
+func (h *Hub) drainMessages() int {
+	for drained := 0; ; drained++ {
+		select {
+		case in := <-h.routeMessage:
+			h.routeClientMessage(in)
+		default:
+			return drained
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/yebrai/go-chat/internal/cache"
+)
+
+func TestShutdownFlushesNoticeAndCloseFrame(t *testing.T) {
+	h := NewHub(cache.NewMemoryStore(), HubOptions{Logger: quietLogger})
+	go h.Run()
+
+	// The server side of every connection, to cut once Shutdown returns, as the process would exit.
+	var mu sync.Mutex
+	var serverConns []*websocket.Conn
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		serverConns = append(serverConns, conn)
+		mu.Unlock()
+		client := NewClient(h, conn, r.URL.Query().Get("user"), "session", "general", 0)
+		h.RegisterClient(client)
+		go client.WritePump()
+		go client.ReadPump()
+	}))
+	defer server.Close()
+
+	users := []string{"alice", "bob", "carol"}
+	conns := make([]*websocket.Conn, len(users))
+	for i, user := range users {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?user="+user, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+		readUntil(t, conn, RoomInfoType)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	for _, conn := range serverConns {
+		_ = conn.UnderlyingConn().Close()
+	}
+	mu.Unlock()
+
+	for i, conn := range conns {
+		readUntil(t, conn, ServerShutdownType)
+		var closeErr *websocket.CloseError
+		if _, _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+			t.Errorf("%s: got %v after the shutdown notice, want a going-away close frame", users[i], err)
+		}
+	}
+}
+
+// readUntil reads messages from conn until one of type typ arrives.
+func readUntil(t *testing.T, conn *websocket.Conn, typ MessageType) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for a %s: %v", typ, err)
+		}
+		if msg.Type == typ {
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package websocket
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yebrai/go-chat/internal/metrics"
+)
+
+// SlowConsumerPolicy is what the Hub does with a message for a client whose send buffer is full,
+// that is a client that does not read its messages as fast as they are sent to it. The Hub never
+// waits for such a client, which would hold up every other client.
+type SlowConsumerPolicy string
+
+const (
+	// DropNewest discards the message, and keeps the client.
+	DropNewest SlowConsumerPolicy = "drop_newest"
+	// DropOldest discards the oldest message waiting in the client's buffer, whatever its class,
+	// to make room for the message, and keeps the client.
+	DropOldest SlowConsumerPolicy = "drop_oldest"
+	// Disconnect discards the message and unregisters the client, which may reconnect and resume
+	// from the last message it received.
+	Disconnect SlowConsumerPolicy = "disconnect"
+)
+
+// MessageClass groups message types by how much missing one of them costs a client.
+type MessageClass string
+
+const (
+	// ChatClass covers the messages a client cannot do without: those sent to rooms and users,
+	// and the changes to them, such as edits, reactions and membership changes.
+	ChatClass MessageClass = "chat"
+	// EphemeralClass covers the messages superseded by the next of their type: typing
+	// notifications, room stats, user lists, user counts, presence, read receipts and unread counts.
+	EphemeralClass MessageClass = "ephemeral"
+	// ReplyClass covers the messages sent to a single connection, mostly in answer to its own
+	// requests: acknowledgements, errors, history pages and other listings.
+	ReplyClass MessageClass = "reply"
+)
+
+// SlowConsumerPolicies are the policies applied to each class of messages. Zero policies mean
+// those of DefaultSlowConsumerPolicies.
+type SlowConsumerPolicies struct {
+	Chat      SlowConsumerPolicy
+	Ephemeral SlowConsumerPolicy
+	Reply     SlowConsumerPolicy
+}
+
+// DefaultSlowConsumerPolicies disconnect clients that cannot keep up with chat messages or
+// replies, so that they resume from where they stopped rather than miss messages silently, but
+// drop ephemeral messages, which are superseded soon enough.
+var DefaultSlowConsumerPolicies = SlowConsumerPolicies{Chat: Disconnect, Ephemeral: DropNewest, Reply: Disconnect}
+
+// String formats the policies as ParseSlowConsumerPolicies accepts them.
+func (p SlowConsumerPolicies) String() string {
+	return fmt.Sprintf("%s=%s,%s=%s,%s=%s", ChatClass, p.Chat, EphemeralClass, p.Ephemeral, ReplyClass, p.Reply)
+}
+
+// ParseSlowConsumerPolicies parses policies written as comma-separated "<class>=<policy>" pairs,
+// e.g. "ephemeral=drop_oldest,reply=drop_newest". Classes left out keep their default policy.
+func ParseSlowConsumerPolicies(s string) (SlowConsumerPolicies, error) {
+	policies := DefaultSlowConsumerPolicies
+	for _, pair := range strings.Split(s, ",") {
+		class, name, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return SlowConsumerPolicies{}, fmt.Errorf("invalid slow consumer policy '%s': expected '<class>=<policy>'", pair)
+		}
+		policy := SlowConsumerPolicy(name)
+		switch policy {
+		case DropNewest, DropOldest, Disconnect:
+		default:
+			return SlowConsumerPolicies{}, fmt.Errorf("unknown slow consumer policy '%s': expected '%s', '%s' or '%s'", name, DropNewest, DropOldest, Disconnect)
+		}
+		switch MessageClass(class) {
+		case ChatClass:
+			policies.Chat = policy
+		case EphemeralClass:
+			policies.Ephemeral = policy
+		case ReplyClass:
+			policies.Reply = policy
+		default:
+			return SlowConsumerPolicies{}, fmt.Errorf("unknown message class '%s': expected '%s', '%s' or '%s'", class, ChatClass, EphemeralClass, ReplyClass)
+		}
+	}
+	return policies, nil
+}
+
+// withDefaults replaces the zero policies of p with those of defaults.
+func (p SlowConsumerPolicies) withDefaults(defaults SlowConsumerPolicies) SlowConsumerPolicies {
+	if p.Chat == "" {
+		p.Chat = defaults.Chat
+	}
+	if p.Ephemeral == "" {
+		p.Ephemeral = defaults.Ephemeral
+	}
+	if p.Reply == "" {
+		p.Reply = defaults.Reply
+	}
+	return p
+}
+
+// forClass returns the policy applied to a class of messages.
+func (p SlowConsumerPolicies) forClass(class MessageClass) SlowConsumerPolicy {
+	switch class {
+	case EphemeralClass:
+		return p.Ephemeral
+	case ReplyClass:
+		return p.Reply
+	default:
+		return p.Chat
+	}
+}
+
+// messageClass returns the class of messages of type t. Types it does not list are chat messages,
+// so that new types are not dropped unless they are meant to be.
+func messageClass(t MessageType) MessageClass {
+	switch t {
+	case UserTypingMessageType, RoomStatsUpdateType, UserListUpdateType, GlobalUserCountUpdateType,
+		PresenceUpdateType, ReadReceiptType, UnreadCountsType:
+		return EphemeralClass
+	case ErrorMessageType, AckMessageType, RecentMessagesType, MissedMessagesType, ResyncRequiredType,
+		HistoryType, ConversationListType, RoomInfoType, PinnedMessagesType, ThreadHistoryType,
+		SubscriptionsType, ServerShutdownType:
+		return ReplyClass
+	default:
+		return ChatClass
+	}
+}
+
+// handleSlowConsumer applies the slow consumer policy of msg's class to c, whose send buffer was
+// full when msg was sent to it, without blocking.
+func (h *Hub) handleSlowConsumer(c *Client, msg *Message) {
+	class := messageClass(msg.Type)
+	policy := h.options.SlowConsumerPolicies.forClass(class)
+	switch policy {
+	case DropOldest:
+		select {
+		case dropped := <-c.send:
+			c.log.Debug("Send channel full; dropped oldest message", "type", msg.Type, "dropped_type", dropped.Type)
+		default: // WritePump made room in the meantime.
+		}
+		select {
+		case c.send <- msg:
+		default: // The buffer filled up again in the meantime, so msg is dropped after all.
+		}
+	case DropNewest:
+		c.log.Debug("Send channel full; dropped message", "type", msg.Type)
+	default:
+		c.log.Warn("Send channel full; scheduling unregister", "type", msg.Type)
+		h.unregisterLater(c)
+	}
+	metrics.DroppedMessages.WithLabelValues(metrics.QueueClientSend).Inc()
+	metrics.SlowConsumerOutcomes.WithLabelValues(string(class), string(policy)).Inc()
+}
@@ -0,0 +1,138 @@
+package websocket
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/metrics"
+)
+
+// fullClient registers a client of h whose send buffer is full of chat messages "old0" to
+// "old255", oldest first. It is registered without the store's bookkeeping, so that only the
+// test sends it messages, and nothing drains its buffer.
+func fullClient(t *testing.T, h *Hub) *Client {
+	t.Helper()
+	c := NewClient(h, nil, "alice", "session-alice", "", 0)
+	for i := 0; i < cap(c.send); i++ {
+		c.send <- &Message{Type: TextMessageType, RoomID: "general", Content: fmt.Sprint("old", i)}
+	}
+	h.mu.Lock()
+	h.clients[c] = true
+	h.mu.Unlock()
+	return c
+}
+
+// buffered returns the contents of the messages waiting in c's send buffer, oldest first, and
+// whether the Hub closed it, which it does once it has unregistered c.
+func buffered(t *testing.T, c *Client) (contents []string, closed bool) {
+	t.Helper()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return contents, true
+			}
+			contents = append(contents, msg.Content)
+		default:
+			return contents, false
+		}
+	}
+}
+
+// summary describes messages by their number, first and last.
+func summary(messages []string) string {
+	if len(messages) == 0 {
+		return "no messages"
+	}
+	return fmt.Sprintf("%d messages, %q to %q", len(messages), messages[0], messages[len(messages)-1])
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	old := make([]string, 256)
+	for i := range old {
+		old[i] = fmt.Sprint("old", i)
+	}
+	for _, tc := range []struct {
+		policies   SlowConsumerPolicies
+		msg        *Message
+		class      MessageClass
+		outcome    SlowConsumerPolicy
+		want       []string // What the client is left with.
+		disconnect bool
+	}{
+		{
+			policies: SlowConsumerPolicies{Ephemeral: DropOldest},
+			msg:      &Message{Type: UserTypingMessageType, RoomID: "general", Content: "new"},
+			class:    EphemeralClass,
+			outcome:  DropOldest,
+			want:     append(old[1:len(old):len(old)], "new"),
+		},
+		{
+			policies: SlowConsumerPolicies{Chat: DropNewest},
+			msg:      &Message{Type: TextMessageType, RoomID: "general", Content: "new"},
+			class:    ChatClass,
+			outcome:  DropNewest,
+			want:     old,
+		},
+		{
+			msg:        &Message{Type: AckMessageType, Content: "new"},
+			class:      ReplyClass,
+			outcome:    Disconnect,
+			disconnect: true,
+		},
+	} {
+		t.Run(string(tc.outcome), func(t *testing.T) {
+			h := newTestHub(t, cache.NewMemoryStore(), HubOptions{SlowConsumerPolicies: tc.policies})
+			c := fullClient(t, h)
+			outcomes := metrics.SlowConsumerOutcomes.WithLabelValues(string(tc.class), string(tc.outcome))
+			dropped := metrics.DroppedMessages.WithLabelValues(metrics.QueueClientSend)
+			outcomesBefore, droppedBefore := testutil.ToFloat64(outcomes), testutil.ToFloat64(dropped)
+			forcedBefore := testutil.ToFloat64(metrics.ForcedUnregisters)
+
+			h.sendToClient(c, tc.msg)
+			if got := testutil.ToFloat64(outcomes) - outcomesBefore; got != 1 {
+				t.Errorf("%s/%s outcomes counted %v times, want once", tc.class, tc.outcome, got)
+			}
+			if got := testutil.ToFloat64(dropped) - droppedBefore; got != 1 {
+				t.Errorf("dropped client_send messages counted %v times, want once", got)
+			}
+			forced := 0.0
+			if tc.disconnect {
+				forced = 1
+			}
+			if got := testutil.ToFloat64(metrics.ForcedUnregisters) - forcedBefore; got != forced {
+				t.Errorf("forced unregisters counted %v times, want %v", got, forced)
+			}
+
+			if !tc.disconnect {
+				if got, closed := buffered(t, c); closed || !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("client left with %s (closed: %t), want %s", summary(got), closed, summary(tc.want))
+				}
+				return
+			}
+			// The client is unregistered on the event loop, which closes its send buffer: the client
+			// reads the messages it already had, then finds it closed.
+			deadline := time.After(testTimeout)
+			for {
+				if _, closed := buffered(t, c); closed {
+					break
+				}
+				select {
+				case <-deadline:
+					t.Fatal("slow client was not disconnected")
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
+			h.mu.RLock()
+			defer h.mu.RUnlock()
+			if h.clients[c] {
+				t.Error("slow client still registered")
+			}
+		})
+	}
+}
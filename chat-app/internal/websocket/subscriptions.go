@@ -0,0 +1,100 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/logging"
+)
+
+// maxRoomSubscriptions bounds how many rooms one connection can be subscribed to at once,
+// the focused room included.
+const maxRoomSubscriptions = 50
+
+// subscribedRooms returns the IDs of the rooms the client is subscribed to, sorted.
+// Only the Hub's event loop may call it.
+func (c *Client) subscribedRooms() []string {
+	rooms := make([]string, 0, len(c.subscriptions))
+	for roomID := range c.subscriptions {
+		rooms = append(rooms, roomID)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// focusRoom makes roomID, which the client must be subscribed to, the client's focused room:
+// the one its requests default to.
+func (h *Hub) focusRoom(client *Client, roomID string) {
+	client.setCurrentRoomID(roomID)
+}
+
+// subscriptionsMessage builds the SubscriptionsType message listing a client's rooms.
+func subscriptionsMessage(client *Client) *Message {
+	return &Message{
+		Type:      SubscriptionsType,
+		Username:  client.username,
+		Data:      SubscriptionsPayload{Rooms: client.subscribedRooms(), Focus: client.currentRoomID()},
+		Timestamp: time.Now().UTC(),
+		System:    true,
+	}
+}
+
+// refuseSubscription tells client, and returns true, if subscribing to roomID would exceed
+// maxRoomSubscriptions.
+func (h *Hub) refuseSubscription(client *Client, roomID string) bool {
+	if client.subscribedTo(roomID) || len(client.subscriptions) < maxRoomSubscriptions {
+		return false
+	}
+	client.log.Warn("Too many subscriptions", "room_id", roomID, "subscriptions", len(client.subscriptions))
+	h.sendToClient(client, &Message{Type: ErrorMessageType, Content: fmt.Sprintf("A connection can be subscribed to at most %d rooms.", maxRoomSubscriptions), RoomID: roomID, Timestamp: time.Now().UTC()})
+	return true
+}
+
+// handleSubscription answers a client's SubscribeType or UnsubscribeType request. Message.Content
+// carries a JSON-encoded JoinRoomData naming the room. Subscribing admits the client to the room
+// like JoinRoomMessageType, but keeps its focus (unless it had none) and its other rooms.
+// Unsubscribing from the focused room leaves the client without a focus. Either way, the client
+// is then sent its rooms as a SubscriptionsType.
+func (h *Hub) handleSubscription(client *Client, msg *Message) {
+	var request JoinRoomData
+	if err := json.Unmarshal([]byte(msg.Content), &request); err != nil {
+		client.log.Warn("Invalid request data", "type", msg.Type, "error", err, logging.Content(msg.Content))
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Invalid subscription request format.", Timestamp: time.Now().UTC()})
+		return
+	}
+	if request.RoomID == "" {
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "RoomID required for subscription request.", Timestamp: time.Now().UTC()})
+		return
+	}
+
+	switch msg.Type {
+	case SubscribeType:
+		if h.refuseSubscription(client, request.RoomID) {
+			return
+		}
+		h.joinRoom(client, msg, request.RoomID, func(room *cache.Room) {
+			if h.refuseSubscription(client, room.ID) { // Other subscriptions were admitted meanwhile.
+				return
+			}
+			h.handleClientJoinRoom(client, room, true)
+			if client.currentRoomID() == "" {
+				h.focusRoom(client, room.ID)
+			}
+			client.log.Info("Subscribed to room", "room_id", room.ID, "subscriptions", len(client.subscriptions))
+			h.sendToClient(client, subscriptionsMessage(client))
+		}, nil)
+		return // The client is sent its rooms once the room's worker has admitted it.
+
+	case UnsubscribeType:
+		if !client.subscribedTo(request.RoomID) {
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "You are not subscribed to this room.", RoomID: request.RoomID, Timestamp: time.Now().UTC()})
+			return
+		}
+		h.handleClientLeaveRoom(client, request.RoomID, false)
+		client.log.Info("Unsubscribed from room", "room_id", request.RoomID, "subscriptions", len(client.subscriptions))
+	}
+	h.sendToClient(client, subscriptionsMessage(client))
+}
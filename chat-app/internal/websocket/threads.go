@@ -0,0 +1,202 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/cache"
+	"github.com/yebrai/go-chat/internal/logging"
+)
+
+// ErrInvalidThread is returned when a message cannot start a thread: it is deleted, it is not
+// a chat message, or it is itself a reply (threads are one level deep).
+var ErrInvalidThread = errors.New("this message cannot be replied to")
+
+// threadParent returns a message of a room that can start a thread, decoded, failing with
+// ErrMessageNotFound or ErrInvalidThread otherwise.
+func (h *Hub) threadParent(ctx context.Context, roomID string, parentID int64) (*Message, error) {
+	parent, _, err := h.loggedMessage(ctx, roomID, parentID)
+	if err != nil {
+		return nil, err
+	}
+	if parent.Deleted || parent.Type != TextMessageType || parent.ParentID != 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidThread, parentID)
+	}
+	return parent, nil
+}
+
+// deliverThreadReply indexes a stored reply in its thread and delivers it. The sender follows
+// the thread from now on, and so does the parent's author once the thread gets its first reply.
+// The reply goes to every follower who can still access the room, on every instance; the rest
+// of the room only gets a ThreadUpdatedType with the parent's new reply count, which is also
+// recorded on the parent in the history.
+func (h *Hub) deliverThreadReply(ctx context.Context, reply *Message, parentAuthor string) {
+	count, err := h.store.AddThreadReply(ctx, reply.RoomID, reply.ParentID, reply.ID)
+	if err != nil {
+		h.log.Error("Indexing thread reply failed", "room_id", reply.RoomID, "parent_id", reply.ParentID, "message_id", reply.ID, "error", err)
+	}
+	if err := h.store.FollowThread(ctx, reply.RoomID, reply.ParentID, reply.Username); err != nil {
+		h.log.Error("Following thread failed", "room_id", reply.RoomID, "parent_id", reply.ParentID, "user", reply.Username, "error", err)
+	}
+	if count == 1 && parentAuthor != "" {
+		if err := h.store.FollowThread(ctx, reply.RoomID, reply.ParentID, parentAuthor); err != nil {
+			h.log.Error("Following thread failed", "room_id", reply.RoomID, "parent_id", reply.ParentID, "user", parentAuthor, "error", err)
+		}
+	}
+
+	// Keep the parent's thread summary current. Counts and times only ever grow, so concurrent
+	// replies cannot roll the summary back.
+	lastReplyAt := reply.Timestamp
+	_, err = h.rewriteMessage(ctx, reply.RoomID, reply.ParentID, func(parent *Message) (*Message, error) {
+		if parent.ReplyCount >= count && parent.LastReplyAt != nil && !parent.LastReplyAt.Before(lastReplyAt) {
+			return nil, nil
+		}
+		if count > parent.ReplyCount {
+			parent.ReplyCount = count
+		}
+		if parent.LastReplyAt == nil || parent.LastReplyAt.Before(lastReplyAt) {
+			parent.LastReplyAt = &lastReplyAt
+		}
+		return parent, nil
+	})
+	if err != nil {
+		h.log.Error("Updating thread summary failed", "room_id", reply.RoomID, "parent_id", reply.ParentID, "error", err)
+	}
+
+	followers, err := h.store.GetThreadFollowers(ctx, reply.RoomID, reply.ParentID)
+	if err != nil {
+		h.log.Error("Getting thread followers failed", "room_id", reply.RoomID, "parent_id", reply.ParentID, "error", err)
+		followers = []string{reply.Username}
+	}
+	room, err := h.store.GetRoom(ctx, reply.RoomID)
+	if err != nil {
+		h.log.Error("Getting room to deliver reply failed", "room_id", reply.RoomID, "message_id", reply.ID, "error", err)
+		followers = []string{reply.Username}
+	}
+	for _, follower := range followers {
+		if room != nil {
+			if err := checkMembership(ctx, h.store, room, follower); err != nil {
+				continue // Followers who lost access to the room no longer get its replies.
+			}
+		}
+		h.deliverToUser(follower, reply)
+		h.publishUserEvent(follower, reply)
+	}
+	h.log.Debug("Thread reply delivered to followers", "room_id", reply.RoomID, "parent_id", reply.ParentID, "message_id", reply.ID, "followers", len(followers))
+
+	h.broadcastToRoom(&Message{
+		Type:      ThreadUpdatedType,
+		Username:  reply.Username,
+		RoomID:    reply.RoomID,
+		Timestamp: time.Now().UTC(),
+		System:    true,
+		Data:      ThreadSummaryPayload{RoomID: reply.RoomID, ParentID: reply.ParentID, ReplyCount: count, LastReplyAt: lastReplyAt, LastReplyBy: reply.Username},
+	})
+}
+
+// LoadThread reads one page of the replies to a message of a room, with the same cursor and
+// limit semantics as LoadHistory. The first page (an empty cursor) also carries the parent
+// message. Callers are responsible for checking the requester's access to the room.
+func LoadThread(ctx context.Context, store cache.Store, logger *slog.Logger, roomID string, parentID int64, before string, limit int) (*HistoryPayload, error) {
+	if roomID == "" {
+		return nil, fmt.Errorf("roomID cannot be empty")
+	}
+	parentJSON, err := store.GetMessage(ctx, roomID, parentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message %d of room '%s': %w", parentID, roomID, err)
+	}
+	if parentJSON == "" {
+		return nil, fmt.Errorf("%w: %d", ErrMessageNotFound, parentID)
+	}
+	page, err := loadHistoryPage(func(beforeID int64, limit int) ([]string, error) {
+		return store.GetThreadRepliesBefore(ctx, roomID, parentID, beforeID, limit)
+	}, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load thread %d of room '%s': %w", parentID, roomID, err)
+	}
+	page.RoomID = roomID
+	page.ParentID = parentID
+	if before == "" {
+		page.Parent = json.RawMessage(parentJSON)
+	}
+	page.Reactions = messageReactions(ctx, store, logger, roomID, page.Messages)
+	return page, nil
+}
+
+// withoutThreadReplies drops thread replies from a page of a room's messages, which only
+// shows top-level messages; replies are read with LoadThread.
+func withoutThreadReplies(messages []json.RawMessage) []json.RawMessage {
+	topLevel := messages[:0:0]
+	for _, messageJSON := range messages {
+		var message struct {
+			ParentID int64 `json:"parent_id"`
+		}
+		if err := json.Unmarshal(messageJSON, &message); err == nil && message.ParentID != 0 {
+			continue
+		}
+		topLevel = append(topLevel, messageJSON)
+	}
+	return topLevel
+}
+
+// handleThreadRequest answers a client's LoadThreadType, FollowThreadType or UnfollowThreadType
+// request. Message.Content carries a JSON-encoded ThreadRequestData whose room defaults to the
+// client's current room. The request is answered on the room's worker.
+func (h *Hub) handleThreadRequest(client *Client, msg *Message) {
+	var request ThreadRequestData
+	if err := json.Unmarshal([]byte(msg.Content), &request); err != nil {
+		client.log.Warn("Invalid request data", "type", msg.Type, "error", err, logging.Content(msg.Content))
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "Invalid thread request format.", Timestamp: time.Now().UTC()})
+		return
+	}
+	roomID := request.RoomID
+	if roomID == "" {
+		roomID = client.currentRoomID()
+	}
+	if roomID == "" {
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: "RoomID required for thread request.", Timestamp: time.Now().UTC()})
+		return
+	}
+
+	h.runOnWorker(roomID, client, msg, func(ctx context.Context) {
+		if _, err := h.CheckRoomAccess(ctx, roomID, client.username); err != nil {
+			client.log.Warn("Reading threads refused", "room_id", roomID, "error", err)
+			h.sendToClient(client, &Message{Type: ErrorMessageType, Content: roomJoinErrorText(err), RoomID: roomID, Timestamp: time.Now().UTC()})
+			return
+		}
+
+		var err error
+		switch msg.Type {
+		case LoadThreadType:
+			var page *HistoryPayload
+			page, err = LoadThread(ctx, h.store, client.log, roomID, request.ParentID, request.Before, request.Limit)
+			if err == nil {
+				h.sendToClient(client, &Message{Type: ThreadHistoryType, RoomID: roomID, Data: page, Timestamp: time.Now().UTC(), System: true})
+				return
+			}
+		case FollowThreadType:
+			if _, err = h.threadParent(ctx, roomID, request.ParentID); err == nil {
+				err = h.store.FollowThread(ctx, roomID, request.ParentID, client.username)
+			}
+		case UnfollowThreadType:
+			err = h.store.UnfollowThread(ctx, roomID, request.ParentID, client.username)
+		}
+		if err == nil {
+			return
+		}
+
+		client.log.Warn("Thread request failed", "type", msg.Type, "room_id", roomID, "parent_id", request.ParentID, "error", err)
+		content := "Failed to process the thread request. Please try again later."
+		switch {
+		case errors.Is(err, ErrInvalidCursor):
+			content = "Invalid history cursor."
+		case errors.Is(err, ErrMessageNotFound), errors.Is(err, ErrInvalidThread):
+			content = err.Error()
+		}
+		h.sendToClient(client, &Message{Type: ErrorMessageType, Content: content, RoomID: roomID, Timestamp: time.Now().UTC()})
+	})
+}
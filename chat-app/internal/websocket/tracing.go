@@ -0,0 +1,26 @@
+package websocket
+
+import (
+	"encoding/json"
+)
+
+// routeClientMessage has the Hub handle a message read from a client, and ends the span that
+// traced it since ReadPump received it. The span records when the message left the routeMessage
+// queue, which tells the time spent waiting in it from the time spent handling it.
+func (h *Hub) routeClientMessage(in *clientMessage) {
+	in.span.AddEvent("dequeued")
+	if in.retryAfter > 0 {
+		h.sendRateLimited(in.client, in.msg, in.retryAfter)
+	} else {
+		h.handleIncomingMessage(in.client, in.msg)
+	}
+	in.span.End()
+}
+
+// storedJSON serializes a message for the store. Its trace context is left out: it only
+// describes how the message was delivered live, not the message itself.
+func storedJSON(msg *Message) ([]byte, error) {
+	stored := *msg
+	stored.Trace = nil
+	return json.Marshal(&stored)
+}
@@ -0,0 +1,207 @@
+package websocket
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/yebrai/go-chat/internal/metrics"
+	"github.com/yebrai/go-chat/internal/tracing"
+)
+
+const (
+	// DefaultRoomWorkers is how many room workers a Hub runs, unless it is configured otherwise.
+	DefaultRoomWorkers = 16
+
+	// DefaultStoreTimeout bounds each job the room workers run for the Hub, unless the Hub is
+	// configured otherwise.
+	DefaultStoreTimeout = 5 * time.Second
+
+	// roomWorkerQueueSize is how many jobs may wait for each room worker before the requests of
+	// clients for its rooms are refused, and the Hub's own lookups skipped, rather than queued.
+	// The jobs keeping the store in step with the Hub's connections are always queued.
+	roomWorkerQueueSize = 256
+
+	// instanceWorkerKey is the room worker key of the jobs the Hub runs for itself rather than for
+	// a room or user: its heartbeat, the reaping of dead instances and the renewal of username claims.
+	instanceWorkerKey = "instance"
+)
+
+// userWorkerKey is the room worker key of the jobs concerning username's connections and presence,
+// which must run in the order the event loop submitted them.
+func userWorkerKey(username string) string {
+	return "user:" + username
+}
+
+// roomWorkers run the store calls of the Hub off its event loop, so that a slow store only holds
+// up the rooms and users waiting on it rather than every client. Jobs are sharded by key, a room
+// ID, a conversation or a user (see userWorkerKey): the jobs for one key all run on the same
+// worker, one at a time and in the order they were submitted, which keeps the messages of a room
+// in order, and a connection's joins and leaves in the order the event loop made them.
+type roomWorkers struct {
+	workers []*roomWorker
+	wg      sync.WaitGroup
+}
+
+// roomWorker is the queue of one room worker.
+type roomWorker struct {
+	mu      sync.Mutex
+	ready   *sync.Cond // Signalled when a job is queued, or the worker is stopped.
+	jobs    []func()
+	stopped bool // Whether stop was called: the worker runs the jobs left, then returns.
+}
+
+// newRoomWorkers starts n room workers.
+func newRoomWorkers(n int) *roomWorkers {
+	w := &roomWorkers{workers: make([]*roomWorker, n)}
+	for i := range w.workers {
+		worker := &roomWorker{}
+		worker.ready = sync.NewCond(&worker.mu)
+		w.workers[i] = worker
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			worker.run()
+		}()
+	}
+	return w
+}
+
+// run runs the worker's jobs as they are queued, until it is stopped and has none left.
+func (w *roomWorker) run() {
+	for {
+		w.mu.Lock()
+		for len(w.jobs) == 0 && !w.stopped {
+			w.ready.Wait()
+		}
+		if len(w.jobs) == 0 {
+			w.mu.Unlock()
+			return
+		}
+		job := w.jobs[0]
+		w.jobs[0] = nil
+		w.jobs = w.jobs[1:]
+		w.mu.Unlock()
+		job()
+	}
+}
+
+// submit queues job on the worker of key without blocking, and reports whether it was queued. If
+// bounded is set and the worker already has roomWorkerQueueSize jobs waiting, job is not queued.
+// Once the workers are stopped, as the Hub shuts down, job runs right away instead. It may be
+// called from any goroutine, including the workers' jobs.
+func (w *roomWorkers) submit(key string, job func(), bounded bool) bool {
+	shard := fnv.New32a()
+	_, _ = shard.Write([]byte(key))
+	worker := w.workers[shard.Sum32()%uint32(len(w.workers))]
+	worker.mu.Lock()
+	if worker.stopped {
+		worker.mu.Unlock()
+		job()
+		return true
+	}
+	if bounded && len(worker.jobs) >= roomWorkerQueueSize {
+		worker.mu.Unlock()
+		return false
+	}
+	worker.jobs = append(worker.jobs, job)
+	worker.ready.Signal()
+	worker.mu.Unlock()
+	return true
+}
+
+// stop waits for the workers to run the jobs already queued, then stops them. Only the Hub's
+// event loop may call it, once.
+func (w *roomWorkers) stop() {
+	for _, worker := range w.workers {
+		worker.mu.Lock()
+		worker.stopped = true
+		worker.ready.Signal()
+		worker.mu.Unlock()
+	}
+	w.wg.Wait()
+}
+
+// runOnWorker has the worker of key handle msg, a message from client, by running job with a
+// context that carries msg's trace and expires after the Hub's StoreTimeout. If the worker has
+// too many jobs waiting already, the client is told to retry instead, and runOnWorker returns
+// false. job runs outside the event loop: it may only reach the Hub's state through methods safe
+// to call from any goroutine, such as sendToClient and broadcastToRoom, or through onLoop.
+func (h *Hub) runOnWorker(key string, client *Client, msg *Message, job func(ctx context.Context)) bool {
+	queued := time.Now()
+	submitted := h.workers.submit(key, func() {
+		ctx, span := tracing.Tracer().Start(tracing.Extract(msg.Trace), "hub.room_worker")
+		defer span.End()
+		span.SetAttributes(attribute.String("chat.message.type", string(msg.Type)), attribute.Int64("chat.queue_wait_ms", time.Since(queued).Milliseconds()))
+		ctx, cancel := context.WithTimeout(ctx, h.options.StoreTimeout)
+		defer cancel()
+		job(ctx)
+	}, true)
+	if !submitted {
+		client.log.Warn("Room worker queue full; message refused", "type", msg.Type, "room_id", msg.RoomID)
+		metrics.DroppedMessages.WithLabelValues(metrics.QueueRoomWorker).Inc()
+		h.sendToClient(client, &Message{
+			Type:        ErrorMessageType,
+			Content:     "The server is busy. Please try again.",
+			RoomID:      msg.RoomID,
+			To:          msg.To,
+			ClientMsgID: msg.ClientMsgID,
+			Timestamp:   time.Now().UTC(),
+		})
+	}
+	return submitted
+}
+
+// onRoomWorker runs job on the worker of key, a room ID or one of the keys above, with a context
+// that expires after the Hub's StoreTimeout, for store calls the Hub makes of its own accord, such
+// as room stats lookups and periodic presence checks. If the worker has too many jobs waiting
+// already, job is skipped: such calls are repeated soon enough. Like runOnWorker's, job runs
+// outside the event loop. It may be called from any goroutine.
+func (h *Hub) onRoomWorker(key string, job func(ctx context.Context)) {
+	submitted := h.workers.submit(key, func() {
+		ctx, cancel := h.storeContext()
+		defer cancel()
+		job(ctx)
+	}, true)
+	if !submitted {
+		h.log.Debug("Room worker queue full; lookup skipped", "key", key)
+		metrics.DroppedMessages.WithLabelValues(metrics.QueueRoomWorker).Inc()
+	}
+}
+
+// mustRunOnWorker is onRoomWorker for the jobs that keep the store in step with what the event
+// loop did, such as recording a connection in a room's user set: they are queued on the worker
+// of key however many jobs it has waiting, and never skipped.
+func (h *Hub) mustRunOnWorker(key string, job func(ctx context.Context)) {
+	h.workers.submit(key, func() {
+		ctx, cancel := h.storeContext()
+		defer cancel()
+		job(ctx)
+	}, false)
+}
+
+// onLoop hands job to the Hub's event loop, for jobs running elsewhere, such as on the room
+// workers, to apply their results to the state only the loop may change. It waits until the loop
+// takes job, unless the Hub shuts down first, in which case job may never run: the loop then
+// waits for the room workers, and disconnects every client anyway. The loop itself must not call it.
+func (h *Hub) onLoop(job func()) {
+	select {
+	case h.loopJobs <- job:
+	case <-h.shutdown:
+	}
+}
+
+// storeContext returns a context for store calls that expires after the Hub's StoreTimeout,
+// for store calls made outside of runOnWorker's jobs.
+func (h *Hub) storeContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), h.options.StoreTimeout)
+}
+
+// messageContext is storeContext for the store calls made for msg outside of runOnWorker's jobs,
+// such as publishing it: the context also carries msg's trace.
+func (h *Hub) messageContext(msg *Message) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(tracing.Extract(msg.Trace), h.options.StoreTimeout)
+}
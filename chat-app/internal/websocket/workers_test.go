@@ -0,0 +1,199 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yebrai/go-chat/internal/cache"
+)
+
+func TestRoomLogChangesFollowTheRoomsMessages(t *testing.T) {
+	store := &slowStore{Store: cache.NewMemoryStore(), delay: 50 * time.Millisecond}
+	h := newTestHub(t, store, HubOptions{})
+	if _, err := h.CreateRoom(context.Background(), "general", "alice", RoomSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	alice := connectTestClient(t, h, "alice", "general")
+
+	// Everything Alice does to her message is sent before the message is even stored.
+	alice.post(&Message{Type: TextMessageType, RoomID: "general", Content: "m1", ClientMsgID: "c1"})
+	for _, msg := range []*Message{
+		{Type: EditMessageType, Content: `{"message_id":1,"content":"m1 edited"}`},
+		{Type: AddReactionType, Content: `{"message_id":1,"emoji":"👍"}`},
+		{Type: PinMessageType, Content: `{"message_id":1}`},
+		{Type: MarkReadType, Content: `{"message_id":1}`},
+		{Type: LoadHistoryType, RoomID: "general"},
+	} {
+		alice.post(msg)
+	}
+
+	received := make(map[MessageType]*Message)
+	timeout := time.After(testTimeout)
+	for received[HistoryType] == nil {
+		select {
+		case msg := <-alice.received:
+			if msg.Type == ErrorMessageType {
+				t.Fatalf("request refused: %s", msg.Content)
+			}
+			received[msg.Type] = msg
+		case <-timeout:
+			t.Fatal("alice received no history")
+		}
+	}
+	for _, typ := range []MessageType{MessageEditedType, ReactionUpdatedType, MessagePinnedType} {
+		if received[typ] == nil {
+			t.Errorf("alice received no %s before the history", typ)
+		}
+	}
+	page := received[HistoryType].Data.(*HistoryPayload)
+	if got := contents(t, page.Messages); len(got) != 1 || got[0] != "m1 edited" {
+		t.Errorf("history = %v, want [m1 edited]", got)
+	}
+}
+
+// stalledStore is a MemoryStore whose lookups of rooms and conversations, and recording of users'
+// connections and statuses, hang while it is stalled, like a Redis server that stopped answering,
+// until their context is done.
+type stalledStore struct {
+	cache.Store
+	mu      sync.Mutex
+	stalled chan struct{} // Closed to resume; nil while not stalled.
+}
+
+// stall stalls the store until resume is called.
+func (s *stalledStore) stall() (resume func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stalled := make(chan struct{})
+	s.stalled = stalled
+	return func() {
+		s.mu.Lock()
+		s.stalled = nil
+		s.mu.Unlock()
+		close(stalled)
+	}
+}
+
+func (s *stalledStore) wait(ctx context.Context) error {
+	s.mu.Lock()
+	stalled := s.stalled
+	s.mu.Unlock()
+	if stalled == nil {
+		return nil
+	}
+	select {
+	case <-stalled:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *stalledStore) GetRoom(ctx context.Context, roomID string) (*cache.Room, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.Store.GetRoom(ctx, roomID)
+}
+
+func (s *stalledStore) GetConversations(ctx context.Context, username string, limit int) ([]cache.Conversation, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.Store.GetConversations(ctx, username, limit)
+}
+
+func (s *stalledStore) GetDirectMessagesBefore(ctx context.Context, userA string, userB string, beforeID int64, limit int) ([]string, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.Store.GetDirectMessagesBefore(ctx, userA, userB, beforeID, limit)
+}
+
+func (s *stalledStore) AddUserToGlobalSet(ctx context.Context, instanceID string, username string) (int64, error) {
+	if err := s.wait(ctx); err != nil {
+		return 0, err
+	}
+	return s.Store.AddUserToGlobalSet(ctx, instanceID, username)
+}
+
+func (s *stalledStore) SetUserStatus(ctx context.Context, username string, status string, text string) error {
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	return s.Store.SetUserStatus(ctx, username, status, text)
+}
+
+func TestEventLoopServesOtherRoomsWhileRequestsWaitOnStore(t *testing.T) {
+	store := &stalledStore{Store: cache.NewMemoryStore()}
+	// Store calls would hold up the event loop for longer than the test waits.
+	h := newTestHub(t, store, HubOptions{StoreTimeout: time.Minute})
+	if _, err := h.CreateRoom(context.Background(), "slow", "alice", RoomSettings{}); err != nil {
+		t.Fatal(err)
+	}
+	alice := connectTestClient(t, h, "alice", "slow")
+	bob := connectTestClient(t, h, "bob", "other")
+	carol := connectTestClient(t, h, "carol", "other")
+	alice.post(&Message{Type: TextMessageType, RoomID: "slow", Content: "m1", ClientMsgID: "c1"})
+	alice.next(t, AckMessageType)
+
+	// Bob's typing only goes through the event loop, which must not be waiting for the store.
+	// Carol skips what Bob typed while the loop was held up by earlier requests.
+	loopServesOthers := func(t *testing.T, name string) {
+		t.Helper()
+		bob.post(&Message{Type: UserTypingMessageType, RoomID: "other", Content: name})
+		for carol.next(t, UserTypingMessageType).Content != name {
+		}
+	}
+	for _, request := range []*Message{
+		{Type: LoadHistoryType, RoomID: "slow"},
+		{Type: LoadHistoryType, To: "bob"},
+		{Type: ListConversationsType},
+		{Type: ListPinnedMessagesType, RoomID: "slow"},
+		{Type: EditMessageType, Content: `{"roomID":"slow","message_id":1,"content":"edited"}`},
+		{Type: DeleteMessageType, Content: `{"roomID":"slow","message_id":1}`},
+		{Type: PinMessageType, Content: `{"roomID":"slow","message_id":1}`},
+		{Type: AddReactionType, Content: `{"roomID":"slow","message_id":1,"emoji":"👍"}`},
+		{Type: LoadThreadType, Content: `{"roomID":"slow","parent_id":1}`},
+		{Type: FollowThreadType, Content: `{"roomID":"slow","parent_id":1}`},
+		{Type: MarkReadType, Content: `{"roomID":"slow","message_id":1}`},
+		{Type: InviteToRoomType, Content: `{"roomID":"slow","username":"dave"}`},
+		{Type: MuteUserType, Content: `{"roomID":"slow","username":"dave","duration_seconds":60}`},
+		{Type: SetPresenceType, Content: `{"status":"dnd"}`},
+		{Type: SubscribeType, Content: `{"roomID":"lobby"}`},
+		{Type: JoinRoomMessageType, Content: `{"roomID":"lobby"}`},
+	} {
+		name := string(request.Type)
+		if request.To != "" {
+			name += "_to_user"
+		}
+		t.Run(name, func(t *testing.T) {
+			resume := store.stall()
+			defer resume()
+			alice.post(request)
+			loopServesOthers(t, name)
+		})
+	}
+	t.Run("registration", func(t *testing.T) {
+		resume := store.stall()
+		defer resume()
+		h.register <- NewClient(h, nil, "dave", "session-dave", "slow", 0)
+		loopServesOthers(t, "registration")
+	})
+}
+
+func TestEventLoopStoreCallsTimeOut(t *testing.T) {
+	store := &stalledStore{Store: cache.NewMemoryStore()}
+	h := newTestHub(t, store, HubOptions{StoreTimeout: 50 * time.Millisecond})
+	alice := connectTestClient(t, h, "alice", "general")
+	resume := store.stall()
+	defer resume()
+
+	// Joins are checked on the room's worker, which gives up on the store after StoreTimeout.
+	alice.post(&Message{Type: JoinRoomMessageType, Content: `{"roomID":"lobby"}`})
+	if msg := alice.next(t, ErrorMessageType); msg.RoomID != "lobby" {
+		t.Errorf("error about room %q, want %q", msg.RoomID, "lobby")
+	}
+}
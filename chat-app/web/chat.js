@@ -32,13 +32,27 @@ document.addEventListener('DOMContentLoaded', () => {
 
     // Client State
     let ws = null;
+    let sessionToken = ''; // Signed session token from /api/login; proves our identity to /ws.
     let currentUsername = '';
     let currentRoomID = '';
     let isTyping = false;
     let typingTimer = null;
+    let historyCursor = ''; // ID of the oldest message shown; older pages are requested before it.
+    let hasMoreHistory = false;
+    let lastSeenMessageID = 0; // Newest message ID shown in the current room; sent on reconnect to resume from it.
+    const displayedMessageIDs = new Set(); // Server message IDs already shown, to skip duplicates (e.g. after reconnecting).
+    const messageReactions = new Map(); // Message ID -> { emoji: count } for the current room's messages.
+    const unreadCounts = new Map(); // Room ID -> number of unread messages, for the room list badges.
+    const readReceipts = new Map(); // Username -> last message ID they have read in the current room.
+    const userPresence = new Map(); // Username -> { status, status_text, last_seen }, for the user list.
+    let roomUsers = []; // Users currently in the current room, as last listed by the server.
+    const subscribedRooms = new Set(); // Rooms followed with /subscribe besides the current one; restored on reconnect.
+    let markReadTimer = null;
+    let loadingHistory = false;
     let reconnectAttempts = 0;
     const maxReconnectAttempts = 5;
     const baseReconnectDelay = 1000; // 1 second
+    let shutdownReconnectDelay = null; // Delay the server asked for before it shut down; replaces the backoff once.
 
     // MessageType constants (mirroring backend)
     const MessageType = {
@@ -47,13 +61,97 @@ document.addEventListener('DOMContentLoaded', () => {
         UserLeft: "user_left",
         RoomStatsUpdate: "room_stats",
         RecentMessages: "recent_messages",
-        UserListUpdate: "user_list",
+        UserListUpdate: "user_list_update",
         GlobalUserCountUpdate: "global_user_count",
         Error: "error_message",
         JoinRoom: "join_room", // Client to Server
         LeaveRoom: "leave_room", // Client to Server (not explicitly used in this UI version yet)
         UserTyping: "user_typing", // Client to Server & Server to Client
-        RequestStats: "request_stats" // Client to Server
+        RequestStats: "request_stats", // Client to Server
+        LoadHistory: "load_history", // Client to Server
+        History: "history",
+        Ack: "ack",
+        MissedMessages: "missed_messages",
+        ResyncRequired: "resync_required",
+        DirectMessage: "direct_message", // Client to Server & Server to Client
+        ListConversations: "list_conversations", // Client to Server
+        ConversationList: "conversation_list",
+        RoomInfo: "room_info",
+        InviteToRoom: "invite_to_room", // Client to Server
+        KickFromRoom: "kick_from_room", // Client to Server
+        BanFromRoom: "ban_from_room", // Client to Server
+        UnbanFromRoom: "unban_from_room", // Client to Server
+        RoomInvitation: "room_invitation",
+        RemovedFromRoom: "removed_from_room",
+        RoomMemberUpdate: "room_member_update",
+        SetRoomRole: "set_room_role", // Client to Server
+        MuteUser: "mute_user", // Client to Server
+        UnmuteUser: "unmute_user", // Client to Server
+        EditMessage: "edit_message", // Client to Server
+        DeleteMessage: "delete_message", // Client to Server
+        PinMessage: "pin_message", // Client to Server
+        UnpinMessage: "unpin_message", // Client to Server
+        ListPinnedMessages: "list_pinned_messages", // Client to Server
+        RoomRoleChanged: "room_role_changed",
+        UserMuted: "user_muted",
+        UserUnmuted: "user_unmuted",
+        MessageEdited: "message_edited",
+        MessageDeleted: "message_deleted",
+        MessagePinned: "message_pinned",
+        MessageUnpinned: "message_unpinned",
+        PinnedMessages: "pinned_messages",
+        AddReaction: "add_reaction", // Client to Server
+        RemoveReaction: "remove_reaction", // Client to Server
+        ReactionUpdated: "reaction_updated",
+        LoadThread: "load_thread", // Client to Server
+        FollowThread: "follow_thread", // Client to Server
+        UnfollowThread: "unfollow_thread", // Client to Server
+        ThreadHistory: "thread_history",
+        ThreadUpdated: "thread_updated",
+        MarkRead: "mark_read", // Client to Server
+        UnreadCounts: "unread_counts",
+        ReadReceipt: "read_receipt",
+        Subscribe: "subscribe", // Client to Server
+        Unsubscribe: "unsubscribe", // Client to Server
+        Subscriptions: "subscriptions",
+        SetPresence: "set_presence", // Client to Server
+        PresenceUpdate: "presence_update",
+        ServerShutdown: "server_shutdown"
+    };
+
+    // Room membership commands, available to a room's moderators: "/invite <user>" and so on.
+    const membershipCommands = {
+        '/invite': MessageType.InviteToRoom,
+        '/kick': MessageType.KickFromRoom,
+        '/ban': MessageType.BanFromRoom,
+        '/unban': MessageType.UnbanFromRoom,
+        '/mute': MessageType.MuteUser, // "/mute <user> [minutes]"
+        '/unmute': MessageType.UnmuteUser,
+        '/mod': MessageType.SetRoomRole, // Owner only.
+        '/unmod': MessageType.SetRoomRole // Owner only.
+    };
+
+    // Message commands: "/delete <message id>" and so on. Authors can delete their own messages for a
+    // while after sending them; moderators can delete any message and pin or unpin messages.
+    const messageCommands = {
+        '/delete': MessageType.DeleteMessage,
+        '/pin': MessageType.PinMessage,
+        '/unpin': MessageType.UnpinMessage
+    };
+
+    // Thread commands: "/thread <message id>" shows a message's replies; "/follow" and "/unfollow"
+    // choose whether new replies to it are delivered to you. Replying follows the thread.
+    const threadCommands = {
+        '/thread': MessageType.LoadThread,
+        '/follow': MessageType.FollowThread,
+        '/unfollow': MessageType.UnfollowThread
+    };
+
+    // Subscription commands: "/subscribe <room>" keeps receiving a room's messages while you chat
+    // in another one (they show up as unread badges); "/unsubscribe <room>" stops it.
+    const subscriptionCommands = {
+        '/subscribe': MessageType.Subscribe,
+        '/unsubscribe': MessageType.Unsubscribe
     };
 
     // --- Initialization ---
@@ -64,6 +162,9 @@ document.addEventListener('DOMContentLoaded', () => {
         messageForm.addEventListener('submit', handleSendMessage);
         messageInput.addEventListener('input', handleTyping);
         switchRoomBtn.addEventListener('click', handleSwitchRoom);
+        messageArea.addEventListener('scroll', () => {
+            if (messageArea.scrollTop === 0) requestOlderMessages(); // Scrolled to the top: page back through history.
+        });
 
         // Example room list click handling
         roomListExampleUl.addEventListener('click', (event) => {
@@ -79,7 +180,7 @@ document.addEventListener('DOMContentLoaded', () => {
     }
 
     // --- Event Handlers ---
-    function handleJoinChat(event) {
+    async function handleJoinChat(event) {
         event.preventDefault();
         const username = usernameInput.value.trim();
         const roomID = roomIdSetupInput.value.trim();
@@ -89,11 +190,32 @@ document.addEventListener('DOMContentLoaded', () => {
             return;
         }
 
-        currentUsername = username;
+        // Exchange the username for a session token before opening the WebSocket.
+        try {
+            const response = await fetch('/api/login', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ username: username })
+            });
+            if (!response.ok) {
+                alert(`Login failed: ${(await response.text()).trim()}`);
+                return;
+            }
+            const session = await response.json();
+            sessionToken = session.token;
+            currentUsername = session.username; // Server-normalised username.
+        } catch (e) {
+            console.error('Login request failed:', e);
+            alert('Could not reach the server to log in.');
+            return;
+        }
+
+        currentUsername = currentUsername || username;
         currentRoomID = roomID; // Set initial room
 
         displayUsername.textContent = currentUsername;
         displayRoomId.textContent = currentRoomID;
+        loadRoomList();
 
         setupView.style.display = 'none';
         chatView.style.display = 'flex'; // Use flex as per new CSS
@@ -123,9 +245,114 @@ document.addEventListener('DOMContentLoaded', () => {
                 roomID: targetRoomID,
                 username: currentUsername
             }));
+        } else if (text.startsWith('/dm ')) {
+            // "/dm <user> <text>" sends a direct message to another user.
+            const match = text.match(/^\/dm\s+(\S+)\s+([\s\S]+)$/);
+            if (!match) {
+                displaySystemMessage("Usage: /dm <user> <message>", true);
+                return;
+            }
+            ws.send(JSON.stringify({
+                type: MessageType.DirectMessage,
+                client_msg_id: newClientMsgID(),
+                to: match[1],
+                content: match[2]
+            }));
+        } else if (text.startsWith('/status')) {
+            // "/status <online|away|dnd> [text]" sets how others see you; no text clears it.
+            const match = text.match(/^\/status\s+(online|away|dnd)(?:\s+([\s\S]+))?$/);
+            if (!match) {
+                displaySystemMessage("Usage: /status <online|away|dnd> [status text]", true);
+                return;
+            }
+            ws.send(JSON.stringify({
+                type: MessageType.SetPresence,
+                content: JSON.stringify({ status: match[1], status_text: match[2] || '' })
+            }));
+        } else if (text.startsWith('/conversations')) {
+            ws.send(JSON.stringify({ type: MessageType.ListConversations }));
+        } else if (membershipCommands[text.split(/\s+/)[0]]) {
+            const [command, target, minutes] = text.split(/\s+/);
+            if (!target) {
+                displaySystemMessage(`Usage: ${command} <user>`, true);
+                return;
+            }
+            const request = { roomID: currentRoomID, username: target };
+            if (command === '/mod' || command === '/unmod') request.role = command === '/mod' ? 'moderator' : 'member';
+            if (command === '/mute' && minutes) request.duration_seconds = Math.round(parseFloat(minutes) * 60);
+            ws.send(JSON.stringify({ type: membershipCommands[command], content: JSON.stringify(request) }));
+        } else if (text.startsWith('/edit ')) {
+            // "/edit <message id> <text>" changes one of your recent messages.
+            const match = text.match(/^\/edit\s+(\d+)\s+([\s\S]+)$/);
+            if (!match) {
+                displaySystemMessage("Usage: /edit <message id> <new text>", true);
+                return;
+            }
+            ws.send(JSON.stringify({
+                type: MessageType.EditMessage,
+                content: JSON.stringify({ roomID: currentRoomID, message_id: parseInt(match[1], 10), content: match[2] })
+            }));
+        } else if (text.startsWith('/react ') || text.startsWith('/unreact ')) {
+            // "/react <message id> <emoji>" reacts to a message; "/unreact" withdraws the reaction.
+            const match = text.match(/^\/(un)?react\s+(\d+)\s+(\S+)$/);
+            if (!match) {
+                displaySystemMessage("Usage: /react <message id> <emoji> or /unreact <message id> <emoji>", true);
+                return;
+            }
+            ws.send(JSON.stringify({
+                type: match[1] ? MessageType.RemoveReaction : MessageType.AddReaction,
+                content: JSON.stringify({ roomID: currentRoomID, message_id: parseInt(match[2], 10), emoji: match[3] })
+            }));
+        } else if (text.startsWith('/reply ')) {
+            // "/reply <message id> <text>" answers a message in its thread.
+            const match = text.match(/^\/reply\s+(\d+)\s+([\s\S]+)$/);
+            if (!match) {
+                displaySystemMessage("Usage: /reply <message id> <text>", true);
+                return;
+            }
+            ws.send(JSON.stringify({
+                type: MessageType.Text,
+                client_msg_id: newClientMsgID(),
+                content: match[2],
+                roomID: currentRoomID,
+                parent_id: parseInt(match[1], 10)
+            }));
+        } else if (subscriptionCommands[text.split(/\s+/)[0]]) {
+            const [command, roomID] = text.split(/\s+/);
+            if (!roomID) {
+                displaySystemMessage(`Usage: ${command} <room>`, true);
+                return;
+            }
+            if (command === '/subscribe') subscribedRooms.add(roomID);
+            else subscribedRooms.delete(roomID);
+            ws.send(JSON.stringify({ type: subscriptionCommands[command], content: JSON.stringify({ roomID: roomID }) }));
+        } else if (threadCommands[text.split(/\s+/)[0]]) {
+            const [command, id] = text.split(/\s+/);
+            if (!/^\d+$/.test(id || '')) {
+                displaySystemMessage(`Usage: ${command} <message id>`, true);
+                return;
+            }
+            ws.send(JSON.stringify({
+                type: threadCommands[command],
+                content: JSON.stringify({ roomID: currentRoomID, parent_id: parseInt(id, 10) })
+            }));
+            if (command !== '/thread') displaySystemMessage(`${command === '/follow' ? 'Following' : 'No longer following'} the thread of #${id}.`);
+        } else if (messageCommands[text.split(/\s+/)[0]]) {
+            const [command, id] = text.split(/\s+/);
+            if (!/^\d+$/.test(id || '')) {
+                displaySystemMessage(`Usage: ${command} <message id>`, true);
+                return;
+            }
+            ws.send(JSON.stringify({
+                type: messageCommands[command],
+                content: JSON.stringify({ roomID: currentRoomID, message_id: parseInt(id, 10) })
+            }));
+        } else if (text.startsWith('/pins')) {
+            ws.send(JSON.stringify({ type: MessageType.ListPinnedMessages, roomID: currentRoomID }));
         } else {
             ws.send(JSON.stringify({
                 type: MessageType.Text,
+                client_msg_id: newClientMsgID(), // Lets the server acknowledge this message and drop retries.
                 content: text,
                 roomID: currentRoomID,
                 username: currentUsername // Client sends its username, server can verify/override
@@ -189,9 +416,35 @@ document.addEventListener('DOMContentLoaded', () => {
         userListUl.innerHTML = ''; // Clear old user list
         roomUserCountSpan.textContent = '0'; // Reset room user count
         typingIndicatorDiv.textContent = ''; // Clear typing indicator
+        resetHistoryState();
         displaySystemMessage(`Attempting to join room: ${newRoom}...`);
     }
 
+    function requestOlderMessages() {
+        if (!hasMoreHistory || loadingHistory || !ws || ws.readyState !== WebSocket.OPEN) return;
+        loadingHistory = true;
+        ws.send(JSON.stringify({
+            type: MessageType.LoadHistory,
+            roomID: currentRoomID,
+            content: JSON.stringify({ before: historyCursor, limit: 50 })
+        }));
+    }
+
+    function newClientMsgID() {
+        if (window.crypto && crypto.randomUUID) return crypto.randomUUID();
+        return `${Date.now().toString(36)}-${Math.random().toString(36).slice(2)}`;
+    }
+
+    function resetHistoryState() {
+        displayedMessageIDs.clear();
+        messageReactions.clear();
+        readReceipts.clear();
+        lastSeenMessageID = 0;
+        historyCursor = '';
+        hasMoreHistory = false;
+        loadingHistory = false;
+    }
+
 
     // --- WebSocket Logic ---
     function connectWebSocket(username, roomID) {
@@ -199,7 +452,12 @@ document.addEventListener('DOMContentLoaded', () => {
             ws.close();
         }
 
-        const wsUrl = `ws://${window.location.host}/ws?username=${encodeURIComponent(username)}&roomID=${encodeURIComponent(roomID)}`;
+        // Browsers cannot set headers on the WebSocket handshake, so the token travels as a query parameter.
+        const wsScheme = window.location.protocol === 'https:' ? 'wss' : 'ws';
+        let wsUrl = `${wsScheme}://${window.location.host}/ws?token=${encodeURIComponent(sessionToken)}&roomID=${encodeURIComponent(roomID)}`;
+        if (lastSeenMessageID > 0) {
+            wsUrl += `&lastMessageID=${lastSeenMessageID}`; // Reconnecting: only fetch what we missed.
+        }
         ws = new WebSocket(wsUrl);
         updateConnectionStatus('reconnecting', 'Connecting...');
 
@@ -209,6 +467,10 @@ document.addEventListener('DOMContentLoaded', () => {
             console.log(`WebSocket connected for user ${username} in room ${roomID}`);
             // Initial join is handled by server based on query params.
             // No explicit "join_room" message needed here for the *initial* room.
+            // Other subscriptions do not outlive the connection, so renew them.
+            subscribedRooms.forEach(subscribedRoom => {
+                ws.send(JSON.stringify({ type: MessageType.Subscribe, content: JSON.stringify({ roomID: subscribedRoom }) }));
+            });
         };
 
         ws.onmessage = (event) => {
@@ -217,21 +479,34 @@ document.addEventListener('DOMContentLoaded', () => {
 
             switch (msg.type) {
                 case MessageType.Text:
+                    if (msg.roomID && msg.roomID !== currentRoomID) {
+                        // A message from another room we are subscribed to: only count it.
+                        if (msg.username !== currentUsername) {
+                            unreadCounts.set(msg.roomID, (unreadCounts.get(msg.roomID) || 0) + 1);
+                            renderUnreadBadges();
+                        }
+                        break;
+                    }
                     displayMessage(msg, false);
+                    scheduleMarkRead();
                     break;
                 case MessageType.UserJoined:
                 case MessageType.UserLeft:
+                    if (msg.roomID && msg.roomID !== currentRoomID) break;
                     displaySystemMessage(msg.content); // Content usually like "UserX joined/left"
                     // User list and room stats are updated via their specific messages
                     break;
                 case MessageType.RecentMessages:
-                    if (msg.data && msg.data.messages) {
+                    if (msg.data && msg.data.messages && msg.roomID === currentRoomID) {
+                        applyReactions(msg.data.reactions);
                         msg.data.messages.forEach(mJson => {
                             try {
                                 const historicalMsg = JSON.parse(mJson); // Messages are stored as JSON strings
                                 displayMessage(historicalMsg, true);
                             } catch (e) { console.error("Error parsing historical message:", e, mJson); }
                         });
+                        trackOldestMessage(msg.data.messages);
+                        scheduleMarkRead();
                          // Add a marker for historical messages
                         if (msg.data.messages.length > 0) {
                             displaySystemMessage("--- Previous messages loaded ---");
@@ -240,8 +515,119 @@ document.addEventListener('DOMContentLoaded', () => {
                         }
                     }
                     break;
+                case MessageType.MissedMessages:
+                    if (msg.data && msg.roomID === currentRoomID) {
+                        applyReactions(msg.data.reactions);
+                        (msg.data.messages || []).forEach(missedMsg => displayMessage(missedMsg, true));
+                        scheduleMarkRead();
+                    }
+                    break;
+                case MessageType.ResyncRequired:
+                    // Too much was missed to replay: start the room over from its newest history page.
+                    if (msg.roomID === currentRoomID) {
+                        messageArea.innerHTML = '';
+                        resetHistoryState();
+                        displaySystemMessage("--- Reloaded after a long disconnection ---");
+                        hasMoreHistory = true;
+                        requestOlderMessages();
+                    }
+                    break;
+                case MessageType.RoomInfo:
+                    if (msg.data && msg.roomID === currentRoomID) showRoomInfo(msg.data);
+                    break;
+                case MessageType.RoomInvitation:
+                case MessageType.RoomMemberUpdate:
+                case MessageType.RoomRoleChanged:
+                case MessageType.UserMuted:
+                case MessageType.UserUnmuted:
+                case MessageType.MessageUnpinned:
+                    displaySystemMessage(msg.content);
+                    break;
+                case MessageType.MessageEdited:
+                    if (msg.data && msg.data.message && msg.roomID === currentRoomID) markMessageEdited(msg.data.message);
+                    break;
+                case MessageType.ReactionUpdated:
+                    if (msg.data && msg.roomID === currentRoomID) updateReaction(msg.data);
+                    break;
+                case MessageType.ThreadUpdated:
+                    if (msg.data && msg.roomID === currentRoomID) updateThreadSummary(msg.data);
+                    break;
+                case MessageType.UnreadCounts:
+                    if (msg.data) {
+                        (msg.data.rooms || []).forEach(room => unreadCounts.set(room.roomID, room.unread));
+                        renderUnreadBadges();
+                    }
+                    break;
+                case MessageType.ServerShutdown:
+                    // The server is restarting: reconnect after the delay it suggests, likely to another instance.
+                    shutdownReconnectDelay = msg.data ? msg.data.reconnect_after_ms : baseReconnectDelay;
+                    displaySystemMessage("Server is restarting. Reconnecting shortly...");
+                    break;
+                case MessageType.PresenceUpdate:
+                    if (msg.data) {
+                        userPresence.set(msg.data.username, msg.data);
+                        renderUserList();
+                    }
+                    break;
+                case MessageType.Subscriptions:
+                    if (msg.data) {
+                        const others = (msg.data.rooms || []).filter(room => room !== msg.data.focus);
+                        displaySystemMessage(others.length ? `Also subscribed to: ${others.join(', ')}` : "Not subscribed to any other room.");
+                    }
+                    break;
+                case MessageType.ReadReceipt:
+                    if (msg.data && msg.roomID === currentRoomID) {
+                        readReceipts.set(msg.data.username, msg.data.last_read_id);
+                        renderReadReceipts();
+                    }
+                    break;
+                case MessageType.ThreadHistory:
+                    if (msg.data) displayThread(msg.data);
+                    break;
+                case MessageType.MessageDeleted:
+                    if (msg.data && msg.roomID === currentRoomID) markMessageDeleted(msg.data.message_id);
+                    displaySystemMessage(msg.content);
+                    break;
+                case MessageType.MessagePinned:
+                    displaySystemMessage(msg.content);
+                    if (msg.data && msg.data.message) displayPinnedMessage(msg.data.message);
+                    break;
+                case MessageType.PinnedMessages:
+                    if (msg.data) {
+                        const pinned = msg.data.messages || [];
+                        displaySystemMessage(pinned.length ? `--- ${pinned.length} pinned message(s) ---` : "No pinned messages in this room.");
+                        pinned.forEach(displayPinnedMessage);
+                    }
+                    break;
+                case MessageType.RemovedFromRoom:
+                    if (msg.roomID === currentRoomID) {
+                        // The server took us out of the room: we no longer see its users or activity.
+                        userListUl.innerHTML = '';
+                        roomUserCountSpan.textContent = '0';
+                        typingIndicatorDiv.textContent = '';
+                    }
+                    displaySystemMessage(`${msg.content} Join another room to keep chatting.`, true);
+                    break;
+                case MessageType.DirectMessage:
+                    displayDirectMessage(msg);
+                    break;
+                case MessageType.ConversationList:
+                    if (msg.data) displayConversationList(msg.data.conversations || []);
+                    break;
+                case MessageType.Ack:
+                    console.log(`Message ${msg.data && msg.data.client_msg_id} stored as #${msg.data && msg.data.id}`);
+                    break;
+                case MessageType.History:
+                    loadingHistory = false;
+                    if (msg.data && msg.roomID === currentRoomID) {
+                        applyReactions(msg.data.reactions);
+                        prependHistory(msg.data.messages || []);
+                        historyCursor = msg.data.next_cursor || '';
+                        hasMoreHistory = msg.data.has_more;
+                    }
+                    break;
                 case MessageType.UserListUpdate:
-                    if (msg.data) updateUserList(msg.data);
+                    if (msg.data && msg.roomID === currentRoomID) updateUserList(msg.data);
                     break;
                 case MessageType.GlobalUserCountUpdate:
                     if (msg.data) updateGlobalUserCount(msg.data);
@@ -252,9 +638,14 @@ document.addEventListener('DOMContentLoaded', () => {
                     }
                     break;
                 case MessageType.UserTyping:
-                    showTypingIndicator(msg.username, msg.content === 'start');
+                    if (msg.roomID === currentRoomID) showTypingIndicator(msg.username, msg.content === 'start');
                     break;
                 case MessageType.Error:
+                    if (msg.data && msg.data.code === 429) {
+                        // Rate limited: the message was not sent, and may be retried after retry_after_ms.
+                        displaySystemMessage(`Slow down: ${msg.content || msg.data.message}`, true);
+                        break;
+                    }
                     displaySystemMessage(`Error from server: ${msg.content || (msg.data && msg.data.message)}`, true);
                     break;
                 default:
@@ -274,7 +665,14 @@ document.addEventListener('DOMContentLoaded', () => {
             updateConnectionStatus('disconnected', `Disconnected: ${reason} (Code: ${event.code})`);
             ws = null; // Important to nullify ws object
 
-            if (reconnectAttempts < maxReconnectAttempts && event.code !== 1000) { // Don't retry on normal close (1000)
+            if (shutdownReconnectDelay !== null) {
+                const delay = shutdownReconnectDelay;
+                shutdownReconnectDelay = null;
+                reconnectAttempts = 0; // The server went away on purpose; start the backoff over if this attempt fails.
+                console.log(`Server shut down. Reconnecting in ${delay / 1000}s`);
+                updateConnectionStatus('reconnecting', 'Server restarting. Reconnecting...');
+                setTimeout(() => connectWebSocket(currentUsername, currentRoomID), delay);
+            } else if (reconnectAttempts < maxReconnectAttempts && event.code !== 1000) { // Don't retry on normal close (1000)
                 const delay = Math.pow(2, reconnectAttempts) * baseReconnectDelay;
                 reconnectAttempts++;
                 console.log(`Attempting to reconnect in ${delay / 1000}s (attempt ${reconnectAttempts}/${maxReconnectAttempts})`);
@@ -289,15 +687,19 @@ document.addEventListener('DOMContentLoaded', () => {
 
     // --- UI Update Functions ---
     function displayMessage(msg, isHistory = false) {
+        if (msg.id) {
+            if (displayedMessageIDs.has(msg.id)) return; // Already shown.
+            displayedMessageIDs.add(msg.id);
+            lastSeenMessageID = Math.max(lastSeenMessageID, msg.id);
+        }
         const item = document.createElement('div');
         item.classList.add('message');
+        if (msg.id) item.dataset.id = msg.id;
         if (msg.system) {
             item.classList.add('system');
             item.textContent = msg.content;
         } else {
-            item.classList.add(msg.username === currentUsername ? 'mine' : 'other');
-            item.innerHTML = `<strong>${msg.username}</strong>: ${msg.content}
-                              <span class="timestamp">${new Date(msg.timestamp).toLocaleTimeString()}</span>`;
+            renderMessageBody(item, msg);
         }
 
         if (!isHistory) {
@@ -306,6 +708,241 @@ document.addEventListener('DOMContentLoaded', () => {
 
         messageArea.appendChild(item);
         messageArea.scrollTop = messageArea.scrollHeight;
+        if (msg.username === currentUsername && readReceipts.size > 0) renderReadReceipts();
+    }
+
+    // renderMessageBody fills a message element with a chat message, its tombstone if it was
+    // deleted, or its latest version if it was edited.
+    function renderMessageBody(item, msg) {
+        item.classList.remove('mine', 'other', 'deleted');
+        if (msg.deleted) {
+            item.classList.add('deleted');
+            item.textContent = `Message by ${msg.username} deleted by ${msg.deleted_by}.`;
+            return;
+        }
+        item.classList.add(msg.username === currentUsername ? 'mine' : 'other');
+        const author = document.createElement('strong');
+        author.textContent = msg.username;
+        const timestamp = `${msg.id ? `#${msg.id} ` : ''}${new Date(msg.timestamp).toLocaleTimeString()}${msg.edited_at ? ' (edited)' : ''}`;
+        item.replaceChildren(author, `: ${msg.content} `, createSpan('timestamp', timestamp), ' ',
+            createSpan('reactions'), ' ', createSpan('thread'), ' ', createSpan('receipts'));
+        if (msg.parent_id) item.querySelector('.thread').textContent = `↳ reply to #${msg.parent_id}`;
+        if (msg.reply_count) renderThreadSummary(item, msg.id, msg.reply_count, msg.last_reply_at);
+        renderReactions(item);
+    }
+
+    // renderThreadSummary shows the reply count of a displayed message that has a thread.
+    function renderThreadSummary(item, messageID, replyCount, lastReplyAt) {
+        const span = item.querySelector('.thread');
+        if (!span) return;
+        const last = lastReplyAt ? `, last ${new Date(lastReplyAt).toLocaleTimeString()}` : '';
+        span.textContent = `${replyCount} ${replyCount === 1 ? 'reply' : 'replies'}${last} (/thread ${messageID})`;
+    }
+
+    // updateThreadSummary applies a thread_updated summary to the displayed parent message.
+    function updateThreadSummary(summary) { // { parent_id, reply_count, last_reply_at, last_reply_by }
+        const item = messageArea.querySelector(`.message[data-id="${summary.parent_id}"]`);
+        if (item) renderThreadSummary(item, summary.parent_id, summary.reply_count, summary.last_reply_at);
+    }
+
+    // displayThread shows a page of a thread (oldest first) below the current messages. Replies
+    // are shown as a snapshot and not tracked with the room's live messages.
+    function displayThread(page) { // { roomID, parent_id, parent, messages, next_cursor, has_more }
+        displaySystemMessage(`--- Thread of #${page.parent_id}${page.has_more ? ' (older replies not shown)' : ''} ---`);
+        const messages = page.parent ? [page.parent, ...(page.messages || [])] : (page.messages || []);
+        if (messages.length === 0) displaySystemMessage("No replies yet.");
+        messages.forEach(threadMsg => {
+            const item = document.createElement('div');
+            item.classList.add('message', 'thread-reply');
+            renderMessageBody(item, threadMsg);
+            messageArea.appendChild(item);
+        });
+        messageArea.scrollTop = messageArea.scrollHeight;
+    }
+
+    // renderReactions shows the reaction counts of a displayed message, e.g. "👍 3  🎉 1".
+    function renderReactions(item) {
+        const span = item.querySelector('.reactions');
+        if (!span) return; // System messages and tombstones have no reactions.
+        const counts = messageReactions.get(Number(item.dataset.id)) || {};
+        span.textContent = Object.entries(counts).map(([emoji, count]) => `${emoji} ${count}`).join('  ');
+    }
+
+    // applyReactions records the reaction counts delivered with a batch of history messages,
+    // keyed by message ID, before those messages are displayed.
+    function applyReactions(reactions) {
+        Object.entries(reactions || {}).forEach(([id, counts]) => messageReactions.set(Number(id), { ...counts }));
+    }
+
+    // updateReaction applies a reaction_updated delta to a displayed message.
+    function updateReaction(update) { // { message_id, emoji, count }
+        const counts = messageReactions.get(update.message_id) || {};
+        if (update.count > 0) {
+            counts[update.emoji] = update.count;
+        } else {
+            delete counts[update.emoji];
+        }
+        messageReactions.set(update.message_id, counts);
+        const item = messageArea.querySelector(`.message[data-id="${update.message_id}"]`);
+        if (item) renderReactions(item);
+    }
+
+    // scheduleMarkRead tells the server, after a short pause, that everything shown in the current
+    // room has been read. Bursts of messages are marked in a single request.
+    function scheduleMarkRead() {
+        clearTimeout(markReadTimer);
+        markReadTimer = setTimeout(() => {
+            if (!ws || ws.readyState !== WebSocket.OPEN || !lastSeenMessageID) return;
+            ws.send(JSON.stringify({
+                type: MessageType.MarkRead,
+                content: JSON.stringify({ roomID: currentRoomID, message_id: lastSeenMessageID })
+            }));
+        }, 1000);
+    }
+
+    // renderUnreadBadges shows the unread count next to each room of the room list but the current one.
+    function renderUnreadBadges() {
+        roomListExampleUl.querySelectorAll('a[data-roomid]').forEach(a => {
+            const unread = a.dataset.roomid === currentRoomID ? 0 : (unreadCounts.get(a.dataset.roomid) || 0);
+            let badge = a.parentNode.querySelector('.badge');
+            if (!badge) {
+                badge = document.createElement('span');
+                badge.classList.add('badge');
+                a.parentNode.appendChild(badge);
+            }
+            badge.textContent = unread > 0 ? String(unread) : '';
+        });
+    }
+
+    // renderReadReceipts shows who has read your latest message in the current room.
+    function renderReadReceipts() {
+        messageArea.querySelectorAll('.message.mine .receipts').forEach(span => { span.textContent = ''; });
+        const mine = messageArea.querySelectorAll('.message.mine[data-id]');
+        if (mine.length === 0) return;
+        const latest = mine[mine.length - 1];
+        const readers = [...readReceipts]
+            .filter(([username, lastReadID]) => username !== currentUsername && lastReadID >= Number(latest.dataset.id))
+            .map(([username]) => username);
+        const span = latest.querySelector('.receipts');
+        if (span && readers.length > 0) span.textContent = `Seen by ${readers.join(', ')}`;
+    }
+
+    // showRoomInfo displays the current room's name and topic from its room_info.
+    function showRoomInfo(info) { // { roomID, name, topic, created_by, visibility, archived }
+        displayRoomId.textContent = info.name && info.name !== info.roomID ? `${info.name} (${info.roomID})` : info.roomID;
+        displayRoomId.title = info.topic || '';
+        if (info.topic) displaySystemMessage(`Topic: ${info.topic}`);
+        if (info.archived) displaySystemMessage("This room has been archived. You can read its history but no longer post to it.", true);
+    }
+
+    // loadRoomList replaces the sidebar's room list with the rooms from the room registry.
+    async function loadRoomList() {
+        try {
+            const response = await fetch('/api/rooms', { headers: { 'Authorization': `Bearer ${sessionToken}` } });
+            if (!response.ok) return; // Keep the example rooms.
+            const list = await response.json();
+            roomListExampleUl.innerHTML = '';
+            (list.rooms || []).forEach(room => {
+                const li = document.createElement('li');
+                const a = document.createElement('a');
+                a.href = '#';
+                a.dataset.roomid = room.roomID;
+                a.textContent = room.name;
+                a.title = room.topic || '';
+                li.appendChild(a);
+                roomListExampleUl.appendChild(li);
+            });
+            renderUnreadBadges();
+        } catch (e) {
+            console.error('Loading the room list failed:', e);
+        }
+    }
+
+    // createSpan builds a span of the given class holding text. What users send is only ever shown
+    // as text, never parsed as HTML.
+    function createSpan(className, text = '') {
+        const span = document.createElement('span');
+        span.className = className;
+        span.textContent = text;
+        return span;
+    }
+
+    // displayDirectMessage shows a direct message inline with the room's messages, marked as such.
+    // Its ID is per conversation, so it is not tracked alongside room message IDs.
+    function displayDirectMessage(msg) {
+        const peer = msg.username === currentUsername ? msg.to : msg.username;
+        const item = document.createElement('div');
+        item.classList.add('message', 'direct', msg.username === currentUsername ? 'mine' : 'other', 'new');
+        const label = document.createElement('strong');
+        label.textContent = `[DM ${msg.username === currentUsername ? 'to' : 'from'} ${peer}]`;
+        item.append(label, `: ${msg.content} `, createSpan('timestamp', new Date(msg.timestamp).toLocaleTimeString()));
+        messageArea.appendChild(item);
+        messageArea.scrollTop = messageArea.scrollHeight;
+    }
+
+    function displayConversationList(conversations) {
+        if (conversations.length === 0) {
+            displaySystemMessage("You have no direct conversations yet. Start one with /dm <user> <message>.");
+            return;
+        }
+        const summary = conversations
+            .map(c => `${c.peer} (${new Date(c.last_message_at).toLocaleString()})`)
+            .join(', ');
+        displaySystemMessage(`Your conversations: ${summary}`);
+    }
+
+    // trackOldestMessage records the oldest message ID among freshly loaded recent messages,
+    // so that scrolling up can request the history before it.
+    function trackOldestMessage(messageJSONs) {
+        messageJSONs.forEach(mJson => {
+            try {
+                const id = JSON.parse(mJson).id;
+                if (id && (!historyCursor || id < Number(historyCursor))) historyCursor = String(id);
+            } catch (e) { /* Already reported when displayed. */ }
+        });
+        hasMoreHistory = historyCursor !== '' && Number(historyCursor) > 1;
+    }
+
+    // prependHistory inserts a page of older messages (oldest first) above the current ones,
+    // keeping the visible messages in place.
+    function prependHistory(messages) {
+        const previousHeight = messageArea.scrollHeight;
+        const fragment = document.createDocumentFragment();
+        messages.forEach(historicalMsg => {
+            if (historicalMsg.id) {
+                if (displayedMessageIDs.has(historicalMsg.id)) return; // Already shown.
+                displayedMessageIDs.add(historicalMsg.id);
+                lastSeenMessageID = Math.max(lastSeenMessageID, historicalMsg.id);
+            }
+            const item = document.createElement('div');
+            item.classList.add('message');
+            if (historicalMsg.id) item.dataset.id = historicalMsg.id;
+            renderMessageBody(item, historicalMsg);
+            fragment.appendChild(item);
+        });
+        messageArea.insertBefore(fragment, messageArea.firstChild);
+        messageArea.scrollTop = messageArea.scrollHeight - previousHeight;
+    }
+
+    // markMessageDeleted replaces a displayed message of the current room with its tombstone.
+    function markMessageDeleted(messageID) {
+        messageReactions.delete(messageID);
+        const item = messageArea.querySelector(`.message[data-id="${messageID}"]`);
+        if (!item) return;
+        item.classList.remove('mine', 'other');
+        item.classList.add('deleted');
+        item.textContent = 'Message deleted.';
+    }
+
+    // markMessageEdited shows the new version of a displayed message of the current room.
+    function markMessageEdited(edited) {
+        const item = messageArea.querySelector(`.message[data-id="${edited.id}"]`);
+        if (item) renderMessageBody(item, edited);
+    }
+
+    // displayPinnedMessage shows a pinned message (as stored in the history) as a system line.
+    function displayPinnedMessage(pinned) {
+        displaySystemMessage(`[pinned] #${pinned.id} ${pinned.username}: ${pinned.content}`);
     }
 
     function displaySystemMessage(content, isError = false) {
@@ -320,14 +957,34 @@ document.addEventListener('DOMContentLoaded', () => {
     function updateUserList(userListPayload) { // { roomID: "...", users: ["user1", "user2"] }
         if (userListPayload.roomID !== currentRoomID) return; // Update only if for current room
 
+        (userListPayload.presence || []).forEach(presence => userPresence.set(presence.username, presence));
+        roomUsers = userListPayload.users;
+        renderUserList();
+        roomUserCountSpan.textContent = userListPayload.users.length;
+        animateCountUpdate(roomUserCountSpan);
+    }
+
+    // Lists the current room's users, each with a dot for their status and their status text.
+    function renderUserList() {
         userListUl.innerHTML = ''; // Clear existing list
-        userListPayload.users.forEach(user => {
+        roomUsers.forEach(user => {
+            const presence = userPresence.get(user) || { status: 'online' };
             const li = document.createElement('li');
-            li.textContent = user;
+            const dot = document.createElement('span');
+            dot.className = `presence ${presence.status}`;
+            li.appendChild(dot);
+            li.appendChild(document.createTextNode(user));
+            if (presence.status_text) {
+                const statusText = document.createElement('span');
+                statusText.className = 'status-text';
+                statusText.textContent = presence.status_text;
+                li.appendChild(statusText);
+            }
+            li.title = presence.status === 'offline' && presence.last_seen
+                ? `Last seen ${new Date(presence.last_seen).toLocaleString()}`
+                : presence.status;
             userListUl.appendChild(li);
         });
-        roomUserCountSpan.textContent = userListPayload.users.length;
-        animateCountUpdate(roomUserCountSpan);
     }
 
     function updateGlobalUserCount(payload) { // { count: X }